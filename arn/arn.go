@@ -338,6 +338,10 @@ var UntaggableResourceTypes = map[ResourceType]struct{}{
 	IAMGroupRType:                       struct{}{},
 	IAMMfaDeviceRType:                   struct{}{},
 	IAMAccountAliasRType:                struct{}{},
+	EC2EIPAssociationRType:              struct{}{},
+	EC2InternetGatewayAttachmentRType:   struct{}{},
+	EC2RouteTableAssociationRType:       struct{}{},
+	EC2VPCCIDRAssociationRType:          struct{}{},
 }
 
 // NamespaceForResource maps ResourceType to an ARN namespace
@@ -383,14 +387,72 @@ func SplitHostedZoneID(hzID string) ResourceName {
 	return ResourceName(hzID)
 }
 
-func getAutoScalingGroupARN(rn ResourceName) (string, error) {
+// IsGlobalResourceType returns whether resources of type t are managed by a
+// global AWS service rather than in a region
+func IsGlobalResourceType(t ResourceType) bool {
+	switch NamespaceForResource(t) {
+	case IAMNamespace, Route53Namespace, S3Namespace:
+		return true
+	}
+	return false
+}
+
+// RegionForARN returns the region in an ARN, or an empty string if the ARN
+// does not contain a region, ex. ARNs of IAM resources
+func RegionForARN(a ResourceARN) string {
+	if fields := strings.SplitN(a.String(), ":", 5); len(fields) == 5 {
+		return fields[3]
+	}
+	return ""
+}
+
+// AccountForARN returns the account ID in an ARN, or an empty string if the
+// ARN does not contain an account ID, ex. ARNs of S3 buckets
+func AccountForARN(a ResourceARN) string {
+	if fields := strings.SplitN(a.String(), ":", 6); len(fields) == 6 {
+		return fields[4]
+	}
+	return ""
+}
+
+// SessionFunc creates a session in region r of the account with ID id.
+// Either is empty if it is not known.
+type SessionFunc func(id, r string) (*session.Session, error)
+
+// newSession creates sessions of requests made to map resources to ARNs
+var newSession SessionFunc = newEnvSession
+
+// newEnvSession creates a session with the environment's credentials in r, or
+// the environment's region if r is empty
+func newEnvSession(id, r string) (*session.Session, error) {
+	cfg := &aws.Config{}
+	if r != "" {
+		cfg.Region = aws.String(r)
+	}
+	return session.NewSession(cfg)
+}
+
+// SetSessionFunc sets the function creating sessions of requests made to map
+// resources to ARNs, ex. so requests use the credentials of the account a
+// resource was created in. Sessions use the environment's credentials if f is
+// nil.
+func SetSessionFunc(f SessionFunc) {
+	if f == nil {
+		f = newEnvSession
+	}
+	newSession = f
+}
+
+func getAutoScalingGroupARN(rn ResourceName, accountID, region string) (string, error) {
 	if rn == "" {
 		return "", nil
 	}
 
-	svc := autoscaling.New(session.Must(session.NewSession(
-		&aws.Config{},
-	)))
+	sess, err := newSession(accountID, region)
+	if err != nil {
+		return "", err
+	}
+	svc := autoscaling.New(sess)
 	params := &autoscaling.DescribeAutoScalingGroupsInput{
 		AutoScalingGroupNames: aws.StringSlice([]string{rn.String()}),
 	}
@@ -431,7 +493,7 @@ func MapResourceTypeToARN(rt ResourceType, rn ResourceName, parsedEvents ...gjso
 	switch rt {
 	case AutoScalingGroupRType:
 		// arn:aws:autoscaling:region:account-id:autoScalingGroup:groupid:autoScalingGroupName/groupfriendlyname
-		asgARN, err := getAutoScalingGroupARN(rn)
+		asgARN, err := getAutoScalingGroupARN(rn, accountID, region)
 		if err != nil || asgARN == "" {
 			return ""
 		}
@@ -466,6 +528,8 @@ func MapResourceTypeToARN(rt ResourceType, rn ResourceName, parsedEvents ...gjso
 		// arn:aws:ec2:region:account-id:dhcp-options/dhcp-options-id
 		arn = fmt.Sprintf("%s:dhcp-options/%s", ARNPrefix, rn)
 	case EC2EIPRType:
+		// arn:aws:ec2:region:account-id:elastic-ip/eipalloc-id
+		arn = fmt.Sprintf("%s:elastic-ip/%s", ARNPrefix, rn)
 	case EC2EIPAssociationRType:
 	case EC2ExportTaskRType:
 	case EC2FlowLogRType:
@@ -483,6 +547,8 @@ func MapResourceTypeToARN(rt ResourceType, rn ResourceName, parsedEvents ...gjso
 		// arn:aws:ec2:region:account-id:key-pair/key-pair-name
 		arn = fmt.Sprintf("%s:key-pair/%s", ARNPrefix, rn)
 	case EC2NatGatewayRType:
+		// arn:aws:ec2:region:account-id:natgateway/nat-id
+		arn = fmt.Sprintf("%s:natgateway/%s", ARNPrefix, rn)
 	case EC2NetworkACLRType:
 		// arn:aws:ec2:region:account-id:network-acl/nacl-id
 		arn = fmt.Sprintf("%s:network-acl/%s", ARNPrefix, rn)
@@ -663,10 +729,14 @@ func MapARNToRTypeAndRName(arnStr ResourceARN) (ResourceType, ResourceName) {
 		switch {
 		case strings.HasPrefix(sfx, "customer-gateway/"):
 			return EC2CustomerGatewayRType, arnToID("customer-gateway/", sfx)
+		case strings.HasPrefix(sfx, "elastic-ip/"):
+			return EC2EIPRType, arnToID("elastic-ip/", sfx)
 		case strings.HasPrefix(sfx, "instance/"):
 			return EC2InstanceRType, arnToID("instance/", sfx)
 		case strings.HasPrefix(sfx, "internet-gateway/"):
 			return EC2InternetGatewayRType, arnToID("internet-gateway/", sfx)
+		case strings.HasPrefix(sfx, "natgateway/"):
+			return EC2NatGatewayRType, arnToID("natgateway/", sfx)
 		case strings.HasPrefix(sfx, "network-acl/"):
 			return EC2NetworkACLRType, arnToID("network-acl/", sfx)
 		case strings.HasPrefix(sfx, "network-interface/"):
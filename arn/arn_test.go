@@ -1,8 +1,10 @@
 package arn
 
 import (
+	"errors"
 	"testing"
 
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudtrail"
 	"github.com/tidwall/gjson"
 )
@@ -33,6 +35,43 @@ func TestNamespaceForResource(t *testing.T) {
 	}
 }
 
+func TestRegionForARN(t *testing.T) {
+	cases := []struct {
+		Input    ResourceARN
+		Expected string
+	}{
+		{"arn:aws:ec2:us-west-2:123456789101:instance/i-1", "us-west-2"},
+		{"arn:aws:autoscaling:eu-west-1:123456789101:autoScalingGroup:id:autoScalingGroupName/asg", "eu-west-1"},
+		{"arn:aws:iam::123456789101:role/role-1", ""},
+		{"arn:aws:s3:::bucket-1", ""},
+		{"malformed", ""},
+	}
+
+	for _, c := range cases {
+		if r := RegionForARN(c.Input); c.Expected != r {
+			t.Errorf("RegionForARN(%s) failed\nwanted %q\ngot %q\n", c.Input, c.Expected, r)
+		}
+	}
+}
+
+func TestAccountForARN(t *testing.T) {
+	cases := []struct {
+		Input    ResourceARN
+		Expected string
+	}{
+		{"arn:aws:ec2:us-west-2:123456789101:instance/i-1", "123456789101"},
+		{"arn:aws:iam::123456789101:role/role-1", "123456789101"},
+		{"arn:aws:s3:::bucket-1", ""},
+		{"malformed", ""},
+	}
+
+	for _, c := range cases {
+		if a := AccountForARN(c.Input); c.Expected != a {
+			t.Errorf("AccountForARN(%s) failed\nwanted %q\ngot %q\n", c.Input, c.Expected, a)
+		}
+	}
+}
+
 var testCloudTrailResources = []*cloudtrail.Resource{}
 
 func TestMapResourceTypeToARN(t *testing.T) {
@@ -71,6 +110,11 @@ func TestMapResourceTypeToARN(t *testing.T) {
 			InputType: EC2DHCPOptionsRType,
 			InputName: "dhcp-options-id",
 		},
+		{
+			Expected:  "arn:aws:ec2:us-east-1:12345678910:elastic-ip/eipalloc-id",
+			InputType: EC2EIPRType,
+			InputName: "eipalloc-id",
+		},
 		{
 			Expected:  "arn:aws:ec2:us-east-1:12345678910:dedicated-host/host-id",
 			InputType: EC2HostRType,
@@ -86,6 +130,11 @@ func TestMapResourceTypeToARN(t *testing.T) {
 			InputType: EC2InternetGatewayRType,
 			InputName: "igw-id",
 		},
+		{
+			Expected:  "arn:aws:ec2:us-east-1:12345678910:natgateway/nat-id",
+			InputType: EC2NatGatewayRType,
+			InputName: "nat-id",
+		},
 		{
 			Expected:  "arn:aws:ec2:us-east-1:12345678910:key-pair/key-pair-name",
 			InputType: EC2KeyPairRType,
@@ -321,6 +370,16 @@ func TestMapARNToRTypeAndRName(t *testing.T) {
 			EC2CustomerGatewayRType,
 			"cgw-id",
 		},
+		{
+			"arn:aws:ec2:us-east-1:12345678910:elastic-ip/eipalloc-id",
+			EC2EIPRType,
+			"eipalloc-id",
+		},
+		{
+			"arn:aws:ec2:us-east-1:12345678910:natgateway/nat-id",
+			EC2NatGatewayRType,
+			"nat-id",
+		},
 		{
 			"arn:aws:ec2:us-east-1:12345678910:instance/instance-id",
 			EC2InstanceRType,
@@ -432,3 +491,21 @@ func TestMapARNToRTypeAndRNameMalformedARN(t *testing.T) {
 		}
 	}
 }
+
+func TestAutoScalingGroupARNSession(t *testing.T) {
+	defer SetSessionFunc(nil)
+
+	var gotID, gotRegion string
+	SetSessionFunc(func(id, r string) (*session.Session, error) {
+		gotID, gotRegion = id, r
+		return nil, errors.New("no credentials")
+	})
+
+	event := gjson.Parse(`{"awsRegion":"us-west-2","userIdentity":{"accountId":"123456789101"}}`)
+	if got := MapResourceTypeToARN(AutoScalingGroupRType, "asg-1", event); got != "" {
+		t.Errorf("MapResourceTypeToARN: wanted no ARN, got %s", got)
+	}
+	if gotID != "123456789101" || gotRegion != "us-west-2" {
+		t.Errorf("session func: wanted account 123456789101 and region us-west-2, got %q and %q", gotID, gotRegion)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright © 2017 grafiti authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/coreos/grafiti/arn"
+	"github.com/spf13/viper"
+)
+
+// Account is an AWS account grafiti manages resources in by assuming a role
+type Account struct {
+	RoleARN    string
+	ExternalID string
+}
+
+// ID returns the ID of the account a's role is in
+func (a Account) ID() string {
+	return arn.AccountForARN(arn.ResourceARN(a.RoleARN))
+}
+
+// credentials creates credentials that assume a's role using the
+// environment's credentials. Credentials are refreshed before they expire.
+func (a Account) credentials() *credentials.Credentials {
+	return stscreds.NewCredentials(newAWSSessionWith(nil, ""), a.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+		if a.ExternalID != "" {
+			p.ExternalID = aws.String(a.ExternalID)
+		}
+	})
+}
+
+var (
+	// accountID is the ID of the AWS account commands currently run in, if
+	// known.
+	accountID string
+	// accountCreds are the credentials of the account commands currently run
+	// in. The environment's credentials are used if accountCreds is nil.
+	accountCreds *credentials.Credentials
+)
+
+// getAccounts reads accounts from the 'accounts' config table array.
+func getAccounts() ([]Account, error) {
+	var accounts []Account
+	if err := viper.UnmarshalKey("accounts", &accounts); err != nil {
+		return nil, fmt.Errorf("read accounts: %s", err)
+	}
+	for i, a := range accounts {
+		if a.ID() == "" {
+			return nil, fmt.Errorf("account %d: invalid role ARN %q", i, a.RoleARN)
+		}
+	}
+	return accounts, nil
+}
+
+// accountCredsCache holds credentials created by credentialsForAccount by
+// account ID, so roles are not assumed again for every session.
+var accountCredsCache = make(map[string]*credentials.Credentials)
+
+// credentialsForAccount returns credentials for the account with ID id. If no
+// accounts are configured, nil credentials are returned so the environment's
+// credentials are used.
+func credentialsForAccount(id string) (*credentials.Credentials, error) {
+	if creds, ok := accountCredsCache[id]; ok {
+		return creds, nil
+	}
+
+	accounts, err := getAccounts()
+	if err != nil || len(accounts) == 0 {
+		return nil, err
+	}
+	for _, a := range accounts {
+		if a.ID() == id {
+			creds := a.credentials()
+			accountCredsCache[id] = creds
+			return creds, nil
+		}
+	}
+	return nil, fmt.Errorf("no role configured for account %q", id)
+}
+
+// forEachAccount runs f in each configured account in order, stopping at the
+// first error. If no accounts are configured, f runs once with the
+// environment's credentials.
+func forEachAccount(f func() error) error {
+	accounts, err := getAccounts()
+	if err != nil {
+		return err
+	}
+	if len(accounts) == 0 {
+		return inAccount(requestAccountID(), nil, f)
+	}
+
+	for _, a := range accounts {
+		creds, err := credentialsForAccount(a.ID())
+		if err != nil {
+			return err
+		}
+		if err := inAccount(a.ID(), creds, f); err != nil {
+			return fmt.Errorf("account %s: %s", a.ID(), err)
+		}
+	}
+	return nil
+}
+
+// forEachAccountRegion runs f in each configured region of each configured
+// account.
+func forEachAccountRegion(f func() error) error {
+	return forEachAccount(func() error {
+		return forEachRegion(f)
+	})
+}
+
+// inAccount runs f in the account with ID id using creds.
+func inAccount(id string, creds *credentials.Credentials, f func() error) error {
+	accountID, accountCreds = id, creds
+	defer func() {
+		accountID, accountCreds = "", nil
+	}()
+
+	logger.Debugf("running in account %q", id)
+	return f()
+}
+
+// requestAccountID requests the ID of the account of the environment's
+// credentials, so output and logs can carry it. An empty ID is returned if
+// the request fails.
+func requestAccountID() string {
+	svc := sts.New(newAWSSessionWith(nil, ""))
+	ctx := aws.BackgroundContext()
+	resp, err := svc.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		logger.Debugln("sts: get caller identity:", err)
+		return ""
+	}
+	return aws.StringValue(resp.Account)
+}
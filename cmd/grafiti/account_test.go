@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestGetAccounts(t *testing.T) {
+	defer viper.Set("accounts", nil)
+
+	viper.Set("accounts", []map[string]interface{}{
+		{"roleARN": "arn:aws:iam::123456789101:role/grafiti", "externalID": "id-1"},
+		{"roleARN": "arn:aws:iam::109876543210:role/grafiti"},
+	})
+	expected := []Account{
+		{RoleARN: "arn:aws:iam::123456789101:role/grafiti", ExternalID: "id-1"},
+		{RoleARN: "arn:aws:iam::109876543210:role/grafiti"},
+	}
+	got, err := getAccounts()
+	if err != nil {
+		t.Fatalf("getAccounts failed: %s", err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("getAccounts failed\nwanted %+v\ngot %+v\n", expected, got)
+	}
+	if id := got[1].ID(); id != "109876543210" {
+		t.Errorf("Account.ID failed: wanted 109876543210, got %s", id)
+	}
+
+	// Resources in accounts without a role cannot be managed
+	if _, err := credentialsForAccount("111111111111"); err == nil {
+		t.Error("credentialsForAccount failed: expected error")
+	}
+
+	viper.Set("accounts", []map[string]interface{}{{"roleARN": "grafiti"}})
+	if _, err := getAccounts(); err == nil {
+		t.Error("getAccounts failed: expected error for invalid role ARN")
+	}
+}
+
+func TestTaggingMetadataTarget(t *testing.T) {
+	cases := []struct {
+		Input    TaggingMetadata
+		Expected tagTarget
+	}{
+		{
+			TaggingMetadata{ResourceARN: "arn:aws:ec2:us-west-2:123456789101:instance/i-1"},
+			tagTarget{"123456789101", "us-west-2"},
+		},
+		{
+			TaggingMetadata{ResourceARN: "arn:aws:ec2:us-west-2:123456789101:instance/i-1", AccountID: "109876543210", Region: "eu-west-1"},
+			tagTarget{"109876543210", "eu-west-1"},
+		},
+		{
+			TaggingMetadata{ResourceARN: "arn:aws:route53:::hostedzone/HZ1"},
+			tagTarget{},
+		},
+	}
+
+	for i, c := range cases {
+		if got := c.Input.target(); got != c.Expected {
+			t.Errorf("case %d: TaggingMetadata.target failed\nwanted %+v\ngot %+v\n", i, c.Expected, got)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright © 2017 grafiti authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var applyPlanFile string
+
+func init() {
+	RootCmd.AddCommand(applyCmd)
+	applyCmd.PersistentFlags().StringVarP(&applyPlanFile, "plan-file", "p", "", "Plan file created by 'grafiti plan'.")
+	applyCmd.PersistentFlags().BoolVar(&wantReport, "report", false, "Pretty-print a report of resource deletion errors, if any.")
+}
+
+var applyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "Delete resources in a plan created by 'grafiti plan'.",
+	Long: `Delete exactly the resources in 'plan-file', in plan order. Tags are not resolved and dependencies are not discovered again,
+so no resource outside of the plan is deleted.`,
+	RunE:          runApplyCommand,
+	SilenceErrors: true,
+	SilenceUsage:  true,
+}
+
+func runApplyCommand(cmd *cobra.Command, args []string) error {
+	var reader io.Reader = os.Stdin
+	// Same data as that in applyPlanFile may be passed by stdin.
+	if applyPlanFile != "" {
+		file, err := os.Open(applyPlanFile)
+		if err != nil {
+			return fmt.Errorf("apply: open plan file: %s", err)
+		}
+		defer file.Close()
+		reader = bufio.NewReader(file)
+	}
+
+	if err := applyPlan(reader); err != nil {
+		return fmt.Errorf("apply: %s", err)
+	}
+
+	return nil
+}
+
+func applyPlan(reader io.Reader) error {
+	var p Plan
+	if err := json.NewDecoder(reader).Decode(&p); err != nil {
+		return fmt.Errorf("decode plan: %s", err)
+	}
+
+	tgs, err := p.Graphs()
+	if err != nil {
+		return fmt.Errorf("invalid plan: %s", err)
+	}
+
+	// Resources are deleted in the account and region they were planned in,
+	// regardless of the 'accounts' and 'regions' config fields
+	for _, tg := range tgs {
+		if err := applyTargetGraph(tg); err != nil {
+			return err
+		}
+	}
+
+	return printDeleteReport()
+}
+
+// applyTargetGraph deletes all resources in tg in its account and region.
+func applyTargetGraph(tg *targetGraph) error {
+	creds, err := credentialsForAccount(tg.AccountID)
+	if err != nil {
+		return err
+	}
+
+	err = inAccount(tg.AccountID, creds, func() error {
+		return inRegion(tg.Region, true, func() error {
+			return deleteGraph(tg.Graph)
+		})
+	})
+	if err != nil && tg.String() != "" {
+		return fmt.Errorf("%s: %s", tg.planTarget, err)
+	}
+	return err
+}
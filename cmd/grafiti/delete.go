@@ -16,13 +16,15 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	rgta "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
@@ -32,47 +34,25 @@ import (
 	"github.com/coreos/grafiti/arn"
 	"github.com/coreos/grafiti/deleter"
 	"github.com/coreos/grafiti/graph"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cast"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 var (
-	deleteFile string
-	delAllDeps bool
-	wantReport bool
+	deleteFile        string
+	delAllDeps        bool
+	wantReport        bool
+	deleteTimeFilters []string
+	notifyOnDelete    bool
 )
 
-// DeleteOrder contains the REVERSE order of deletion for all resource types
-var DeleteOrder = arn.ResourceTypes{
-	arn.EC2VPCRType,
-	arn.EC2VPNGatewayRType, // Deletes EC2 VPN Gateway Attachments
-	arn.EC2SecurityGroupRType,
-	arn.EC2RouteTableRType, // Deletes EC2 Route Table Routes
-	arn.EC2SubnetRType,
-	arn.EC2VolumeRType,
-	arn.EC2CustomerGatewayRType,
-	arn.EC2VPNConnectionRType, // Deletes EC2 VPN Connection Routes
-	arn.EC2NetworkACLRType,
-	arn.EC2NetworkInterfaceRType,
-	arn.EC2InternetGatewayRType,
-	arn.IAMUserRType,
-	arn.IAMRoleRType, // Deletes IAM Role Policies
-	arn.IAMInstanceProfileRType,
-	arn.AutoScalingLaunchConfigurationRType,
-	arn.EC2EIPRType,
-	arn.EC2EIPAssociationRType,
-	arn.EC2NatGatewayRType,
-	arn.ElasticLoadBalancingLoadBalancerRType,
-	arn.AutoScalingGroupRType,
-	arn.EC2InstanceRType,
-	arn.EC2RouteTableAssociationRType,
-	arn.Route53HostedZoneRType, // Deletes Route53 RecordSets
-	arn.S3BucketRType,          // Delete S3 Objects
-}
-
-// TagFileInput holds a list of all tags to be deleted
+// TagFileInput holds a list of all tags to be deleted, and time predicates
+// evaluated on tag values
 type TagFileInput struct {
-	TagFilters []*rgta.TagFilter
+	TagFilters  []*rgta.TagFilter
+	TimeFilters []*TimeFilter
 }
 
 func init() {
@@ -80,6 +60,8 @@ func init() {
 	deleteCmd.PersistentFlags().StringVarP(&deleteFile, "delete-file", "f", "", "File of tags of resources to delete.")
 	deleteCmd.PersistentFlags().BoolVar(&delAllDeps, "all-deps", false, "Delete all dependencies of all tagged resourcs.")
 	deleteCmd.PersistentFlags().BoolVar(&wantReport, "report", false, "Pretty-print a report of resource deletion errors, if any.")
+	deleteCmd.PersistentFlags().StringSliceVar(&deleteTimeFilters, "time-filter", nil, "Only delete resources with a time tag before ('Key<time') or after ('Key>time') a time, ex. 'ExpiresAt<now'. Applies to every delete file entry.")
+	deleteCmd.PersistentFlags().BoolVar(&notifyOnDelete, "notify", false, "Notify owners of deleted resources, and resources that failed to be deleted, using webhooks in the 'notify' config table.")
 }
 
 var deleteCmd = &cobra.Command{
@@ -125,18 +107,67 @@ func deleteFromStdIn() error {
 }
 
 func deleteFromTags(reader io.Reader) error {
-	dec := json.NewDecoder(reader)
-	// ARNs for all resources tagged with key:values encoded in tagFile.
-	var arns arn.ResourceARNs
+	tfs, err := parseTimeFilterFlags(deleteTimeFilters)
+	if err != nil {
+		return err
+	}
 
-	svc := rgta.New(session.Must(session.NewSession(
-		&aws.Config{},
-	)))
+	// Tags are resolved again in every account and region
+	tagFile, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return fmt.Errorf("read delete input: %s", err)
+	}
+
+	if notifyOnDelete {
+		return deleteAndNotify(tagFile, tfs)
+	}
+
+	err = forEachAccountRegion(func() error {
+		rs, err := getResourcesForTagFile(rgta.New(newAWSSession()), bytes.NewReader(tagFile), tfs)
+		if err != nil {
+			return err
+		}
+
+		// Delete batch of matching resources
+		return deleteARNs(rs.ARNs())
+	})
+	if err != nil {
+		return err
+	}
+
+	return printDeleteReport()
+}
+
+// taggedResource holds the ARN and all tags of a resource
+type taggedResource struct {
+	ARN  arn.ResourceARN
+	Tags map[string]string
+}
+
+type taggedResources []taggedResource
+
+// ARNs returns the ARN of each resource in rs
+func (rs taggedResources) ARNs() arn.ResourceARNs {
+	arns := make(arn.ResourceARNs, 0, len(rs))
+	for _, r := range rs {
+		arns = append(arns, r.ARN)
+	}
+	return arns
+}
+
+// getResourcesForTagFile requests all resources tagged with key:values encoded
+// in a tag file read from reader, and matching time filters in the tag file
+// and tfs.
+func getResourcesForTagFile(svc rgtaiface.ResourceGroupsTaggingAPIAPI, reader io.Reader, tfs []*TimeFilter) (taggedResources, error) {
+	dec := json.NewDecoder(reader)
+	// All resources tagged with key:values encoded in tagFile.
+	var rs taggedResources
+	now := time.Now()
 
 	for {
 		t, isEOF, err := decodeTagFileInput(dec)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if isEOF {
 			break
@@ -147,23 +178,34 @@ func deleteFromTags(reader io.Reader) error {
 
 		// Request all RGTA-taggable resources tagged with key:values encoded in
 		// tagFile.
-		if arns, err = getARNsForResource(svc, t.TagFilters, arns); err != nil {
-			return err
+		preds, err := compileTimeFilters(append(t.TimeFilters, tfs...), now)
+		if err != nil {
+			return nil, err
+		}
+		// Time filters are evaluated client-side, so only request resources
+		// with their tag keys
+		tagFilters := preds.addKeyTagFilters(t.TagFilters)
+
+		if rs, err = getResourcesForTags(svc, tagFilters, preds, rs); err != nil {
+			return nil, err
 		}
 		for rtk := range arn.RGTAUnsupportedResourceTypes {
+			// Resources of global services are requested in one region only
+			if arn.IsGlobalResourceType(rtk) && !inGlobalRegion {
+				continue
+			}
 			// Request all RGTA-unsupported resources tagged with key:values encoded
 			// in tagFile.
-			if arns, err = getARNsForUnsupportedResource(rtk, t.TagFilters, arns); err != nil {
-				return err
+			if rs, err = getUnsupportedResourcesForTags(rtk, tagFilters, preds, rs); err != nil {
+				return nil, err
 			}
 		}
 	}
 
-	// Delete batch of matching resources
-	return deleteARNs(arns)
+	return rs, nil
 }
 
-func getARNsForResource(svc rgtaiface.ResourceGroupsTaggingAPIAPI, tags []*rgta.TagFilter, arnList arn.ResourceARNs) (arn.ResourceARNs, error) {
+func getResourcesForTags(svc rgtaiface.ResourceGroupsTaggingAPIAPI, tags []*rgta.TagFilter, preds timePredicates, rs taggedResources) (taggedResources, error) {
 	// Get ARNs of matching tags
 	params := &rgta.GetResourcesInput{
 		TagFilters:  tags,
@@ -191,18 +233,22 @@ func getARNsForResource(svc rgtaiface.ResourceGroupsTaggingAPIAPI, tags []*rgta.
 		if err != nil {
 			if ignoreErrors {
 				logger.Debugln("rgta: get resources:", err)
-				return arnList, nil
+				return rs, nil
 			}
-			return arnList, fmt.Errorf("rgta: get resources: %s", err)
+			return rs, fmt.Errorf("rgta: get resources: %s", err)
 		}
 
 		if len(resp.ResourceTagMappingList) == 0 {
-			return arnList, nil
+			return rs, nil
 		}
 
 		for _, r := range resp.ResourceTagMappingList {
+			tags := rgtaTagMap(r.Tags)
+			if !preds.Match(tags) {
+				continue
+			}
 			if arnStr := aws.StringValue(r.ResourceARN); arnStr != "" {
-				arnList = append(arnList, arn.ResourceARN(arnStr))
+				rs = append(rs, taggedResource{arn.ResourceARN(arnStr), tags})
 			}
 		}
 
@@ -213,36 +259,34 @@ func getARNsForResource(svc rgtaiface.ResourceGroupsTaggingAPIAPI, tags []*rgta.
 		params.PaginationToken = resp.PaginationToken
 	}
 
-	return arnList, nil
+	return rs, nil
 }
 
-func getARNsForUnsupportedResource(rt arn.ResourceType, tags []*rgta.TagFilter, arnList arn.ResourceARNs) (arn.ResourceARNs, error) {
-	sess := session.Must(session.NewSession(
-		&aws.Config{},
-	))
+func getUnsupportedResourcesForTags(rt arn.ResourceType, tags []*rgta.TagFilter, preds timePredicates, rs taggedResources) (taggedResources, error) {
+	sess := newAWSSession()
 
 	switch arn.NamespaceForResource(rt) {
 	case arn.AutoScalingNamespace:
-		return getAutoScalingResourcesByTags(autoscaling.New(sess), rt, tags, arnList)
+		return getAutoScalingResourcesByTags(autoscaling.New(sess), rt, tags, preds, rs)
 	case arn.Route53Namespace:
-		return getRoute53ResourcesByTags(route53.New(sess), rt, tags, arnList)
+		return getRoute53ResourcesByTags(route53.New(sess), rt, tags, preds, rs)
 	}
 
-	return arnList, nil
+	return rs, nil
 }
 
-func getAutoScalingResourcesByTags(svc autoscalingiface.AutoScalingAPI, rt arn.ResourceType, rgtaTags []*rgta.TagFilter, arnList arn.ResourceARNs) (arn.ResourceARNs, error) {
-	if len(rgtaTags) == 0 || len(arnList) == 0 {
-		return arnList, nil
+func getAutoScalingResourcesByTags(svc autoscalingiface.AutoScalingAPI, rt arn.ResourceType, rgtaTags []*rgta.TagFilter, preds timePredicates, rs taggedResources) (taggedResources, error) {
+	if len(rgtaTags) == 0 || len(rs) == 0 {
+		return rs, nil
 	}
 
 	// Currently only AutoScaling Groups support tagging
 	if rt != arn.AutoScalingGroupRType {
 		if ignoreErrors {
 			logger.Debugf("autoscaling: ResourceType %q not supported", rt)
-			return arnList, nil
+			return rs, nil
 		}
-		return arnList, fmt.Errorf("autoscaling: ResourceType %q not supported", rt)
+		return rs, fmt.Errorf("autoscaling: ResourceType %q not supported", rt)
 	}
 
 	asgTags := make([]*autoscaling.Filter, 0)
@@ -270,14 +314,14 @@ func getAutoScalingResourcesByTags(svc autoscalingiface.AutoScalingAPI, rt arn.R
 		resp, err := svc.DescribeTagsWithContext(ctx, params)
 		if err != nil {
 			if ignoreErrors {
-				logger.Debugln("autoscaling: describe tags: %s", err)
-				return arnList, nil
+				logger.Debugf("autoscaling: describe tags: %s", err)
+				return rs, nil
 			}
-			return arnList, fmt.Errorf("autoscaling: describe tags: %s", err)
+			return rs, fmt.Errorf("autoscaling: describe tags: %s", err)
 		}
 
 		if len(resp.Tags) == 0 {
-			return arnList, nil
+			return rs, nil
 		}
 
 		for _, t := range resp.Tags {
@@ -298,41 +342,47 @@ func getAutoScalingResourcesByTags(svc autoscalingiface.AutoScalingAPI, rt arn.R
 	asgs, err := asgDel.RequestAutoScalingGroups()
 	if err != nil {
 		if ignoreErrors {
-			logger.Debugln("autoscaling: request ASGs: %s", err)
-			return arnList, nil
+			logger.Debugf("autoscaling: request ASGs: %s", err)
+			return rs, nil
 		}
-		return arnList, fmt.Errorf("autoscaling: request ASGs: %s", err)
+		return rs, fmt.Errorf("autoscaling: request ASGs: %s", err)
 	}
 
 	for _, asg := range asgs {
-		arnList = append(arnList, arn.ToResourceARN(asg.AutoScalingGroupARN))
+		asgTags := make(map[string]string, len(asg.Tags))
+		for _, t := range asg.Tags {
+			asgTags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+		}
+		if preds.Match(asgTags) {
+			rs = append(rs, taggedResource{arn.ToResourceARN(asg.AutoScalingGroupARN), asgTags})
+		}
 	}
 
-	return arnList, nil
+	return rs, nil
 }
 
-func getRoute53ResourcesByTags(svc route53iface.Route53API, rt arn.ResourceType, rgtaTags []*rgta.TagFilter, arnList arn.ResourceARNs) (arn.ResourceARNs, error) {
-	if len(rgtaTags) == 0 || len(arnList) == 0 {
-		return arnList, nil
+func getRoute53ResourcesByTags(svc route53iface.Route53API, rt arn.ResourceType, rgtaTags []*rgta.TagFilter, preds timePredicates, rs taggedResources) (taggedResources, error) {
+	if len(rgtaTags) == 0 || len(rs) == 0 {
+		return rs, nil
 	}
 
 	// Currently only Route53 HostedZones support tagging
 	if rt != arn.Route53HostedZoneRType {
 		if ignoreErrors {
 			logger.Debugf("route53: ResourceType %q not supported", rt)
-			return arnList, nil
+			return rs, nil
 		}
-		return arnList, fmt.Errorf("route53: ResourceType %q not supported", rt)
+		return rs, fmt.Errorf("route53: ResourceType %q not supported", rt)
 	}
 
 	rd := deleter.Route53HostedZoneDeleter{Client: svc}
 	hzs, err := rd.RequestAllRoute53HostedZones()
 	if err != nil || len(hzs) == 0 {
 		if ignoreErrors {
-			logger.Debugln("route53: request hosted zones: %s", err)
-			return arnList, nil
+			logger.Debugf("route53: request hosted zones: %s", err)
+			return rs, nil
 		}
-		return arnList, fmt.Errorf("route53: request hosted zones: %s", err)
+		return rs, fmt.Errorf("route53: request hosted zones: %s", err)
 	}
 
 	var hzIDs arn.ResourceNames
@@ -345,6 +395,7 @@ func getRoute53ResourcesByTags(svc route53iface.Route53API, rt arn.ResourceType,
 	tagMap := createHostedZoneTagMap(rgtaTags)
 	size, chunk := len(hzIDs), 10
 	var filteredHZIDs arn.ResourceNames
+	hzTags := make(map[arn.ResourceName]map[string]string)
 	// Can only tag hosted zones in batches of 10
 	for i := 0; i < size; i += chunk {
 		stop := deleter.CalcChunk(i, size, chunk)
@@ -357,21 +408,24 @@ func getRoute53ResourcesByTags(svc route53iface.Route53API, rt arn.ResourceType,
 		resp, err := svc.ListTagsForResourcesWithContext(ctx, params)
 		if err != nil {
 			if ignoreErrors {
-				logger.Debugln("route53: list resource tags: %s", err)
-				return arnList, nil
+				logger.Debugf("route53: list resource tags: %s", err)
+				return rs, nil
 			}
-			return arnList, fmt.Errorf("route53: list resource tags: %s", err)
+			return rs, fmt.Errorf("route53: list resource tags: %s", err)
 		}
 
-		filteredHZIDs = filterHostedZones(filteredHZIDs, resp.ResourceTagSets, tagMap)
+		for _, rts := range resp.ResourceTagSets {
+			hzTags[arn.ToResourceName(rts.ResourceId)] = route53TagMap(rts.Tags)
+		}
+		filteredHZIDs = filterHostedZones(filteredHZIDs, resp.ResourceTagSets, tagMap, preds)
 	}
 
 	for _, id := range filteredHZIDs {
 		hzARN := arn.MapResourceTypeToARN(arn.Route53HostedZoneRType, id)
-		arnList = append(arnList, arn.ResourceARN(hzARN))
+		rs = append(rs, taggedResource{arn.ResourceARN(hzARN), hzTags[id]})
 	}
 
-	return arnList, nil
+	return rs, nil
 }
 
 // createHostedZoneTagMap creates a map[string][]string corresponding to tags of
@@ -392,10 +446,14 @@ func createHostedZoneTagMap(rgtaTags []*rgta.TagFilter) map[string][]string {
 }
 
 // filterHostedZones adds hosted zone IDs to hzIDs if their tag key(s) (and
-// values if present) match those provided by those in deleteFile.
-func filterHostedZones(hzIDs arn.ResourceNames, tagSets []*route53.ResourceTagSet, tagMap map[string][]string) arn.ResourceNames {
+// values if present) match those provided by those in deleteFile, and their
+// tags match preds.
+func filterHostedZones(hzIDs arn.ResourceNames, tagSets []*route53.ResourceTagSet, tagMap map[string][]string, preds timePredicates) arn.ResourceNames {
 	for _, rts := range tagSets {
 		nameStr := arn.ToResourceName(rts.ResourceId)
+		if !preds.Match(route53TagMap(rts.Tags)) {
+			continue
+		}
 		for _, tag := range rts.Tags {
 			if vals, ok := tagMap[aws.StringValue(tag.Key)]; ok {
 				// If no tag values are specified, then we want all hosted zones that
@@ -416,70 +474,88 @@ func filterHostedZones(hzIDs arn.ResourceNames, tagSets []*route53.ResourceTagSe
 	return hzIDs
 }
 
-// Traverse dependency graph and request all possible ID's of resource
-// dependencies, then bucket them according to ResourceType.
-func bucketARNs(ARNs arn.ResourceARNs) map[arn.ResourceType]deleter.ResourceDeleter {
-	// All ARN's stored here. Key is some arn.*RType, value is a slice of ARN's
-	resMap := make(map[arn.ResourceType]deleter.ResourceDeleter)
-	seen := map[arn.ResourceName]struct{}{}
+// buildGraph adds all resources in ARNs to a dependency graph, then traverses
+// the graph and requests all possible ID's of resource dependencies if
+// delAllDeps is set.
+func buildGraph(ARNs arn.ResourceARNs) *graph.Graph {
+	g := graph.NewGraph()
 
-	// Initialize with all ID's from ARN's tagged in CloudTrail logs
+	// Initialize with all ID's from ARN's tagged in CloudTrail logs. AddNode
+	// removes duplicates and nil resources
 	for _, a := range ARNs {
-		rt, rn := arn.MapARNToRTypeAndRName(a)
-		// Remove duplicates and nil resources
-		if _, ok := seen[rn]; ok || rt == "" || rn == "" {
-			continue
-		}
-		seen[rn] = struct{}{}
-
-		if _, ok := resMap[rt]; !ok {
-			resMap[rt] = deleter.InitResourceDeleter(rt)
-		}
-		resMap[rt].AddResourceNames(rn)
+		g.AddNode(arn.MapARNToRTypeAndRName(a))
 	}
 
 	// Unless the user specifies the --all-deps flag, do not find/delete
 	// dependencies of resources
 	if delAllDeps {
-		graph.FillDependencyGraph(resMap)
+		graph.FillDependencyGraph(g)
 	}
 
-	return resMap
+	return g
 }
 
-type delResMap struct {
-	Type     string
-	Deleters deleter.ResourceDeleter
+func deleteARNs(ARNs arn.ResourceARNs) error {
+	return deleteGraph(buildGraph(ARNs))
 }
 
-func deleteARNs(ARNs arn.ResourceARNs) error {
-	// Create a slice of ARN's for every ResourceType in ARNs
-	resMap := bucketARNs(ARNs)
-	if len(resMap) == 0 {
+// deleteGraph deletes all resources in g in dependency order.
+func deleteGraph(g *graph.Graph) error {
+	if g.Len() == 0 {
 		return nil
 	}
 
-	// Ensure deletion order. Most resources have dependencies, so a dependency
-	// graph must be constructed and executed. See README for deletion order.
-	sorted := organizeByDelOrder(resMap)
+	// Ensure deletion order. Most resources have dependencies, so the dependency
+	// graph is sorted into batches that can each be deleted once all batches
+	// they depend on are deleted. See Documentation/deletion-order.md.
+	batches, err := g.Batches()
+	if err != nil {
+		return fmt.Errorf("sort resources: %s", err)
+	}
 
-	cfg := &deleter.DeleteConfig{
-		IgnoreErrors: ignoreErrors,
-		DryRun:       dryRun,
-		Logger:       logger,
+	// Delete independent batches concurrently
+	sched := &graph.Scheduler{
+		Workers:       viper.GetInt("deleteConcurrency"),
+		ServiceLimits: getServiceConcurrencyLimits(),
+	}
+	var regionLogger logrus.FieldLogger = logger
+	if accountID != "" {
+		regionLogger = regionLogger.WithField("account_id", accountID)
+	}
+	if region != "" {
+		regionLogger = regionLogger.WithField("region", region)
 	}
+	err = sched.Run(batches, func(b *graph.Batch) error {
+		cfg := &deleter.DeleteConfig{
+			IgnoreErrors: ignoreErrors,
+			DryRun:       dryRun,
+			Logger:       regionLogger,
+		}
+		// Attribute interleaved log entries to the VPC of a batch, if known
+		if b.Scope != "" {
+			cfg.Logger = regionLogger.WithField("vpc_id", b.Scope)
+		}
 
-	// Delete all ARN's in a slice mapped by ResourceType. Iterate in reverse to
-	// delete all non-dependent resources first
-	for i := len(sorted) - 1; i >= 0; i-- {
-		if err := sorted[i].Deleters.DeleteResources(cfg); err != nil {
-			// DeleteResources should only return an error when ignoreErrors == false,
-			// so we want to return this err if one is encountered.
-			return fmt.Errorf("delete resources: %s", err)
+		// Global resources may have been deleted in a previous region
+		for _, rd := range graph.Deleters(claimNodes(b.Nodes)) {
+			if err := rd.DeleteResources(cfg); err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		// DeleteResources should only return an error when ignoreErrors == false,
+		// so we want to return this err if one is encountered.
+		return fmt.Errorf("delete resources: %s", err)
 	}
 
-	// Print all failed deletion logs in report format at end of deletion cycle
+	return nil
+}
+
+// printDeleteReport prints all failed deletion logs in report format if a
+// report was requested. Call once at the end of a deletion cycle.
+func printDeleteReport() error {
 	if wantReport && logger.LogFile != "" {
 		f, err := os.Open(logger.LogFile)
 		if err != nil {
@@ -494,29 +570,32 @@ func deleteARNs(ARNs arn.ResourceARNs) error {
 	return nil
 }
 
-func organizeByDelOrder(resMap map[arn.ResourceType]deleter.ResourceDeleter) []delResMap {
-	sorted := make([]delResMap, 0, len(resMap))
-
-	// Append ARN's to sorted in deletion order
-	for _, rt := range DeleteOrder {
-		if dels, ok := resMap[rt]; ok {
-			sorted = append(sorted, delResMap{
-				Type:     rt.String(),
-				Deleters: dels,
-			})
-			delete(resMap, rt)
-		}
+// getServiceConcurrencyLimits reads the maximum number of concurrent deletion
+// batches per AWS service namespace from the 'serviceConcurrency' config table.
+func getServiceConcurrencyLimits() map[string]int {
+	limits := make(map[string]int)
+	for svc, limit := range viper.GetStringMap("serviceConcurrency") {
+		limits[svc] = cast.ToInt(limit)
 	}
+	return limits
+}
 
-	// Add the remaining ARN's
-	for rt, dels := range resMap {
-		sorted = append(sorted, delResMap{
-			Type:     rt.String(),
-			Deleters: dels,
-		})
+// rgtaTagMap converts RGTA tags to a map of tag key to value.
+func rgtaTagMap(tags []*rgta.Tag) map[string]string {
+	m := make(map[string]string, len(tags))
+	for _, t := range tags {
+		m[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
 	}
+	return m
+}
 
-	return sorted
+// route53TagMap converts Route53 tags to a map of tag key to value.
+func route53TagMap(tags []*route53.Tag) map[string]string {
+	m := make(map[string]string, len(tags))
+	for _, t := range tags {
+		m[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return m
 }
 
 func decodeTagFileInput(decoder *json.Decoder) (*TagFileInput, bool, error) {
@@ -550,6 +629,18 @@ func formatReportLogEntry(e *deleter.LogEntry) (m string) {
 		m = fmt.Sprintf("%s from %s %s", m, e.ParentResourceType, e.ParentResourceName)
 	}
 
+	if e.VPCID != "" {
+		m = fmt.Sprintf("%s in VPC %s", m, e.VPCID)
+	}
+
+	if e.Region != "" {
+		m = fmt.Sprintf("%s in %s", m, e.Region)
+	}
+
+	if e.AccountID != "" {
+		m = fmt.Sprintf("%s of account %s", m, e.AccountID)
+	}
+
 	switch {
 	case e.AWSErrorCode != "":
 		// AWS error messages are verbose and should be logged to a log file instead
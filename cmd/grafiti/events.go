@@ -0,0 +1,168 @@
+// Copyright © 2017 grafiti authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/coreos/grafiti/arn"
+	"github.com/spf13/viper"
+)
+
+// Holds data that identifies a resource in a raw CloudTrail event: the name of
+// the event creating the resource, resource type, and gjson.Result search path
+// for resource names. A path can contain '#' to select names from every
+// element of an array, ex. 'items.#.instanceId'.
+type rawEventIdentity struct {
+	EventName        string
+	ResourceType     string
+	ResourceNamePath string
+}
+
+// defaultRawEventIdentities identifies resources of every type grafiti can
+// delete in the raw CloudTrail events that create them. Association and
+// attachment names are the IDs their deleters expect. Inline role policies are
+// deleted with their role, and have no ARN of their own, so they are not
+// identified.
+var defaultRawEventIdentities = []rawEventIdentity{
+	// AutoScaling
+	{"CreateAutoScalingGroup", arn.AutoScalingGroupRType, "requestParameters.autoScalingGroupName"},
+	{"CreateLaunchConfiguration", arn.AutoScalingLaunchConfigurationRType, "requestParameters.launchConfigurationName"},
+	// EC2
+	{"AllocateAddress", arn.EC2EIPRType, "responseElements.allocationId"},
+	{"AssociateAddress", arn.EC2EIPAssociationRType, "responseElements.associationId"},
+	{"AssociateRouteTable", arn.EC2RouteTableAssociationRType, "responseElements.associationId"},
+	{"AssociateVpcCidrBlock", arn.EC2VPCCIDRAssociationRType, "responseElements.AssociateVpcCidrBlockResponse.cidrBlockAssociation.associationId"},
+	{"AssociateVpcCidrBlock", arn.EC2VPCCIDRAssociationRType, "responseElements.AssociateVpcCidrBlockResponse.ipv6CidrBlockAssociation.associationId"},
+	{"AttachInternetGateway", arn.EC2InternetGatewayAttachmentRType, "requestParameters.vpcId"},
+	{"CreateCustomerGateway", arn.EC2CustomerGatewayRType, "responseElements.customerGateway.customerGatewayId"},
+	{"CreateInternetGateway", arn.EC2InternetGatewayRType, "responseElements.internetGateway.internetGatewayId"},
+	{"CreateNatGateway", arn.EC2NatGatewayRType, "responseElements.CreateNatGatewayResponse.natGateway.natGatewayId"},
+	{"CreateNetworkAcl", arn.EC2NetworkACLRType, "responseElements.networkAcl.networkAclId"},
+	{"CreateNetworkInterface", arn.EC2NetworkInterfaceRType, "responseElements.networkInterface.networkInterfaceId"},
+	{"CreateRouteTable", arn.EC2RouteTableRType, "responseElements.routeTable.routeTableId"},
+	{"CreateSecurityGroup", arn.EC2SecurityGroupRType, "responseElements.groupId"},
+	{"CreateSubnet", arn.EC2SubnetRType, "responseElements.subnet.subnetId"},
+	{"CreateVolume", arn.EC2VolumeRType, "responseElements.volumeId"},
+	{"CreateVpc", arn.EC2VPCRType, "responseElements.vpc.vpcId"},
+	{"CreateVpnConnection", arn.EC2VPNConnectionRType, "responseElements.vpnConnection.vpnConnectionId"},
+	{"CreateVpnGateway", arn.EC2VPNGatewayRType, "responseElements.vpnGateway.vpnGatewayId"},
+	{"RunInstances", arn.EC2InstanceRType, "responseElements.instancesSet.items.#.instanceId"},
+	{"RunInstances", arn.EC2NetworkInterfaceRType, "responseElements.instancesSet.items.#.networkInterfaceSet.items.#.networkInterfaceId"},
+	// ElasticLoadBalancing
+	{"CreateLoadBalancer", arn.ElasticLoadBalancingLoadBalancerRType, "requestParameters.loadBalancerName"},
+	// IAM
+	{"CreateInstanceProfile", arn.IAMInstanceProfileRType, "requestParameters.instanceProfileName"},
+	{"CreateRole", arn.IAMRoleRType, "requestParameters.roleName"},
+	// Route53
+	{"CreateHostedZone", arn.Route53HostedZoneRType, "responseElements.hostedZone.id"},
+	// S3
+	{"CreateBucket", arn.S3BucketRType, "requestParameters.bucketName"},
+}
+
+// defaultDeleteEventIdentities identifies resources of every type grafiti can
+// delete in the raw CloudTrail events that delete them. Resource names are
+// the same as those of defaultRawEventIdentities, except hosted zone IDs,
+// which are matched by ARN.
+var defaultDeleteEventIdentities = []rawEventIdentity{
+	// AutoScaling
+	{"DeleteAutoScalingGroup", arn.AutoScalingGroupRType, "requestParameters.autoScalingGroupName"},
+	{"DeleteLaunchConfiguration", arn.AutoScalingLaunchConfigurationRType, "requestParameters.launchConfigurationName"},
+	// EC2
+	{"ReleaseAddress", arn.EC2EIPRType, "requestParameters.allocationId"},
+	{"DisassociateAddress", arn.EC2EIPAssociationRType, "requestParameters.associationId"},
+	{"DisassociateRouteTable", arn.EC2RouteTableAssociationRType, "requestParameters.associationId"},
+	{"DisassociateVpcCidrBlock", arn.EC2VPCCIDRAssociationRType, "requestParameters.DisassociateVpcCidrBlockRequest.AssociationId"},
+	{"DetachInternetGateway", arn.EC2InternetGatewayAttachmentRType, "requestParameters.vpcId"},
+	{"DeleteCustomerGateway", arn.EC2CustomerGatewayRType, "requestParameters.customerGatewayId"},
+	{"DeleteInternetGateway", arn.EC2InternetGatewayRType, "requestParameters.internetGatewayId"},
+	{"DeleteNatGateway", arn.EC2NatGatewayRType, "requestParameters.DeleteNatGatewayRequest.NatGatewayId"},
+	{"DeleteNetworkAcl", arn.EC2NetworkACLRType, "requestParameters.networkAclId"},
+	{"DeleteNetworkInterface", arn.EC2NetworkInterfaceRType, "requestParameters.networkInterfaceId"},
+	{"DeleteRouteTable", arn.EC2RouteTableRType, "requestParameters.routeTableId"},
+	{"DeleteSecurityGroup", arn.EC2SecurityGroupRType, "requestParameters.groupId"},
+	{"DeleteSubnet", arn.EC2SubnetRType, "requestParameters.subnetId"},
+	{"DeleteVolume", arn.EC2VolumeRType, "requestParameters.volumeId"},
+	{"DeleteVpc", arn.EC2VPCRType, "requestParameters.vpcId"},
+	{"DeleteVpnConnection", arn.EC2VPNConnectionRType, "requestParameters.vpnConnectionId"},
+	{"DeleteVpnGateway", arn.EC2VPNGatewayRType, "requestParameters.vpnGatewayId"},
+	{"TerminateInstances", arn.EC2InstanceRType, "requestParameters.instancesSet.items.#.instanceId"},
+	// ElasticLoadBalancing
+	{"DeleteLoadBalancer", arn.ElasticLoadBalancingLoadBalancerRType, "requestParameters.loadBalancerName"},
+	// IAM
+	{"DeleteInstanceProfile", arn.IAMInstanceProfileRType, "requestParameters.instanceProfileName"},
+	{"DeleteRole", arn.IAMRoleRType, "requestParameters.roleName"},
+	// Route53
+	{"DeleteHostedZone", arn.Route53HostedZoneRType, "requestParameters.id"},
+	// S3
+	{"DeleteBucket", arn.S3BucketRType, "requestParameters.bucketName"},
+}
+
+// Maps CloudTrail eventName to a rawEventIdentity for each type of resource
+// created by the event
+var rawEventMap = newRawEventMap(defaultRawEventIdentities)
+
+// Maps CloudTrail eventName to a rawEventIdentity for each type of resource
+// deleted by the event
+var deleteEventMap = newRawEventMap(defaultDeleteEventIdentities)
+
+func newRawEventMap(ids []rawEventIdentity) map[string][]rawEventIdentity {
+	m := make(map[string][]rawEventIdentity)
+	for _, id := range ids {
+		m[id.EventName] = append(m[id.EventName], id)
+	}
+	return m
+}
+
+// getRawEventIdentities reads identities from the 'eventResources' config
+// table array and adds them to the default identities. A configured identity
+// replaces default identities of the same event and resource type.
+func getRawEventIdentities() ([]rawEventIdentity, error) {
+	var configured []rawEventIdentity
+	if err := viper.UnmarshalKey("eventResources", &configured); err != nil {
+		return nil, fmt.Errorf("read eventResources: %s", err)
+	}
+
+	replaced := make(map[rawEventIdentity]bool)
+	for i, id := range configured {
+		switch {
+		case id.EventName == "":
+			return nil, fmt.Errorf("eventResources %d: no eventName", i)
+		case arn.NamespaceForResource(arn.ResourceType(id.ResourceType)) == "":
+			return nil, fmt.Errorf("eventResources %d: unknown resourceType %q", i, id.ResourceType)
+		case id.ResourceNamePath == "":
+			return nil, fmt.Errorf("eventResources %d: no resourceNamePath", i)
+		}
+		replaced[rawEventIdentity{EventName: id.EventName, ResourceType: id.ResourceType}] = true
+	}
+
+	var ids []rawEventIdentity
+	for _, id := range defaultRawEventIdentities {
+		if !replaced[rawEventIdentity{EventName: id.EventName, ResourceType: id.ResourceType}] {
+			ids = append(ids, id)
+		}
+	}
+	return append(ids, configured...), nil
+}
+
+// initEventResources sets the resources identified in raw CloudTrail events
+// from the default identities and the 'eventResources' config table array.
+func initEventResources() {
+	ids, err := getRawEventIdentities()
+	if err != nil {
+		exitWithError(err)
+	}
+	rawEventMap = newRawEventMap(ids)
+}
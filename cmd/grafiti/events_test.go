@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/grafiti/arn"
+	"github.com/coreos/grafiti/deleter"
+	"github.com/spf13/viper"
+)
+
+// newTestEvent creates a raw CloudTrail event named name with elements, a
+// comma-separated list of JSON object members.
+func newTestEvent(name, elements string) string {
+	return fmt.Sprintf(`{
+		"eventName": %q,
+		"awsRegion": "us-west-2",
+		"recipientAccountId": "123456789101",
+		"userIdentity": {"accountId": "123456789101", "arn": "arn:aws:iam::123456789101:user/test-user"},
+		%s
+	}`, name, elements)
+}
+
+type testEventResource struct {
+	Type string
+	Name string
+	ARN  string
+}
+
+func TestParseRawEventIdentities(t *testing.T) {
+	viper.Set("tagPatterns", []string{})
+	viper.Set("filterPatterns", []string{})
+
+	// Auto scaling group ARNs are requested from AWS, so CreateAutoScalingGroup
+	// is not tested here.
+	cases := []struct {
+		Event    string
+		Expected []testEventResource
+	}{
+		{
+			newTestEvent("CreateLaunchConfiguration", `"requestParameters": {"launchConfigurationName": "lc-1"}, "responseElements": null`),
+			[]testEventResource{{arn.AutoScalingLaunchConfigurationRType, "lc-1", ""}},
+		},
+		{
+			newTestEvent("AllocateAddress", `"requestParameters": {"domain": "vpc"}, "responseElements": {"publicIp": "1.2.3.4", "domain": "vpc", "allocationId": "eipalloc-1"}`),
+			[]testEventResource{{arn.EC2EIPRType, "eipalloc-1", "arn:aws:ec2:us-west-2:123456789101:elastic-ip/eipalloc-1"}},
+		},
+		{
+			newTestEvent("AssociateAddress", `"requestParameters": {"allocationId": "eipalloc-1", "instanceId": "i-1"}, "responseElements": {"_return": true, "associationId": "eipassoc-1"}`),
+			[]testEventResource{{arn.EC2EIPAssociationRType, "eipassoc-1", ""}},
+		},
+		{
+			newTestEvent("AssociateRouteTable", `"requestParameters": {"routeTableId": "rtb-1", "subnetId": "subnet-1"}, "responseElements": {"associationId": "rtbassoc-1"}`),
+			[]testEventResource{{arn.EC2RouteTableAssociationRType, "rtbassoc-1", ""}},
+		},
+		{
+			newTestEvent("AssociateVpcCidrBlock", `"requestParameters": {"vpcId": "vpc-1"}, "responseElements": {"AssociateVpcCidrBlockResponse": {"vpcId": "vpc-1", "cidrBlockAssociation": {"associationId": "vpc-cidr-assoc-1", "cidrBlock": "10.1.0.0/16"}}}`),
+			[]testEventResource{{arn.EC2VPCCIDRAssociationRType, "vpc-cidr-assoc-1", ""}},
+		},
+		{
+			newTestEvent("AssociateVpcCidrBlock", `"requestParameters": {"vpcId": "vpc-1"}, "responseElements": {"AssociateVpcCidrBlockResponse": {"vpcId": "vpc-1", "ipv6CidrBlockAssociation": {"associationId": "vpc-cidr-assoc-2"}}}`),
+			[]testEventResource{{arn.EC2VPCCIDRAssociationRType, "vpc-cidr-assoc-2", ""}},
+		},
+		{
+			newTestEvent("AttachInternetGateway", `"requestParameters": {"internetGatewayId": "igw-1", "vpcId": "vpc-1"}, "responseElements": {"_return": true}`),
+			[]testEventResource{{arn.EC2InternetGatewayAttachmentRType, "vpc-1", ""}},
+		},
+		{
+			newTestEvent("CreateCustomerGateway", `"responseElements": {"customerGateway": {"customerGatewayId": "cgw-1"}}`),
+			[]testEventResource{{arn.EC2CustomerGatewayRType, "cgw-1", "arn:aws:ec2:us-west-2:123456789101:customer-gateway/cgw-1"}},
+		},
+		{
+			newTestEvent("CreateInternetGateway", `"responseElements": {"internetGateway": {"internetGatewayId": "igw-1"}}`),
+			[]testEventResource{{arn.EC2InternetGatewayRType, "igw-1", "arn:aws:ec2:us-west-2:123456789101:internet-gateway/igw-1"}},
+		},
+		{
+			newTestEvent("CreateNatGateway", `"requestParameters": {"CreateNatGatewayRequest": {"SubnetId": "subnet-1", "AllocationId": "eipalloc-1"}}, "responseElements": {"CreateNatGatewayResponse": {"natGateway": {"natGatewayId": "nat-1", "subnetId": "subnet-1", "vpcId": "vpc-1"}}}`),
+			[]testEventResource{{arn.EC2NatGatewayRType, "nat-1", "arn:aws:ec2:us-west-2:123456789101:natgateway/nat-1"}},
+		},
+		{
+			newTestEvent("CreateNetworkAcl", `"responseElements": {"networkAcl": {"networkAclId": "acl-1"}}`),
+			[]testEventResource{{arn.EC2NetworkACLRType, "acl-1", "arn:aws:ec2:us-west-2:123456789101:network-acl/acl-1"}},
+		},
+		{
+			newTestEvent("CreateNetworkInterface", `"responseElements": {"networkInterface": {"networkInterfaceId": "eni-1"}}`),
+			[]testEventResource{{arn.EC2NetworkInterfaceRType, "eni-1", "arn:aws:ec2:us-west-2:123456789101:network-interface/eni-1"}},
+		},
+		{
+			newTestEvent("CreateRouteTable", `"responseElements": {"routeTable": {"routeTableId": "rtb-1"}}`),
+			[]testEventResource{{arn.EC2RouteTableRType, "rtb-1", "arn:aws:ec2:us-west-2:123456789101:route-table/rtb-1"}},
+		},
+		{
+			newTestEvent("CreateSecurityGroup", `"responseElements": {"_return": true, "groupId": "sg-1"}`),
+			[]testEventResource{{arn.EC2SecurityGroupRType, "sg-1", "arn:aws:ec2:us-west-2:123456789101:security-group/sg-1"}},
+		},
+		{
+			newTestEvent("CreateSubnet", `"responseElements": {"subnet": {"subnetId": "subnet-1"}}`),
+			[]testEventResource{{arn.EC2SubnetRType, "subnet-1", "arn:aws:ec2:us-west-2:123456789101:subnet/subnet-1"}},
+		},
+		{
+			newTestEvent("CreateVolume", `"responseElements": {"volumeId": "vol-1"}`),
+			[]testEventResource{{arn.EC2VolumeRType, "vol-1", "arn:aws:ec2:us-west-2:123456789101:volume/vol-1"}},
+		},
+		{
+			newTestEvent("CreateVpc", `"responseElements": {"vpc": {"vpcId": "vpc-1"}}`),
+			[]testEventResource{{arn.EC2VPCRType, "vpc-1", "arn:aws:ec2:us-west-2:123456789101:vpc/vpc-1"}},
+		},
+		{
+			newTestEvent("CreateVpnConnection", `"responseElements": {"vpnConnection": {"vpnConnectionId": "vpn-1"}}`),
+			[]testEventResource{{arn.EC2VPNConnectionRType, "vpn-1", "arn:aws:ec2:us-west-2:123456789101:vpn-connection/vpn-1"}},
+		},
+		{
+			newTestEvent("CreateVpnGateway", `"responseElements": {"vpnGateway": {"vpnGatewayId": "vgw-1"}}`),
+			[]testEventResource{{arn.EC2VPNGatewayRType, "vgw-1", "arn:aws:ec2:us-west-2:123456789101:vpn-gateway/vgw-1"}},
+		},
+		{
+			newTestEvent("RunInstances", `"responseElements": {"instancesSet": {"items": [{"instanceId": "i-1", "networkInterfaceSet": {"items": [{"networkInterfaceId": "eni-1"}]}, "blockDeviceMapping": {}}]}}`),
+			[]testEventResource{
+				{arn.EC2InstanceRType, "i-1", "arn:aws:ec2:us-west-2:123456789101:instance/i-1"},
+				{arn.EC2NetworkInterfaceRType, "eni-1", "arn:aws:ec2:us-west-2:123456789101:network-interface/eni-1"},
+			},
+		},
+		{
+			newTestEvent("CreateLoadBalancer", `"requestParameters": {"loadBalancerName": "elb-1"}`),
+			[]testEventResource{{arn.ElasticLoadBalancingLoadBalancerRType, "elb-1", "arn:aws:elasticloadbalancing:us-west-2:123456789101:loadbalancer/elb-1"}},
+		},
+		{
+			newTestEvent("CreateInstanceProfile", `"requestParameters": {"instanceProfileName": "profile-1"}`),
+			[]testEventResource{{arn.IAMInstanceProfileRType, "profile-1", ""}},
+		},
+		{
+			newTestEvent("CreateRole", `"requestParameters": {"roleName": "role-1"}`),
+			[]testEventResource{{arn.IAMRoleRType, "role-1", ""}},
+		},
+		{
+			newTestEvent("CreateHostedZone", `"responseElements": {"hostedZone": {"id": "/hostedzone/Z1"}}`),
+			[]testEventResource{{arn.Route53HostedZoneRType, "/hostedzone/Z1", "arn:aws:route53:::hostedzone/Z1"}},
+		},
+		{
+			newTestEvent("CreateBucket", `"requestParameters": {"bucketName": "bucket-1"}`),
+			[]testEventResource{{arn.S3BucketRType, "bucket-1", "arn:aws:s3:::bucket-1"}},
+		},
+		// Events that do not create resources
+		{
+			newTestEvent("PutRolePolicy", `"requestParameters": {"roleName": "role-1", "policyName": "policy-1"}`),
+			nil,
+		},
+		{
+			newTestEvent("DescribeInstances", `"responseElements": null`),
+			nil,
+		},
+	}
+
+	for i, c := range cases {
+		var got []testEventResource
+		for _, o := range parseRawCloudTrailEvent(c.Event) {
+			var out Output
+			if err := json.Unmarshal([]byte(o.Output), &out); err != nil {
+				t.Fatalf("parseRawCloudTrailEvent case %d: unmarshal output: %s", i+1, err)
+			}
+			tm := out.TaggingMetadata
+			got = append(got, testEventResource{tm.ResourceType.String(), tm.ResourceName.String(), tm.ResourceARN.String()})
+		}
+		if !reflect.DeepEqual(got, c.Expected) {
+			t.Errorf("parseRawCloudTrailEvent case %d failed\nwanted: %+v\ngot: %+v", i+1, c.Expected, got)
+		}
+	}
+}
+
+func TestRawEventIdentitiesCoverDeleters(t *testing.T) {
+	deletable := []arn.ResourceType{
+		arn.AutoScalingGroupRType,
+		arn.AutoScalingLaunchConfigurationRType,
+		arn.EC2CustomerGatewayRType,
+		arn.EC2EIPRType,
+		arn.EC2EIPAssociationRType,
+		arn.EC2InstanceRType,
+		arn.EC2InternetGatewayAttachmentRType,
+		arn.EC2InternetGatewayRType,
+		arn.EC2NatGatewayRType,
+		arn.EC2NetworkACLRType,
+		arn.EC2NetworkInterfaceRType,
+		arn.EC2RouteTableAssociationRType,
+		arn.EC2RouteTableRType,
+		arn.EC2SecurityGroupRType,
+		arn.EC2SubnetRType,
+		arn.EC2VolumeRType,
+		arn.EC2VPCCIDRAssociationRType,
+		arn.EC2VPCRType,
+		arn.EC2VPNGatewayRType,
+		arn.EC2VPNConnectionRType,
+		arn.ElasticLoadBalancingLoadBalancerRType,
+		arn.IAMInstanceProfileRType,
+		// Role policies are deleted with their role
+		arn.IAMRoleRType,
+		arn.Route53HostedZoneRType,
+		arn.S3BucketRType,
+	}
+
+	covered := make(map[arn.ResourceType]bool)
+	for _, id := range defaultRawEventIdentities {
+		covered[arn.ResourceType(id.ResourceType)] = true
+	}
+	deleteCovered := make(map[arn.ResourceType]bool)
+	for _, id := range defaultDeleteEventIdentities {
+		deleteCovered[arn.ResourceType(id.ResourceType)] = true
+	}
+	for _, rt := range deletable {
+		if deleter.InitResourceDeleter(rt) == nil {
+			t.Errorf("%s does not have a deleter", rt)
+		}
+		if !covered[rt] {
+			t.Errorf("no raw event identity for %s", rt)
+		}
+		if !deleteCovered[rt] {
+			t.Errorf("no delete event identity for %s", rt)
+		}
+	}
+}
+
+func TestGetRawEventIdentities(t *testing.T) {
+	defer viper.Set("eventResources", nil)
+
+	cases := []struct {
+		Config   []map[string]interface{}
+		Expected []rawEventIdentity
+		WantErr  bool
+	}{
+		{
+			Config: []map[string]interface{}{
+				{"eventName": "CreateDBInstance", "resourceType": "AWS::RDS::DBInstance", "resourceNamePath": "requestParameters.dBInstanceIdentifier"},
+				{"eventName": "CreateVolume", "resourceType": "AWS::EC2::Volume", "resourceNamePath": "responseElements.volume.volumeId"},
+			},
+			Expected: []rawEventIdentity{
+				{"CreateDBInstance", "AWS::RDS::DBInstance", "requestParameters.dBInstanceIdentifier"},
+				{"CreateVolume", "AWS::EC2::Volume", "responseElements.volume.volumeId"},
+			},
+		},
+		{
+			Config:  []map[string]interface{}{{"eventName": "CreateThing", "resourceType": "Thing", "resourceNamePath": "responseElements.thingId"}},
+			WantErr: true,
+		},
+		{
+			Config:  []map[string]interface{}{{"eventName": "CreateVolume", "resourceType": "AWS::EC2::Volume"}},
+			WantErr: true,
+		},
+	}
+
+	for i, c := range cases {
+		viper.Set("eventResources", c.Config)
+		ids, err := getRawEventIdentities()
+		if (err != nil) != c.WantErr {
+			t.Errorf("getRawEventIdentities case %d: wanted error %t, got %v", i+1, c.WantErr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		m := newRawEventMap(ids)
+		for _, id := range c.Expected {
+			if !reflect.DeepEqual(m[id.EventName], []rawEventIdentity{id}) {
+				t.Errorf("getRawEventIdentities case %d: wanted %+v, got %+v", i+1, id, m[id.EventName])
+			}
+		}
+		if len(ids) != len(defaultRawEventIdentities)+1 {
+			t.Errorf("getRawEventIdentities case %d: got %d identities, wanted %d", i+1, len(ids), len(defaultRawEventIdentities)+1)
+		}
+	}
+}
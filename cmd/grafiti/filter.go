@@ -1,14 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	rgta "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
 	rgtaiface "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
 	"github.com/coreos/grafiti/arn"
@@ -16,14 +16,16 @@ import (
 )
 
 var (
-	ignoreFile string
-	filterFile string
+	ignoreFile        string
+	filterFile        string
+	filterTimeFilters []string
 )
 
 func init() {
 	RootCmd.AddCommand(filterCmd)
 	filterCmd.PersistentFlags().StringVarP(&ignoreFile, "ignore-file", "i", "", "File containing tags to ignore, in the format of the aws-sdk-go/service/resourcegrouptaggingapi.TagFilters struct.")
 	filterCmd.PersistentFlags().StringVarP(&filterFile, "filter-file", "f", "", "File containing JSON objects of filterable resource ARN's and tag key/value pairs. Format is the output format of grafiti parse.")
+	filterCmd.PersistentFlags().StringSliceVar(&filterTimeFilters, "time-filter", nil, "Only ignore resources with a time tag before ('Key<time') or after ('Key>time') a time, ex. 'ExpiresAt>now'. Applies to every ignore file entry.")
 }
 
 var filterCmd = &cobra.Command{
@@ -48,27 +50,29 @@ func runFilterCommand(cmd *cobra.Command, args []string) error {
 	}
 	defer iFile.Close()
 
-	svc := rgta.New(session.Must(session.NewSession(
-		&aws.Config{},
-	)))
+	// Create a map that contains all ignorable ARN's in every account and region
+	itMap, err := getIgnoreTagMap(iFile)
+	if err != nil {
+		return fmt.Errorf("filter: %s", err)
+	}
 
 	// filterFile holds data structured in the output format of `grafiti parse`.
 	if filterFile != "" {
-		if err := filterFromFile(svc, iFile, filterFile); err != nil {
+		if err := filterFromFile(itMap, filterFile); err != nil {
 			return fmt.Errorf("filter: %s", err)
 		}
 		return nil
 	}
 
 	// Same data as that in filterFile but passed by stdin.
-	if err := filterFromStdIn(svc, iFile); err != nil {
+	if err := filterFromStdIn(itMap); err != nil {
 		return fmt.Errorf("filter: %s", err)
 	}
 
 	return nil
 }
 
-func filterFromFile(svc rgtaiface.ResourceGroupsTaggingAPIAPI, r io.Reader, fname string) error {
+func filterFromFile(itMap map[arn.ResourceARN]struct{}, fname string) error {
 	// Open filterFile
 	f, err := os.OpenFile(fname, os.O_RDONLY, 0644)
 	if err != nil {
@@ -76,23 +80,17 @@ func filterFromFile(svc rgtaiface.ResourceGroupsTaggingAPIAPI, r io.Reader, fnam
 	}
 	defer f.Close()
 
-	return filter(svc, r, f)
+	return filter(itMap, f)
 }
 
-func filterFromStdIn(svc rgtaiface.ResourceGroupsTaggingAPIAPI, f io.Reader) error {
-	return filter(svc, os.Stdin, f)
+func filterFromStdIn(itMap map[arn.ResourceARN]struct{}) error {
+	return filter(itMap, os.Stdin)
 }
 
-// Filter input by ignoreFile tags
-func filter(svc rgtaiface.ResourceGroupsTaggingAPIAPI, r, f io.Reader) error {
+// Filter input by ARN's in itMap
+func filter(itMap map[arn.ResourceARN]struct{}, r io.Reader) error {
 	dec := json.NewDecoder(r)
 
-	// Create a map that contains all ignorable ARN's
-	itMap, err := initIgnoreTagMap(svc, f)
-	if err != nil {
-		return err
-	}
-
 	for {
 		o, isEOF, err := decodeIntoOutput(dec)
 		if err != nil {
@@ -113,41 +111,46 @@ func filter(svc rgtaiface.ResourceGroupsTaggingAPIAPI, r, f io.Reader) error {
 	return nil
 }
 
-// Query relevant API's for resources with tags in the ignoreFile and return a
-// map with all resource ARN's to ignore
-func initIgnoreTagMap(svc rgtaiface.ResourceGroupsTaggingAPIAPI, r io.Reader) (map[arn.ResourceARN]struct{}, error) {
-	// Tag file decoder
-	dec := json.NewDecoder(r)
-	// Collection of ARN's of resources to ignore
-	arns := make(arn.ResourceARNs, 0)
-	// Map of resources ARN's to ignore
-	itMap := map[arn.ResourceARN]struct{}{}
+// getIgnoreTagMap creates a map with all resource ARN's tagged with tags in
+// the ignoreFile read from r, in every account and region
+func getIgnoreTagMap(r io.Reader) (map[arn.ResourceARN]struct{}, error) {
+	// Tags are resolved again in every account and region
+	ignoreTags, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read ignore file: %s", err)
+	}
 
-	for {
-		t, isEOF, err := decodeTagFileInput(dec)
+	itMap := map[arn.ResourceARN]struct{}{}
+	err = forEachAccountRegion(func() error {
+		regionMap, err := initIgnoreTagMap(rgta.New(newAWSSession()), bytes.NewReader(ignoreTags))
 		if err != nil {
-			return nil, err
-		}
-		if isEOF {
-			break
+			return err
 		}
-		if t == nil {
-			continue
+		for a := range regionMap {
+			itMap[a] = struct{}{}
 		}
+		return nil
+	})
+	return itMap, err
+}
 
-		if arns, err = getARNsForResource(svc, t.TagFilters, arns); err != nil {
-			return nil, err
-		}
+// Query relevant API's for resources with tags in the ignoreFile and return a
+// map with all resource ARN's to ignore
+func initIgnoreTagMap(svc rgtaiface.ResourceGroupsTaggingAPIAPI, r io.Reader) (map[arn.ResourceARN]struct{}, error) {
+	tfs, err := parseTimeFilterFlags(filterTimeFilters)
+	if err != nil {
+		return nil, err
+	}
 
-		for rtk := range arn.RGTAUnsupportedResourceTypes {
-			// Request all RGTA-unsupported resources with the same tags
-			if arns, err = getARNsForUnsupportedResource(rtk, t.TagFilters, arns); err != nil {
-				return nil, err
-			}
-		}
+	// Collection of resources to ignore
+	rs, err := getResourcesForTagFile(svc, r, tfs)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, arn := range arns {
+	// Map of resources ARN's to ignore
+	itMap := map[arn.ResourceARN]struct{}{}
+	for _, arn := range rs.ARNs() {
 		if _, ok := itMap[arn]; !ok {
 			itMap[arn] = struct{}{}
 		}
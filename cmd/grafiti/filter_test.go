@@ -13,6 +13,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/request"
 	rgta "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
 	rgtaiface "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
+	"github.com/coreos/grafiti/arn"
 	"github.com/spf13/viper"
 )
 
@@ -27,7 +28,7 @@ func (m *mockRGTAGetResources) GetResourcesWithContext(ctx aws.Context, in *rgta
 }
 
 // Set stdout to pipe and capture printed output of a Print event
-func captureFilterStdOut(f func(rgtaiface.ResourceGroupsTaggingAPIAPI, io.Reader, io.Reader) error, svc rgtaiface.ResourceGroupsTaggingAPIAPI, v1, v2 io.Reader) (string, error) {
+func captureFilterStdOut(f func(map[arn.ResourceARN]struct{}, io.Reader) error, itMap map[arn.ResourceARN]struct{}, v io.Reader) (string, error) {
 	oldStdOut := os.Stdout
 	r, w, err := os.Pipe()
 	if err != nil {
@@ -44,7 +45,7 @@ func captureFilterStdOut(f func(rgtaiface.ResourceGroupsTaggingAPIAPI, io.Reader
 	}()
 
 	// Execute any f that takes an interface{} argument
-	if err := f(svc, v1, v2); err != nil {
+	if err := f(itMap, v); err != nil {
 		w.Close()
 		os.Stdout = oldStdOut
 		return "", err
@@ -107,7 +108,12 @@ func TestFilter(t *testing.T) {
 			t.Fatal("Could not open", c.InputTagFilePath)
 		}
 
-		filteredOutput, err := captureFilterStdOut(filter, svc, &wi, tf)
+		itMap, err := initIgnoreTagMap(svc, tf)
+		if err != nil {
+			t.Fatal("Failed to get ignored resources:", err)
+		}
+
+		filteredOutput, err := captureFilterStdOut(filter, itMap, &wi)
 		if err != nil {
 			t.Fatal("Failed to capture stdout:", err)
 		}
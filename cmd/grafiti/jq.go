@@ -0,0 +1,114 @@
+// Copyright © 2017 grafiti authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/itchyny/gojq"
+	"github.com/spf13/viper"
+)
+
+// jqCodes holds compiled jq patterns by pattern, so each pattern is compiled
+// once rather than once per event.
+var jqCodes = struct {
+	sync.Mutex
+	codes map[string]*gojq.Code
+}{codes: make(map[string]*gojq.Code)}
+
+// jqVariables are the variables patterns can refer to: the resolved owner of
+// an event, the event, the TaggingMetadata of a resource and pattern
+// variables. Values of variables are passed to evalJQ in the same order.
+var jqVariables = []string{"$owner", "$event", "$metadata", "$vars"}
+
+// compileJQ parses and compiles the jq pattern p, or returns its cached code.
+func compileJQ(p string) (*gojq.Code, error) {
+	jqCodes.Lock()
+	defer jqCodes.Unlock()
+
+	if code, ok := jqCodes.codes[p]; ok {
+		return code, nil
+	}
+	q, err := gojq.Parse(p)
+	if err != nil {
+		return nil, fmt.Errorf("parse jq pattern %q: %s", p, err)
+	}
+	code, err := gojq.Compile(q, gojq.WithVariables(jqVariables))
+	if err != nil {
+		return nil, fmt.Errorf("compile jq pattern %q: %s", p, err)
+	}
+	jqCodes.codes[p] = code
+	return code, nil
+}
+
+// initPatterns compiles all patterns in the 'tagPatterns' and
+// 'filterPatterns' config fields so invalid patterns are reported before any
+// events are parsed.
+func initPatterns() {
+	for _, key := range []string{"tagPatterns", "filterPatterns"} {
+		for _, p := range viper.GetStringSlice(key) {
+			if _, err := compileJQ(p); err != nil {
+				exitWithError(fmt.Errorf("%s: %s", key, err))
+			}
+		}
+	}
+}
+
+// decodeJQInput decodes raw JSON into a value jq patterns can be run on.
+func decodeJQInput(raw []byte) (interface{}, error) {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, fmt.Errorf("decode jq input: %s", err)
+	}
+	return v, nil
+}
+
+// toJQValue converts v to a value jq patterns can be run on, by its JSON
+// encoding.
+func toJQValue(v interface{}) (interface{}, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("encode jq input: %s", err)
+	}
+	return decodeJQInput(raw)
+}
+
+// evalJQ runs the jq pattern p on v and returns all of its results. values are
+// the values of jqVariables, which are null if not given. Evaluation stops at
+// the first error.
+func evalJQ(p string, v interface{}, values ...interface{}) ([]interface{}, error) {
+	code, err := compileJQ(p)
+	if err != nil {
+		return nil, err
+	}
+
+	vars := make([]interface{}, len(jqVariables))
+	copy(vars, values)
+	var results []interface{}
+	iter := code.Run(v, vars...)
+	for {
+		r, ok := iter.Next()
+		if !ok {
+			break
+		}
+		if err, ok := r.(error); ok {
+			return nil, fmt.Errorf("eval jq pattern %q: %s", p, err)
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
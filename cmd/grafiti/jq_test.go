@@ -0,0 +1,89 @@
+// Copyright © 2017 grafiti authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEvalJQ(t *testing.T) {
+	cases := []struct {
+		Pattern  string
+		Input    string
+		Expected []interface{}
+		WantErr  bool
+	}{
+		{
+			Pattern:  ".userIdentity.arn",
+			Input:    `{"userIdentity":{"arn":"arn:aws:iam::123456789101:user/test-user"}}`,
+			Expected: []interface{}{"arn:aws:iam::123456789101:user/test-user"},
+		},
+		{
+			Pattern:  ".items[] | {Name: .}",
+			Input:    `{"items":["a","b"]}`,
+			Expected: []interface{}{map[string]interface{}{"Name": "a"}, map[string]interface{}{"Name": "b"}},
+		},
+		{
+			Pattern:  ".missing",
+			Input:    `{}`,
+			Expected: []interface{}{nil},
+		},
+		{
+			Pattern: "{CreatedBy: .userIdentity.arn",
+			Input:   `{}`,
+			WantErr: true,
+		},
+		{
+			Pattern: ".eventTime | strptime(\"%Y\")",
+			Input:   `{"eventTime":1}`,
+			WantErr: true,
+		},
+	}
+
+	for i, c := range cases {
+		v, err := decodeJQInput([]byte(c.Input))
+		if err != nil {
+			t.Fatalf("evalJQ case %d: %s", i+1, err)
+		}
+		results, err := evalJQ(c.Pattern, v)
+		if (err != nil) != c.WantErr {
+			t.Errorf("evalJQ case %d: wanted error %t, got %v", i+1, c.WantErr, err)
+			continue
+		}
+		if !reflect.DeepEqual(results, c.Expected) {
+			t.Errorf("evalJQ case %d failed\nwanted: %v\ngot: %v", i+1, c.Expected, results)
+		}
+	}
+}
+
+func TestTagValue(t *testing.T) {
+	cases := []struct {
+		Input    interface{}
+		Expected string
+	}{
+		{nil, ""},
+		{"test-user", "test-user"},
+		{float64(1497253282), "1497253282"},
+		{true, "true"},
+		{[]interface{}{"a", "b"}, `["a","b"]`},
+	}
+
+	for i, c := range cases {
+		if got := tagValue(c.Input); got != c.Expected {
+			t.Errorf("tagValue case %d failed\nwanted: %s\ngot: %s", i+1, c.Expected, got)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright © 2017 grafiti authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tidwall/gjson"
+
+	"github.com/coreos/grafiti/arn"
+)
+
+// Values of the 'deletedResources' config field
+const (
+	// deletedResourcesSuppress drops output of resources deleted in the parsed
+	// time window.
+	deletedResourcesSuppress = "suppress"
+	// deletedResourcesInclude outputs resources deleted in the parsed time
+	// window with a "deleted" Lifecycle.
+	deletedResourcesInclude = "include"
+	// deletedResourcesIgnore does not track deletions, so output is printed as
+	// soon as an event is parsed. This is the default, since tracking deletions
+	// holds all output of a run in memory.
+	deletedResourcesIgnore = "ignore"
+)
+
+// lifecycleDeleted is the Lifecycle of output of deleted resources.
+const lifecycleDeleted = "deleted"
+
+// lifecycle holds parse output until all events in a time window are parsed,
+// so output of resources deleted in the window can be dropped or marked. Held
+// output grows with the number of resources parsed. Deletions are not tracked
+// if lifecycle is nil.
+var lifecycle *lifecycleTracker
+
+type pendingOutput struct {
+	key    string
+	time   time.Time
+	output string
+}
+
+type lifecycleTracker struct {
+	includeDeleted bool
+	outputs        []pendingOutput
+	// deleted maps resource keys to the time of their latest deletion
+	deleted map[string]time.Time
+	// states are saved once all output is printed
+	states []*State
+}
+
+// newLifecycleTracker creates a tracker for the 'deletedResources' config
+// field. Nil is returned if deletions should not be tracked.
+func newLifecycleTracker() (*lifecycleTracker, error) {
+	t := &lifecycleTracker{deleted: make(map[string]time.Time)}
+	switch mode := viper.GetString("deletedResources"); mode {
+	case deletedResourcesSuppress:
+	case deletedResourcesInclude:
+		t.includeDeleted = true
+	case "", deletedResourcesIgnore:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("deletedResources must be one of %q, %q or %q, got %q", deletedResourcesSuppress, deletedResourcesInclude, deletedResourcesIgnore, mode)
+	}
+	return t, nil
+}
+
+// add holds output of the resource with key, created or modified at time at.
+func (t *lifecycleTracker) add(key string, at time.Time, output string) {
+	t.outputs = append(t.outputs, pendingOutput{key, at, output})
+}
+
+// markDeleted records that the resource with key was deleted at time at.
+func (t *lifecycleTracker) markDeleted(key string, at time.Time) {
+	if d, ok := t.deleted[key]; !ok || at.After(d) {
+		t.deleted[key] = at
+	}
+}
+
+// saveOnFlush saves st after held output is printed, so state never records
+// progress whose output was not printed.
+func (t *lifecycleTracker) saveOnFlush(st *State) {
+	for _, s := range t.states {
+		if s == st {
+			return
+		}
+	}
+	t.states = append(t.states, st)
+}
+
+// flush prints held output in the order it was added. Output of a resource
+// at or before its deletion is dropped, or marked deleted if deleted resources
+// are included.
+func (t *lifecycleTracker) flush() error {
+	for _, o := range t.outputs {
+		if d, ok := t.deleted[o.key]; ok && !o.time.After(d) {
+			if !t.includeDeleted {
+				logger.Debugln("skipping output of deleted resource", o.key)
+				continue
+			}
+			marked, err := withLifecycle(o.output, lifecycleDeleted)
+			if err != nil {
+				return err
+			}
+			o.output = marked
+		}
+		printOutput(o.output)
+	}
+	t.outputs = nil
+
+	for _, st := range t.states {
+		if err := st.save(); err != nil {
+			return err
+		}
+	}
+	t.states = nil
+	return nil
+}
+
+// withLifecycle sets the Lifecycle field of a JSON-encoded output object.
+func withLifecycle(output, lc string) (string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(output), &fields); err != nil {
+		return "", fmt.Errorf("decode parse output: %s", err)
+	}
+	fields["Lifecycle"], _ = json.Marshal(lc)
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return "", fmt.Errorf("encode parse output: %s", err)
+	}
+	return string(b), nil
+}
+
+// emitOutput prints output of the resource with key, or holds it if deletions
+// are tracked.
+func emitOutput(key string, at time.Time, output string) {
+	if lifecycle == nil {
+		printOutput(output)
+		return
+	}
+	lifecycle.add(key, at, output)
+}
+
+// saveParsedState saves st now, or once held output is printed if deletions
+// are tracked.
+func saveParsedState(st *State) error {
+	if lifecycle == nil {
+		return st.save()
+	}
+	lifecycle.saveOnFlush(st)
+	return nil
+}
+
+// lifecycleKey identifies a resource across the events that create and delete
+// it: its ARN, or its account, region, type and name if it has no ARN.
+func lifecycleKey(rt arn.ResourceType, rn arn.ResourceName, ARN arn.ResourceARN, parsedEvent gjson.Result) string {
+	if ARN != "" {
+		return string(ARN)
+	}
+	return strings.Join([]string{eventAccountID(parsedEvent), parsedEvent.Get("awsRegion").String(), string(rt), string(rn)}, "/")
+}
+
+// eventTime returns the time an event occurred at.
+func eventTime(parsedEvent gjson.Result) time.Time {
+	t, err := time.Parse(time.RFC3339, parsedEvent.Get("eventTime").String())
+	if err != nil {
+		logger.Debugln("parse eventTime:", err)
+	}
+	return t
+}
+
+// isDeleteEventOf returns true if parsedEvent successfully deleted a resource
+// of type rt.
+func isDeleteEventOf(rt arn.ResourceType, parsedEvent gjson.Result) bool {
+	if parsedEvent.Get("errorCode").Exists() {
+		return false
+	}
+	for _, id := range deleteEventMap[parsedEvent.Get("eventName").String()] {
+		if arn.ResourceType(id.ResourceType) == rt {
+			return true
+		}
+	}
+	return false
+}
+
+// markRawEventDeletions records each resource deleted by a raw CloudTrail
+// event. Failed deletions are ignored.
+func markRawEventDeletions(parsedEvent gjson.Result) {
+	if lifecycle == nil || parsedEvent.Get("errorCode").Exists() {
+		return
+	}
+
+	at := eventTime(parsedEvent)
+	for _, id := range deleteEventMap[parsedEvent.Get("eventName").String()] {
+		rt := arn.ResourceType(id.ResourceType)
+		for _, rn := range resourceNames(parsedEvent.Get(id.ResourceNamePath)) {
+			ARN := arn.MapResourceTypeToARN(rt, rn, parsedEvent)
+			lifecycle.markDeleted(lifecycleKey(rt, rn, ARN, parsedEvent), at)
+		}
+	}
+}
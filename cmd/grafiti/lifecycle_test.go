@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudtrail"
+	"github.com/spf13/viper"
+)
+
+// newTestLifecycleEvent creates a raw CloudTrail event named name occurring at
+// eventTime with elements, a comma-separated list of JSON object members.
+func newTestLifecycleEvent(name, eventTime, elements string) string {
+	return newTestEvent(name, fmt.Sprintf(`"eventTime": %q, %s`, eventTime, elements))
+}
+
+type lifecycleRecord struct {
+	Name      string
+	Lifecycle string
+}
+
+// decodeLifecycleRecords decodes the resource name and lifecycle of each
+// line of parse output.
+func decodeLifecycleRecords(t *testing.T, out string) []lifecycleRecord {
+	var records []lifecycleRecord
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if line == "" {
+			continue
+		}
+		var in TagInput
+		if err := json.Unmarshal([]byte(line), &in); err != nil {
+			t.Fatalf("unmarshal output %q: %s", line, err)
+		}
+		records = append(records, lifecycleRecord{string(in.TaggingMetadata.ResourceName), in.Lifecycle})
+	}
+	return records
+}
+
+func TestParseLifecycle(t *testing.T) {
+	viper.Set("tagPatterns", []string{})
+	viper.Set("filterPatterns", []string{})
+	defer viper.Set("deletedResources", "")
+
+	events := []string{
+		newTestLifecycleEvent("RunInstances", "2017-06-01T19:00:00Z", `"responseElements": {"instancesSet": {"items": [{"instanceId": "i-1"}, {"instanceId": "i-2"}]}}`),
+		newTestLifecycleEvent("CreateVolume", "2017-06-01T19:01:00Z", `"responseElements": {"volumeId": "vol-1"}`),
+		newTestLifecycleEvent("CreateBucket", "2017-06-01T19:02:00Z", `"requestParameters": {"bucketName": "bucket-1"}`),
+		newTestLifecycleEvent("TerminateInstances", "2017-06-01T19:03:00Z", `"requestParameters": {"instancesSet": {"items": [{"instanceId": "i-1"}]}}`),
+		// Failed deletions are ignored
+		newTestLifecycleEvent("DeleteVolume", "2017-06-01T19:04:00Z", `"errorCode": "VolumeInUse", "requestParameters": {"volumeId": "vol-1"}`),
+		// Resources created after their name was last deleted are kept
+		newTestLifecycleEvent("DeleteBucket", "2017-06-01T19:05:00Z", `"requestParameters": {"bucketName": "bucket-1"}`),
+		newTestLifecycleEvent("CreateBucket", "2017-06-01T19:06:00Z", `"requestParameters": {"bucketName": "bucket-1"}`),
+		// Deletions of resources not created in the time window do not output
+		newTestLifecycleEvent("DeleteVpc", "2017-06-01T19:07:00Z", `"requestParameters": {"vpcId": "vpc-1"}`),
+	}
+
+	cases := []struct {
+		Mode     string
+		Expected []lifecycleRecord
+	}{
+		{
+			deletedResourcesSuppress,
+			[]lifecycleRecord{{"i-2", ""}, {"vol-1", ""}, {"bucket-1", ""}},
+		},
+		{
+			deletedResourcesInclude,
+			[]lifecycleRecord{{"i-1", lifecycleDeleted}, {"i-2", ""}, {"vol-1", ""}, {"bucket-1", lifecycleDeleted}, {"bucket-1", ""}},
+		},
+		{
+			deletedResourcesIgnore,
+			[]lifecycleRecord{{"i-1", ""}, {"i-2", ""}, {"vol-1", ""}, {"bucket-1", ""}, {"bucket-1", ""}},
+		},
+		{
+			"",
+			[]lifecycleRecord{{"i-1", ""}, {"i-2", ""}, {"vol-1", ""}, {"bucket-1", ""}, {"bucket-1", ""}},
+		},
+	}
+
+	for i, c := range cases {
+		viper.Set("deletedResources", c.Mode)
+		tracker, err := newLifecycleTracker()
+		if err != nil {
+			t.Fatalf("newLifecycleTracker case %d: %s", i+1, err)
+		}
+
+		var flushErr error
+		f := func(v interface{}) {
+			lifecycle = tracker
+			defer func() { lifecycle = nil }()
+			for _, e := range v.([]string) {
+				printRawCloudTrailEvent(e)
+			}
+			if lifecycle != nil {
+				flushErr = lifecycle.flush()
+			}
+		}
+		got := decodeLifecycleRecords(t, captureStdOut(f, events))
+		if flushErr != nil {
+			t.Fatalf("flush case %d: %s", i+1, flushErr)
+		}
+		if !reflect.DeepEqual(got, c.Expected) {
+			t.Errorf("parse lifecycle case %d (%q) failed\nwanted: %+v\ngot: %+v", i+1, c.Mode, c.Expected, got)
+		}
+	}
+
+	viper.Set("deletedResources", "forget")
+	if _, err := newLifecycleTracker(); err == nil {
+		t.Error("newLifecycleTracker: expected error for an invalid mode")
+	}
+}
+
+func TestPrintEventsLifecycle(t *testing.T) {
+	viper.Set("tagPatterns", []string{})
+	viper.Set("filterPatterns", []string{})
+	viper.Set("includeEvent", false)
+	viper.Set("deletedResources", deletedResourcesSuppress)
+	defer viper.Set("deletedResources", "")
+
+	newEvent := func(name, eventTime, instanceID string) *cloudtrail.Event {
+		return &cloudtrail.Event{
+			EventName:       aws.String(name),
+			CloudTrailEvent: aws.String(newTestLifecycleEvent(name, eventTime, `"requestParameters": null`)),
+			Resources: []*cloudtrail.Resource{
+				{ResourceName: aws.String(instanceID), ResourceType: aws.String("AWS::EC2::Instance")},
+			},
+		}
+	}
+	// The CloudTrail API returns the most recent events first
+	events := []*cloudtrail.Event{
+		newEvent("TerminateInstances", "2017-06-01T19:03:00Z", "i-1"),
+		newEvent("RunInstances", "2017-06-01T19:01:00Z", "i-2"),
+		newEvent("RunInstances", "2017-06-01T19:00:00Z", "i-1"),
+	}
+
+	f := func(v interface{}) {
+		lifecycle, _ = newLifecycleTracker()
+		defer func() { lifecycle = nil }()
+		printEvents(v.([]*cloudtrail.Event))
+		lifecycle.flush()
+	}
+	got := decodeLifecycleRecords(t, captureStdOut(f, events))
+	expected := []lifecycleRecord{{"i-2", ""}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("printEvents lifecycle failed\nwanted: %+v\ngot: %+v", expected, got)
+	}
+}
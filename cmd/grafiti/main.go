@@ -19,10 +19,13 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/coreos/grafiti/arn"
+	"github.com/coreos/grafiti/ratelimit"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -37,13 +40,26 @@ var (
 
 // Grafiti-specific environment variables are prefixed with GRF_
 var envVarMap = map[string]string{
-	"GRF_LOG_DIR":         "logDir",
-	"GRF_START_HOUR":      "startHour",
-	"GRF_END_HOUR":        "endHour",
-	"GRF_START_TIMESTAMP": "startTimeStamp",
-	"GRF_END_TIMESTAMP":   "endTimeStamp",
-	"GRF_INCLUDE_EVENT":   "includeEvent",
-	"GRF_MAX_NUM_RETRIES": "maxNumRequestRetries",
+	"GRF_LOG_DIR":                  "logDir",
+	"GRF_START_HOUR":               "startHour",
+	"GRF_END_HOUR":                 "endHour",
+	"GRF_START_TIMESTAMP":          "startTimeStamp",
+	"GRF_END_TIMESTAMP":            "endTimeStamp",
+	"GRF_SINCE":                    "since",
+	"GRF_UNTIL":                    "until",
+	"GRF_INCLUDE_EVENT":            "includeEvent",
+	"GRF_TAG_MERGE_POLICY":         "tagMergePolicy",
+	"GRF_MAX_NUM_RETRIES":          "maxNumRequestRetries",
+	"GRF_DELETE_CONCURRENCY":       "deleteConcurrency",
+	"GRF_NOTIFY_SLACK_WEBHOOK_URL": "notify.slackWebhookURL",
+	"GRF_NOTIFY_WEBHOOK_URL":       "notify.webhookURL",
+	"GRF_REGIONS":                  "regions",
+	"GRF_STATE_FILE":               "stateFile",
+	"GRF_S3_ENDPOINT":              "s3Endpoint",
+	"GRF_SQS_ENDPOINT":             "sqsEndpoint",
+	"GRF_DELETED_RESOURCES":        "deletedResources",
+	"GRF_WATCH_QUEUE_URL":          "watch.queueURL",
+	"GRF_WATCH_IGNORE_FILE":        "watch.ignoreFile",
 }
 
 // http://tldp.org/LDP/abs/html/exitcodes.html
@@ -54,6 +70,44 @@ func exitWithError(err error) {
 	os.Exit(errExit)
 }
 
+// newAWSSession creates a session in the account and region commands
+// currently run in, whose requests are rate limited per service by limits in
+// the 'rateLimits' config table.
+func newAWSSession() *session.Session {
+	return newAWSSessionWith(accountCreds, region)
+}
+
+// newAWSSessionWith creates a rate limited session using creds in region r.
+// The environment's credentials and region are used if creds is nil or r is
+// empty.
+func newAWSSessionWith(creds *credentials.Credentials, r string) *session.Session {
+	return ratelimit.Attach(session.Must(session.NewSession(awsConfig(creds, r))))
+}
+
+// initRateLimits reads per-service request rate limits from the 'rateLimits'
+// config table. Services not in the table use ratelimit.DefaultLimits.
+func initRateLimits() {
+	limits := make(map[string]ratelimit.Limit)
+	if err := viper.UnmarshalKey("rateLimits", &limits); err != nil {
+		exitWithError(fmt.Errorf("read rateLimits: %s", err))
+	}
+	ratelimit.SetLimits(limits)
+}
+
+// newARNSession creates a rate limited session in region r of the account with
+// ID id, for requests made to map resources to ARNs. The account commands
+// currently run in is used if id is empty.
+func newARNSession(id, r string) (*session.Session, error) {
+	creds := accountCreds
+	if id != "" && id != accountID {
+		var err error
+		if creds, err = credentialsForAccount(id); err != nil {
+			return nil, err
+		}
+	}
+	return newAWSSessionWith(creds, r), nil
+}
+
 // RequestLogger holds a logger and its log file, if any.
 type RequestLogger struct {
 	logrus.Logger
@@ -124,6 +178,7 @@ var RootCmd = &cobra.Command{
 
 func init() {
 	cobra.OnInitialize(initConfig)
+	arn.SetSessionFunc(newARNSession)
 
 	// Root config holds global config
 	RootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "", "Config file (default: $HOME/.grafiti.toml).")
@@ -134,11 +189,6 @@ func init() {
 
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
-	// Ensure jq is installed and in $PATH
-	if path, err := exec.LookPath("jq"); err != nil || path == "" {
-		exitWithError(errors.New("'jq' must be installed before running grafiti"))
-	}
-
 	if cfgFile != "" { // enable ability to specify config file via flag
 		viper.SetConfigFile(cfgFile)
 	} else {
@@ -150,6 +200,11 @@ func initConfig() {
 	viper.SetDefault("bucketEjectLimitSeconds", 300)
 	// Default number of delete request retries
 	viper.SetDefault("maxNumRequestRetries", 8)
+	// Default number of resource batches deleted concurrently
+	viper.SetDefault("deleteConcurrency", 4)
+	// Default tags identifying resource owners and expiry times for notifications
+	viper.SetDefault("notify.ownerTagKeys", []string{"CreatedBy", "CreatorARN"})
+	viper.SetDefault("notify.expiryTagKey", "ExpiresAt")
 
 	// Prefer env variables over config file fields
 	for ev, path := range envVarMap {
@@ -170,6 +225,11 @@ func initConfig() {
 		logger.Infoln("Using config file:", viper.ConfigFileUsed())
 		// Initialize global logger after reading config file in case 'logDir' is set
 		logger.initRequestLogger()
+		initRateLimits()
+		initPatterns()
+		initTagRules()
+		initTagMergePolicies()
+		initEventResources()
 		return
 	}
 
@@ -183,6 +243,11 @@ func initConfig() {
 		// Initialize global logger after reading config file in case 'GRF_LOG_DIR'
 		// is set
 		logger.initRequestLogger()
+		initRateLimits()
+		initPatterns()
+		initTagRules()
+		initTagMergePolicies()
+		initEventResources()
 		return
 	}
 }
@@ -0,0 +1,351 @@
+// Copyright © 2017 grafiti authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	rgta "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	rgtaiface "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+	"github.com/coreos/grafiti/arn"
+	"github.com/spf13/viper"
+)
+
+// Policies deciding whether a tag replaces a tag of the same key that already
+// exists on a resource
+const (
+	// mergeOverwrite always replaces the existing tag
+	mergeOverwrite = "overwrite"
+	// mergeKeepExisting never replaces the existing tag
+	mergeKeepExisting = "keep-existing"
+	// mergeKeepLaterDate replaces the existing tag only if both values are dates
+	// and the new date is later, ex. so expiry dates extended by hand are kept
+	mergeKeepLaterDate = "keep-later-date"
+)
+
+// tagMergePolicies are the merge policies set by the 'tagMergePolicy' and
+// 'tagMergePolicies' config fields.
+var tagMergePolicies mergePolicies
+
+// mergePolicies maps tag keys to merge policies.
+type mergePolicies struct {
+	// Default is the policy of keys not in Keys. The zero value is
+	// mergeOverwrite
+	Default string
+	// Keys maps tag keys to their policy
+	Keys map[string]string
+}
+
+// tagMergePolicyEntry is an entry in the 'tagMergePolicies' config table
+// array.
+type tagMergePolicyEntry struct {
+	Keys   []string
+	Policy string
+}
+
+// policy returns the merge policy of tag key k.
+func (p mergePolicies) policy(k string) string {
+	if pol, ok := p.Keys[k]; ok {
+		return pol
+	}
+	if p.Default == "" {
+		return mergeOverwrite
+	}
+	return p.Default
+}
+
+// readsExisting returns true if existing tags must be read before tagging.
+func (p mergePolicies) readsExisting() bool {
+	if p.policy("") != mergeOverwrite {
+		return true
+	}
+	for _, pol := range p.Keys {
+		if pol != mergeOverwrite {
+			return true
+		}
+	}
+	return false
+}
+
+// readKeys returns the keys of tags whose existing values must be read before
+// tags are applied, in sorted order.
+func (p mergePolicies) readKeys(tags Tags) []string {
+	var keys []string
+	for k := range tags {
+		if p.policy(k) != mergeOverwrite {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// merge returns the tags in tags that should be applied to a resource with
+// existing tags. If existing tags could not be read, existing is nil and only
+// tags with policy mergeOverwrite are returned.
+func (p mergePolicies) merge(tags, existing Tags) Tags {
+	merged := make(Tags, len(tags))
+	for k, v := range tags {
+		pol := p.policy(k)
+		ev, found := existing[k]
+		switch {
+		case pol == mergeOverwrite:
+			merged[k] = v
+		case existing == nil:
+			// Existing tags are unknown, so they might be replaced
+		case !found:
+			merged[k] = v
+		case pol == mergeKeepLaterDate && isLaterDate(v, ev):
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// isLaterDate returns true if v and old are dates and v is after old. Values
+// that are not dates are never later, so they do not replace existing tags.
+func isLaterDate(v, old string) bool {
+	t, err := parseTagTime(v)
+	if err != nil {
+		return false
+	}
+	ot, err := parseTagTime(old)
+	if err != nil {
+		return false
+	}
+	return t.After(ot)
+}
+
+func isValidMergePolicy(pol string) bool {
+	switch pol {
+	case mergeOverwrite, mergeKeepExisting, mergeKeepLaterDate:
+		return true
+	}
+	return false
+}
+
+// getTagMergePolicies reads the default merge policy from 'tagMergePolicy'
+// and per-key merge policies from the 'tagMergePolicies' config table array.
+func getTagMergePolicies() (mergePolicies, error) {
+	p := mergePolicies{Default: mergeOverwrite, Keys: make(map[string]string)}
+	if pol := viper.GetString("tagMergePolicy"); pol != "" {
+		if !isValidMergePolicy(pol) {
+			return p, fmt.Errorf("tagMergePolicy: unknown policy %q", pol)
+		}
+		p.Default = pol
+	}
+
+	var entries []tagMergePolicyEntry
+	if err := viper.UnmarshalKey("tagMergePolicies", &entries); err != nil {
+		return p, fmt.Errorf("read tagMergePolicies: %s", err)
+	}
+	for i, e := range entries {
+		if !isValidMergePolicy(e.Policy) {
+			return p, fmt.Errorf("tagMergePolicies %d: unknown policy %q", i, e.Policy)
+		}
+		if len(e.Keys) == 0 {
+			return p, fmt.Errorf("tagMergePolicies %d: no keys", i)
+		}
+		for _, k := range e.Keys {
+			if pol, ok := p.Keys[k]; ok && pol != e.Policy {
+				return p, fmt.Errorf("tagMergePolicies %d: key %q already has policy %q", i, k, pol)
+			}
+			p.Keys[k] = e.Policy
+		}
+	}
+	return p, nil
+}
+
+// initTagMergePolicies sets tag merge policies from config.
+func initTagMergePolicies() {
+	p, err := getTagMergePolicies()
+	if err != nil {
+		exitWithError(err)
+	}
+	tagMergePolicies = p
+}
+
+// getRGTATags gets the tags of resources in svc's region of resourceTypes, in
+// the format of rgtaResourceType, with any tag in keys. Requesting every
+// resource in a region is slow, so keys must not be empty.
+func getRGTATags(svc rgtaiface.ResourceGroupsTaggingAPIAPI, resourceTypes, keys []string) (map[arn.ResourceARN]Tags, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("rgta: get resources: no tag keys")
+	}
+
+	existing := make(map[arn.ResourceARN]Tags)
+	// Tag filters must all match, so resources with any of keys are requested
+	// separately per key
+	for _, k := range keys {
+		params := &rgta.GetResourcesInput{
+			ResourceTypeFilters: aws.StringSlice(resourceTypes),
+			TagFilters:          []*rgta.TagFilter{{Key: aws.String(k)}},
+			TagsPerPage:         aws.Int64(100),
+		}
+		for {
+			ctx := aws.BackgroundContext()
+			resp, err := svc.GetResourcesWithContext(ctx, params)
+			if err != nil {
+				return nil, fmt.Errorf("rgta: get resources: %s", err)
+			}
+
+			for _, r := range resp.ResourceTagMappingList {
+				if arnStr := aws.StringValue(r.ResourceARN); arnStr != "" {
+					existing[arn.ResourceARN(arnStr)] = rgtaTagMap(r.Tags)
+				}
+			}
+
+			if aws.StringValue(resp.PaginationToken) == "" {
+				break
+			}
+			params.PaginationToken = resp.PaginationToken
+		}
+	}
+	return existing, nil
+}
+
+// rgtaResourceType returns the resource type of a in the format of RGTA
+// resource type filters, ex. 'ec2:instance', or only its service if a has no
+// resource type, ex. 's3'.
+func rgtaResourceType(a arn.ResourceARN) string {
+	fields := strings.SplitN(a.String(), ":", 6)
+	if len(fields) != 6 {
+		return ""
+	}
+	if i := strings.IndexAny(fields[5], "/:"); i > 0 {
+		return fields[2] + ":" + fields[5][:i]
+	}
+	return fields[2]
+}
+
+// rgtaTagQuery is a request for existing tags with Key of resources of
+// ResourceType.
+type rgtaTagQuery struct {
+	ResourceType string
+	Key          string
+}
+
+// existingTags gets the existing tags with keys of arns in tt. Tags of each
+// resource type and key are requested once, and kept until the tagger is reset.
+func (tg *tagger) existingTags(tt tagTarget, svc rgtaiface.ResourceGroupsTaggingAPIAPI, arns arn.ResourceARNs, keys []string) (map[arn.ResourceARN]Tags, error) {
+	if tg.existing == nil {
+		tg.existing = make(map[tagTarget]map[rgtaTagQuery]map[arn.ResourceARN]string)
+	}
+	cache, ok := tg.existing[tt]
+	if !ok {
+		cache = make(map[rgtaTagQuery]map[arn.ResourceARN]string)
+		tg.existing[tt] = cache
+	}
+
+	existing := make(map[arn.ResourceARN]Tags, len(arns))
+	for _, a := range arns {
+		et := make(Tags)
+		for _, k := range keys {
+			q := rgtaTagQuery{rgtaResourceType(a), k}
+			values, ok := cache[q]
+			if !ok {
+				tags, err := getRGTATags(svc, []string{q.ResourceType}, []string{k})
+				if err != nil {
+					return nil, err
+				}
+				values = make(map[arn.ResourceARN]string, len(tags))
+				for ta, t := range tags {
+					values[ta] = t[k]
+				}
+				cache[q] = values
+			}
+			if v, ok := values[a]; ok {
+				et[k] = v
+			}
+		}
+		existing[a] = et
+	}
+	return existing, nil
+}
+
+// getAutoScalingTags gets the tags of autoscaling group rn.
+func getAutoScalingTags(svc autoscalingiface.AutoScalingAPI, rn arn.ResourceName) (Tags, error) {
+	params := &autoscaling.DescribeTagsInput{
+		Filters: []*autoscaling.Filter{
+			{
+				Name:   aws.String("auto-scaling-group"),
+				Values: []*string{rn.AWSString()},
+			},
+		},
+	}
+
+	existing := make(Tags)
+	for {
+		ctx := aws.BackgroundContext()
+		resp, err := svc.DescribeTagsWithContext(ctx, params)
+		if err != nil {
+			return nil, fmt.Errorf("autoscaling: describe tags: %s", err)
+		}
+
+		for _, t := range resp.Tags {
+			existing[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+		}
+
+		if aws.StringValue(resp.NextToken) == "" {
+			break
+		}
+		params.NextToken = resp.NextToken
+	}
+	return existing, nil
+}
+
+// getRoute53Tags gets the tags of hosted zone rn.
+func getRoute53Tags(svc route53iface.Route53API, rn arn.ResourceName) (Tags, error) {
+	params := &route53.ListTagsForResourceInput{
+		ResourceId:   rn.AWSString(),
+		ResourceType: aws.String("hostedzone"),
+	}
+
+	ctx := aws.BackgroundContext()
+	resp, err := svc.ListTagsForResourceWithContext(ctx, params)
+	if err != nil {
+		return nil, fmt.Errorf("route53: list tags for resource: %s", err)
+	}
+	if resp.ResourceTagSet == nil {
+		return make(Tags), nil
+	}
+	return route53TagMap(resp.ResourceTagSet.Tags), nil
+}
+
+// mergeARNSet merges the tags of s with the existing tags of each ARN in s,
+// and buckets ARNs by their merged tags. If existing tags could not be read,
+// existing is nil.
+func mergeARNSet(s TrackedARNSet, existing map[arn.ResourceARN]Tags) ARNSetBucket {
+	b := NewARNSetBucket()
+	for a := range s.ARNSet {
+		var et Tags
+		if existing != nil {
+			// Resources not found have none of the tags that were read
+			if et = existing[a]; et == nil {
+				et = make(Tags)
+			}
+		}
+		b.AddARNToBuckets(a, tagMergePolicies.merge(s.Tags, et))
+	}
+	return b
+}
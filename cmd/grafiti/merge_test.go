@@ -0,0 +1,220 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	rgta "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	rgtaiface "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
+	"github.com/coreos/grafiti/arn"
+	"github.com/spf13/viper"
+)
+
+func TestGetTagMergePolicies(t *testing.T) {
+	defer viper.Set("tagMergePolicy", "")
+	defer viper.Set("tagMergePolicies", nil)
+
+	cases := []struct {
+		Default  string
+		Entries  []map[string]interface{}
+		Expected mergePolicies
+		WantErr  bool
+	}{
+		{
+			"",
+			nil,
+			mergePolicies{Default: mergeOverwrite, Keys: map[string]string{}},
+			false,
+		},
+		{
+			"keep-existing",
+			[]map[string]interface{}{
+				{"keys": []string{"ExpiresAt"}, "policy": "keep-later-date"},
+				{"keys": []string{"TaggedAt", "CreatedBy"}, "policy": "overwrite"},
+			},
+			mergePolicies{Default: mergeKeepExisting, Keys: map[string]string{"ExpiresAt": mergeKeepLaterDate, "TaggedAt": mergeOverwrite, "CreatedBy": mergeOverwrite}},
+			false,
+		},
+		{"keep-newest", nil, mergePolicies{}, true},
+		{"", []map[string]interface{}{{"keys": []string{"ExpiresAt"}, "policy": "later"}}, mergePolicies{}, true},
+		{"", []map[string]interface{}{{"policy": "keep-existing"}}, mergePolicies{}, true},
+		{
+			"",
+			[]map[string]interface{}{
+				{"keys": []string{"ExpiresAt"}, "policy": "keep-later-date"},
+				{"keys": []string{"ExpiresAt"}, "policy": "overwrite"},
+			},
+			mergePolicies{},
+			true,
+		},
+	}
+
+	for i, c := range cases {
+		viper.Set("tagMergePolicy", c.Default)
+		viper.Set("tagMergePolicies", c.Entries)
+		got, err := getTagMergePolicies()
+		if (err != nil) != c.WantErr {
+			t.Errorf("getTagMergePolicies case %d: wanted error %t, got %v", i+1, c.WantErr, err)
+			continue
+		}
+		if !c.WantErr && !reflect.DeepEqual(got, c.Expected) {
+			t.Errorf("getTagMergePolicies case %d failed\nwanted: %+v\ngot: %+v", i+1, c.Expected, got)
+		}
+	}
+}
+
+func TestMergeTags(t *testing.T) {
+	p := mergePolicies{
+		Default: mergeOverwrite,
+		Keys:    map[string]string{"ExpiresAt": mergeKeepLaterDate, "Owner": mergeKeepExisting},
+	}
+	tags := Tags{"ExpiresAt": "2026-11-01", "Owner": "ci", "TaggedAt": "2026-10-17"}
+
+	cases := []struct {
+		Policies mergePolicies
+		Existing Tags
+		Expected Tags
+	}{
+		{p, Tags{}, tags},
+		{p, Tags{"ExpiresAt": "2026-12-01", "Owner": "alice"}, Tags{"TaggedAt": "2026-10-17"}},
+		{p, Tags{"ExpiresAt": "2026-10-01T00:00:00Z"}, tags},
+		{p, Tags{"ExpiresAt": "never"}, Tags{"Owner": "ci", "TaggedAt": "2026-10-17"}},
+		// Existing tags could not be read
+		{p, nil, Tags{"TaggedAt": "2026-10-17"}},
+		{mergePolicies{Default: mergeKeepExisting}, Tags{"TaggedAt": "2026-10-01"}, Tags{"ExpiresAt": "2026-11-01", "Owner": "ci"}},
+		{mergePolicies{}, Tags{"ExpiresAt": "2026-12-01", "Owner": "alice"}, tags},
+	}
+
+	for i, c := range cases {
+		if got := c.Policies.merge(tags, c.Existing); !reflect.DeepEqual(got, c.Expected) {
+			t.Errorf("merge case %d failed\nwanted: %v\ngot: %v", i+1, c.Expected, got)
+		}
+	}
+}
+
+func TestRGTAResourceType(t *testing.T) {
+	cases := []struct {
+		Input    arn.ResourceARN
+		Expected string
+	}{
+		{"arn:aws:ec2:us-west-2:123456789101:instance/i-1", "ec2:instance"},
+		{"arn:aws:elasticloadbalancing:us-west-2:123456789101:loadbalancer/app/lb/1", "elasticloadbalancing:loadbalancer"},
+		{"arn:aws:rds:us-west-2:123456789101:db:db-1", "rds:db"},
+		{"arn:aws:s3:::bucket", "s3"},
+		{"not-an-arn", ""},
+	}
+
+	for i, c := range cases {
+		if got := rgtaResourceType(c.Input); got != c.Expected {
+			t.Errorf("rgtaResourceType case %d failed\nwanted: %s\ngot: %s", i+1, c.Expected, got)
+		}
+	}
+}
+
+// Mock RGTA type that gets resources in Existing, records the resource types
+// and tag keys of each request, and records tags applied to each ARN
+type mockMergeTagResources struct {
+	rgtaiface.ResourceGroupsTaggingAPIAPI
+	Existing map[string]Tags
+	Requests []rgtaTagQuery
+	Tagged   map[string][]string
+}
+
+func (tr *mockMergeTagResources) GetResourcesWithContext(ctx aws.Context, in *rgta.GetResourcesInput, opts ...request.Option) (*rgta.GetResourcesOutput, error) {
+	for _, tf := range in.TagFilters {
+		tr.Requests = append(tr.Requests, rgtaTagQuery{strings.Join(aws.StringValueSlice(in.ResourceTypeFilters), ","), aws.StringValue(tf.Key)})
+	}
+
+	out := &rgta.GetResourcesOutput{}
+	for a, tags := range tr.Existing {
+		match := len(in.ResourceTypeFilters) == 0
+		for _, rt := range in.ResourceTypeFilters {
+			if aws.StringValue(rt) == rgtaResourceType(arn.ResourceARN(a)) {
+				match = true
+			}
+		}
+		for _, tf := range in.TagFilters {
+			if _, ok := tags[aws.StringValue(tf.Key)]; !ok {
+				match = false
+			}
+		}
+		if !match {
+			continue
+		}
+		var rtags []*rgta.Tag
+		for k, v := range tags {
+			rtags = append(rtags, &rgta.Tag{Key: aws.String(k), Value: aws.String(v)})
+		}
+		out.ResourceTagMappingList = append(out.ResourceTagMappingList, &rgta.ResourceTagMapping{ResourceARN: aws.String(a), Tags: rtags})
+	}
+	return out, nil
+}
+
+func (tr *mockMergeTagResources) TagResources(in *rgta.TagResourcesInput) (*rgta.TagResourcesOutput, error) {
+	key := Tags(aws.StringValueMap(in.Tags)).key()
+	tr.Tagged[key] = append(tr.Tagged[key], aws.StringValueSlice(in.ResourceARNList)...)
+	sort.Strings(tr.Tagged[key])
+	return &rgta.TagResourcesOutput{}, nil
+}
+
+func TestTaggerMergePolicies(t *testing.T) {
+	tagMergePolicies = mergePolicies{
+		Default: mergeOverwrite,
+		Keys:    map[string]string{"ExpiresAt": mergeKeepLaterDate, "Owner": mergeKeepExisting},
+	}
+	defer func() { tagMergePolicies = mergePolicies{} }()
+
+	arnPrefix := "arn:aws:ec2:us-west-2:123456789101:instance/"
+	tr := &mockMergeTagResources{
+		Existing: map[string]Tags{
+			arnPrefix + "i-1":     {"ExpiresAt": "2026-12-01", "Owner": "alice"},
+			arnPrefix + "i-3":     {"ExpiresAt": "2026-10-01", "Owner": "bob"},
+			arnPrefix + "i-4":     {"Name": "untracked"},
+			"arn:aws:s3:::bucket": {"Owner": "carol"},
+		},
+		Tagged: map[string][]string{},
+	}
+	tg := newTagger()
+	tg.svcs[tagTarget{"123456789101", "us-west-2"}] = tr
+	// Resources are tagged in two batches, which share requests for existing
+	// tags
+	for _, ids := range [][]string{{"i-1", "i-2"}, {"i-3", "i-4"}} {
+		for _, id := range ids {
+			tg.add(&TagInput{
+				TaggingMetadata: TaggingMetadata{
+					ResourceName: arn.ResourceName(id),
+					ResourceType: arn.EC2InstanceRType,
+					ResourceARN:  arn.ResourceARN(arnPrefix + id),
+				},
+				Tags: Tags{"ExpiresAt": "2026-11-01", "Owner": "ci", "TaggedAt": "2026-10-17"},
+			})
+		}
+
+		f := func(v interface{}) {
+			if err := tg.eject(true); err != nil {
+				t.Fatal("eject:", err)
+			}
+		}
+		captureStdOut(f, nil)
+	}
+
+	// Only the keys with a policy other than overwrite are read, for the
+	// resource types being tagged
+	expectedRequests := []rgtaTagQuery{{"ec2:instance", "ExpiresAt"}, {"ec2:instance", "Owner"}}
+	if !reflect.DeepEqual(tr.Requests, expectedRequests) {
+		t.Errorf("tagger merge policies requests\nwanted: %v\ngot: %v", expectedRequests, tr.Requests)
+	}
+
+	expected := map[string][]string{
+		Tags{"TaggedAt": "2026-10-17"}.key():                                           {arnPrefix + "i-1"},
+		Tags{"ExpiresAt": "2026-11-01", "TaggedAt": "2026-10-17"}.key():                {arnPrefix + "i-3"},
+		Tags{"ExpiresAt": "2026-11-01", "Owner": "ci", "TaggedAt": "2026-10-17"}.key(): {arnPrefix + "i-2", arnPrefix + "i-4"},
+	}
+	if !reflect.DeepEqual(tr.Tagged, expected) {
+		t.Errorf("tagger merge policies failed\nwanted: %v\ngot: %v", expected, tr.Tagged)
+	}
+}
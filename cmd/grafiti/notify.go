@@ -0,0 +1,325 @@
+// Copyright © 2017 grafiti authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	rgta "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/coreos/grafiti/arn"
+	"github.com/coreos/grafiti/graph"
+	"github.com/coreos/grafiti/notify"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	notifyTagFile        string
+	notifyExpiringWithin string
+)
+
+const drStr = "(dry-run)"
+
+func init() {
+	RootCmd.AddCommand(notifyCmd)
+	notifyCmd.PersistentFlags().StringVarP(&notifyTagFile, "tag-file", "f", "", "File of tags of resources to notify owners of (default: all resources with an expiry tag).")
+	notifyCmd.PersistentFlags().StringVar(&notifyExpiringWithin, "expiring-within", "7d", "Notify owners of resources expiring within this duration, ex. '7d' or '36h'.")
+}
+
+var notifyCmd = &cobra.Command{
+	Use:   "notify",
+	Short: "Notify owners of AWS resources that expire soon.",
+	Long: `Find resources whose expiry tag is within 'expiring-within' of now, group them by owner tag, and post a summary per owner
+to the Slack and/or JSON webhooks in the 'notify' config table.`,
+	RunE:          runNotifyCommand,
+	SilenceErrors: true,
+	SilenceUsage:  true,
+}
+
+func runNotifyCommand(cmd *cobra.Command, args []string) error {
+	// Unlike other commands, notify does not read stdin by default so it can
+	// run unattended
+	var reader io.Reader = strings.NewReader("{}")
+	if notifyTagFile != "" {
+		file, err := os.Open(notifyTagFile)
+		if err != nil {
+			return fmt.Errorf("notify: open tag file: %s", err)
+		}
+		defer file.Close()
+		reader = bufio.NewReader(file)
+	}
+
+	if err := notifyExpiring(reader, notifyExpiringWithin); err != nil {
+		return fmt.Errorf("notify: %s", err)
+	}
+	return nil
+}
+
+func notifyExpiring(reader io.Reader, within string) error {
+	expiryKey := viper.GetString("notify.expiryTagKey")
+	tfs := []*TimeFilter{{Key: expiryKey, After: "now", Before: "now+" + within}}
+
+	// Tags are resolved again in every account and region
+	tagFile, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return fmt.Errorf("read tag file: %s", err)
+	}
+
+	var nrs []notify.Resource
+	seen := make(map[arn.ResourceARN]bool)
+	err = forEachAccountRegion(func() error {
+		rs, err := getResourcesForTagFile(rgta.New(newAWSSession()), bytes.NewReader(tagFile), tfs)
+		if err != nil {
+			return err
+		}
+
+		for _, r := range rs {
+			// ARNs of global resources may be returned in every region
+			if seen[r.ARN] {
+				continue
+			}
+			seen[r.ARN] = true
+			rt, rn := arn.MapARNToRTypeAndRName(r.ARN)
+			nrs = append(nrs, notify.Resource{
+				ResourceType: rt,
+				ResourceName: rn,
+				ResourceARN:  r.ARN,
+				AccountID:    accountID,
+				Region:       region,
+				Owner:        resourceOwner(r.Tags),
+				ExpiresAt:    r.Tags[expiryKey],
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendNotifications(notify.GroupByOwner(notify.EventExpiring, nrs))
+}
+
+// resourceOwner returns the value of the first owner tag in tags, or an empty
+// string if tags have no owner tag.
+func resourceOwner(tags map[string]string) string {
+	for _, k := range viper.GetStringSlice("notify.ownerTagKeys") {
+		if v := tags[k]; v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// getNotifiers creates a Notifier for each webhook in the 'notify' config
+// table.
+func getNotifiers() []notify.Notifier {
+	var ns []notify.Notifier
+	if url := viper.GetString("notify.slackWebhookURL"); url != "" {
+		ns = append(ns, &notify.SlackNotifier{WebhookURL: url})
+	}
+	if url := viper.GetString("notify.webhookURL"); url != "" {
+		ns = append(ns, &notify.WebhookNotifier{URL: url})
+	}
+	return ns
+}
+
+// sendNotifications sends summaries with all configured notifiers, or prints
+// them if dryRun is set.
+func sendNotifications(summaries []*notify.Summary) error {
+	if len(summaries) == 0 {
+		return nil
+	}
+
+	if dryRun {
+		for _, s := range summaries {
+			fmt.Println(drStr, s.Text())
+		}
+		return nil
+	}
+
+	ns := getNotifiers()
+	if len(ns) == 0 {
+		return errors.New("no webhook configured, set 'notify.slackWebhookURL' or 'notify.webhookURL'")
+	}
+	if err := notify.NotifyAll(ns, summaries); err != nil {
+		if ignoreErrors {
+			logger.Debugln("send notifications:", err)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+type resourceKey struct {
+	Type arn.ResourceType
+	Name arn.ResourceName
+}
+
+// deleteResultHook records the result of every resource deletion request
+// logged by a ResourceDeleter.
+type deleteResultHook struct {
+	mu      sync.Mutex
+	results map[resourceKey]error
+}
+
+func newDeleteResultHook() *deleteResultHook {
+	return &deleteResultHook{results: make(map[resourceKey]error)}
+}
+
+// reset removes all recorded results, ex. before deleting resources in
+// another region.
+func (h *deleteResultHook) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.results = make(map[resourceKey]error)
+}
+
+// Levels implements logrus.Hook
+func (h *deleteResultHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.InfoLevel}
+}
+
+// Fire implements logrus.Hook. A failed request overrides successful requests
+// for the same resource.
+func (h *deleteResultHook) Fire(e *logrus.Entry) error {
+	rt, tok := e.Data["resource_type"]
+	rn, nok := e.Data["resource_name"]
+	if !tok || !nok {
+		return nil
+	}
+	// Requests for children of a resource are attributed to the resource
+	if prt, ok := e.Data["parent_resource_type"]; ok {
+		rt, rn = prt, e.Data["parent_resource_name"]
+	}
+
+	k := resourceKey{arn.ResourceType(fmt.Sprint(rt)), arn.ResourceName(fmt.Sprint(rn))}
+	var rerr error
+	if err, ok := e.Data["error"].(error); ok && err != nil {
+		rerr = err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if prev, ok := h.results[k]; !ok || prev == nil {
+		h.results[k] = rerr
+	}
+	return nil
+}
+
+// deleteResults creates a notify.Resource for every resource in g with a
+// recorded deletion result. Owners of tagged resources are read from tags;
+// discovered resources inherit the owner of a resource they were discovered
+// from.
+func (h *deleteResultHook) deleteResults(g *graph.Graph, tags map[resourceKey]map[string]string) []notify.Resource {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	owners := make(map[*graph.Node]string, g.Len())
+	var ownerOf func(n *graph.Node, seen map[*graph.Node]bool) string
+	ownerOf = func(n *graph.Node, seen map[*graph.Node]bool) string {
+		if o, ok := owners[n]; ok {
+			return o
+		}
+		if seen[n] {
+			return ""
+		}
+		seen[n] = true
+		o := resourceOwner(tags[resourceKey{n.Type, n.Name}])
+		for _, p := range n.DiscoveredFrom {
+			if o != "" {
+				break
+			}
+			o = ownerOf(p, seen)
+		}
+		owners[n] = o
+		return o
+	}
+
+	rs := make([]notify.Resource, 0)
+	for _, n := range g.Nodes() {
+		err, ok := h.results[resourceKey{n.Type, n.Name}]
+		if !ok {
+			continue
+		}
+		r := notify.Resource{
+			ResourceType: n.Type,
+			ResourceName: n.Name,
+			Owner:        ownerOf(n, make(map[*graph.Node]bool)),
+		}
+		if err != nil {
+			r.Error = err.Error()
+		}
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+// deleteAndNotify deletes resources tagged with tags in tagFile and their
+// dependencies in every account and region, then notifies owners of deleted resources and
+// resources that failed to be deleted.
+func deleteAndNotify(tagFile []byte, tfs []*TimeFilter) error {
+	hook := newDeleteResultHook()
+	if logger.Hooks == nil {
+		logger.Hooks = make(logrus.LevelHooks)
+	}
+	logger.Hooks.Add(hook)
+
+	var results []notify.Resource
+	derr := forEachAccountRegion(func() error {
+		rs, err := getResourcesForTagFile(rgta.New(newAWSSession()), bytes.NewReader(tagFile), tfs)
+		if err != nil {
+			return err
+		}
+
+		tags := make(map[resourceKey]map[string]string, len(rs))
+		for _, r := range rs {
+			rt, rn := arn.MapARNToRTypeAndRName(r.ARN)
+			tags[resourceKey{rt, rn}] = r.Tags
+		}
+
+		hook.reset()
+		g := buildGraph(rs.ARNs())
+		err = deleteGraph(g)
+		for _, r := range hook.deleteResults(g, tags) {
+			r.AccountID, r.Region = accountID, region
+			results = append(results, r)
+		}
+		return err
+	})
+	if derr == nil {
+		derr = printDeleteReport()
+	}
+
+	// Notify owners of partial results even if deletion stopped early
+	summaries := notify.GroupByOwner(notify.EventDeleted, results)
+	if err := sendNotifications(summaries); err != nil {
+		if derr != nil {
+			logger.Errorln("notify:", err)
+			return derr
+		}
+		return fmt.Errorf("notify: %s", err)
+	}
+	return derr
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/grafiti/arn"
+	"github.com/coreos/grafiti/graph"
+	"github.com/coreos/grafiti/notify"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+func TestDeleteResults(t *testing.T) {
+	viper.Set("notify.ownerTagKeys", []string{"CreatedBy", "CreatorARN"})
+
+	g := graph.NewGraph()
+	vpc := g.AddNode(arn.EC2VPCRType, "vpc-1")
+	subnet := g.AddNode(arn.EC2SubnetRType, "subnet-1")
+	g.AddEdge(vpc, subnet)
+	g.AddNode(arn.S3BucketRType, "bucket-1")
+	g.AddNode(arn.EC2InstanceRType, "i-1")
+
+	tags := map[resourceKey]map[string]string{
+		{arn.EC2VPCRType, "vpc-1"}:      {"CreatorARN": "alice"},
+		{arn.S3BucketRType, "bucket-1"}: {"CreatedBy": "bob", "CreatorARN": "carol"},
+	}
+
+	l := logrus.New()
+	l.Out = ioutil.Discard
+	hook := newDeleteResultHook()
+	l.Hooks.Add(hook)
+
+	l.WithFields(logrus.Fields{"error": nil, "resource_type": arn.EC2VPCRType, "resource_name": "vpc-1"}).Info("Resource request was successful.")
+	l.WithFields(logrus.Fields{"error": nil, "resource_type": arn.S3BucketRType, "resource_name": arn.ResourceName("bucket-1")}).Info("Resource request was successful.")
+	// Failed child requests are attributed to their parent resource
+	l.WithFields(logrus.Fields{
+		"error":                errors.New("DependencyViolation"),
+		"resource_type":        "AWS::EC2::SubnetRule",
+		"resource_name":        "rule",
+		"parent_resource_type": arn.EC2SubnetRType,
+		"parent_resource_name": "subnet-1",
+	}).Info("Resource request failed.")
+
+	expected := []notify.Resource{
+		{ResourceType: arn.EC2VPCRType, ResourceName: "vpc-1", Owner: "alice"},
+		{ResourceType: arn.EC2SubnetRType, ResourceName: "subnet-1", Owner: "alice", Error: "DependencyViolation"},
+		{ResourceType: arn.S3BucketRType, ResourceName: "bucket-1", Owner: "bob"},
+	}
+	if got := hook.deleteResults(g, tags); !reflect.DeepEqual(got, expected) {
+		t.Errorf("deleteResults failed\nwanted\n%+v\ngot\n%+v\n", expected, got)
+	}
+}
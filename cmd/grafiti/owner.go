@@ -0,0 +1,135 @@
+// Copyright © 2017 grafiti authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/coreos/grafiti/arn"
+	"github.com/tidwall/gjson"
+)
+
+// Sources of an owner's name
+const (
+	ownerSourceUserName      = "userName"
+	ownerSourceWebIdentity   = "webIdentity"
+	ownerSourceSessionName   = "sessionName"
+	ownerSourceSessionIssuer = "sessionIssuer"
+	ownerSourceInvokedBy     = "invokedBy"
+	ownerSourceAccountID     = "accountId"
+)
+
+// Owner is the identity a resource created by an event is attributed to,
+// resolved from the event's 'userIdentity'.
+type Owner struct {
+	// Name is the name of the owner: the IAM user, federated user or web
+	// identity subject, the session name of an assumed role, or the service that
+	// created the resource.
+	Name string
+	// Source is the 'userIdentity' field Name was resolved from, ex.
+	// "sessionName" or "invokedBy".
+	Source string `json:",omitempty"`
+	// Type is the 'userIdentity.type' of the event, ex. "AssumedRole".
+	Type string `json:",omitempty"`
+	// ARN is the ARN of the principal that made the request.
+	ARN       arn.ResourceARN `json:",omitempty"`
+	AccountID string          `json:",omitempty"`
+	// IssuerARN and IssuerName identify the role or user that issued the
+	// temporary credentials of an assumed role or federated user session.
+	IssuerARN  arn.ResourceARN  `json:",omitempty"`
+	IssuerName arn.ResourceName `json:",omitempty"`
+	// SessionName is the role session name of an assumed role.
+	SessionName string `json:",omitempty"`
+	// IdentityProvider is the web identity or SAML provider the owner
+	// authenticated with.
+	IdentityProvider string `json:",omitempty"`
+	// InvokedBy is the AWS service that made the request on the owner's behalf.
+	InvokedBy string `json:",omitempty"`
+}
+
+// resolveOwner resolves the owner of resources created by parsedEvent. Assumed
+// roles are attributed to their web identity subject, or else their session
+// name or issuing role. Federated users are attributed to their federated user
+// name, and AWS services to the service that acted.
+func resolveOwner(parsedEvent gjson.Result) *Owner {
+	id := parsedEvent.Get("userIdentity")
+	o := &Owner{
+		Type:             id.Get("type").String(),
+		ARN:              arn.ResourceARN(id.Get("arn").String()),
+		AccountID:        id.Get("accountId").String(),
+		IssuerARN:        arn.ResourceARN(id.Get("sessionContext.sessionIssuer.arn").String()),
+		IssuerName:       arn.ResourceName(id.Get("sessionContext.sessionIssuer.userName").String()),
+		IdentityProvider: id.Get("identityProvider").String(),
+		InvokedBy:        id.Get("invokedBy").String(),
+	}
+
+	switch o.Type {
+	case "AssumedRole":
+		o.SessionName = principalSessionName(o.ARN, "assumed-role/")
+		if o.IdentityProvider == "" {
+			o.IdentityProvider = id.Get("sessionContext.webIdFederationData.federatedProvider").String()
+		}
+		o.setName(webIdentitySubject(id), ownerSourceWebIdentity)
+		o.setName(o.SessionName, ownerSourceSessionName)
+		o.setName(string(o.IssuerName), ownerSourceSessionIssuer)
+	case "FederatedUser":
+		o.setName(principalSessionName(o.ARN, "federated-user/"), ownerSourceUserName)
+		o.setName(string(o.IssuerName), ownerSourceSessionIssuer)
+	case "AWSService":
+		o.setName(o.InvokedBy, ownerSourceInvokedBy)
+	}
+	o.setName(id.Get("userName").String(), ownerSourceUserName)
+	o.setName(o.InvokedBy, ownerSourceInvokedBy)
+	o.setName(o.AccountID, ownerSourceAccountID)
+	return o
+}
+
+// setName sets o's name to name if o has none yet.
+func (o *Owner) setName(name, source string) {
+	if o.Name == "" && name != "" {
+		o.Name, o.Source = name, source
+	}
+}
+
+// principalSessionName returns the session name in an STS principal ARN, ex.
+// 'session' in 'arn:aws:sts::123456789012:assumed-role/role/session'.
+func principalSessionName(principal arn.ResourceARN, prefix string) string {
+	i := strings.Index(string(principal), ":"+prefix)
+	if i < 0 {
+		return ""
+	}
+	name := string(principal)[i+len(prefix)+1:]
+	if prefix == "assumed-role/" {
+		if j := strings.Index(name, "/"); j >= 0 {
+			return name[j+1:]
+		}
+		return ""
+	}
+	return name
+}
+
+// webIdentitySubject returns the 'sub' claim of the web identity token an
+// assumed role session was created with, if any.
+func webIdentitySubject(id gjson.Result) string {
+	var sub string
+	id.Get("sessionContext.webIdFederationData.attributes").ForEach(func(k, v gjson.Result) bool {
+		if strings.HasSuffix(k.String(), ":sub") {
+			sub = v.String()
+			return false
+		}
+		return true
+	})
+	return sub
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/tidwall/gjson"
+)
+
+func TestResolveOwner(t *testing.T) {
+	cases := []struct {
+		UserIdentity string
+		Expected     Owner
+	}{
+		{
+			`{"type":"IAMUser","arn":"arn:aws:iam::123456789101:user/test-user","accountId":"123456789101","userName":"test-user"}`,
+			Owner{Name: "test-user", Source: "userName", Type: "IAMUser", ARN: "arn:aws:iam::123456789101:user/test-user", AccountID: "123456789101"},
+		},
+		{
+			`{"type":"AssumedRole","arn":"arn:aws:sts::123456789101:assumed-role/ci/build-1234","accountId":"123456789101",
+			"sessionContext":{"sessionIssuer":{"type":"Role","arn":"arn:aws:iam::123456789101:role/ci","userName":"ci"}}}`,
+			Owner{Name: "build-1234", Source: "sessionName", Type: "AssumedRole", ARN: "arn:aws:sts::123456789101:assumed-role/ci/build-1234", AccountID: "123456789101", IssuerARN: "arn:aws:iam::123456789101:role/ci", IssuerName: "ci", SessionName: "build-1234"},
+		},
+		{
+			`{"type":"AssumedRole","arn":"arn:aws:sts::123456789101:assumed-role/ci/botocore-session-1","accountId":"123456789101",
+			"sessionContext":{"sessionIssuer":{"type":"Role","arn":"arn:aws:iam::123456789101:role/ci","userName":"ci"},
+			"webIdFederationData":{"federatedProvider":"arn:aws:iam::123456789101:oidc-provider/token.actions.githubusercontent.com",
+			"attributes":{"token.actions.githubusercontent.com:aud":"sts.amazonaws.com","token.actions.githubusercontent.com:sub":"repo:coreos/grafiti:ref:refs/heads/master"}}}}`,
+			Owner{Name: "repo:coreos/grafiti:ref:refs/heads/master", Source: "webIdentity", Type: "AssumedRole", ARN: "arn:aws:sts::123456789101:assumed-role/ci/botocore-session-1", AccountID: "123456789101", IssuerARN: "arn:aws:iam::123456789101:role/ci", IssuerName: "ci", SessionName: "botocore-session-1", IdentityProvider: "arn:aws:iam::123456789101:oidc-provider/token.actions.githubusercontent.com"},
+		},
+		{
+			`{"type":"AssumedRole","accountId":"123456789101","invokedBy":"cloudformation.amazonaws.com",
+			"sessionContext":{"sessionIssuer":{"type":"Role","arn":"arn:aws:iam::123456789101:role/deploy","userName":"deploy"}}}`,
+			Owner{Name: "deploy", Source: "sessionIssuer", Type: "AssumedRole", AccountID: "123456789101", IssuerARN: "arn:aws:iam::123456789101:role/deploy", IssuerName: "deploy", InvokedBy: "cloudformation.amazonaws.com"},
+		},
+		{
+			`{"type":"FederatedUser","arn":"arn:aws:sts::123456789101:federated-user/alice","accountId":"123456789101",
+			"sessionContext":{"sessionIssuer":{"type":"IAMUser","arn":"arn:aws:iam::123456789101:user/broker","userName":"broker"}}}`,
+			Owner{Name: "alice", Source: "userName", Type: "FederatedUser", ARN: "arn:aws:sts::123456789101:federated-user/alice", AccountID: "123456789101", IssuerARN: "arn:aws:iam::123456789101:user/broker", IssuerName: "broker"},
+		},
+		{
+			`{"type":"AWSService","invokedBy":"autoscaling.amazonaws.com"}`,
+			Owner{Name: "autoscaling.amazonaws.com", Source: "invokedBy", Type: "AWSService", InvokedBy: "autoscaling.amazonaws.com"},
+		},
+		{
+			`{"type":"WebIdentityUser","userName":"accounts.google.com:1234","identityProvider":"accounts.google.com"}`,
+			Owner{Name: "accounts.google.com:1234", Source: "userName", Type: "WebIdentityUser", IdentityProvider: "accounts.google.com"},
+		},
+		{
+			`{"type":"AWSAccount","accountId":"123456789012"}`,
+			Owner{Name: "123456789012", Source: "accountId", Type: "AWSAccount", AccountID: "123456789012"},
+		},
+	}
+
+	for i, c := range cases {
+		got := resolveOwner(gjson.Parse(`{"userIdentity":` + c.UserIdentity + `}`))
+		if !reflect.DeepEqual(*got, c.Expected) {
+			t.Errorf("resolveOwner case %d failed\nwanted: %+v\ngot: %+v", i+1, c.Expected, *got)
+		}
+	}
+}
+
+func TestGetTagsOwner(t *testing.T) {
+	viper.Set("tagPatterns", []string{
+		"{Owner: $owner.Name, Role: $owner.IssuerName}",
+		"if $owner.Type == \"AssumedRole\" then {Session: $owner.SessionName} else empty end",
+	})
+	defer viper.Set("tagPatterns", []string{})
+
+	event := `{"userIdentity":{"type":"AssumedRole","arn":"arn:aws:sts::123456789101:assumed-role/ci/build-1234",
+	"sessionContext":{"sessionIssuer":{"arn":"arn:aws:iam::123456789101:role/ci","userName":"ci"}}}}`
+	expected := map[string]string{"Owner": "build-1234", "Role": "ci", "Session": "build-1234"}
+
+	got := getTags(event, &TaggingMetadata{Owner: resolveOwner(gjson.Parse(event))})
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("getTags failed\nwanted: %v\ngot: %v", expected, got)
+	}
+}
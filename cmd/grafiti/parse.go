@@ -16,20 +16,20 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"compress/gzip"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudtrail"
 	"github.com/aws/aws-sdk-go/service/cloudtrail/cloudtrailiface"
-	jq "github.com/estroz/jqpipe-go"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/tidwall/gjson"
@@ -37,82 +37,92 @@ import (
 	"github.com/coreos/grafiti/arn"
 )
 
-var inputFile string
-
-// Holds data that identifies a raw CloudTrail event: gjson.Result search path
-// for resource name, and resource type
-type rawEventIdentity struct {
-	ResourceType     string
-	ResourceNamePath string
-}
-
-// Maps CloudTrail eventName to a rawEventIdentity
-var rawEventMap = map[string]rawEventIdentity{
-	"CreateAutoScalingGroup": {arn.AutoScalingGroupRType, "requestParameters.autoScalingGroupName"},
-	"CreateBucket":           {arn.S3BucketRType, "requestParameters.bucketName"},
-	"CreateCustomerGateway":  {arn.EC2CustomerGatewayRType, "responseElements.customerGateway.customerGatewayId"},
-	"CreateHostedZone":       {arn.Route53HostedZoneRType, "responseElements.hostedZone.id"},
-	"CreateInternetGateway":  {arn.EC2InternetGatewayRType, "responseElements.internetGateway.internetGatewayId"},
-	"CreateLoadBalancer":     {arn.ElasticLoadBalancingLoadBalancerRType, "requestParameters.loadBalancerName"},
-	"CreateNetworkAcl":       {arn.EC2NetworkACLRType, "responseElements.networkAcl.networkAclId"},
-	"CreateNetworkInterface": {arn.EC2NetworkInterfaceRType, "responseElements.networkInterface.networkInterfaceId"},
-	"CreateRouteTable":       {arn.EC2RouteTableRType, "responseElements.routeTable.routeTableId"},
-	"CreateSecurityGroup":    {arn.EC2SecurityGroupRType, "responseElements.groupId"},
-	"CreateSubnet":           {arn.EC2SubnetRType, "responseElements.subnet.subnetId"},
-	"CreateVolume":           {arn.EC2VolumeRType, "responseElements.volumeId"},
-	"CreateVpc":              {arn.EC2VPCRType, "responseElements.vpc.vpcId"},
-	"CreateVpnConnection":    {arn.EC2VPNConnectionRType, "responseElements.vpnConnection.vpnConnectionId"},
-	"CreateVpnGateway":       {arn.EC2VPNGatewayRType, "responseElements.vpnGateway.vpnGatewayId"},
-	"RunInstances":           {arn.EC2InstanceRType, "responseElements.instancesSet.items.0.instanceId"},
-}
+var inputFiles []string
 
 func init() {
 	RootCmd.AddCommand(parseCmd)
-	parseCmd.PersistentFlags().StringVarP(&inputFile, "input-file", "f", "", "CloudTrail log file of raw CloudTrail events. Supports gzip-compressed files.")
+	parseCmd.PersistentFlags().StringArrayVarP(&inputFiles, "input-file", "f", nil, "CloudTrail log file, directory or glob of log files of raw CloudTrail events, or an s3://bucket/prefix/ URL of CloudTrail log files. Can be set multiple times. Supports gzip-compressed files, concatenated log files and newline-delimited events.")
+	parseCmd.PersistentFlags().StringVar(&parseSince, "since", "", "Parse events since a duration ago ('36h', '7d'), a date or RFC-3339 timestamp, 'last-run', or a calendar expression ('today', 'yesterday+9h', 'this-week', 'last-month'). Overrides time window config fields.")
+	parseCmd.PersistentFlags().StringVar(&parseUntil, "until", "", "Parse events until a time in any format --since accepts (default: now).")
 }
 
 var parseCmd = &cobra.Command{
-	Use:           "parse",
+	Use:           "parse [log files]",
 	Short:         "Parse resource data from CloudTrail logs.",
-	Long:          "Parse CloudTrail logs and output resource data. By default, grafiti requests data from the CloudTrail API.",
+	Long:          "Parse CloudTrail logs and output resource data. By default, grafiti requests data from the CloudTrail API. If 'stateFile' is set, progress is saved after each page of events if 'deletedResources' is 'ignore', so a run that is killed resumes from its last page, and otherwise once parsing ends or fails.",
 	RunE:          runParseCommand,
 	SilenceErrors: true,
 	SilenceUsage:  true,
 }
 
 func runParseCommand(cmd *cobra.Command, args []string) error {
-	// `grafiti parse`'s default behavior is to parse data from the CloudTrail API
-	// and not from stdin like other sub-commands, so we must check if data exists
-	// in stdin before proceeding with that logic branch.
-	fi, err := os.Stdin.Stat()
+	// CloudTrail delivers overlapping log files if multiple trails log the same
+	// events, so events parsed from log files are de-duplicated.
+	parsedEventIDs = newEventIDWindow(parsedEventIDsWindow)
+	defer func() { parsedEventIDs = nil }()
+
+	// If deletions are tracked, output is held until all events are parsed so
+	// resources deleted later in the time window are known.
+	tracker, err := newLifecycleTracker()
 	if err != nil {
-		return fmt.Errorf("parse: stdin stat: %s", err)
+		return fmt.Errorf("parse: %s", err)
 	}
-	if (fi.Mode() & os.ModeCharDevice) == 0 {
-		if err := parseFromStdin(); err != nil {
-			return fmt.Errorf("parse: %s", err)
-		}
-		return nil
+	lifecycle = tracker
+	defer func() { lifecycle = nil }()
+
+	// State is loaded once so progress of every source is saved together
+	st, err := loadState()
+	if err != nil {
+		return fmt.Errorf("parse: %s", err)
 	}
 
-	// inputFile encodes CloudTrail log data, in JSON or gzipped JSON encoding,
-	// for grafiti to extract resource information from.
-	if inputFile != "" {
-		if err := parseFromFile(inputFile); err != nil {
-			return fmt.Errorf("parse: %s", err)
+	parseErr := parseInput(args, st)
+	// The next run can continue from this run with '--since last-run'
+	if parseErr == nil && st.window != nil {
+		st.LastRunEnd = aws.Time(st.window.end)
+		parseErr = saveParsedState(st)
+	}
+	if lifecycle != nil {
+		if err := lifecycle.flush(); err != nil && parseErr == nil {
+			parseErr = err
 		}
-		return nil
 	}
+	if parseErr != nil {
+		return fmt.Errorf("parse: %s", parseErr)
+	}
+	return nil
+}
 
-	// Parse resource data from the CloudTrail API.
-	svc := cloudtrail.New(session.Must(session.NewSession(
-		&aws.Config{},
-	)))
-	if err := parseFromCloudTrail(svc); err != nil {
-		return fmt.Errorf("parse: %s", err)
+// parseInput parses CloudTrail events from input files in args, stdin or the
+// CloudTrail API, in that order of precedence. Progress is recorded in st.
+func parseInput(args []string, st *State) error {
+	// Input files are S3 URLs of prefixes of CloudTrail log files, or encode
+	// CloudTrail log data, in JSON or gzipped JSON encoding, for grafiti to
+	// extract resource information from. Unflagged arguments are input files as
+	// well, so shell-expanded globs can be passed to -f.
+	if sources := append(inputFiles, args...); len(sources) != 0 {
+		return parseFromSources(sources, st)
 	}
 
-	return nil
+	// `grafiti parse`'s default behavior is to parse data from the CloudTrail API
+	// and not from stdin like other sub-commands, so we must check if data exists
+	// in stdin before proceeding with that logic branch.
+	fi, err := os.Stdin.Stat()
+	if err != nil {
+		return fmt.Errorf("stdin stat: %s", err)
+	}
+	if (fi.Mode() & os.ModeCharDevice) == 0 {
+		return parseFromStdin()
+	}
+
+	// Parse resource data from the CloudTrail API of each account and region.
+	// Events of global services are only logged in one region, so they are
+	// parsed once.
+	return forEachAccountRegion(func() error {
+		sess := newAWSSession()
+		scope := accountID + "/" + aws.StringValue(sess.Config.Region)
+		return parseFromCloudTrail(cloudtrail.New(sess), scope, st)
+	})
 }
 
 // CloudTrailLogFile holds the array of Record strings in a S3 CloudTrail log
@@ -121,33 +131,304 @@ type CloudTrailLogFile struct {
 	Events []json.RawMessage `json:"Records"`
 }
 
-func parseBytes(raw []byte) error {
-	var logFile CloudTrailLogFile
-	if err := json.Unmarshal(raw, &logFile); err != nil {
-		return err
+// logFileEventsKey is the key of the array of events in a CloudTrail log file
+const logFileEventsKey = "Records"
+
+// parseEvents decodes CloudTrail events from r and prints parse output for each
+// event as soon as it is decoded, so only one event is held in memory at a
+// time. r can hold any number of concatenated CloudTrail log files, ex.
+// '{"Records":[...]}{"Records":[...]}', or whitespace-delimited events.
+func parseEvents(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("decode events: %s", err)
+		}
+		if tok != json.Delim('{') {
+			return fmt.Errorf("decode events: expected a log file or event object, got %v", tok)
+		}
+		if err := parseObject(dec); err != nil {
+			return fmt.Errorf("decode events: %s", err)
+		}
 	}
+}
 
-	for _, eventData := range logFile.Events {
-		event, err := eventData.MarshalJSON()
+// parseObject decodes the rest of an object whose opening delimiter was read
+// from dec. Events in a log file's Records array are parsed one by one. Any
+// other object is parsed as a single event.
+func parseObject(dec *json.Decoder) error {
+	var event bytes.Buffer
+	for dec.More() {
+		tok, err := dec.Token()
 		if err != nil {
+			return err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return fmt.Errorf("expected an object key, got %v", tok)
+		}
+
+		if key == logFileEventsKey {
+			if err := parseRecords(dec); err != nil {
+				return err
+			}
 			continue
 		}
 
-		if eventStr := parseRawCloudTrailEvent(string(event)); eventStr != "" {
-			fmt.Println(eventStr)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return err
+		}
+		kb, _ := json.Marshal(key)
+		if event.Len() == 0 {
+			event.WriteByte('{')
+		} else {
+			event.WriteByte(',')
 		}
+		event.Write(kb)
+		event.WriteByte(':')
+		event.Write(value)
+	}
+	// Consume the object's closing delimiter
+	if _, err := dec.Token(); err != nil {
+		return err
 	}
 
+	if event.Len() != 0 {
+		event.WriteByte('}')
+		printRawCloudTrailEvent(event.String())
+	}
 	return nil
 }
 
+// parseRecords decodes and parses each event in a log file's Records array.
+func parseRecords(dec *json.Decoder) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if tok != json.Delim('[') {
+		return fmt.Errorf("expected %s array, got %v", logFileEventsKey, tok)
+	}
+
+	for dec.More() {
+		var event json.RawMessage
+		if err := dec.Decode(&event); err != nil {
+			return err
+		}
+		printRawCloudTrailEvent(string(event))
+	}
+	// Consume the array's closing delimiter
+	_, err = dec.Token()
+	return err
+}
+
+// outputHandler receives each parse output instead of stdout, if set.
+var outputHandler func(output string)
+
+// printOutput prints parse output, or passes it to outputHandler if set.
+func printOutput(output string) {
+	if outputHandler != nil {
+		outputHandler(output)
+		return
+	}
+	fmt.Println(output)
+}
+
+// parsedEventIDsWindow is how long the IDs of parsed events are remembered,
+// in event time. Log files are parsed in the order they were delivered, and
+// overlapping log files are delivered within about 15 minutes of each other.
+const parsedEventIDsWindow = 15 * time.Minute
+
+// eventIDWindow holds the IDs of events parsed within window of the latest
+// event parsed.
+type eventIDWindow struct {
+	window time.Duration
+	ids    map[string]time.Time
+	// latest is the time of the latest event parsed, and pruned is the value of
+	// latest when IDs were last pruned
+	latest, pruned time.Time
+}
+
+func newEventIDWindow(window time.Duration) *eventIDWindow {
+	return &eventIDWindow{window: window, ids: make(map[string]time.Time)}
+}
+
+// seen returns true if the event with id was parsed, and records it at time at
+// otherwise. IDs of events older than window are pruned at most once every
+// window, so at most about two windows of IDs are held.
+func (w *eventIDWindow) seen(id string, at time.Time) bool {
+	if _, ok := w.ids[id]; ok {
+		return true
+	}
+	w.ids[id] = at
+
+	if at.After(w.latest) {
+		w.latest = at
+	}
+	if w.latest.Sub(w.pruned) >= w.window {
+		for i, t := range w.ids {
+			if t.Before(w.latest.Add(-w.window)) {
+				delete(w.ids, i)
+			}
+		}
+		w.pruned = w.latest
+	}
+	return false
+}
+
+// parsedEventIDs holds the IDs of events recently parsed from log files in
+// this run. Events are not de-duplicated if parsedEventIDs is nil.
+var parsedEventIDs *eventIDWindow
+
+func printRawCloudTrailEvent(event string) {
+	parsedEvent := gjson.Parse(event)
+	at := eventTime(parsedEvent)
+	if parsedEventIDs != nil {
+		if id := parsedEvent.Get("eventID").String(); id != "" && parsedEventIDs.seen(id, at) {
+			return
+		}
+	}
+
+	markRawEventDeletions(parsedEvent)
+	for _, r := range parseRawCloudTrailEvent(event) {
+		emitOutput(r.Key, at, r.Output)
+	}
+}
+
 func parseFromStdin() error {
-	raw, err := ioutil.ReadAll(os.Stdin)
+	r, closeFn, err := newLogReader(os.Stdin)
 	if err != nil {
 		return fmt.Errorf("read from stdin: %s", err)
 	}
+	defer closeFn()
+
+	return parseEvents(r)
+}
+
+// parseFromSources parses CloudTrail log files in sources, which are local
+// paths or S3 URLs. Local log files are parsed in delivery time order before
+// log files in S3, whose progress is recorded in st.
+func parseFromSources(sources []string, st *State) error {
+	var paths, urls []string
+	for _, src := range sources {
+		if isS3URL(src) {
+			urls = append(urls, src)
+		} else {
+			paths = append(paths, src)
+		}
+	}
+
+	files, err := expandLogFiles(paths)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := parseFromFile(f); err != nil {
+			return fmt.Errorf("%s: %s", f, err)
+		}
+	}
+
+	for _, u := range urls {
+		if err := runParseS3(u, st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandLogFiles expands paths, which are files, directories or globs, into
+// log files sorted by delivery time. Directories are walked recursively for
+// '.json' and '.json.gz' files. Files without a CloudTrail log file name are
+// ordered by modification time.
+func expandLogFiles(paths []string) ([]string, error) {
+	var files logFiles
+	seen := make(map[string]bool)
+	addFile := func(path string, fi os.FileInfo) {
+		if seen[path] {
+			return
+		}
+		seen[path] = true
+		t, ok := logFileTime(filepath.Base(path))
+		if !ok {
+			t = fi.ModTime()
+		}
+		files = append(files, logFile{path, t})
+	}
+
+	for _, p := range paths {
+		matches := []string{p}
+		if strings.ContainsAny(p, "*?[") {
+			var err error
+			if matches, err = filepath.Glob(p); err != nil {
+				return nil, fmt.Errorf("glob %q: %s", p, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match %q", p)
+			}
+		}
+
+		for _, m := range matches {
+			fi, err := os.Stat(m)
+			if err != nil {
+				return nil, fmt.Errorf("stat input file: %s", err)
+			}
+			if !fi.IsDir() {
+				addFile(m, fi)
+				continue
+			}
+
+			err = filepath.Walk(m, func(path string, fi os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if fi.Mode().IsRegular() && isLogFileName(path) {
+					addFile(path, fi)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("walk input directory: %s", err)
+			}
+		}
+	}
+
+	sort.Sort(files)
+	sorted := make([]string, len(files))
+	for i, f := range files {
+		sorted[i] = f.path
+	}
+	return sorted, nil
+}
 
-	return parseBytes(raw)
+type logFile struct {
+	path string
+	time time.Time
+}
+
+// logFiles sorts log files by delivery time, then path.
+type logFiles []logFile
+
+func (fs logFiles) Len() int      { return len(fs) }
+func (fs logFiles) Swap(i, j int) { fs[i], fs[j] = fs[j], fs[i] }
+func (fs logFiles) Less(i, j int) bool {
+	if !fs[i].time.Equal(fs[j].time) {
+		return fs[i].time.Before(fs[j].time)
+	}
+	return fs[i].path < fs[j].path
+}
+
+// isLogFileName returns true if path has the extension of a CloudTrail log
+// file.
+func isLogFileName(path string) bool {
+	return strings.HasSuffix(path, ".json") || strings.HasSuffix(path, ".json.gz")
 }
 
 func parseFromFile(logFileName string) error {
@@ -157,62 +438,116 @@ func parseFromFile(logFileName string) error {
 	}
 	defer f.Close()
 
-	br := bufio.NewReader(f)
-
-	var r io.Reader
-	r = br
-	if isGzip, err := isGzipFile(br); err != nil {
-		return err
-	} else if isGzip {
-		if r, err = gzip.NewReader(br); err != nil {
-			return fmt.Errorf("create gzip reader: %s", err)
-		}
-		defer r.(*gzip.Reader).Close()
+	r, closeFn, err := newLogReader(f)
+	if err != nil {
+		return fmt.Errorf("read parse file: %s", err)
 	}
+	defer closeFn()
+
+	return parseEvents(r)
+}
 
-	raw, err := ioutil.ReadAll(r)
+// newLogReader returns a reader of CloudTrail log data in r, decompressing it
+// if it is gzip-compressed. Concatenated gzip archives are read as one stream.
+// The returned func closes the decompressor, if any.
+func newLogReader(r io.Reader) (io.Reader, func() error, error) {
+	br := bufio.NewReader(r)
+	noop := func() error { return nil }
+
+	isGzip, err := isGzipFile(br)
 	if err != nil {
-		return fmt.Errorf("read parse file: %s", err)
+		return nil, noop, err
+	}
+	if !isGzip {
+		return br, noop, nil
 	}
 
-	return parseBytes(raw)
+	gr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, noop, fmt.Errorf("create gzip reader: %s", err)
+	}
+	return gr, gr.Close, nil
 }
 
 // Check for gzip magic number, 0x1f8b, in the files' first 2 bytes
 func isGzipFile(tr *bufio.Reader) (bool, error) {
 	tb, err := tr.Peek(2)
+	if err == io.EOF {
+		// Input with less than 2 bytes cannot be gzip-compressed
+		return false, nil
+	}
 	if err != nil {
 		return false, fmt.Errorf("peek gzip magic number: %s", err)
 	}
 	return tb[0] == 31 && tb[1] == 139, nil
 }
 
-func parseRawCloudTrailEvent(event string) string {
+// parsedResource is parse output of a resource and the key identifying it
+// across events.
+type parsedResource struct {
+	Key    string
+	Output string
+}
+
+// parseRawCloudTrailEvent returns parse output for each resource created by a
+// raw CloudTrail event.
+func parseRawCloudTrailEvent(event string) []parsedResource {
 	parsedEvent := gjson.Parse(event)
 	eventName := parsedEvent.Get("eventName")
-	eventIdentity, ok := rawEventMap[eventName.String()]
+	eventIdentities, ok := rawEventMap[eventName.String()]
 	if !ok {
-		return ""
+		return nil
 	}
 
-	rn := arn.ResourceName(parsedEvent.Get(eventIdentity.ResourceNamePath).String())
-	rt := arn.ResourceType(eventIdentity.ResourceType)
-
-	return parseDataFromEvent(rt, rn, parsedEvent, nil)
+	var outputs []parsedResource
+	for _, eventIdentity := range eventIdentities {
+		rt := arn.ResourceType(eventIdentity.ResourceType)
+		_, untaggable := arn.UntaggableResourceTypes[rt]
+		for _, rn := range resourceNames(parsedEvent.Get(eventIdentity.ResourceNamePath)) {
+			// Resources that cannot be tagged, ex. associations, may not have an
+			// ARN. They are output regardless so they can be filtered and inspected.
+			ARN := arn.MapResourceTypeToARN(rt, rn, parsedEvent)
+			if ARN == "" && !untaggable {
+				continue
+			}
+			if output := parseDataFromEvent(rt, rn, ARN, parsedEvent, nil); output != "" {
+				outputs = append(outputs, parsedResource{lifecycleKey(rt, rn, ARN, parsedEvent), output})
+			}
+		}
+	}
+	return outputs
 }
 
-func parseFromCloudTrail(svc cloudtrailiface.CloudTrailAPI) error {
-	var start, end *time.Time
-	// Check if timestamps or hours exist
-	if viper.IsSet("startTimeStamp") && viper.IsSet("endTimeStamp") {
-		start, end = calcTimeWindowFromTimeStamp(viper.GetString("startTimeStamp"), viper.GetString("endTimeStamp"))
-	} else if viper.IsSet("startHour") && viper.IsSet("endHour") {
-		start, end = calcTimeWindowFromHourRange(viper.GetInt("startHour"), viper.GetInt("endHour"))
+// resourceNames returns all unique, non-empty resource names in r. Names in
+// arrays, including nested arrays selected by multiple '#' in a path, are
+// flattened.
+func resourceNames(r gjson.Result) []arn.ResourceName {
+	var names []arn.ResourceName
+	seen := make(map[string]bool)
+	var add func(gjson.Result)
+	add = func(v gjson.Result) {
+		if v.Type == gjson.JSON && strings.HasPrefix(v.Raw, "[") {
+			for _, e := range v.Array() {
+				add(e)
+			}
+			return
+		}
+		if name := v.String(); name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, arn.ResourceName(name))
+		}
 	}
-	if start == nil {
-		return errors.New("start of time window was invalid or nil")
-	} else if end == nil {
-		return errors.New("end of time window was invalid or nil")
+	add(r)
+	return names
+}
+
+// parseFromCloudTrail parses events of each configured resource type from the
+// CloudTrail API. scope is the '<account ID>/<region>' of svc, under which
+// progress of each resource type is recorded in st.
+func parseFromCloudTrail(svc cloudtrailiface.CloudTrailAPI, scope string, st *State) error {
+	start, end, err := getTimeWindow(st)
+	if err != nil {
+		return err
 	}
 
 	// Create LookupEvents for all resourceTypes. If none are specified,
@@ -231,7 +566,12 @@ func parseFromCloudTrail(svc cloudtrailiface.CloudTrailAPI) error {
 	}
 
 	for _, attr := range attrs {
-		if err := parseLookupAttribute(svc, attr, start, end); err != nil {
+		var rt string
+		if attr != nil {
+			rt = aws.StringValue(attr.AttributeValue)
+		}
+		cp := st.lookupCheckpoint(scope + "/" + rt)
+		if err := parseLookupAttribute(svc, attr, start, end, cp, st); err != nil {
 			return err
 		}
 	}
@@ -239,44 +579,12 @@ func parseFromCloudTrail(svc cloudtrailiface.CloudTrailAPI) error {
 	return nil
 }
 
-// Calculates a time window between a starting RFC3339 timestamp string and
-// ending RFC3339 timestamp string.
-func calcTimeWindowFromTimeStamp(start, end string) (*time.Time, *time.Time) {
-	startTime, err := time.Parse(time.RFC3339, start)
-	if err != nil {
-		logger.Debugln("startTimeStamp parse error:", err)
-		return nil, nil
-	}
-
-	endTime, err := time.Parse(time.RFC3339, end)
-	if err != nil {
-		logger.Debugln("endTimeStamp parse error:", err)
-		return nil, nil
-	}
-
-	if startTime.After(endTime) || startTime.Equal(endTime) {
-		logger.Debugf("startTimeStamp (%s) is at or after endTimeStamp (%s)", startTime, endTime)
-		return nil, nil
-	}
-
-	return aws.Time(startTime), aws.Time(endTime)
-}
-
-// Calculates a time window between a starting hour and ending hour.
-func calcTimeWindowFromHourRange(start, end int) (*time.Time, *time.Time) {
-	if start >= end {
-		logger.Debugf("startHour (%d) is at or after endHour (%d)", start, end)
-		return nil, nil
-	}
-
-	now := time.Now()
-	startTime := now.Add(time.Duration(start) * time.Hour)
-	endTime := now.Add(time.Duration(end) * time.Hour)
-
-	return aws.Time(startTime), aws.Time(endTime)
-}
-
-func parseLookupAttribute(svc cloudtrailiface.CloudTrailAPI, attr *cloudtrail.LookupAttribute, start, end *time.Time) error {
+// parseLookupAttribute parses events matching attr from the CloudTrail API.
+// Events are looked up from the end of the last run recorded in cp, or from
+// start if there is none, until end. A run that did not complete resumes from
+// its last page. Progress is saved in st after each page, or when parsing ends
+// if deletions are tracked.
+func parseLookupAttribute(svc cloudtrailiface.CloudTrailAPI, attr *cloudtrail.LookupAttribute, start, end *time.Time, cp *LookupCheckpoint, st *State) error {
 	params := &cloudtrail.LookupEventsInput{
 		EndTime:          end,
 		MaxResults:       aws.Int64(50),
@@ -284,6 +592,20 @@ func parseLookupAttribute(svc cloudtrailiface.CloudTrailAPI, attr *cloudtrail.Lo
 		LookupAttributes: []*cloudtrail.LookupAttribute{attr},
 	}
 
+	if cp.inProgress() {
+		logger.Infof("resuming CloudTrail lookup between %s and %s", cp.StartTime, cp.EndTime)
+		params.StartTime, params.EndTime = cp.StartTime, cp.EndTime
+		params.NextToken = aws.String(cp.NextToken)
+	} else {
+		if !cp.LastEventTime.IsZero() {
+			if !cp.LastEventTime.Before(*end) {
+				return nil
+			}
+			params.StartTime = aws.Time(cp.LastEventTime)
+		}
+		cp.StartTime, cp.EndTime = params.StartTime, params.EndTime
+	}
+
 	for {
 		ctx := aws.BackgroundContext()
 		resp, err := svc.LookupEventsWithContext(ctx, params)
@@ -291,16 +613,35 @@ func parseLookupAttribute(svc cloudtrailiface.CloudTrailAPI, attr *cloudtrail.Lo
 			return fmt.Errorf("parse lookup event: %s", err)
 		}
 
-		printEvents(resp.Events)
+		// Events at the time the last run ended were parsed by that run
+		var events []*cloudtrail.Event
+		for _, e := range resp.Events {
+			id, t := aws.StringValue(e.EventId), aws.TimeValue(e.EventTime)
+			if cp.parsed(id, t) {
+				continue
+			}
+			cp.observe(id, t)
+			events = append(events, e)
+		}
+		printEvents(events)
 
 		if aws.StringValue(resp.NextToken) == "" {
 			break
 		}
 
 		params.NextToken = resp.NextToken
+		cp.NextToken = aws.StringValue(resp.NextToken)
+		// Saving the position of a run whose output is held would skip that
+		// output if the run were killed, so only runs that print output as events
+		// are parsed can resume after being killed. Held output and the position
+		// are still saved together if the run fails.
+		if err := saveParsedState(st); err != nil {
+			return err
+		}
 	}
 
-	return nil
+	cp.complete()
+	return saveParsedState(st)
 }
 
 // OutputWithEvent holds all data associated with a resource when the
@@ -334,27 +675,37 @@ func printEvent(event *cloudtrail.Event, parsedEvent gjson.Result) {
 		}
 
 		rt, rn := arn.ResourceType(typeStr), arn.ResourceName(nameStr)
-		if tmString := parseDataFromEvent(rt, rn, parsedEvent, event); tmString != "" {
-			fmt.Println(tmString)
+		ARN := arn.MapResourceTypeToARN(rt, rn, parsedEvent)
+		if ARN == "" {
+			continue
+		}
+		key := lifecycleKey(rt, rn, ARN, parsedEvent)
+		// Resources deleted by an event are not output if deletions are tracked
+		if lifecycle != nil && isDeleteEventOf(rt, parsedEvent) {
+			lifecycle.markDeleted(key, eventTime(parsedEvent))
+			continue
+		}
+		if tmString := parseDataFromEvent(rt, rn, ARN, parsedEvent, event); tmString != "" {
+			emitOutput(key, eventTime(parsedEvent), tmString)
 		}
 	}
 }
 
-func parseDataFromEvent(rt arn.ResourceType, rn arn.ResourceName, parsedEvent gjson.Result, event *cloudtrail.Event) string {
+func parseDataFromEvent(rt arn.ResourceType, rn arn.ResourceName, ARN arn.ResourceARN, parsedEvent gjson.Result, event *cloudtrail.Event) string {
 	includeEvent := viper.GetBool("includeEvent")
-	ARN := arn.MapResourceTypeToARN(rt, rn, parsedEvent)
-	if ARN == "" {
-		return ""
-	}
 
-	tags := getTags(parsedEvent.String())
+	owner := resolveOwner(parsedEvent)
 	tm := &TaggingMetadata{
 		ResourceName: rn,
 		ResourceType: rt,
 		ResourceARN:  ARN,
 		CreatorARN:   arn.ResourceARN(parsedEvent.Get("userIdentity.arn").String()),
-		CreatorName:  arn.ResourceName(parsedEvent.Get("userIdentity.userName").String()),
+		CreatorName:  arn.ResourceName(owner.Name),
+		Owner:        owner,
+		Region:       parsedEvent.Get("awsRegion").String(),
+		AccountID:    eventAccountID(parsedEvent),
 	}
+	tags := getTags(parsedEvent.String(), tm)
 
 	output := getOutput(includeEvent, tags, tm, event)
 
@@ -370,14 +721,33 @@ func parseDataFromEvent(rt arn.ResourceType, rn arn.ResourceName, parsedEvent gj
 	return ""
 }
 
+// eventAccountID returns the ID of the account an event occurred in.
+func eventAccountID(parsedEvent gjson.Result) string {
+	if id := parsedEvent.Get("recipientAccountId").String(); id != "" {
+		return id
+	}
+	return parsedEvent.Get("userIdentity.accountId").String()
+}
+
 func matchFilter(output []byte) bool {
-	for _, f := range viper.GetStringSlice("filterPatterns") {
-		results, err := jq.Eval(string(output), f)
+	filterPatterns := viper.GetStringSlice("filterPatterns")
+	if len(filterPatterns) == 0 {
+		return true
+	}
+
+	v, err := decodeJQInput(output)
+	if err != nil {
+		logger.Debugln(err)
+		return false
+	}
+
+	for _, f := range filterPatterns {
+		results, err := evalJQ(f, v)
 		if err != nil || len(results) == 0 {
 			return false
 		}
 
-		if rj, _ := results[0].MarshalJSON(); string(rj) != "true" {
+		if match, ok := results[0].(bool); !ok || !match {
 			return false
 		}
 	}
@@ -385,42 +755,97 @@ func matchFilter(output []byte) bool {
 	return true
 }
 
-func getTags(rawEvent string) map[string]string {
+// getTags runs all tag patterns, and tag patterns of tag rules that apply, on
+// rawEvent. Patterns can refer to the resolved owner of the event as '$owner',
+// the event as '$event', tm as '$metadata' and pattern variables as '$vars'.
+// Tags of later patterns replace tags of earlier ones with the same key.
+func getTags(rawEvent string, tm *TaggingMetadata) map[string]string {
 	tagPatterns := viper.GetStringSlice("tagPatterns")
-	if len(tagPatterns) == 0 {
+	if len(tagPatterns) == 0 && len(tagRules) == 0 {
+		return map[string]string{}
+	}
+
+	v, err := decodeJQInput([]byte(rawEvent))
+	if err != nil {
+		logger.Debugln(err)
+		return map[string]string{}
+	}
+	values, err := tagPatternValues(v, tm)
+	if err != nil {
+		logger.Debugln(err)
 		return map[string]string{}
 	}
 
 	allTags := make(map[string]string)
-	for _, p := range tagPatterns {
-		results, err := jq.Eval(rawEvent, p)
+	addTags(allTags, tagPatterns, v, values)
+	for _, r := range tagRules {
+		match, err := r.matches(tm.ResourceType, v, values)
 		if err != nil {
-			logger.Debugln("jq eval tag pattern:", err)
+			logger.Debugln(err)
 			continue
 		}
+		if match {
+			addTags(allTags, r.TagPatterns, v, values)
+		}
+	}
+	return allTags
+}
 
-		for _, r := range results {
-			rBytes, err := r.MarshalJSON()
-			if err != nil {
-				logger.Debugln("marshal tag result:", err)
-				break
-			}
+// tagPatternValues returns the values of jqVariables for tag patterns run on
+// the event v that created the resource of tm.
+func tagPatternValues(v interface{}, tm *TaggingMetadata) ([]interface{}, error) {
+	owner, err := toJQValue(tm.Owner)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := toJQValue(tm)
+	if err != nil {
+		return nil, err
+	}
+	vars, err := toJQValue(patternVars)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{owner, v, metadata, vars}, nil
+}
 
-			tagMap, ok := gjson.Parse(string(rBytes)).Value().(map[string]interface{})
+// addTags runs patterns on v and adds the tags they generate to tags.
+func addTags(tags map[string]string, patterns []string, v interface{}, values []interface{}) {
+	for _, p := range patterns {
+		results, err := evalJQ(p, v, values...)
+		if err != nil {
+			logger.Debugln(err)
+			continue
+		}
+
+		for _, r := range results {
+			tagMap, ok := r.(map[string]interface{})
 			if !ok {
 				break
 			}
 
-			for k, v := range tagMap {
-				if v == nil {
-					allTags[k] = ""
-				} else {
-					allTags[k] = v.(string)
-				}
+			for k, tv := range tagMap {
+				tags[k] = tagValue(tv)
 			}
 		}
 	}
-	return allTags
+}
+
+// tagValue converts a value generated by a tag pattern to a tag value. Values
+// that are not strings are JSON-encoded.
+func tagValue(v interface{}) string {
+	switch tv := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return tv
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		logger.Debugln("marshal tag value:", err)
+		return ""
+	}
+	return string(b)
 }
 
 func getOutput(includeEvent bool, tags map[string]string, taggingMetadata *TaggingMetadata, event *cloudtrail.Event) interface{} {
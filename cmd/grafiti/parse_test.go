@@ -2,19 +2,24 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
-	"sort"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/cloudtrail"
+	"github.com/aws/aws-sdk-go/service/cloudtrail/cloudtrailiface"
 	"github.com/spf13/viper"
+	"github.com/tidwall/gjson"
 )
 
 type mockCloudTrailAPIEvents struct {
@@ -67,22 +72,30 @@ func TestCalcTimeWindowFromHourRange(t *testing.T) {
 		InputStart   int
 		InputEnd     int
 		ExpectedDiff time.Duration
+		WantErr      bool
 	}{
-		{-8, 0, time.Duration(8) * time.Hour},
-		{-25, -17, time.Duration(8) * time.Hour},
-		{0, -8, time.Duration(0)},
-		{0, 0, time.Duration(0)},
+		{-8, 0, time.Duration(8) * time.Hour, false},
+		{-25, -17, time.Duration(8) * time.Hour, false},
+		{0, -8, time.Duration(0), true},
+		{0, 0, time.Duration(0), true},
+		// Hours are relative to now, so positive hours are in the future
+		{8, 0, time.Duration(0), true},
+		{0, 8, time.Duration(0), true},
 	}
 
 	for i, c := range cases {
-		st, et := calcTimeWindowFromHourRange(c.InputStart, c.InputEnd)
+		st, et, err := calcTimeWindowFromHourRange(c.InputStart, c.InputEnd)
 
-		if c.InputStart >= c.InputEnd {
-			if st != nil || et != nil {
-				t.Errorf("calcTimeWindow case %d failed\nwanted et=nil, st=nil\ngot st=%s, et=%s\n", i+1, st, et)
+		if c.WantErr {
+			if err == nil {
+				t.Errorf("calcTimeWindow case %d failed\nwanted error\ngot st=%s, et=%s\n", i+1, st, et)
 			}
 			continue
 		}
+		if err != nil {
+			t.Errorf("calcTimeWindow case %d failed: %s", i+1, err)
+			continue
+		}
 
 		diff := (*et).Sub(*st)
 		if c.ExpectedDiff != diff {
@@ -96,26 +109,28 @@ func TestCalcTimeWindowFromTimeStamp(t *testing.T) {
 		InputStart   string
 		InputEnd     string
 		ExpectedDiff time.Duration
+		WantErr      bool
 	}{
-		{"2017-06-14T01:01:01Z", "2017-06-14T09:01:01Z", time.Duration(8) * time.Hour},
-		{"2017-06-13T23:01:01Z", "2017-06-14T07:01:01Z", time.Duration(8) * time.Hour},
-		{"2017-06-14T09:01:01Z", "2017-06-14T01:01:01Z", time.Duration(0)},
-		{"2017-06-14T01:01:01Z", "2017-06-14T01:01:01Z", time.Duration(0)},
+		{"2017-06-14T01:01:01Z", "2017-06-14T09:01:01Z", time.Duration(8) * time.Hour, false},
+		{"2017-06-13T23:01:01Z", "2017-06-14T07:01:01Z", time.Duration(8) * time.Hour, false},
+		{"2017-06-14T09:01:01Z", "2017-06-14T01:01:01Z", time.Duration(0), true},
+		{"2017-06-14T01:01:01Z", "2017-06-14T01:01:01Z", time.Duration(0), true},
+		{"2017-06-14", "2017-06-14T01:01:01Z", time.Duration(0), true},
 	}
 
 	for i, c := range cases {
-		st, et := calcTimeWindowFromTimeStamp(c.InputStart, c.InputEnd)
-
-		// Sorting two timestamp strings will put the earlier stamp first
-		sorted := []string{c.InputStart, c.InputEnd}
-		sort.Strings(sorted)
+		st, et, err := calcTimeWindowFromTimeStamp(c.InputStart, c.InputEnd)
 
-		if sorted[0] == c.InputEnd {
-			if st != nil || et != nil {
-				t.Errorf("calcTimeWindow case %d failed\nwanted et=nil, st=nil\ngot st=%s, et=%s\n", i+1, st, et)
+		if c.WantErr {
+			if err == nil {
+				t.Errorf("calcTimeWindow case %d failed\nwanted error\ngot st=%s, et=%s\n", i+1, st, et)
 			}
 			continue
 		}
+		if err != nil {
+			t.Errorf("calcTimeWindow case %d failed: %s", i+1, err)
+			continue
+		}
 
 		diff := (*et).Sub(*st)
 		if c.ExpectedDiff != diff {
@@ -156,7 +171,9 @@ func TestParseCloudTrailEvent(t *testing.T) {
 				continue
 			}
 
-			gotStr += parseRawCloudTrailEvent(string(event)) + "\n"
+			for _, r := range parseRawCloudTrailEvent(string(event)) {
+				gotStr += r.Output + "\n"
+			}
 		}
 
 		if string(want) != gotStr {
@@ -165,6 +182,242 @@ func TestParseCloudTrailEvent(t *testing.T) {
 	}
 }
 
+func TestParseRawCloudTrailEventResources(t *testing.T) {
+	viper.Set("tagPatterns", []string{})
+	viper.Set("filterPatterns", []string{})
+
+	event := `{
+		"eventName": "RunInstances",
+		"awsRegion": "us-west-2",
+		"recipientAccountId": "123456789101",
+		"userIdentity": {"arn": "arn:aws:iam::123456789101:user/test-user"},
+		"responseElements": {"instancesSet": {"items": [
+			{
+				"instanceId": "i-1",
+				"networkInterfaceSet": {"items": [{"networkInterfaceId": "eni-1"}, {"networkInterfaceId": "eni-2"}]},
+				"blockDeviceMapping": {}
+			},
+			{
+				"instanceId": "i-2",
+				"networkInterfaceSet": {"items": [{"networkInterfaceId": "eni-3"}]},
+				"blockDeviceMapping": {}
+			}
+		]}}
+	}`
+
+	expected := []struct {
+		Type string
+		Name string
+	}{
+		{"AWS::EC2::Instance", "i-1"},
+		{"AWS::EC2::Instance", "i-2"},
+		{"AWS::EC2::NetworkInterface", "eni-1"},
+		{"AWS::EC2::NetworkInterface", "eni-2"},
+		{"AWS::EC2::NetworkInterface", "eni-3"},
+	}
+
+	outputs := parseRawCloudTrailEvent(event)
+	if len(outputs) != len(expected) {
+		t.Fatalf("parseRawCloudTrailEvent returned %d records, wanted %d:\n%v", len(outputs), len(expected), outputs)
+	}
+	for i, o := range outputs {
+		var out Output
+		if err := json.Unmarshal([]byte(o.Output), &out); err != nil {
+			t.Fatalf("unmarshal record %d: %s", i+1, err)
+		}
+		tm := out.TaggingMetadata
+		if string(tm.ResourceType) != expected[i].Type || string(tm.ResourceName) != expected[i].Name {
+			t.Errorf("parseRawCloudTrailEvent record %d: wanted %s %s, got %s %s", i+1, expected[i].Type, expected[i].Name, tm.ResourceType, tm.ResourceName)
+		}
+	}
+}
+
+func TestParseEvents(t *testing.T) {
+	wd, _ := os.Getwd()
+	viper.Set("tagPatterns", []string{})
+	viper.Set("filterPatterns", []string{})
+
+	logFile, err := ioutil.ReadFile(wd + "/../../testdata/parse/cloudtrail-logfile-input.json")
+	if err != nil {
+		t.Fatal("Failed to open log file:", err)
+	}
+	want, err := ioutil.ReadFile(wd + "/../../testdata/parse/parsed-logfile-output.json")
+	if err != nil {
+		t.Fatal("Failed to open parsed log file:", err)
+	}
+
+	// Newline-delimited events
+	var ndjson bytes.Buffer
+	for _, e := range cloudTrailLogFileEvents.Events {
+		if err := json.Compact(&ndjson, e); err != nil {
+			t.Fatal("Failed to compact event:", err)
+		}
+		ndjson.WriteByte('\n')
+	}
+
+	// Concatenated gzip-compressed log files
+	var gz bytes.Buffer
+	for i := 0; i < 2; i++ {
+		gw := gzip.NewWriter(&gz)
+		gw.Write(logFile)
+		gw.Close()
+	}
+
+	cases := []struct {
+		Input    []byte
+		Expected string
+	}{
+		{logFile, string(want)},
+		{append(append([]byte{}, logFile...), logFile...), string(want) + string(want)},
+		{ndjson.Bytes(), string(want)},
+		{gz.Bytes(), string(want) + string(want)},
+		{[]byte(`{"Records":[]}`), ""},
+		{[]byte(""), ""},
+	}
+
+	for i, c := range cases {
+		var parseErr error
+		f := func(v interface{}) {
+			r, closeFn, err := newLogReader(bytes.NewReader(v.([]byte)))
+			if err != nil {
+				parseErr = err
+				return
+			}
+			defer closeFn()
+			parseErr = parseEvents(r)
+		}
+
+		got := captureStdOut(f, c.Input)
+		if parseErr != nil {
+			t.Errorf("parseEvents case %d failed: %s", i+1, parseErr)
+		}
+		if got != c.Expected {
+			t.Errorf("parseEvents case %d failed\nwanted\n%s\n\ngot\n%s\n", i+1, c.Expected, got)
+		}
+	}
+
+	// Input that is not a log file or event
+	if err := parseEvents(bytes.NewReader([]byte(`["a"]`))); err == nil {
+		t.Error("parseEvents did not fail on an array")
+	}
+
+	// Events in overlapping log files are parsed once. The log file spans hours
+	// of events, unlike a delivered log file, so the window is wider than that.
+	parsedEventIDs = newEventIDWindow(24 * time.Hour)
+	defer func() { parsedEventIDs = nil }()
+	f := func(v interface{}) {
+		parseEvents(bytes.NewReader(v.([]byte)))
+	}
+	if got := captureStdOut(f, append(append([]byte{}, logFile...), logFile...)); got != string(want) {
+		t.Errorf("parseEvents did not de-duplicate events\nwanted\n%s\n\ngot\n%s\n", want, got)
+	}
+}
+
+func TestEventIDWindow(t *testing.T) {
+	base := time.Date(2017, 6, 1, 19, 0, 0, 0, time.UTC)
+	cases := []struct {
+		ID       string
+		Minute   int
+		Expected bool
+		// Held is the number of IDs held after the event is parsed
+		Held int
+	}{
+		{"1", 0, false, 1},
+		{"2", 5, false, 2},
+		{"1", 10, true, 2},
+		// Events are delivered out of order within the window
+		{"3", 2, false, 3},
+		// IDs of events older than the window are pruned
+		{"4", 16, false, 3},
+		{"5", 40, false, 1},
+		// Pruned events are parsed again
+		{"1", 0, false, 2},
+	}
+
+	w := newEventIDWindow(15 * time.Minute)
+	for i, c := range cases {
+		at := base.Add(time.Duration(c.Minute) * time.Minute)
+		if got := w.seen(c.ID, at); got != c.Expected {
+			t.Errorf("eventIDWindow case %d: wanted seen %t, got %t", i+1, c.Expected, got)
+		}
+		if len(w.ids) != c.Held {
+			t.Errorf("eventIDWindow case %d: wanted %d IDs held, got %d", i+1, c.Held, len(w.ids))
+		}
+	}
+}
+
+func TestExpandLogFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grafiti-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{
+		"2017/06/02/123456789101_CloudTrail_us-west-2_20170602T0005Z_a.json.gz",
+		"2017/06/01/123456789101_CloudTrail_us-west-2_20170601T1905Z_b.json.gz",
+		"2017/06/01/123456789101_CloudTrail_us-east-1_20170601T1900Z_c.json",
+		"2017/06/01/notes.txt",
+		"other/events.json",
+	}
+	for _, f := range files {
+		p := filepath.Join(dir, f)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Files without a log file name are ordered by modification time
+	old := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(dir, "other/events.json"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		Input    []string
+		Expected []string
+		WantErr  bool
+	}{
+		{
+			Input:    []string{dir},
+			Expected: []string{files[4], files[2], files[1], files[0]},
+		},
+		{
+			Input:    []string{filepath.Join(dir, "2017/06/01/*"), filepath.Join(dir, "2017/06/02")},
+			Expected: []string{files[2], files[1], files[0], files[3]},
+		},
+		{
+			Input:    []string{filepath.Join(dir, "2017/06/02/*.json.gz"), filepath.Join(dir, "other/events.json")},
+			Expected: []string{files[4], files[0]},
+		},
+		{
+			Input:   []string{filepath.Join(dir, "*.csv")},
+			WantErr: true,
+		},
+		{
+			Input:   []string{filepath.Join(dir, "missing.json")},
+			WantErr: true,
+		},
+	}
+
+	for i, c := range cases {
+		got, err := expandLogFiles(c.Input)
+		if (err != nil) != c.WantErr {
+			t.Errorf("expandLogFiles case %d: wanted error %t, got %v", i+1, c.WantErr, err)
+			continue
+		}
+		var want []string
+		for _, f := range c.Expected {
+			want = append(want, filepath.Join(dir, f))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expandLogFiles case %d failed\nwanted: %v\ngot: %v", i+1, want, got)
+		}
+	}
+}
+
 // Set stdout to pipe and capture printed output of a Print event
 func captureStdOut(f func(interface{}), v interface{}) string {
 	oldStdOut := os.Stdout
@@ -243,7 +496,8 @@ func TestGetTags(t *testing.T) {
 	}
 
 	for _, e := range cloudTrailAPIEvents.Events {
-		te := getTags(aws.StringValue(e.CloudTrailEvent))
+		raw := aws.StringValue(e.CloudTrailEvent)
+		te := getTags(raw, &TaggingMetadata{Owner: resolveOwner(gjson.Parse(raw))})
 		if te != nil && !reflect.DeepEqual(te, mockTags) {
 			t.Errorf("getTags failed\nwanted:\n%s,\n\ngot:\n%s\n\n", mockTags, te)
 		}
@@ -294,3 +548,127 @@ func TestMatchFilter(t *testing.T) {
 	}
 
 }
+
+// mockLookupEvents serves LookupEvents requests from Events, which are sorted
+// from newest to oldest, in pages of 2. Requests fail once FailAt requests
+// have been made, if set.
+type mockLookupEvents struct {
+	cloudtrailiface.CloudTrailAPI
+	Events   []*cloudtrail.Event
+	FailAt   int
+	requests int
+}
+
+func (m *mockLookupEvents) LookupEventsWithContext(ctx aws.Context, in *cloudtrail.LookupEventsInput, opts ...request.Option) (*cloudtrail.LookupEventsOutput, error) {
+	m.requests++
+	if m.FailAt != 0 && m.requests >= m.FailAt {
+		return nil, fmt.Errorf("request %d failed", m.requests)
+	}
+
+	var matched []*cloudtrail.Event
+	for _, e := range m.Events {
+		if !e.EventTime.Before(*in.StartTime) && !e.EventTime.After(*in.EndTime) {
+			matched = append(matched, e)
+		}
+	}
+	start, _ := strconv.Atoi(aws.StringValue(in.NextToken))
+	out := &cloudtrail.LookupEventsOutput{}
+	for i := start; i < len(matched) && i < start+2; i++ {
+		out.Events = append(out.Events, matched[i])
+	}
+	if start+2 < len(matched) {
+		out.NextToken = aws.String(strconv.Itoa(start + 2))
+	}
+	return out, nil
+}
+
+func TestParseLookupAttributeCheckpoint(t *testing.T) {
+	viper.Set("tagPatterns", []string{})
+	viper.Set("filterPatterns", []string{})
+	viper.Set("includeEvent", false)
+
+	dir, err := ioutil.TempDir("", "grafiti-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	viper.Set("stateFile", filepath.Join(dir, "state.json"))
+	defer viper.Set("stateFile", "")
+
+	base := time.Date(2017, 6, 1, 19, 0, 0, 0, time.UTC)
+	newEvent := func(id string, minute int) *cloudtrail.Event {
+		eventTime := base.Add(time.Duration(minute) * time.Minute)
+		return &cloudtrail.Event{
+			EventId:         aws.String(id),
+			EventName:       aws.String("RunInstances"),
+			EventTime:       aws.Time(eventTime),
+			CloudTrailEvent: aws.String(newTestLifecycleEvent("RunInstances", eventTime.Format(time.RFC3339), `"requestParameters": null`)),
+			Resources: []*cloudtrail.Resource{
+				{ResourceName: aws.String("i-" + id), ResourceType: aws.String("AWS::EC2::Instance")},
+			},
+		}
+	}
+	first := []*cloudtrail.Event{newEvent("5", 5), newEvent("4", 4), newEvent("3", 3), newEvent("2", 2), newEvent("1", 1)}
+	// Events arriving after the first run, one at the time the first run ended
+	later := append([]*cloudtrail.Event{newEvent("7", 7), newEvent("6", 5)}, first...)
+	tracked := append([]*cloudtrail.Event{newEvent("10", 10), newEvent("9", 9), newEvent("8", 8)}, later...)
+
+	cases := []struct {
+		Events   []*cloudtrail.Event
+		FailAt   int
+		End      int
+		Expected []string
+		WantErr  bool
+		// Tracked runs hold output until parsing ends, like runParseCommand
+		Tracked bool
+	}{
+		// A failed run prints its first page and saves its position
+		{first, 2, 10, []string{"i-5", "i-4"}, true, false},
+		// The failed run resumes from its last page
+		{first, 0, 10, []string{"i-3", "i-2", "i-1"}, false, false},
+		// The next run continues from the latest event of the last run
+		{later, 0, 10, []string{"i-7", "i-6"}, false, false},
+		{later, 0, 10, nil, false, false},
+		// Runs tracking deletions print held output and save their position
+		// together when they fail, and resume from their last page
+		{tracked, 2, 20, []string{"i-10", "i-9"}, true, true},
+		{tracked, 0, 20, []string{"i-8"}, false, true},
+	}
+
+	start := aws.Time(base)
+	for i, c := range cases {
+		st, err := loadState()
+		if err != nil {
+			t.Fatalf("parseLookupAttribute case %d: %s", i+1, err)
+		}
+		cp := st.lookupCheckpoint("123456789101/us-west-2/AWS::EC2::Instance")
+		svc := &mockLookupEvents{Events: c.Events, FailAt: c.FailAt}
+		end := aws.Time(base.Add(time.Duration(c.End) * time.Minute))
+
+		var parseErr error
+		f := func(interface{}) {
+			if c.Tracked {
+				lifecycle = &lifecycleTracker{deleted: make(map[string]time.Time)}
+				defer func() { lifecycle = nil }()
+			}
+			parseErr = parseLookupAttribute(svc, nil, start, end, cp, st)
+			if lifecycle != nil {
+				if err := lifecycle.flush(); err != nil {
+					t.Errorf("parseLookupAttribute case %d: flush: %s", i+1, err)
+				}
+			}
+		}
+		out := captureStdOut(f, nil)
+		if (parseErr != nil) != c.WantErr {
+			t.Errorf("parseLookupAttribute case %d: wanted error %t, got %v", i+1, c.WantErr, parseErr)
+		}
+
+		var got []string
+		for _, r := range decodeLifecycleRecords(t, out) {
+			got = append(got, r.Name)
+		}
+		if !reflect.DeepEqual(got, c.Expected) {
+			t.Errorf("parseLookupAttribute case %d failed\nwanted: %v\ngot: %v", i+1, c.Expected, got)
+		}
+	}
+}
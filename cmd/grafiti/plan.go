@@ -0,0 +1,302 @@
+// Copyright © 2017 grafiti authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	rgta "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/coreos/grafiti/arn"
+	"github.com/coreos/grafiti/graph"
+	"github.com/spf13/cobra"
+)
+
+var (
+	planTagFile     string
+	planOutFile     string
+	planTimeFilters []string
+)
+
+// PlanVersion is the version of the plan file format written by `grafiti plan`
+const PlanVersion = 1
+
+// Reasons a resource is included in a plan
+const (
+	// PlanReasonTagged resources matched a tag in the delete file
+	PlanReasonTagged = "tagged"
+	// PlanReasonDependency resources were discovered as a dependency of another
+	// resource in the plan
+	PlanReasonDependency = "dependency"
+)
+
+// Plan holds every resource `grafiti apply` will delete, in deletion order
+type Plan struct {
+	Version   int
+	CreatedAt time.Time
+	Resources []PlanResource
+}
+
+// PlanResourceRef references a resource in a Plan
+type PlanResourceRef struct {
+	ResourceType arn.ResourceType
+	ResourceName arn.ResourceName
+}
+
+// PlanResource describes a resource in a Plan and why it was included
+type PlanResource struct {
+	ResourceType arn.ResourceType
+	ResourceName arn.ResourceName
+	ResourceARN  arn.ResourceARN `json:",omitempty"`
+	Reason       string
+	// DiscoveredFrom holds the resources this resource was discovered from, if
+	// Reason is PlanReasonDependency
+	DiscoveredFrom []PlanResourceRef `json:",omitempty"`
+	// AccountID and Region are the account and region this resource is deleted
+	// in. Resources discovered from each other are in the same account and
+	// region
+	AccountID string `json:",omitempty"`
+	Region    string `json:",omitempty"`
+	// VPCID is the VPC this resource belongs to, if known
+	VPCID string `json:",omitempty"`
+	// Position is the index of this resource in deletion order
+	Position int
+	// Level is the number of deletion steps that must complete before this
+	// resource is deleted. Resources of the same level may be deleted
+	// concurrently
+	Level int
+}
+
+func init() {
+	RootCmd.AddCommand(planCmd)
+	planCmd.PersistentFlags().StringVarP(&planTagFile, "delete-file", "f", "", "File of tags of resources to plan deletion of.")
+	planCmd.PersistentFlags().StringVarP(&planOutFile, "output", "o", "", "File to write the plan to (default: stdout).")
+	planCmd.PersistentFlags().BoolVar(&delAllDeps, "all-deps", false, "Include all dependencies of all tagged resources.")
+	planCmd.PersistentFlags().StringSliceVar(&planTimeFilters, "time-filter", nil, "Only include resources with a time tag before ('Key<time') or after ('Key>time') a time, ex. 'ExpiresAt<now'. Applies to every delete file entry.")
+}
+
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Plan deletion of resources in AWS by tag.",
+	Long: `Resolve tags specified in 'delete-file' and write every resource that would be deleted, and the order of deletion, to a plan file.
+Pass the plan file to 'grafiti apply' to delete exactly the resources in the plan.`,
+	RunE:          runPlanCommand,
+	SilenceErrors: true,
+	SilenceUsage:  true,
+}
+
+func runPlanCommand(cmd *cobra.Command, args []string) error {
+	var reader io.Reader = os.Stdin
+	// Same data as that in planTagFile may be passed by stdin.
+	if planTagFile != "" {
+		file, err := os.Open(planTagFile)
+		if err != nil {
+			return fmt.Errorf("plan: open delete file: %s", err)
+		}
+		defer file.Close()
+		reader = bufio.NewReader(file)
+	}
+
+	tfs, err := parseTimeFilterFlags(planTimeFilters)
+	if err != nil {
+		return fmt.Errorf("plan: %s", err)
+	}
+
+	// Tags are resolved again in every account and region
+	tagFile, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return fmt.Errorf("plan: read delete file: %s", err)
+	}
+
+	p := newPlan()
+	err = forEachAccountRegion(func() error {
+		rs, err := getResourcesForTagFile(rgta.New(newAWSSession()), bytes.NewReader(tagFile), tfs)
+		if err != nil {
+			return err
+		}
+
+		arns := rs.ARNs()
+		return p.addGraph(accountID, region, buildGraph(arns), arns)
+	})
+	if err != nil {
+		return fmt.Errorf("plan: %s", err)
+	}
+
+	pj, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("plan: marshal plan: %s", err)
+	}
+
+	if planOutFile == "" {
+		fmt.Println(string(pj))
+		return nil
+	}
+
+	f, err := os.OpenFile(planOutFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("plan: open output file: %s", err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, string(pj)); err != nil {
+		return fmt.Errorf("plan: write output file: %s", err)
+	}
+
+	return nil
+}
+
+// newPlan creates an empty Plan.
+func newPlan() *Plan {
+	return &Plan{
+		Version:   PlanVersion,
+		CreatedAt: time.Now().UTC(),
+		Resources: make([]PlanResource, 0),
+	}
+}
+
+// addGraph appends all resources in g, which were found in account and region,
+// to p in deletion order. ARNs of tagged resources are looked up in arns.
+// Global resources already in p are not added again.
+func (p *Plan) addGraph(account, region string, g *graph.Graph, arns arn.ResourceARNs) error {
+	batches, err := g.Batches()
+	if err != nil {
+		return err
+	}
+
+	arnMap := make(map[PlanResourceRef]arn.ResourceARN, len(arns))
+	for _, a := range arns {
+		rt, rn := arn.MapARNToRTypeAndRName(a)
+		arnMap[PlanResourceRef{rt, rn}] = a
+	}
+
+	// Global resources may have been planned in a previous region
+	planned := make(map[*graph.Node]bool, g.Len())
+	for _, b := range batches {
+		for _, n := range claimNodes(b.Nodes) {
+			planned[n] = true
+		}
+	}
+
+	for _, b := range batches {
+		for _, n := range b.Nodes {
+			if !planned[n] {
+				continue
+			}
+			ref := PlanResourceRef{n.Type, n.Name}
+			r := PlanResource{
+				ResourceType: n.Type,
+				ResourceName: n.Name,
+				ResourceARN:  arnMap[ref],
+				Reason:       PlanReasonTagged,
+				AccountID:    account,
+				Region:       region,
+				VPCID:        n.Scope,
+				Position:     len(p.Resources),
+				Level:        b.Level,
+			}
+			// Resources both tagged and discovered are included because they are
+			// tagged
+			if _, ok := arnMap[ref]; !ok && len(n.DiscoveredFrom) > 0 {
+				r.Reason = PlanReasonDependency
+			}
+			for _, parent := range n.DiscoveredFrom {
+				if planned[parent] {
+					r.DiscoveredFrom = append(r.DiscoveredFrom, PlanResourceRef{parent.Type, parent.Name})
+				}
+			}
+			p.Resources = append(p.Resources, r)
+		}
+	}
+
+	return nil
+}
+
+// planTarget is an account and region resources in a Plan are deleted in
+type planTarget struct {
+	AccountID string
+	Region    string
+}
+
+func (t planTarget) String() string {
+	var parts []string
+	if t.AccountID != "" {
+		parts = append(parts, "account "+t.AccountID)
+	}
+	if t.Region != "" {
+		parts = append(parts, "region "+t.Region)
+	}
+	return strings.Join(parts, ": ")
+}
+
+// targetGraph is the dependency graph of all resources of a Plan in an account
+// and region
+type targetGraph struct {
+	planTarget
+	Graph *graph.Graph
+}
+
+// Graphs validates p and rebuilds the dependency graph of resources in each
+// account and region of p, in order of first appearance. No resources outside
+// of p are added to the graphs.
+func (p *Plan) Graphs() ([]*targetGraph, error) {
+	if p.Version != PlanVersion {
+		return nil, fmt.Errorf("unsupported plan version %d", p.Version)
+	}
+
+	var tgs []*targetGraph
+	byTarget := make(map[planTarget]*graph.Graph)
+	for i, r := range p.Resources {
+		if r.ResourceType == "" || r.ResourceName == "" {
+			return nil, fmt.Errorf("resource %d: type and name are required", i)
+		}
+		t := planTarget{r.AccountID, r.Region}
+		g, ok := byTarget[t]
+		if !ok {
+			g = graph.NewGraph()
+			byTarget[t] = g
+			tgs = append(tgs, &targetGraph{t, g})
+		}
+		if g.Node(r.ResourceType, r.ResourceName) != nil {
+			return nil, fmt.Errorf("resource %d: duplicate resource %s %s", i, r.ResourceType, r.ResourceName)
+		}
+		g.AddNode(r.ResourceType, r.ResourceName)
+	}
+
+	for _, r := range p.Resources {
+		g := byTarget[planTarget{r.AccountID, r.Region}]
+		child := g.Node(r.ResourceType, r.ResourceName)
+		for _, ref := range r.DiscoveredFrom {
+			parent := g.Node(ref.ResourceType, ref.ResourceName)
+			if parent == nil {
+				return nil, fmt.Errorf("%s %s discovered from %s %s, which is not in the plan in the same account and region", r.ResourceType, r.ResourceName, ref.ResourceType, ref.ResourceName)
+			}
+			g.AddEdge(parent, child)
+		}
+	}
+
+	// Restore scopes after all edges are added so inherited scopes match the
+	// plan exactly
+	for _, r := range p.Resources {
+		byTarget[planTarget{r.AccountID, r.Region}].Node(r.ResourceType, r.ResourceName).Scope = r.VPCID
+	}
+
+	return tgs, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/coreos/grafiti/arn"
+	"github.com/coreos/grafiti/graph"
+)
+
+func TestNewPlan(t *testing.T) {
+	g := graph.NewGraph()
+	vpc := g.AddNode(arn.EC2VPCRType, "vpc-1")
+	subnet := g.AddNode(arn.EC2SubnetRType, "subnet-1")
+	g.AddEdge(vpc, subnet)
+	g.AddEdge(vpc, g.AddNode(arn.EC2InstanceRType, "i-1"))
+
+	arns := arn.ResourceARNs{
+		"arn:aws:ec2:us-west-2:123456789101:vpc/vpc-1",
+		"arn:aws:ec2:us-west-2:123456789101:subnet/subnet-1",
+	}
+	p := newPlan()
+	if err := p.addGraph("123456789101", "us-west-2", g, arns); err != nil {
+		t.Fatalf("Plan.addGraph failed: %s", err)
+	}
+
+	vpcRef := []PlanResourceRef{{arn.EC2VPCRType, "vpc-1"}}
+	expected := []PlanResource{
+		{
+			ResourceType:   arn.EC2InstanceRType,
+			ResourceName:   "i-1",
+			Reason:         PlanReasonDependency,
+			DiscoveredFrom: vpcRef,
+			AccountID:      "123456789101",
+			Region:         "us-west-2",
+			VPCID:          "vpc-1",
+			Position:       0,
+			Level:          0,
+		},
+		{
+			ResourceType:   arn.EC2SubnetRType,
+			ResourceName:   "subnet-1",
+			ResourceARN:    arns[1],
+			Reason:         PlanReasonTagged,
+			DiscoveredFrom: vpcRef,
+			AccountID:      "123456789101",
+			Region:         "us-west-2",
+			VPCID:          "vpc-1",
+			Position:       1,
+			Level:          1,
+		},
+		{
+			ResourceType: arn.EC2VPCRType,
+			ResourceName: "vpc-1",
+			ResourceARN:  arns[0],
+			Reason:       PlanReasonTagged,
+			AccountID:    "123456789101",
+			Region:       "us-west-2",
+			VPCID:        "vpc-1",
+			Position:     2,
+			Level:        2,
+		},
+	}
+	if !reflect.DeepEqual(p.Resources, expected) {
+		t.Errorf("newPlan failed\nwanted\n%+v\ngot\n%+v\n", expected, p.Resources)
+	}
+
+	// A plan must rebuild the graph it was created from
+	tgs, err := p.Graphs()
+	if err != nil {
+		t.Fatalf("Plan.Graphs failed: %s", err)
+	}
+	if len(tgs) != 1 || tgs[0].AccountID != "123456789101" || tgs[0].Region != "us-west-2" {
+		t.Fatalf("Plan.Graphs failed: wanted one graph in us-west-2 of account 123456789101, got %v", tgs)
+	}
+	rp := newPlan()
+	if err := rp.addGraph(tgs[0].AccountID, tgs[0].Region, tgs[0].Graph, arns); err != nil {
+		t.Fatalf("Plan.addGraph failed: %s", err)
+	}
+	if !reflect.DeepEqual(rp.Resources, expected) {
+		t.Errorf("Plan.Graphs failed\nwanted\n%+v\ngot\n%+v\n", expected, rp.Resources)
+	}
+}
+
+func TestPlanGraphsInvalid(t *testing.T) {
+	instance := PlanResource{ResourceType: arn.EC2InstanceRType, ResourceName: "i-1"}
+	cases := []Plan{
+		// Unsupported version
+		{Version: PlanVersion + 1},
+		// Missing resource name
+		{Version: PlanVersion, Resources: []PlanResource{{ResourceType: arn.EC2InstanceRType}}},
+		// Duplicate resource
+		{Version: PlanVersion, Resources: []PlanResource{instance, instance}},
+		// Discovered from a resource not in the plan
+		{
+			Version: PlanVersion,
+			Resources: []PlanResource{
+				{
+					ResourceType:   arn.EC2SubnetRType,
+					ResourceName:   "subnet-1",
+					DiscoveredFrom: []PlanResourceRef{{arn.EC2VPCRType, "vpc-1"}},
+				},
+			},
+		},
+		// Discovered from a resource in another region
+		{
+			Version: PlanVersion,
+			Resources: []PlanResource{
+				{ResourceType: arn.EC2VPCRType, ResourceName: "vpc-1", Region: "us-west-2"},
+				{
+					ResourceType:   arn.EC2SubnetRType,
+					ResourceName:   "subnet-1",
+					Region:         "eu-west-1",
+					DiscoveredFrom: []PlanResourceRef{{arn.EC2VPCRType, "vpc-1"}},
+				},
+			},
+		},
+	}
+
+	for i, c := range cases {
+		if _, err := c.Graphs(); err == nil {
+			t.Errorf("case %d: Plan.Graphs failed: expected error", i)
+		}
+	}
+}
+
+func TestPlanRegions(t *testing.T) {
+	// Global resources are planned in the first region they are found in
+	west := graph.NewGraph()
+	westLC := west.AddNode(arn.AutoScalingLaunchConfigurationRType, "lc-1")
+	west.AddEdge(westLC, west.AddNode(arn.IAMInstanceProfileRType, "plan-regions-profile"))
+	east := graph.NewGraph()
+	eastLC := east.AddNode(arn.AutoScalingLaunchConfigurationRType, "lc-1")
+	east.AddEdge(eastLC, east.AddNode(arn.IAMInstanceProfileRType, "plan-regions-profile"))
+
+	p := newPlan()
+	for _, c := range []struct {
+		Region string
+		Graph  *graph.Graph
+	}{{"us-west-2", west}, {"us-east-1", east}} {
+		if err := p.addGraph("", c.Region, c.Graph, nil); err != nil {
+			t.Fatalf("Plan.addGraph failed: %s", err)
+		}
+	}
+
+	lcRef := []PlanResourceRef{{arn.AutoScalingLaunchConfigurationRType, "lc-1"}}
+	expected := []PlanResource{
+		{ResourceType: arn.AutoScalingLaunchConfigurationRType, ResourceName: "lc-1", Reason: PlanReasonTagged, Region: "us-west-2", Position: 0, Level: 0},
+		{ResourceType: arn.IAMInstanceProfileRType, ResourceName: "plan-regions-profile", Reason: PlanReasonDependency, DiscoveredFrom: lcRef, Region: "us-west-2", Position: 1, Level: 1},
+		{ResourceType: arn.AutoScalingLaunchConfigurationRType, ResourceName: "lc-1", Reason: PlanReasonTagged, Region: "us-east-1", Position: 2, Level: 0},
+	}
+	if !reflect.DeepEqual(p.Resources, expected) {
+		t.Errorf("Plan.addGraph failed\nwanted\n%+v\ngot\n%+v\n", expected, p.Resources)
+	}
+
+	tgs, err := p.Graphs()
+	if err != nil {
+		t.Fatalf("Plan.Graphs failed: %s", err)
+	}
+	if len(tgs) != 2 || tgs[0].Region != "us-west-2" || tgs[0].Graph.Len() != 2 || tgs[1].Region != "us-east-1" || tgs[1].Graph.Len() != 1 {
+		t.Errorf("Plan.Graphs failed: unexpected graphs %v", tgs)
+	}
+}
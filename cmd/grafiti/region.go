@@ -0,0 +1,165 @@
+// Copyright © 2017 grafiti authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/coreos/grafiti/arn"
+	"github.com/coreos/grafiti/deleter"
+	"github.com/coreos/grafiti/graph"
+	"github.com/spf13/viper"
+)
+
+// allRegions is the 'regions' config value selecting every region enabled for
+// an account
+const allRegions = "all"
+
+var (
+	// region is the AWS region commands currently run in. An empty region is
+	// the region configured in the environment.
+	region string
+	// inGlobalRegion is set if resources of global services, ex. IAM, are looked
+	// up in region. Global resources are looked up in the first region only.
+	inGlobalRegion = true
+)
+
+// awsConfig creates a session config using creds in region r. The
+// environment's credentials and region are used if creds is nil or r is empty.
+func awsConfig(creds *credentials.Credentials, r string) *aws.Config {
+	cfg := &aws.Config{Credentials: creds}
+	if r != "" {
+		cfg.Region = aws.String(r)
+	}
+	return cfg
+}
+
+// getRegions reads regions from the 'regions' config field, which is either a
+// list of regions or "all". Regions are requested from EC2 if "all" is set.
+func getRegions() ([]string, error) {
+	var regions []string
+	// Regions set by environment variable are comma-separated
+	for _, rs := range viper.GetStringSlice("regions") {
+		for _, r := range strings.Split(rs, ",") {
+			if r = strings.TrimSpace(r); r != "" {
+				regions = append(regions, r)
+			}
+		}
+	}
+
+	for _, r := range regions {
+		if r == allRegions {
+			return requestAllRegions(ec2.New(newAWSSessionWith(accountCreds, "")))
+		}
+	}
+	return regions, nil
+}
+
+// requestAllRegions requests the names of all regions enabled for an account.
+func requestAllRegions(svc ec2iface.EC2API) ([]string, error) {
+	ctx := aws.BackgroundContext()
+	resp, err := svc.DescribeRegionsWithContext(ctx, &ec2.DescribeRegionsInput{})
+	if err != nil {
+		return nil, fmt.Errorf("ec2: describe regions: %s", err)
+	}
+
+	regions := make([]string, 0, len(resp.Regions))
+	for _, r := range resp.Regions {
+		if name := aws.StringValue(r.RegionName); name != "" {
+			regions = append(regions, name)
+		}
+	}
+	sort.Strings(regions)
+	return regions, nil
+}
+
+// forEachRegion runs f in each configured region in order, stopping at the
+// first error. If no regions are configured, f runs once in the environment's
+// region.
+func forEachRegion(f func() error) error {
+	regions, err := getRegions()
+	if err != nil {
+		return err
+	}
+	if len(regions) == 0 {
+		// Resolve the environment's region so output and logs can carry it
+		sess, err := session.NewSession()
+		if err != nil {
+			return fmt.Errorf("create session: %s", err)
+		}
+		return inRegion(aws.StringValue(sess.Config.Region), true, f)
+	}
+
+	for i, r := range regions {
+		if err := inRegion(r, i == 0, f); err != nil {
+			return fmt.Errorf("region %s: %s", r, err)
+		}
+	}
+	return nil
+}
+
+// inRegion runs f in region r. Global resources are only looked up if global
+// is set.
+func inRegion(r string, global bool, f func() error) error {
+	region, inGlobalRegion = r, global
+	deleter.SetSessionConfig(awsConfig(accountCreds, r))
+	defer func() {
+		region, inGlobalRegion = "", true
+		deleter.SetSessionConfig(nil)
+	}()
+
+	logger.Debugf("running in region %q", r)
+	return f()
+}
+
+type globalResourceKey struct {
+	AccountID string
+	resourceKey
+}
+
+// globalResources holds all resources of global services handled in any
+// region of an account, so they are handled exactly once.
+var globalResources = struct {
+	sync.Mutex
+	seen map[globalResourceKey]bool
+}{seen: make(map[globalResourceKey]bool)}
+
+// claimNodes removes nodes of global resources handled in a previous region of
+// the current account from nodes, and claims the rest.
+func claimNodes(nodes []*graph.Node) []*graph.Node {
+	globalResources.Lock()
+	defer globalResources.Unlock()
+
+	claimed := make([]*graph.Node, 0, len(nodes))
+	for _, n := range nodes {
+		if arn.IsGlobalResourceType(n.Type) {
+			k := globalResourceKey{accountID, resourceKey{n.Type, n.Name}}
+			if globalResources.seen[k] {
+				continue
+			}
+			globalResources.seen[k] = true
+		}
+		claimed = append(claimed, n)
+	}
+	return claimed
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/coreos/grafiti/arn"
+	"github.com/coreos/grafiti/graph"
+	"github.com/spf13/viper"
+)
+
+type mockEC2DescribeRegions struct {
+	ec2iface.EC2API
+	Resp ec2.DescribeRegionsOutput
+}
+
+func (m *mockEC2DescribeRegions) DescribeRegionsWithContext(ctx aws.Context, in *ec2.DescribeRegionsInput, os ...request.Option) (*ec2.DescribeRegionsOutput, error) {
+	return &m.Resp, nil
+}
+
+func TestGetRegions(t *testing.T) {
+	defer viper.Set("regions", nil)
+
+	cases := []struct {
+		Input    interface{}
+		Expected []string
+	}{
+		{nil, nil},
+		{[]string{"us-east-1", "us-west-2"}, []string{"us-east-1", "us-west-2"}},
+		// Set by environment variable
+		{"us-east-1, us-west-2,eu-west-1", []string{"us-east-1", "us-west-2", "eu-west-1"}},
+	}
+
+	for i, c := range cases {
+		viper.Set("regions", c.Input)
+		got, err := getRegions()
+		if err != nil {
+			t.Fatalf("case %d: getRegions failed: %s", i, err)
+		}
+		if !reflect.DeepEqual(got, c.Expected) {
+			t.Errorf("case %d: getRegions failed\nwanted %v\ngot %v\n", i, c.Expected, got)
+		}
+	}
+}
+
+func TestRequestAllRegions(t *testing.T) {
+	svc := &mockEC2DescribeRegions{
+		Resp: ec2.DescribeRegionsOutput{
+			Regions: []*ec2.Region{
+				{RegionName: aws.String("us-west-2")},
+				{RegionName: aws.String("eu-west-1")},
+				{RegionName: aws.String("us-east-1")},
+			},
+		},
+	}
+
+	expected := []string{"eu-west-1", "us-east-1", "us-west-2"}
+	got, err := requestAllRegions(svc)
+	if err != nil {
+		t.Fatalf("requestAllRegions failed: %s", err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("requestAllRegions failed\nwanted %v\ngot %v\n", expected, got)
+	}
+}
+
+func TestClaimNodes(t *testing.T) {
+	first, second := graph.NewGraph(), graph.NewGraph()
+	for _, g := range []*graph.Graph{first, second} {
+		g.AddNode(arn.EC2InstanceRType, "i-1")
+		g.AddNode(arn.IAMRoleRType, "claim-nodes-role")
+	}
+
+	if got := claimNodes(first.Nodes()); !reflect.DeepEqual(got, first.Nodes()) {
+		t.Errorf("claimNodes failed: wanted all nodes of the first region, got %v", got)
+	}
+	// The role was claimed in the first region
+	expected := second.Nodes()[:1]
+	if got := claimNodes(second.Nodes()); !reflect.DeepEqual(got, expected) {
+		t.Errorf("claimNodes failed\nwanted %v\ngot %v\n", expected, got)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright © 2017 grafiti authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	rgta "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/coreos/grafiti/arn"
+	"github.com/coreos/grafiti/deleter"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	retagFile        string
+	retagKey         string
+	retagBy          string
+	retagTimeFilters []string
+)
+
+func init() {
+	RootCmd.AddCommand(retagCmd)
+	retagCmd.PersistentFlags().StringVarP(&retagFile, "retag-file", "f", "", "File of tags of resources to retag. Format is that of 'grafiti delete' input.")
+	retagCmd.PersistentFlags().StringVarP(&retagKey, "key", "k", "", "Key of the date tag to shift. Defaults to the 'notify.expiryTagKey' config field.")
+	retagCmd.PersistentFlags().StringVar(&retagBy, "by", "", "Duration to shift dates by, ex. '7d', '2w' or '-12h'. Takes Go duration units plus 'd' (days) and 'w' (weeks).")
+	retagCmd.PersistentFlags().StringSliceVar(&retagTimeFilters, "time-filter", nil, "Only retag resources with a time tag before ('Key<time') or after ('Key>time') a time, ex. 'ExpiresAt<now+1d'. Applies to every retag file entry.")
+}
+
+var retagCmd = &cobra.Command{
+	Use:           "retag",
+	Aliases:       []string{"extend"},
+	Short:         "Shift date tags of resources in AWS.",
+	Long:          "Shift the date in the tag with key 'key' of resources with tags specified in 'retag-file' by 'by', ex. '--by 7d' extends their expiry by a week.",
+	RunE:          runRetagCommand,
+	SilenceErrors: true,
+	SilenceUsage:  true,
+}
+
+func runRetagCommand(cmd *cobra.Command, args []string) error {
+	if retagBy == "" {
+		return fmt.Errorf("retag: no duration, set --by")
+	}
+	d, err := parseDuration(retagBy)
+	if err != nil {
+		return fmt.Errorf("retag: %s", err)
+	}
+	key := retagKey
+	if key == "" {
+		key = viper.GetString("notify.expiryTagKey")
+	}
+
+	// Shifted dates are requested explicitly, so they always replace existing
+	// dates
+	tagMergePolicies = mergePolicies{}
+
+	input, err := readTagFileInput(retagFile)
+	if err != nil {
+		return fmt.Errorf("retag: %s", err)
+	}
+	if err := retagFromTags(input, key, d); err != nil {
+		return fmt.Errorf("retag: %s", err)
+	}
+	return nil
+}
+
+// retagFromTags shifts the date in tag key by d of resources with tags encoded
+// in input, in every account and region.
+func retagFromTags(input []byte, key string, d time.Duration) error {
+	tfs, err := parseTimeFilterFlags(retagTimeFilters)
+	if err != nil {
+		return err
+	}
+
+	var failures []tagFailure
+	err = forEachAccountRegion(func() error {
+		rs, err := getResourcesForTagFile(rgta.New(newAWSSession()), bytes.NewReader(input), tfs)
+		if err != nil {
+			return err
+		}
+
+		fs, err := retagResources(rs, key, d)
+		failures = append(failures, fs...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if !ignoreErrors {
+		return tagFailuresError(failures, "retagged")
+	}
+	return nil
+}
+
+// retagResources shifts the date in tag key by d of each resource in rs that
+// has the tag. Resources whose tag is not a date are skipped. Resources the
+// RGTA failed to tag are logged and returned.
+func retagResources(rs taggedResources, key string, d time.Duration) ([]tagFailure, error) {
+	sess := newAWSSession()
+
+	// Resources with the same shifted date are tagged in one request
+	b := NewARNSetBucket()
+	for _, r := range rs {
+		tags, err := shiftTags(r.Tags, key, d)
+		if err != nil {
+			logger.Infof("retag: skipping %s: %s", r.ARN, err)
+			continue
+		}
+		if len(tags) == 0 {
+			continue
+		}
+
+		rt, rn := arn.MapARNToRTypeAndRName(r.ARN)
+		if _, ok := arn.RGTAUnsupportedResourceTypes[rt]; !ok {
+			b.AddARNToBuckets(r.ARN, tags)
+			continue
+		}
+
+		switch arn.NamespaceForResource(rt) {
+		case arn.AutoScalingNamespace:
+			err = tagAutoScalingResources(autoscaling.New(sess), rt, rn, tags)
+		case arn.Route53Namespace:
+			err = tagRoute53Resource(route53.New(sess), rt, rn, tags)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	svc := rgta.New(sess)
+	var failures []tagFailure
+	for _, set := range b {
+		// Buckets are not ejected as they fill, so they may hold more than 20
+		// ARNs
+		arns := set.ToARNList()
+		size := len(arns)
+		for i := 0; i < size; i += maxRGTAResources {
+			stop := deleter.CalcChunk(i, size, maxRGTAResources)
+			fs, err := tagARNBucket(svc, arns[i:stop], set.Tags)
+			if err != nil {
+				return nil, err
+			}
+			failures = append(failures, fs...)
+		}
+	}
+	return failures, nil
+}
+
+// shiftTags returns a tag with key whose value is the date in tags[key]
+// shifted by d, or no tags if tags does not have key.
+func shiftTags(tags map[string]string, key string, d time.Duration) (Tags, error) {
+	v, ok := tags[key]
+	if !ok {
+		return nil, nil
+	}
+	shifted, err := shiftTagTime(v, d)
+	if err != nil {
+		return nil, fmt.Errorf("tag %q: %s", key, err)
+	}
+	return Tags{key: shifted}, nil
+}
+
+// shiftTagTime shifts the time in tag value v by d, keeping the format of v.
+func shiftTagTime(v string, d time.Duration) (string, error) {
+	for _, f := range tagTimeFormats {
+		if t, err := time.Parse(f, v); err == nil {
+			return t.Add(d).Format(f), nil
+		}
+	}
+	return "", fmt.Errorf("%q is not a RFC-3339 timestamp or yyyy-mm-dd date", v)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestShiftTagTime(t *testing.T) {
+	cases := []struct {
+		Input    string
+		By       time.Duration
+		Expected string
+		WantErr  bool
+	}{
+		{"2017-06-01", 7 * 24 * time.Hour, "2017-06-08", false},
+		{"2017-06-30", 24 * time.Hour, "2017-07-01", false},
+		{"2017-06-08", -7 * 24 * time.Hour, "2017-06-01", false},
+		{"2017-06-01T08:00:00Z", 36 * time.Hour, "2017-06-02T20:00:00Z", false},
+		{"2017-06-01T08:00:00-07:00", time.Hour, "2017-06-01T09:00:00-07:00", false},
+		{"never", time.Hour, "", true},
+	}
+
+	for i, c := range cases {
+		got, err := shiftTagTime(c.Input, c.By)
+		if (err != nil) != c.WantErr {
+			t.Errorf("shiftTagTime case %d: wanted error %t, got %v", i+1, c.WantErr, err)
+			continue
+		}
+		if got != c.Expected {
+			t.Errorf("shiftTagTime case %d failed\nwanted: %s\ngot: %s", i+1, c.Expected, got)
+		}
+	}
+}
+
+func TestShiftTags(t *testing.T) {
+	week := 7 * 24 * time.Hour
+	cases := []struct {
+		Tags     map[string]string
+		Expected Tags
+		WantErr  bool
+	}{
+		{map[string]string{"ExpiresAt": "2017-06-01", "CreatedBy": "test-user"}, Tags{"ExpiresAt": "2017-06-08"}, false},
+		{map[string]string{"CreatedBy": "test-user"}, nil, false},
+		{map[string]string{"ExpiresAt": "soon"}, nil, true},
+	}
+
+	for i, c := range cases {
+		got, err := shiftTags(c.Tags, "ExpiresAt", week)
+		if (err != nil) != c.WantErr {
+			t.Errorf("shiftTags case %d: wanted error %t, got %v", i+1, c.WantErr, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.Expected) {
+			t.Errorf("shiftTags case %d failed\nwanted: %v\ngot: %v", i+1, c.Expected, got)
+		}
+	}
+}
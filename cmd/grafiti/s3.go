@@ -0,0 +1,204 @@
+// Copyright © 2017 grafiti authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/viper"
+)
+
+const s3Scheme = "s3://"
+
+// logFileTimeLayout is the layout of the delivery time in a CloudTrail log
+// file's name
+const logFileTimeLayout = "20060102T1504Z"
+
+var (
+	// logFileTimeRe matches the delivery time in the key of a CloudTrail log
+	// file, ex. '.../123456789012_CloudTrail_us-west-2_20170601T1905Z_a1B2.json.gz'
+	logFileTimeRe = regexp.MustCompile(`_CloudTrail_[^_/]+_(\d{8}T\d{4}Z)_[^/]*$`)
+	// regionPrefixRe matches prefixes of a trail's log files in one region,
+	// which S3 lists in delivery time order.
+	regionPrefixRe = regexp.MustCompile(`(^|/)CloudTrail/[^/]+/`)
+)
+
+// isS3URL returns true if s is an 's3://' URL.
+func isS3URL(s string) bool {
+	return strings.HasPrefix(s, s3Scheme)
+}
+
+// s3Location is a key prefix in an S3 bucket.
+type s3Location struct {
+	Bucket string
+	Prefix string
+}
+
+// parseS3URL parses an 's3://bucket/prefix' URL.
+func parseS3URL(u string) (s3Location, error) {
+	parts := strings.SplitN(strings.TrimPrefix(u, s3Scheme), "/", 2)
+	if !isS3URL(u) || parts[0] == "" {
+		return s3Location{}, fmt.Errorf("invalid S3 URL %q", u)
+	}
+
+	loc := s3Location{Bucket: parts[0]}
+	if len(parts) == 2 {
+		loc.Prefix = parts[1]
+	}
+	return loc, nil
+}
+
+// url returns the 's3://' URL of key in l's bucket.
+func (l s3Location) url(key string) string {
+	return s3Scheme + l.Bucket + "/" + key
+}
+
+// logFileTime returns the delivery time in the key of a CloudTrail log file.
+// False is returned if key is not a CloudTrail log file.
+func logFileTime(key string) (time.Time, bool) {
+	m := logFileTimeRe.FindStringSubmatch(key)
+	if m == nil {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(logFileTimeLayout, m[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// s3Config creates a config for S3 clients. Requests are sent to the
+// S3-compatible endpoint in the 's3Endpoint' config field, if set.
+func s3Config() *aws.Config {
+	cfg := &aws.Config{}
+	if ep := viper.GetString("s3Endpoint"); ep != "" {
+		cfg.Endpoint = aws.String(ep)
+		cfg.S3ForcePathStyle = aws.Bool(true)
+	}
+	return cfg
+}
+
+// runParseS3 parses CloudTrail log files under the S3 URL u delivered in the
+// configured time window. Parsed log files are recorded in st.
+func runParseS3(u string, st *State) error {
+	loc, err := parseS3URL(u)
+	if err != nil {
+		return err
+	}
+	start, end, err := getTimeWindow(st)
+	if err != nil {
+		return err
+	}
+	svc := s3.New(newAWSSession(), s3Config())
+	return parseFromS3(svc, loc, *start, *end, st)
+}
+
+// parseFromS3 streams and parses each CloudTrail log file under loc delivered
+// between start and end. Log files are selected by delivery time rather than
+// event time, so consecutive time windows parse each event exactly once. Keys
+// of parsed log files are recorded in st, and log files already in st are
+// skipped. st is saved once output of a log file is printed.
+func parseFromS3(svc s3iface.S3API, loc s3Location, start, end time.Time, st *State) error {
+	if st.S3Keys == nil {
+		st.S3Keys = make(map[string]time.Time)
+	}
+	// Log files delivered before the time window will not be listed again
+	for k, t := range st.S3Keys {
+		if t.Before(start) {
+			delete(st.S3Keys, k)
+		}
+	}
+
+	params := &s3.ListObjectsV2Input{
+		Bucket: aws.String(loc.Bucket),
+		Prefix: aws.String(loc.Prefix),
+	}
+	// Skip listing log files of days before the time window, and stop listing
+	// at the end of the time window, if log files are listed in time order.
+	ordered := regionPrefixRe.MatchString(loc.Prefix)
+	if ordered && regionPrefixRe.FindStringIndex(loc.Prefix)[1] == len(loc.Prefix) {
+		params.StartAfter = aws.String(loc.Prefix + start.UTC().Format("2006/01/02/"))
+	}
+
+	var parseErr error
+	ctx := aws.BackgroundContext()
+	err := svc.ListObjectsV2PagesWithContext(ctx, params, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			key := aws.StringValue(obj.Key)
+			t, ok := logFileTime(key)
+			if !ok {
+				continue
+			}
+			if t.Before(start) {
+				continue
+			}
+			if !t.Before(end) {
+				if ordered {
+					return false
+				}
+				continue
+			}
+
+			url := loc.url(key)
+			if _, ok := st.S3Keys[url]; ok {
+				logger.Debugln("skipping parsed log file", url)
+				continue
+			}
+			if parseErr = parseS3Object(svc, loc.Bucket, key); parseErr != nil {
+				return false
+			}
+			st.S3Keys[url] = t
+			if parseErr = saveParsedState(st); parseErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("s3: list objects in %s: %s", loc.url(loc.Prefix), err)
+	}
+	return parseErr
+}
+
+// parseS3Object streams and parses the CloudTrail log file at key in bucket.
+func parseS3Object(svc s3iface.S3API, bucket, key string) error {
+	url := s3Location{Bucket: bucket}.url(key)
+	ctx := aws.BackgroundContext()
+	resp, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("s3: get object %s: %s", url, err)
+	}
+	defer resp.Body.Close()
+
+	r, closeFn, err := newLogReader(resp.Body)
+	if err != nil {
+		return fmt.Errorf("read %s: %s", url, err)
+	}
+	defer closeFn()
+
+	if err := parseEvents(r); err != nil {
+		return fmt.Errorf("parse %s: %s", url, err)
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/viper"
+)
+
+// mockS3Server is a minimal S3-compatible stand-in serving ListObjectsV2,
+// GetObject and PutObject requests for objects in one bucket.
+type mockS3Server struct {
+	bucket  string
+	objects map[string][]byte
+
+	mu   sync.Mutex
+	gets []string
+	// failGets is the number of object requests that fail before objects are
+	// served
+	failGets int
+}
+
+type mockS3ListResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	IsTruncated           bool
+	NextContinuationToken string `xml:",omitempty"`
+	Contents              []struct{ Key string }
+}
+
+// mockS3PageSize is small so pagination is exercised
+const mockS3PageSize = 2
+
+func (m *mockS3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if path == m.bucket && r.URL.Query().Get("list-type") == "2" {
+		m.list(w, r)
+		return
+	}
+	if strings.HasPrefix(path, m.bucket+"/") {
+		key := strings.TrimPrefix(path, m.bucket+"/")
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if r.Method == http.MethodPut {
+			m.objects[key], _ = ioutil.ReadAll(r.Body)
+			return
+		}
+		if m.failGets > 0 {
+			m.failGets--
+			http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+			return
+		}
+		if obj, ok := m.objects[key]; ok {
+			m.gets = append(m.gets, key)
+			w.Write(obj)
+			return
+		}
+	}
+	http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+}
+
+func (m *mockS3Server) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var keys []string
+	for k := range m.objects {
+		if strings.HasPrefix(k, q.Get("prefix")) && k > q.Get("start-after") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	start, _ := strconv.Atoi(q.Get("continuation-token"))
+	res := mockS3ListResult{Name: m.bucket, Prefix: q.Get("prefix")}
+	for i := start; i < len(keys) && i < start+mockS3PageSize; i++ {
+		res.Contents = append(res.Contents, struct{ Key string }{keys[i]})
+	}
+	if start+mockS3PageSize < len(keys) {
+		res.IsTruncated = true
+		res.NextContinuationToken = strconv.Itoa(start + mockS3PageSize)
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(res)
+}
+
+func newMockS3Client(url string) *s3.S3 {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String(url),
+		S3ForcePathStyle: aws.Bool(true),
+	}))
+	return s3.New(sess)
+}
+
+func TestParseS3URL(t *testing.T) {
+	cases := []struct {
+		Input    string
+		Expected s3Location
+		WantErr  bool
+	}{
+		{"s3://bucket", s3Location{Bucket: "bucket"}, false},
+		{"s3://bucket/AWSLogs/123456789101/CloudTrail/", s3Location{"bucket", "AWSLogs/123456789101/CloudTrail/"}, false},
+		{"s3:///AWSLogs/", s3Location{}, true},
+		{"bucket/AWSLogs/", s3Location{}, true},
+	}
+
+	for i, c := range cases {
+		loc, err := parseS3URL(c.Input)
+		if (err != nil) != c.WantErr {
+			t.Errorf("parseS3URL case %d: wanted error %t, got %v", i+1, c.WantErr, err)
+		}
+		if loc != c.Expected {
+			t.Errorf("parseS3URL case %d failed\nwanted: %+v\ngot: %+v", i+1, c.Expected, loc)
+		}
+	}
+}
+
+func TestParseFromS3(t *testing.T) {
+	wd, _ := os.Getwd()
+	viper.Set("tagPatterns", []string{})
+	viper.Set("filterPatterns", []string{})
+
+	logFile, err := ioutil.ReadFile(wd + "/../../testdata/parse/cloudtrail-logfile-input.json")
+	if err != nil {
+		t.Fatal("Failed to open log file:", err)
+	}
+	want, err := ioutil.ReadFile(wd + "/../../testdata/parse/parsed-logfile-output.json")
+	if err != nil {
+		t.Fatal("Failed to open parsed log file:", err)
+	}
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(logFile)
+	gw.Close()
+
+	prefix := "AWSLogs/123456789101/CloudTrail/us-west-2/"
+	mock := &mockS3Server{
+		bucket: "trail",
+		objects: map[string][]byte{
+			prefix + "2017/05/31/123456789101_CloudTrail_us-west-2_20170531T1905Z_a.json.gz":                                  gz.Bytes(),
+			prefix + "2017/06/01/123456789101_CloudTrail_us-west-2_20170601T1855Z_b.json.gz":                                  gz.Bytes(),
+			prefix + "2017/06/01/123456789101_CloudTrail_us-west-2_20170601T1905Z_c.json.gz":                                  gz.Bytes(),
+			prefix + "2017/06/01/123456789101_CloudTrail_us-west-2_20170601T1910Z_d.json":                                     logFile,
+			prefix + "2017/06/01/123456789101_CloudTrail_us-west-2_20170601T1915Z_e.json.gz":                                  gz.Bytes(),
+			prefix + "2017/06/01/123456789101_CloudTrail_us-west-2_20170601T2000Z_f.json.gz":                                  gz.Bytes(),
+			prefix + "2017/06/01/not-a-log-file.txt":                                                                          []byte("not json"),
+			"AWSLogs/123456789101/CloudTrail-Digest/us-west-2/2017/06/01/digest.json.gz":                                      []byte("not json"),
+			"AWSLogs/123456789101/CloudTrail/us-east-1/2017/06/01/123456789101_CloudTrail_us-east-1_20170601T1930Z_g.json.gz": gz.Bytes(),
+		},
+	}
+	srv := httptest.NewServer(mock)
+	defer srv.Close()
+	svc := newMockS3Client(srv.URL)
+
+	dir, err := ioutil.TempDir("", "grafiti-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	viper.Set("stateFile", filepath.Join(dir, "state.json"))
+	defer viper.Set("stateFile", "")
+
+	start := time.Date(2017, 6, 1, 19, 0, 0, 0, time.UTC)
+	end := time.Date(2017, 6, 1, 20, 0, 0, 0, time.UTC)
+	stale := s3Location{"trail", ""}.url("stale.json.gz")
+
+	cases := []struct {
+		Prefix       string
+		ExpectedGets []string
+		Expected     string
+	}{
+		{
+			Prefix: prefix,
+			ExpectedGets: []string{
+				prefix + "2017/06/01/123456789101_CloudTrail_us-west-2_20170601T1905Z_c.json.gz",
+				prefix + "2017/06/01/123456789101_CloudTrail_us-west-2_20170601T1910Z_d.json",
+				prefix + "2017/06/01/123456789101_CloudTrail_us-west-2_20170601T1915Z_e.json.gz",
+			},
+			Expected: strings.Repeat(string(want), 3),
+		},
+		// Log files parsed in the previous run are skipped
+		{
+			Prefix: "AWSLogs/123456789101/",
+			ExpectedGets: []string{
+				"AWSLogs/123456789101/CloudTrail/us-east-1/2017/06/01/123456789101_CloudTrail_us-east-1_20170601T1930Z_g.json.gz",
+			},
+			Expected: string(want),
+		},
+	}
+
+	for i, c := range cases {
+		st, err := loadState()
+		if err != nil {
+			t.Fatalf("parseFromS3 case %d: %s", i+1, err)
+		}
+		if i == 0 {
+			st.S3Keys = map[string]time.Time{stale: start.Add(-time.Hour)}
+		}
+
+		mock.gets = nil
+		var parseErr error
+		f := func(v interface{}) {
+			parseErr = parseFromS3(svc, s3Location{"trail", c.Prefix}, start, end, v.(*State))
+		}
+		got := captureStdOut(f, st)
+		if parseErr != nil {
+			t.Fatalf("parseFromS3 case %d failed: %s", i+1, parseErr)
+		}
+		if !reflect.DeepEqual(mock.gets, c.ExpectedGets) {
+			t.Errorf("parseFromS3 case %d failed\nwanted objects: %v\ngot: %v", i+1, c.ExpectedGets, mock.gets)
+		}
+		if got != c.Expected {
+			t.Errorf("parseFromS3 case %d failed\nwanted\n%s\n\ngot\n%s\n", i+1, c.Expected, got)
+		}
+	}
+
+	st, err := loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.S3Keys) != 4 {
+		t.Errorf("parseFromS3 saved %d keys, wanted 4: %v", len(st.S3Keys), st.S3Keys)
+	}
+	if _, ok := st.S3Keys[stale]; ok {
+		t.Errorf("parseFromS3 did not forget %s", stale)
+	}
+}
+
+func TestS3StateFile(t *testing.T) {
+	mock := &mockS3Server{bucket: "state", objects: map[string][]byte{}}
+	srv := httptest.NewServer(mock)
+	defer srv.Close()
+
+	for k, v := range map[string]string{"AWS_ACCESS_KEY_ID": "id", "AWS_SECRET_ACCESS_KEY": "secret", "AWS_REGION": "us-east-1"} {
+		old, ok := os.LookupEnv(k)
+		os.Setenv(k, v)
+		if ok {
+			defer os.Setenv(k, old)
+		} else {
+			defer os.Unsetenv(k)
+		}
+	}
+	viper.Set("s3Endpoint", srv.URL)
+	defer viper.Set("s3Endpoint", "")
+	viper.Set("stateFile", "s3://state/grafiti/state.json")
+	defer viper.Set("stateFile", "")
+
+	st, err := loadState()
+	if err != nil {
+		t.Fatalf("loadState with no state object: %s", err)
+	}
+	if !reflect.DeepEqual(st, &State{}) {
+		t.Errorf("loadState with no state object: wanted empty state, got %+v", st)
+	}
+
+	cp := st.lookupCheckpoint("123456789101/us-west-2/AWS::EC2::Instance")
+	cp.LastEventTime = time.Date(2017, 6, 1, 19, 5, 0, 0, time.UTC)
+	cp.LastEventIDs = []string{"event-1"}
+	if err := st.save(); err != nil {
+		t.Fatalf("save: %s", err)
+	}
+	if _, ok := mock.objects["grafiti/state.json"]; !ok {
+		t.Fatalf("save did not write the state object: %v", mock.objects)
+	}
+
+	got, err := loadState()
+	if err != nil {
+		t.Fatalf("loadState: %s", err)
+	}
+	if !reflect.DeepEqual(got, st) {
+		t.Errorf("loadState failed\nwanted: %+v\ngot: %+v", st.LookupEvents, got.LookupEvents)
+	}
+}
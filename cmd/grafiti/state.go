@@ -0,0 +1,254 @@
+// Copyright © 2017 grafiti authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/spf13/viper"
+)
+
+// State holds progress grafiti keeps between runs in the file at the
+// 'stateFile' config field.
+type State struct {
+	// S3Keys maps 's3://bucket/key' URLs of CloudTrail log files already parsed
+	// to their delivery time.
+	S3Keys map[string]time.Time `json:",omitempty"`
+	// LookupEvents maps '<account ID>/<region>/<resource type>' to the progress
+	// of parsing events of that resource type from the CloudTrail API.
+	LookupEvents map[string]*LookupCheckpoint `json:",omitempty"`
+	// Watch is the progress of `grafiti watch`.
+	Watch *WatchCheckpoint `json:",omitempty"`
+	// LastRunEnd is the end of the time window of the last `grafiti parse` run
+	// that completed.
+	LastRunEnd *time.Time `json:",omitempty"`
+
+	// window is the time window of the run in progress, once calculated.
+	window *timeWindow
+}
+
+// LookupCheckpoint holds the progress of parsing events from the CloudTrail
+// API in one account, region and resource type.
+type LookupCheckpoint struct {
+	// LastEventTime is the time of the latest event parsed by a completed run,
+	// and LastEventIDs are the IDs of events parsed at that time. The next run
+	// continues from LastEventTime.
+	LastEventTime time.Time
+	LastEventIDs  []string `json:",omitempty"`
+	// NextToken, StartTime and EndTime are set while a run is in progress, so a
+	// run that did not complete resumes from its last page.
+	NextToken string     `json:",omitempty"`
+	StartTime *time.Time `json:",omitempty"`
+	EndTime   *time.Time `json:",omitempty"`
+	// RunEventTime and RunEventIDs are the latest events parsed by the run in
+	// progress.
+	RunEventTime time.Time
+	RunEventIDs  []string `json:",omitempty"`
+}
+
+// lookupCheckpoint returns the checkpoint with key, creating it if needed.
+func (st *State) lookupCheckpoint(key string) *LookupCheckpoint {
+	if st.LookupEvents == nil {
+		st.LookupEvents = make(map[string]*LookupCheckpoint)
+	}
+	cp, ok := st.LookupEvents[key]
+	if !ok {
+		cp = &LookupCheckpoint{}
+		st.LookupEvents[key] = cp
+	}
+	return cp
+}
+
+// inProgress returns true if cp holds a run that did not complete.
+func (cp *LookupCheckpoint) inProgress() bool {
+	return cp.NextToken != "" && cp.StartTime != nil && cp.EndTime != nil
+}
+
+// parsed returns true if an event with id at time t was parsed by the last
+// completed run.
+func (cp *LookupCheckpoint) parsed(id string, t time.Time) bool {
+	if !t.Equal(cp.LastEventTime) {
+		return false
+	}
+	for _, lid := range cp.LastEventIDs {
+		if lid == id {
+			return true
+		}
+	}
+	return false
+}
+
+// observe records an event with id at time t parsed by the run in progress.
+func (cp *LookupCheckpoint) observe(id string, t time.Time) {
+	switch {
+	case t.After(cp.RunEventTime):
+		cp.RunEventTime, cp.RunEventIDs = t, []string{id}
+	case t.Equal(cp.RunEventTime):
+		cp.RunEventIDs = append(cp.RunEventIDs, id)
+	}
+}
+
+// complete ends the run in progress, so the next run continues from its
+// latest event.
+func (cp *LookupCheckpoint) complete() {
+	switch {
+	case cp.RunEventTime.After(cp.LastEventTime):
+		cp.LastEventTime, cp.LastEventIDs = cp.RunEventTime, cp.RunEventIDs
+	case cp.RunEventTime.Equal(cp.LastEventTime):
+		cp.LastEventIDs = append(cp.LastEventIDs, cp.RunEventIDs...)
+	}
+	cp.NextToken, cp.StartTime, cp.EndTime = "", nil, nil
+	cp.RunEventTime, cp.RunEventIDs = time.Time{}, nil
+}
+
+// WatchCheckpoint holds events and log files `grafiti watch` has tagged
+// resources of, so events SQS delivers more than once are skipped.
+type WatchCheckpoint struct {
+	// LastEventTime is the time of the latest event whose resources were tagged.
+	LastEventTime time.Time
+	// EventIDs maps IDs of events whose resources were tagged to their time.
+	EventIDs map[string]time.Time `json:",omitempty"`
+	// S3Keys maps 's3://bucket/key' URLs of log files whose resources were
+	// tagged to the time they were received.
+	S3Keys map[string]time.Time `json:",omitempty"`
+}
+
+// loadState reads state from the 'stateFile' config field, a local path or an
+// 's3://bucket/key' URL. Empty state is returned if 'stateFile' is not set or
+// the file does not exist yet.
+func loadState() (*State, error) {
+	st := &State{}
+	path := viper.GetString("stateFile")
+	if path == "" {
+		return st, nil
+	}
+
+	var raw []byte
+	var err error
+	if isS3URL(path) {
+		raw, err = readStateObject(path)
+	} else {
+		raw, err = ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			return st, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read state file: %s", err)
+	}
+	if raw == nil {
+		return st, nil
+	}
+	if err := json.Unmarshal(raw, st); err != nil {
+		return nil, fmt.Errorf("decode state file %s: %s", path, err)
+	}
+	return st, nil
+}
+
+// save writes st to the file at the 'stateFile' config field, if set. The file
+// is replaced atomically so a crash never leaves partially written state.
+// S3 objects are replaced atomically by S3.
+func (st *State) save() error {
+	path := viper.GetString("stateFile")
+	if path == "" {
+		return nil
+	}
+
+	raw, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode state: %s", err)
+	}
+	if isS3URL(path) {
+		if err := writeStateObject(path, raw); err != nil {
+			return fmt.Errorf("write state file: %s", err)
+		}
+		return nil
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("create state file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write state file: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write state file: %s", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("replace state file: %s", err)
+	}
+	return nil
+}
+
+// newStateS3Client creates an S3 client for state files in S3, using the
+// environment's credentials and region.
+func newStateS3Client() s3iface.S3API {
+	return s3.New(newAWSSessionWith(nil, ""), s3Config())
+}
+
+// readStateObject reads the state file at the S3 URL u. Nil is returned if
+// the object does not exist.
+func readStateObject(u string) ([]byte, error) {
+	loc, err := parseS3URL(u)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := aws.BackgroundContext()
+	resp, err := newStateS3Client().GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(loc.Bucket),
+		Key:    aws.String(loc.Prefix),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("s3: get object %s: %s", u, err)
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// writeStateObject writes raw to the state file at the S3 URL u.
+func writeStateObject(u string, raw []byte) error {
+	loc, err := parseS3URL(u)
+	if err != nil {
+		return err
+	}
+
+	ctx := aws.BackgroundContext()
+	_, err = newStateS3Client().PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(loc.Bucket),
+		Key:    aws.String(loc.Prefix),
+		Body:   bytes.NewReader(raw),
+	})
+	if err != nil {
+		return fmt.Errorf("s3: put object %s: %s", u, err)
+	}
+	return nil
+}
@@ -20,9 +20,12 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
@@ -31,11 +34,18 @@ import (
 	"github.com/aws/aws-sdk-go/service/route53"
 	"github.com/aws/aws-sdk-go/service/route53/route53iface"
 	"github.com/coreos/grafiti/arn"
+	"github.com/coreos/grafiti/deleter"
+	"github.com/coreos/grafiti/graph"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/tidwall/gjson"
 )
 
-var tagFile string
+var (
+	tagFile       string
+	propagateTags bool
+)
 
 // TaggingMetadata is the data required to find and tag a resource
 type TaggingMetadata struct {
@@ -43,22 +53,85 @@ type TaggingMetadata struct {
 	ResourceType arn.ResourceType
 	ResourceARN  arn.ResourceARN
 	CreatorARN   arn.ResourceARN
-	CreatorName  arn.ResourceName
+	// CreatorName is the name of the resource's owner
+	CreatorName arn.ResourceName
+	// Owner is the identity a resource is attributed to
+	Owner *Owner `json:",omitempty"`
+	// Region is the region a resource was created in. Resources are tagged in
+	// this region, or the region in their ARN if empty
+	Region string `json:",omitempty"`
+	// AccountID is the ID of the account a resource was created in. Resources
+	// are tagged in this account, or the account in their ARN if empty
+	AccountID string `json:",omitempty"`
+}
+
+// tagTarget is an account and region resources are tagged in
+type tagTarget struct {
+	AccountID string
+	Region    string
 }
 
-// Tags are an alias for mapping Tag.Key -> Tag.Value
+// target returns the account and region a resource should be tagged in. Empty
+// fields are filled by the environment
+func (tm *TaggingMetadata) target() tagTarget {
+	t := tagTarget{tm.AccountID, tm.Region}
+	if t.AccountID == "" {
+		t.AccountID = arn.AccountForARN(tm.ResourceARN)
+	}
+	if t.Region == "" {
+		t.Region = arn.RegionForARN(tm.ResourceARN)
+	}
+	return t
+}
+
+// newAWSSession creates a session in t
+func (t tagTarget) newAWSSession() (*session.Session, error) {
+	creds, err := credentialsForAccount(t.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	return newAWSSessionWith(creds, t.Region), nil
+}
+
+// The RGTA tags at most 20 resources with at most 50 tags per request
+const (
+	maxRGTAResources = 20
+	maxRGTATags      = 50
+)
+
+// Tags are an alias for mapping tag keys to tag values
 type Tags map[string]string
 
-// Tag holds user-defined tag values from a TOML file
-type Tag struct {
-	Key   string
-	Value string
+// key returns a string identifying the set of tags in t
+func (t Tags) key() string {
+	// Keys of encoded maps are sorted, so equal sets have equal keys
+	b, _ := json.Marshal(t)
+	return string(b)
+}
+
+// split splits t into sets of at most n tags, in order of tag key
+func (t Tags) split(n int) []Tags {
+	keys := make([]string, 0, len(t))
+	for k := range t {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sets []Tags
+	for i, k := range keys {
+		if i%n == 0 {
+			sets = append(sets, make(Tags))
+		}
+		sets[len(sets)-1][k] = t[k]
+	}
+	return sets
 }
 
 // TagInput holds all Data describing a resource
 type TagInput struct {
 	TaggingMetadata TaggingMetadata
 	Tags            Tags
+	Lifecycle       string
 }
 
 func shouldEject(ejectSize, setSize int, createdAt time.Time) bool {
@@ -67,7 +140,7 @@ func shouldEject(ejectSize, setSize int, createdAt time.Time) bool {
 
 	ejectTime := time.Time(createdAt.Add(limit))
 
-	return setSize == ejectSize || ((createdAt.After(ejectTime) || createdAt.Equal(ejectTime)) && setSize > 0)
+	return setSize == ejectSize || (!time.Now().Before(ejectTime) && setSize > 0)
 }
 
 // ARNSet is a set of ARNs (no duplicates)
@@ -98,50 +171,53 @@ func (a *ARNSet) ToARNList() arn.ResourceARNs {
 // limit of 10 minutes
 type TrackedARNSet struct {
 	ARNSet
+	// Tags are applied to every ARN in the set
+	Tags      Tags
 	CreatedAt time.Time
 }
 
 // ShouldEject calculates whether a bucket has at least 20 member ARNs or
 // CreatedAt is after the user-specified duration
 func (s *TrackedARNSet) ShouldEject() bool {
-	return shouldEject(20, len(s.ARNSet), s.CreatedAt)
+	return shouldEject(maxRGTAResources, len(s.ARNSet), s.CreatedAt)
 }
 
-// ARNSetBucket maps a tag to a set of tracked ARNs
-type ARNSetBucket map[Tag]TrackedARNSet
+// ARNSetBucket maps the key of a set of tags to a set of tracked ARNs to apply
+// all of those tags to, so each set is tagged in one request
+type ARNSetBucket map[string]TrackedARNSet
 
-// NewARNSetBucket creates a new map of Tag -> TrackedARNSet
+// NewARNSetBucket creates a new map of tag set key -> TrackedARNSet
 func NewARNSetBucket() ARNSetBucket {
-	return make(map[Tag]TrackedARNSet)
+	return make(map[string]TrackedARNSet)
 }
 
-// AddARNToBuckets adds tags to an ARNSet, or creates a new set if one does
-// not exist
+// AddARNToBuckets adds an ARN to the ARNSet of its tags, or creates a new set
+// if one does not exist. Tags are split into sets of at most 50 tags, the most
+// the RGTA applies in one request
 func (b *ARNSetBucket) AddARNToBuckets(ARN arn.ResourceARN, tags map[string]string) {
 	if ARN == "" {
 		return
 	}
-	for tagKey, tagValue := range tags {
-		tag := Tag{tagKey, tagValue}
+	for _, tagSet := range Tags(tags).split(maxRGTATags) {
+		key := tagSet.key()
 
-		resourceSet, found := (*b)[tag]
+		resourceSet, found := (*b)[key]
 		if !found {
 			resourceSet = TrackedARNSet{
 				ARNSet:    NewARNSet(),
+				Tags:      tagSet,
 				CreatedAt: time.Now(),
 			}
-			(*b)[tag] = resourceSet
+			(*b)[key] = resourceSet
 		}
 		resourceSet.AddARN(ARN)
 	}
 }
 
-// ClearBucket creates a new ARNSet for a specific Tag
-func (b *ARNSetBucket) ClearBucket(bucket Tag) {
-	(*b)[bucket] = TrackedARNSet{
-		ARNSet:    NewARNSet(),
-		CreatedAt: time.Now(),
-	}
+// ClearBucket removes the ARNSet of a tag set key. Tag sets often contain
+// unique values, ex. creation times, so empty sets are not kept
+func (b *ARNSetBucket) ClearBucket(key string) {
+	delete(*b, key)
 }
 
 // ResourceNameSet is a set of ResourceNames (no duplicates) mapped to a map of
@@ -221,6 +297,7 @@ func (b *ResourceNameSetBucket) ClearBucket(bucket arn.ResourceType) {
 func init() {
 	RootCmd.AddCommand(tagCmd)
 	tagCmd.PersistentFlags().StringVarP(&tagFile, "tag-file", "f", "", "File containing JSON objects of taggable resources and tag key/value pairs. Format is the output format of grafiti parse.")
+	tagCmd.PersistentFlags().BoolVar(&propagateTags, "propagate", false, "Also tag resources created implicitly with tagged resources, ex. volumes and network interfaces of instances, with the tags of the resource they were created with.")
 }
 
 var tagCmd = &cobra.Command{
@@ -263,15 +340,9 @@ func tagFromStdIn() error {
 }
 
 func tag(reader io.Reader) error {
-	svc := rgta.New(session.Must(session.NewSession(
-		&aws.Config{},
-	)))
 	dec := json.NewDecoder(reader)
-
-	// Holds all ARN's of resources supported by the RGTA
-	arnBuckets := NewARNSetBucket()
-	// Holds all resource names of resources not supported by the RGTA
-	resourceNameBuckets := NewResourceNameSetBucket()
+	tg := newTagger()
+	tg.propagate = propagateTags
 
 	for {
 		t, isEOF, err := decodeInput(dec)
@@ -282,52 +353,233 @@ func tag(reader io.Reader) error {
 			continue
 		}
 
-		// Check map that holds all RGTA-unsupported resource types and bucket
-		// accordingly
-		tm := t.TaggingMetadata
-		// Certain resources do not support tagging at all. Skip these.
-		if _, ok := arn.UntaggableResourceTypes[tm.ResourceType]; ok {
-			continue
+		tg.add(t)
+		if err := tg.eject(isEOF); err != nil {
+			return err
 		}
 
-		if tm.ResourceType != "" && tm.ResourceName != "" && tm.ResourceARN != "" {
-			if _, ok := arn.RGTAUnsupportedResourceTypes[tm.ResourceType]; ok {
-				resourceNameBuckets.AddResourceNameToBucket(tm.ResourceType, tm.ResourceName, t.Tags)
-			} else {
-				arnBuckets.AddARNToBuckets(tm.ResourceARN, t.Tags)
+		if isEOF {
+			break
+		}
+	}
+
+	// Resources that were not tagged would never expire, so they fail the run
+	if !ignoreErrors {
+		return tagFailuresError(tg.failures, "tagged")
+	}
+	return nil
+}
+
+// tagger buckets resources by tag and tags each bucket once it is full or old
+// enough to eject.
+type tagger struct {
+	// Resources are tagged in the account and region they were created in, so
+	// buckets are kept per target.
+	// Holds all ARN's of resources supported by the RGTA, per target
+	arnBuckets map[tagTarget]ARNSetBucket
+	// Holds all resource names of resources not supported by the RGTA, per
+	// target
+	resourceNameBuckets map[tagTarget]ResourceNameSetBucket
+	// Holds resources whose children are tagged with their tags, per target
+	parentBuckets map[tagTarget]ResourceNameSetBucket
+	// Holds a RGTA client per target
+	svcs map[tagTarget]rgtaiface.ResourceGroupsTaggingAPIAPI
+	// Whether children of resources are tagged with their tags
+	propagate bool
+	// Holds resources the RGTA failed to tag
+	failures []tagFailure
+	// Holds existing tags read with the RGTA, per target
+	existing map[tagTarget]map[rgtaTagQuery]map[arn.ResourceARN]string
+}
+
+func newTagger() *tagger {
+	return &tagger{
+		arnBuckets:          make(map[tagTarget]ARNSetBucket),
+		resourceNameBuckets: make(map[tagTarget]ResourceNameSetBucket),
+		parentBuckets:       make(map[tagTarget]ResourceNameSetBucket),
+		svcs:                make(map[tagTarget]rgtaiface.ResourceGroupsTaggingAPIAPI),
+	}
+}
+
+// add buckets the resource in t, if it can be tagged.
+func (tg *tagger) add(t *TagInput) {
+	// Resources deleted before they were parsed cannot be tagged
+	if t.Lifecycle == lifecycleDeleted {
+		return
+	}
+
+	// Check map that holds all RGTA-unsupported resource types and bucket
+	// accordingly
+	tm := t.TaggingMetadata
+	// Certain resources do not support tagging at all. Skip these.
+	if _, ok := arn.UntaggableResourceTypes[tm.ResourceType]; ok {
+		return
+	}
+
+	if tm.ResourceType != "" && tm.ResourceName != "" && tm.ResourceARN != "" {
+		tt := tm.target()
+		tg.addTarget(tt, tm, t.Tags)
+
+		// Children are discovered in batches, then tagged like their parent
+		if tg.propagate && graph.HasChildren(tm.ResourceType) {
+			if _, ok := tg.parentBuckets[tt]; !ok {
+				tg.parentBuckets[tt] = NewResourceNameSetBucket()
 			}
+			pb := tg.parentBuckets[tt]
+			pb.AddResourceNameToBucket(tm.ResourceType, tm.ResourceName, t.Tags)
 		}
+	}
+}
 
-		for tag, bucket := range arnBuckets {
-			if bucket.ShouldEject() || (isEOF && len(bucket.ARNSet) > 0) {
-				if err := tagARNBucket(svc, bucket.ToARNList(), tag); err != nil {
-					return err
+// addTarget buckets the resource in tm with tags in target tt.
+func (tg *tagger) addTarget(tt tagTarget, tm TaggingMetadata, tags Tags) {
+	if _, ok := arn.RGTAUnsupportedResourceTypes[tm.ResourceType]; ok {
+		if _, ok := tg.resourceNameBuckets[tt]; !ok {
+			tg.resourceNameBuckets[tt] = NewResourceNameSetBucket()
+		}
+		rnb := tg.resourceNameBuckets[tt]
+		rnb.AddResourceNameToBucket(tm.ResourceType, tm.ResourceName, tags)
+	} else {
+		if _, ok := tg.arnBuckets[tt]; !ok {
+			tg.arnBuckets[tt] = NewARNSetBucket()
+		}
+		ab := tg.arnBuckets[tt]
+		ab.AddARNToBuckets(tm.ResourceARN, tags)
+	}
+}
+
+// ejectParents discovers children of resources in each parent bucket that
+// should be ejected, or in every non-empty bucket if all is true, buckets each
+// child with the tags of its parent, and clears those buckets.
+func (tg *tagger) ejectParents(all bool) error {
+	for tt, targetBuckets := range tg.parentBuckets {
+		for rt, bucket := range targetBuckets {
+			if bucket.ShouldEject() || (all && len(bucket.ResourceNameSet) > 0) {
+				names := make(arn.ResourceNames, 0, len(bucket.ResourceNameSet))
+				for n := range bucket.ResourceNameSet {
+					names = append(names, n)
+				}
+				children, err := discoverChildren(tt, rt, names)
+				if err != nil {
+					if !ignoreErrors {
+						return fmt.Errorf("discover children: %s", err)
+					}
+					// Parents are tagged, but their children are not
+					for _, n := range names {
+						f := newTagFailure(childARN(tt, rt, n), err)
+						f.log()
+						tg.failures = append(tg.failures, f)
+					}
+				}
+
+				for _, c := range children {
+					tm := TaggingMetadata{
+						ResourceName: c.Name,
+						ResourceType: c.Type,
+						ResourceARN:  childARN(tt, c.Type, c.Name),
+					}
+					tg.addTarget(tt, tm, bucket.ResourceNameSet[c.Parent])
 				}
-				arnBuckets.ClearBucket(tag)
+				targetBuckets.ClearBucket(rt)
 			}
 		}
+	}
+	return nil
+}
 
-		for rt, buckets := range resourceNameBuckets {
-			if buckets.ShouldEject() || (isEOF && len(buckets.ResourceNameSet) > 0) {
-				if err := tagUnsupportedResourceType(rt, buckets.ResourceNameSet); err != nil {
+// discoverChildren requests children of resources of type rt with names, and
+// their children, in tt.
+var discoverChildren = func(tt tagTarget, rt arn.ResourceType, names arn.ResourceNames) ([]graph.Child, error) {
+	creds, err := credentialsForAccount(tt.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	// graph requests resources with sessions created by deleter
+	prev := deleter.SessionConfig()
+	deleter.SetSessionConfig(awsConfig(creds, tt.Region))
+	defer deleter.SetSessionConfig(prev)
+
+	return graph.DiscoverChildren(rt, names)
+}
+
+// childARN returns the ARN of a child resource in tt, from an event holding
+// only tt's region and account ID.
+func childARN(tt tagTarget, rt arn.ResourceType, rn arn.ResourceName) arn.ResourceARN {
+	event := fmt.Sprintf(`{"awsRegion": %q, "userIdentity": {"accountId": %q}}`, tt.Region, tt.AccountID)
+	return arn.MapResourceTypeToARN(rt, rn, gjson.Parse(event))
+}
+
+// eject tags resources in each bucket that should be ejected, or in every
+// non-empty bucket if all is true, and clears those buckets.
+func (tg *tagger) eject(all bool) error {
+	// Children are tagged with their parents
+	if err := tg.ejectParents(all); err != nil {
+		return err
+	}
+
+	for tt, targetBuckets := range tg.arnBuckets {
+		for key, bucket := range targetBuckets {
+			if bucket.ShouldEject() || (all && len(bucket.ARNSet) > 0) {
+				svc, err := tg.svc(tt)
+				if err != nil {
 					return err
 				}
-				resourceNameBuckets.ClearBucket(rt)
+				sets := ARNSetBucket{key: bucket}
+				// Existing tags are only read for keys whose policy is not overwrite
+				if keys := tagMergePolicies.readKeys(bucket.Tags); len(keys) != 0 {
+					existing, err := tg.existingTags(tt, svc, bucket.ToARNList(), keys)
+					if err != nil {
+						if !ignoreErrors {
+							return err
+						}
+						logger.Debugln(err)
+					}
+					sets = mergeARNSet(bucket, existing)
+				}
+				for _, set := range sets {
+					failures, err := tagARNBucket(svc, set.ToARNList(), set.Tags)
+					if err != nil {
+						return err
+					}
+					tg.failures = append(tg.failures, failures...)
+				}
+				targetBuckets.ClearBucket(key)
 			}
 		}
+	}
 
-		if isEOF {
-			break
+	for tt, targetBuckets := range tg.resourceNameBuckets {
+		for rt, buckets := range targetBuckets {
+			if buckets.ShouldEject() || (all && len(buckets.ResourceNameSet) > 0) {
+				if err := tagUnsupportedResourceType(tt, rt, buckets.ResourceNameSet); err != nil {
+					return err
+				}
+				targetBuckets.ClearBucket(rt)
+			}
 		}
 	}
-
 	return nil
 }
 
-func tagUnsupportedResourceType(rt arn.ResourceType, nameSet ResourceNameSet) error {
-	sess := session.Must(session.NewSession(
-		&aws.Config{},
-	))
+// svc returns the RGTA client of tt, creating it if it does not exist.
+func (tg *tagger) svc(tt tagTarget) (rgtaiface.ResourceGroupsTaggingAPIAPI, error) {
+	if svc, ok := tg.svcs[tt]; ok {
+		return svc, nil
+	}
+	sess, err := tt.newAWSSession()
+	if err != nil {
+		return nil, err
+	}
+	svc := rgta.New(sess)
+	tg.svcs[tt] = svc
+	return svc, nil
+}
+
+func tagUnsupportedResourceType(tt tagTarget, rt arn.ResourceType, nameSet ResourceNameSet) error {
+	sess, err := tt.newAWSSession()
+	if err != nil {
+		return err
+	}
 
 	switch arn.NamespaceForResource(rt) {
 	case arn.AutoScalingNamespace:
@@ -357,6 +609,17 @@ func tagAutoScalingResources(svc autoscalingiface.AutoScalingAPI, rt arn.Resourc
 		return nil
 	}
 
+	if tagMergePolicies.readsExisting() {
+		existing, err := getAutoScalingTags(svc, rn)
+		if err != nil {
+			if !ignoreErrors {
+				return err
+			}
+			logger.Debugln(err)
+		}
+		tags = tagMergePolicies.merge(tags, existing)
+	}
+
 	var asgTags []*autoscaling.Tag
 	for tk, tv := range tags {
 		asgTags = append(asgTags, &autoscaling.Tag{
@@ -407,6 +670,20 @@ func tagRoute53Resource(svc route53iface.Route53API, rt arn.ResourceType, rn arn
 		return nil
 	}
 
+	if tagMergePolicies.readsExisting() {
+		existing, err := getRoute53Tags(svc, rn)
+		if err != nil {
+			if !ignoreErrors {
+				return err
+			}
+			logger.Debugln(err)
+		}
+		tags = tagMergePolicies.merge(tags, existing)
+		if len(tags) == 0 {
+			return nil
+		}
+	}
+
 	hzTags := make([]*route53.Tag, 0, len(tags))
 	for tk, tv := range tags {
 		hzTags = append(hzTags, &route53.Tag{
@@ -447,36 +724,141 @@ func tagRoute53Resource(svc route53iface.Route53API, rt arn.ResourceType, rn arn
 	return nil
 }
 
-func tagARNBucket(svc rgtaiface.ResourceGroupsTaggingAPIAPI, bucket arn.ResourceARNs, tag Tag) error {
+// tagARNBucket applies all tags to every ARN in bucket in one request.
+// Resources the RGTA fails to tag with a retryable error are retried, and
+// resources that still fail are logged and returned.
+func tagARNBucket(svc rgtaiface.ResourceGroupsTaggingAPIAPI, bucket arn.ResourceARNs, tags Tags) ([]tagFailure, error) {
 	params := &rgta.TagResourcesInput{
 		ResourceARNList: bucket.AWSStringSlice(),
-		Tags:            map[string]*string{tag.Key: aws.String(tag.Value)},
+		Tags:            aws.StringMap(tags),
 	}
 
 	pj, err := json.Marshal(params)
 	if err != nil {
 		if ignoreErrors {
 			logger.Debugln("marshal rgta params:", err)
-			return nil
+			return nil, nil
 		}
-		return fmt.Errorf("marshal rgta params: %s", err)
+		return nil, fmt.Errorf("marshal rgta params: %s", err)
 	}
 	fmt.Println(string(pj))
 
 	if dryRun {
-		return nil
+		return nil, nil
 	}
 
-	// Rate limit error is returned if no pause between requests
-	time.Sleep(time.Duration(2) * time.Second)
-	if _, err := svc.TagResources(params); err != nil {
-		if ignoreErrors {
-			logger.Debugln("rgta: tag resources:", err)
-			return nil
+	var failures []tagFailure
+	delay := tagRetryDelay
+	for retry := 0; ; retry++ {
+		// Requests are rate limited by the session svc was created from
+		resp, err := svc.TagResources(params)
+		if err != nil {
+			if ignoreErrors {
+				logger.Debugln("rgta: tag resources:", err)
+				return nil, nil
+			}
+			return nil, fmt.Errorf("rgta: tag resources %s", err)
+		}
+
+		var retryARNs []*string
+		for a, fi := range resp.FailedResourcesMap {
+			if fi == nil {
+				continue
+			}
+			if retry < maxTagRetries && isRetryableTagFailure(fi) {
+				retryARNs = append(retryARNs, aws.String(a))
+				continue
+			}
+			f := tagFailure{
+				ARN:          arn.ResourceARN(a),
+				ErrorCode:    aws.StringValue(fi.ErrorCode),
+				ErrorMessage: aws.StringValue(fi.ErrorMessage),
+			}
+			f.log()
+			failures = append(failures, f)
 		}
-		return fmt.Errorf("rgta: tag resources %s", err)
+		if len(retryARNs) == 0 {
+			break
+		}
+
+		logger.Debugf("rgta: retrying %d resources in %s", len(retryARNs), delay)
+		time.Sleep(delay)
+		delay *= 2
+		params.ResourceARNList = retryARNs
 	}
-	return nil
+	return failures, nil
+}
+
+// The most times resources the RGTA failed to tag with a retryable error are
+// retried
+const maxTagRetries = 3
+
+// tagRetryDelay is the delay before the first retry of resources the RGTA
+// failed to tag. The delay doubles with each retry
+var tagRetryDelay = time.Second
+
+// isRetryableTagFailure returns true if a resource the RGTA failed to tag
+// might be tagged if retried, ex. because its service was throttled or failed
+func isRetryableTagFailure(fi *rgta.FailureInfo) bool {
+	if aws.Int64Value(fi.StatusCode) >= 500 {
+		return true
+	}
+	switch code := aws.StringValue(fi.ErrorCode); code {
+	case rgta.ErrorCodeInternalServiceException:
+		return true
+	default:
+		return strings.Contains(code, "Throttl") || code == "RequestLimitExceeded" || code == "TooManyRequestsException"
+	}
+}
+
+// tagFailure is a resource the RGTA failed to tag
+type tagFailure struct {
+	ARN          arn.ResourceARN
+	ErrorCode    string
+	ErrorMessage string
+}
+
+// newTagFailure creates a failure of the resource with ARN a caused by a
+// request error.
+func newTagFailure(a arn.ResourceARN, err error) tagFailure {
+	f := tagFailure{ARN: a, ErrorMessage: err.Error()}
+	if aerr, ok := err.(awserr.Error); ok {
+		f.ErrorCode, f.ErrorMessage = aerr.Code(), aerr.Message()
+	}
+	return f
+}
+
+func (f tagFailure) String() string {
+	return fmt.Sprintf("%s (%s)", f.ARN, f.ErrorCode)
+}
+
+// log logs f with the fields of a deleter.LogEntry, like failed deletions
+func (f tagFailure) log() {
+	rt, rn := arn.MapARNToRTypeAndRName(f.ARN)
+	fields := logrus.Fields{
+		"error":         fmt.Errorf("%s: %s", f.ErrorCode, f.ErrorMessage),
+		"resource_type": rt,
+		"resource_name": rn,
+		"aws_err_code":  f.ErrorCode,
+		"aws_err_msg":   f.ErrorMessage,
+		"region":        arn.RegionForARN(f.ARN),
+		"account_id":    arn.AccountForARN(f.ARN),
+	}
+	logger.WithFields(fields).Info("Resource request failed.")
+}
+
+// tagFailuresError summarizes resources that failed to be tagged, or changed
+// as described by action, ex. "untagged"
+func tagFailuresError(failures []tagFailure, action string) error {
+	if len(failures) == 0 {
+		return nil
+	}
+	msgs := make([]string, 0, len(failures))
+	for _, f := range failures {
+		msgs = append(msgs, f.String())
+	}
+	sort.Strings(msgs)
+	return fmt.Errorf("%d resources were not %s:\n  %s", len(failures), action, strings.Join(msgs, "\n  "))
 }
 
 func decodeInput(decoder *json.Decoder) (*TagInput, bool, error) {
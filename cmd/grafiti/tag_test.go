@@ -8,9 +8,13 @@ import (
 	"io"
 	"os"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
@@ -19,9 +23,24 @@ import (
 	"github.com/aws/aws-sdk-go/service/route53"
 	"github.com/aws/aws-sdk-go/service/route53/route53iface"
 	"github.com/coreos/grafiti/arn"
+	"github.com/coreos/grafiti/deleter"
+	"github.com/coreos/grafiti/graph"
+	"github.com/spf13/viper"
 )
 
 func TestAddResourceARNToBucket(t *testing.T) {
+	// 60 tags are split into the first 50 and last 10 tags by key
+	manyTags, firstTags, lastTags := make(map[string]string), make(Tags), make(Tags)
+	for i := 0; i < 60; i++ {
+		k := fmt.Sprintf("Key%02d", i)
+		manyTags[k] = "value"
+		if i < 50 {
+			firstTags[k] = "value"
+		} else {
+			lastTags[k] = "value"
+		}
+	}
+
 	cases := []struct {
 		TagInputs      []TagInput
 		ExpectedBucket ARNSetBucket
@@ -40,21 +59,58 @@ func TestAddResourceARNToBucket(t *testing.T) {
 						ResourceType: arn.AutoScalingGroupRType,
 						ResourceARN:  "aws:arn:s3:::bucket-name/s3-bucket-name-2",
 					},
-					Tags: map[string]string{"CreatedBy": "test-user", "ExpiresAt": "2017-05-31"},
+					Tags: map[string]string{"ExpiresAt": "2017-05-31", "CreatedBy": "test-user"},
+				},
+				{
+					TaggingMetadata: TaggingMetadata{
+						ResourceType: arn.AutoScalingGroupRType,
+						ResourceARN:  "aws:arn:s3:::bucket-name/s3-bucket-name-3",
+					},
+					Tags: map[string]string{"CreatedBy": "test-user", "ExpiresAt": "2017-06-01"},
+				},
+				{
+					TaggingMetadata: TaggingMetadata{
+						ResourceType: arn.AutoScalingGroupRType,
+						ResourceARN:  "aws:arn:s3:::bucket-name/s3-bucket-name-4",
+					},
+					Tags: map[string]string{},
 				},
 			},
 			ExpectedBucket: ARNSetBucket{
-				Tag{"CreatedBy", "test-user"}: TrackedARNSet{
+				`{"CreatedBy":"test-user","ExpiresAt":"2017-05-31"}`: TrackedARNSet{
 					ARNSet: ARNSet{
 						"aws:arn:s3:::bucket-name/s3-bucket-name-1": {},
 						"aws:arn:s3:::bucket-name/s3-bucket-name-2": {},
 					},
+					Tags: Tags{"CreatedBy": "test-user", "ExpiresAt": "2017-05-31"},
 				},
-				Tag{"ExpiresAt", "2017-05-31"}: TrackedARNSet{
+				`{"CreatedBy":"test-user","ExpiresAt":"2017-06-01"}`: TrackedARNSet{
 					ARNSet: ARNSet{
-						"aws:arn:s3:::bucket-name/s3-bucket-name-1": {},
-						"aws:arn:s3:::bucket-name/s3-bucket-name-2": {},
+						"aws:arn:s3:::bucket-name/s3-bucket-name-3": {},
 					},
+					Tags: Tags{"CreatedBy": "test-user", "ExpiresAt": "2017-06-01"},
+				},
+			},
+		},
+		// Tag sets larger than the RGTA's limit are split
+		{
+			TagInputs: []TagInput{
+				{
+					TaggingMetadata: TaggingMetadata{
+						ResourceType: arn.EC2InstanceRType,
+						ResourceARN:  "arn:aws:ec2:us-west-2:123456789101:instance/i-1",
+					},
+					Tags: manyTags,
+				},
+			},
+			ExpectedBucket: ARNSetBucket{
+				firstTags.key(): TrackedARNSet{
+					ARNSet: ARNSet{"arn:aws:ec2:us-west-2:123456789101:instance/i-1": {}},
+					Tags:   firstTags,
+				},
+				lastTags.key(): TrackedARNSet{
+					ARNSet: ARNSet{"arn:aws:ec2:us-west-2:123456789101:instance/i-1": {}},
+					Tags:   lastTags,
 				},
 			},
 		},
@@ -67,9 +123,13 @@ func TestAddResourceARNToBucket(t *testing.T) {
 			testBucket.AddARNToBuckets(tm.ResourceARN, ti.Tags)
 		}
 
-		for tag, bucket := range c.ExpectedBucket {
-			if !reflect.DeepEqual(bucket.ARNSet, testBucket[tag].ARNSet) {
-				t.Errorf("AddARNToBuckets case %d failed on Tag %s\nwanted\n%s\ngot\n%s\n", i+1, tag, bucket.ARNSet, testBucket[tag].ARNSet)
+		if len(testBucket) != len(c.ExpectedBucket) {
+			t.Errorf("AddARNToBuckets case %d failed\nwanted %d buckets, got %d", i+1, len(c.ExpectedBucket), len(testBucket))
+		}
+		for key, bucket := range c.ExpectedBucket {
+			got := testBucket[key]
+			if !reflect.DeepEqual(bucket.ARNSet, got.ARNSet) || !reflect.DeepEqual(bucket.Tags, got.Tags) {
+				t.Errorf("AddARNToBuckets case %d failed on tags %s\nwanted\n%s %s\ngot\n%s %s\n", i+1, key, bucket.ARNSet, bucket.Tags, got.ARNSet, got.Tags)
 			}
 		}
 	}
@@ -160,7 +220,7 @@ func TestAddResourceNameToBucket(t *testing.T) {
 }
 
 // Set stdout to pipe and capture printed output of a Print event
-func captureRGTAStdOut(f func(rgtaiface.ResourceGroupsTaggingAPIAPI, arn.ResourceARNs, Tag) error, i rgtaiface.ResourceGroupsTaggingAPIAPI, as arn.ResourceARNs, t Tag) (string, error) {
+func captureRGTAStdOut(f func(rgtaiface.ResourceGroupsTaggingAPIAPI, arn.ResourceARNs, Tags) error, i rgtaiface.ResourceGroupsTaggingAPIAPI, as arn.ResourceARNs, t Tags) (string, error) {
 	oldStdOut := os.Stdout
 	r, w, err := os.Pipe()
 	if err != nil {
@@ -203,7 +263,7 @@ func TestTagARNBucket(t *testing.T) {
 	cases := []struct {
 		Resp     rgta.TagResourcesOutput
 		TestARNs arn.ResourceARNs
-		TestTag  Tag
+		TestTags Tags
 		Expected string
 	}{
 		{
@@ -216,7 +276,7 @@ func TestTagARNBucket(t *testing.T) {
 				"arn:aws:ec2:us-east-1:123456789101:vpc/vpc-aeda0dd7",
 				"arn:aws:ec2:us-east-1:123456789101:internet-gateway/igw-622bab04",
 			},
-			TestTag: Tag{"TaggedAt", "2017-05-31"},
+			TestTags: Tags{"TaggedAt": "2017-05-31", "CreatedBy": "test-user"},
 			Expected: fmt.Sprint(`{"ResourceARNList":[`,
 				`"arn:aws:ec2:us-east-1:123456789101:security-group/sg-a59ca0db",`,
 				`"arn:aws:ec2:us-east-1:123456789101:network-interface/eni-3fec2ff7",`,
@@ -224,11 +284,11 @@ func TestTagARNBucket(t *testing.T) {
 				`"arn:aws:ec2:us-east-1:123456789101:subnet/subnet-01188d49",`,
 				`"arn:aws:ec2:us-east-1:123456789101:vpc/vpc-aeda0dd7",`,
 				`"arn:aws:ec2:us-east-1:123456789101:internet-gateway/igw-622bab04"],`,
-				`"Tags":{"TaggedAt":"2017-05-31"}}`, "\n"),
+				`"Tags":{"CreatedBy":"test-user","TaggedAt":"2017-05-31"}}`, "\n"),
 		}, {
 			Resp:     rgta.TagResourcesOutput{},
 			TestARNs: arn.ResourceARNs{},
-			TestTag:  Tag{"TaggedAt", "2017-05-31"},
+			TestTags: Tags{"TaggedAt": "2017-05-31"},
 			Expected: `{"ResourceARNList":[],"Tags":{"TaggedAt":"2017-05-31"}}` + "\n",
 		},
 	}
@@ -238,7 +298,11 @@ func TestTagARNBucket(t *testing.T) {
 			Resp: c.Resp,
 		}
 
-		outString, err := captureRGTAStdOut(tagARNBucket, tr, c.TestARNs, c.TestTag)
+		f := func(svc rgtaiface.ResourceGroupsTaggingAPIAPI, as arn.ResourceARNs, tags Tags) error {
+			_, err := tagARNBucket(svc, as, tags)
+			return err
+		}
+		outString, err := captureRGTAStdOut(f, tr, c.TestARNs, c.TestTags)
 		if err != nil {
 			t.Fatal("Error capturing tagARNBucket stdout:", err)
 		}
@@ -248,6 +312,138 @@ func TestTagARNBucket(t *testing.T) {
 	}
 }
 
+// Mock RGTA type that fails to tag resources in Failures on each call
+type mockFailedTagResources struct {
+	rgtaiface.ResourceGroupsTaggingAPIAPI
+	Failures []map[string]*rgta.FailureInfo
+	Calls    [][]string
+}
+
+func (tr *mockFailedTagResources) TagResources(in *rgta.TagResourcesInput) (*rgta.TagResourcesOutput, error) {
+	arns := aws.StringValueSlice(in.ResourceARNList)
+	sort.Strings(arns)
+	tr.Calls = append(tr.Calls, arns)
+
+	out := &rgta.TagResourcesOutput{FailedResourcesMap: map[string]*rgta.FailureInfo{}}
+	if i := len(tr.Calls) - 1; i < len(tr.Failures) {
+		for _, a := range arns {
+			if fi, ok := tr.Failures[i][a]; ok {
+				out.FailedResourcesMap[a] = fi
+			}
+		}
+	}
+	return out, nil
+}
+
+func TestTagARNBucketFailures(t *testing.T) {
+	oldDelay := tagRetryDelay
+	tagRetryDelay = 0
+	defer func() { tagRetryDelay = oldDelay }()
+
+	throttled := &rgta.FailureInfo{ErrorCode: aws.String("ThrottlingException"), StatusCode: aws.Int64(400)}
+	internal := &rgta.FailureInfo{ErrorCode: aws.String(rgta.ErrorCodeInternalServiceException), StatusCode: aws.Int64(500)}
+	invalid := &rgta.FailureInfo{ErrorCode: aws.String(rgta.ErrorCodeInvalidParameterException), ErrorMessage: aws.String("not found"), StatusCode: aws.Int64(400)}
+	arns := arn.ResourceARNs{
+		"arn:aws:ec2:us-west-2:123456789101:instance/i-1",
+		"arn:aws:ec2:us-west-2:123456789101:instance/i-2",
+		"arn:aws:ec2:us-west-2:123456789101:instance/i-3",
+	}
+
+	cases := []struct {
+		Failures         []map[string]*rgta.FailureInfo
+		ExpectedCalls    [][]string
+		ExpectedFailures []tagFailure
+	}{
+		{
+			Failures:      nil,
+			ExpectedCalls: [][]string{{string(arns[0]), string(arns[1]), string(arns[2])}},
+		},
+		// Retryable failures are retried, others are returned
+		{
+			Failures: []map[string]*rgta.FailureInfo{
+				{string(arns[0]): throttled, string(arns[1]): invalid},
+				{string(arns[0]): internal},
+			},
+			ExpectedCalls: [][]string{
+				{string(arns[0]), string(arns[1]), string(arns[2])},
+				{string(arns[0])},
+				{string(arns[0])},
+			},
+			ExpectedFailures: []tagFailure{{arns[1], rgta.ErrorCodeInvalidParameterException, "not found"}},
+		},
+		// Resources that still fail after all retries are returned
+		{
+			Failures: []map[string]*rgta.FailureInfo{
+				{string(arns[2]): throttled},
+				{string(arns[2]): throttled},
+				{string(arns[2]): throttled},
+				{string(arns[2]): throttled},
+			},
+			ExpectedCalls: [][]string{
+				{string(arns[0]), string(arns[1]), string(arns[2])},
+				{string(arns[2])},
+				{string(arns[2])},
+				{string(arns[2])},
+			},
+			ExpectedFailures: []tagFailure{{arns[2], "ThrottlingException", ""}},
+		},
+	}
+
+	for i, c := range cases {
+		tr := &mockFailedTagResources{Failures: c.Failures}
+		var failures []tagFailure
+		f := func(svc rgtaiface.ResourceGroupsTaggingAPIAPI, as arn.ResourceARNs, tags Tags) (err error) {
+			failures, err = tagARNBucket(svc, as, tags)
+			return err
+		}
+		if _, err := captureRGTAStdOut(f, tr, arns, Tags{"CreatedBy": "test-user"}); err != nil {
+			t.Fatalf("tagARNBucket case %d: %s", i+1, err)
+		}
+		if !reflect.DeepEqual(tr.Calls, c.ExpectedCalls) {
+			t.Errorf("tagARNBucket case %d failed\nwanted calls: %v\ngot: %v", i+1, c.ExpectedCalls, tr.Calls)
+		}
+		if !reflect.DeepEqual(failures, c.ExpectedFailures) {
+			t.Errorf("tagARNBucket case %d failed\nwanted failures: %v\ngot: %v", i+1, c.ExpectedFailures, failures)
+		}
+	}
+}
+
+func TestTaggerFailures(t *testing.T) {
+	oldDelay := tagRetryDelay
+	tagRetryDelay = 0
+	defer func() { tagRetryDelay = oldDelay }()
+
+	failed := "arn:aws:ec2:us-west-2:123456789101:instance/i-2"
+	tr := &mockFailedTagResources{Failures: []map[string]*rgta.FailureInfo{
+		{failed: {ErrorCode: aws.String(rgta.ErrorCodeInvalidParameterException)}},
+	}}
+	tg := newTagger()
+	tg.svcs[tagTarget{"123456789101", "us-west-2"}] = tr
+	for _, a := range []string{"arn:aws:ec2:us-west-2:123456789101:instance/i-1", failed} {
+		tg.add(&TagInput{
+			TaggingMetadata: TaggingMetadata{
+				ResourceName: arn.ResourceName(a[strings.LastIndex(a, "/")+1:]),
+				ResourceType: arn.EC2InstanceRType,
+				ResourceARN:  arn.ResourceARN(a),
+			},
+			Tags: Tags{"CreatedBy": "test-user"},
+		})
+	}
+
+	f := func(v interface{}) {
+		if err := tg.eject(true); err != nil {
+			t.Fatal("eject:", err)
+		}
+	}
+	captureStdOut(f, nil)
+
+	err := tagFailuresError(tg.failures, "tagged")
+	expected := "1 resources were not tagged:\n  " + failed + " (InvalidParameterException)"
+	if err == nil || err.Error() != expected {
+		t.Errorf("tagger failures failed\nwanted: %s\ngot: %v", expected, err)
+	}
+}
+
 // Set stdout to pipe and capture printed output of a Print event
 func captureRGTAUnsupportedStdOut(f func(interface{}, arn.ResourceType, arn.ResourceName, Tags) error, i interface{}, rt arn.ResourceType, rn arn.ResourceName, t Tags) (string, error) {
 	oldStdOut := os.Stdout
@@ -489,7 +685,7 @@ func TestDecodeInput(t *testing.T) {
 			}
 
 			if !reflect.DeepEqual(ti.TaggingMetadata, c.Expected[i].TaggingMetadata) {
-				t.Errorf("decodeInput failed\nwanted\n%s\ngot\n%s\n", c.Expected[i].TaggingMetadata, ti.TaggingMetadata)
+				t.Errorf("decodeInput failed\nwanted\n%+v\ngot\n%+v\n", c.Expected[i].TaggingMetadata, ti.TaggingMetadata)
 			}
 			if !reflect.DeepEqual(ti.Tags, c.Expected[i].Tags) {
 				t.Errorf("decodeInput failed\nwanted\n%s\ngot\n%s\n", c.Expected[i].Tags, ti.Tags)
@@ -497,3 +693,170 @@ func TestDecodeInput(t *testing.T) {
 		}
 	}
 }
+
+func TestShouldEject(t *testing.T) {
+	viper.Set("bucketEjectLimitSeconds", 60)
+	defer viper.Set("bucketEjectLimitSeconds", 300)
+
+	now := time.Now()
+	cases := []struct {
+		SetSize   int
+		CreatedAt time.Time
+		Expected  bool
+	}{
+		{20, now, true},
+		{1, now, false},
+		{1, now.Add(-2 * time.Minute), true},
+		{0, now.Add(-2 * time.Minute), false},
+	}
+
+	for i, c := range cases {
+		if got := shouldEject(20, c.SetSize, c.CreatedAt); got != c.Expected {
+			t.Errorf("shouldEject case %d: wanted %t, got %t", i+1, c.Expected, got)
+		}
+	}
+}
+
+func TestChildARN(t *testing.T) {
+	tt := tagTarget{"123456789101", "us-west-2"}
+	cases := []struct {
+		Type     arn.ResourceType
+		Name     arn.ResourceName
+		Expected arn.ResourceARN
+	}{
+		{arn.EC2VolumeRType, "vol-1", "arn:aws:ec2:us-west-2:123456789101:volume/vol-1"},
+		{arn.EC2NetworkInterfaceRType, "eni-1", "arn:aws:ec2:us-west-2:123456789101:network-interface/eni-1"},
+		{arn.EC2EIPRType, "eipalloc-1", "arn:aws:ec2:us-west-2:123456789101:elastic-ip/eipalloc-1"},
+		{arn.EC2EIPAssociationRType, "eipassoc-1", ""},
+	}
+
+	for i, c := range cases {
+		if got := childARN(tt, c.Type, c.Name); got != c.Expected {
+			t.Errorf("childARN case %d failed\nwanted: %s\ngot: %s", i+1, c.Expected, got)
+		}
+	}
+}
+
+func TestDiscoverChildrenSessionConfig(t *testing.T) {
+	prev := &aws.Config{Region: aws.String("eu-west-1")}
+	deleter.SetSessionConfig(prev)
+	defer deleter.SetSessionConfig(nil)
+
+	// S3 buckets have no children, so no requests are made
+	if _, err := discoverChildren(tagTarget{"123456789101", "us-west-2"}, arn.S3BucketRType, arn.ResourceNames{"bucket"}); err != nil {
+		t.Fatal("discoverChildren:", err)
+	}
+	if got := deleter.SessionConfig(); got != prev {
+		t.Errorf("discoverChildren did not restore the session config, got region %s", aws.StringValue(got.Region))
+	}
+}
+
+func TestTaggerPropagate(t *testing.T) {
+	oldDiscover := discoverChildren
+	defer func() { discoverChildren = oldDiscover }()
+	discoverChildren = func(tt tagTarget, rt arn.ResourceType, names arn.ResourceNames) ([]graph.Child, error) {
+		var children []graph.Child
+		for _, n := range names {
+			if rt == arn.EC2InstanceRType && n == "i-1" {
+				children = append(children,
+					graph.Child{Parent: n, Type: arn.EC2VolumeRType, Name: "vol-1"},
+					graph.Child{Parent: n, Type: arn.EC2NetworkInterfaceRType, Name: "eni-1"},
+				)
+			}
+		}
+		return children, nil
+	}
+
+	arnPrefix := "arn:aws:ec2:us-west-2:123456789101:"
+	tr := &mockMergeTagResources{Tagged: map[string][]string{}}
+	tg := newTagger()
+	tg.propagate = true
+	tg.svcs[tagTarget{"123456789101", "us-west-2"}] = tr
+	inputs := []struct {
+		Type arn.ResourceType
+		Name string
+		Tags Tags
+	}{
+		{arn.EC2InstanceRType, "instance/i-1", Tags{"CreatedBy": "test-user"}},
+		{arn.EC2InstanceRType, "instance/i-2", Tags{"CreatedBy": "other-user"}},
+		// Subnets have no children
+		{arn.EC2SubnetRType, "subnet/subnet-1", Tags{"CreatedBy": "test-user"}},
+	}
+	for _, in := range inputs {
+		tg.add(&TagInput{
+			TaggingMetadata: TaggingMetadata{
+				ResourceName: arn.ResourceName(in.Name[strings.Index(in.Name, "/")+1:]),
+				ResourceType: in.Type,
+				ResourceARN:  arn.ResourceARN(arnPrefix + in.Name),
+			},
+			Tags: in.Tags,
+		})
+	}
+	if _, ok := tg.parentBuckets[tagTarget{"123456789101", "us-west-2"}][arn.EC2SubnetRType]; ok {
+		t.Error("tagger propagate failed: subnets should not be parents")
+	}
+
+	f := func(v interface{}) {
+		if err := tg.eject(true); err != nil {
+			t.Fatal("eject:", err)
+		}
+	}
+	captureStdOut(f, nil)
+
+	expected := map[string][]string{
+		Tags{"CreatedBy": "test-user"}.key(): {
+			arnPrefix + "instance/i-1",
+			arnPrefix + "network-interface/eni-1",
+			arnPrefix + "subnet/subnet-1",
+			arnPrefix + "volume/vol-1",
+		},
+		Tags{"CreatedBy": "other-user"}.key(): {arnPrefix + "instance/i-2"},
+	}
+	if !reflect.DeepEqual(tr.Tagged, expected) {
+		t.Errorf("tagger propagate failed\nwanted: %v\ngot: %v", expected, tr.Tagged)
+	}
+}
+
+func TestTaggerPropagateErrors(t *testing.T) {
+	oldDiscover := discoverChildren
+	defer func() { discoverChildren = oldDiscover }()
+	discoverChildren = func(tt tagTarget, rt arn.ResourceType, names arn.ResourceNames) ([]graph.Child, error) {
+		return nil, awserr.New("UnauthorizedOperation", "not allowed", nil)
+	}
+	defer func() { ignoreErrors = false }()
+
+	instanceARN := arn.ResourceARN("arn:aws:ec2:us-west-2:123456789101:instance/i-1")
+	cases := []struct {
+		IgnoreErrors     bool
+		WantErr          bool
+		ExpectedFailures []tagFailure
+	}{
+		{false, true, nil},
+		// Parents whose children could not be discovered are failures
+		{true, false, []tagFailure{{instanceARN, "UnauthorizedOperation", "not allowed"}}},
+	}
+
+	for i, c := range cases {
+		ignoreErrors = c.IgnoreErrors
+		tg := newTagger()
+		tg.propagate = true
+		tg.svcs[tagTarget{"123456789101", "us-west-2"}] = &mockMergeTagResources{Tagged: map[string][]string{}}
+		tg.add(&TagInput{
+			TaggingMetadata: TaggingMetadata{
+				ResourceName: "i-1",
+				ResourceType: arn.EC2InstanceRType,
+				ResourceARN:  instanceARN,
+			},
+			Tags: Tags{"CreatedBy": "test-user"},
+		})
+
+		var err error
+		captureStdOut(func(interface{}) { err = tg.eject(true) }, nil)
+		if (err != nil) != c.WantErr {
+			t.Errorf("tagger propagate errors case %d: wanted error %t, got %v", i+1, c.WantErr, err)
+		}
+		if !reflect.DeepEqual(tg.failures, c.ExpectedFailures) {
+			t.Errorf("tagger propagate errors case %d failed\nwanted: %v\ngot: %v", i+1, c.ExpectedFailures, tg.failures)
+		}
+	}
+}
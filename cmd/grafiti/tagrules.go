@@ -0,0 +1,139 @@
+// Copyright © 2017 grafiti authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/coreos/grafiti/arn"
+	"github.com/spf13/viper"
+)
+
+// patternVarEnvPrefix prefixes env variables that set pattern variables, ex.
+// GRF_VAR_TEAM sets '$vars.team'.
+const patternVarEnvPrefix = "GRF_VAR_"
+
+var (
+	// tagRules are the rules in the 'tagRules' config table array.
+	tagRules []tagRule
+	// patternVars are the values of '$vars' in tag patterns.
+	patternVars = map[string]interface{}{}
+)
+
+// tagRule generates tags for resources that match its conditions, in addition
+// to tags generated by the 'tagPatterns' config field.
+type tagRule struct {
+	// ResourceTypes are the resource types the rule applies to. The rule applies
+	// to all resource types if empty.
+	ResourceTypes []string
+	// When is a jq pattern run like tag patterns. The rule only applies if the
+	// pattern's first result is true.
+	When string
+	// TagPatterns generate tags like the 'tagPatterns' config field.
+	TagPatterns []string
+}
+
+// matches returns true if r applies to a resource of type rt created by the
+// event v. values are the values of jqVariables.
+func (r tagRule) matches(rt arn.ResourceType, v interface{}, values []interface{}) (bool, error) {
+	if len(r.ResourceTypes) != 0 {
+		found := false
+		for _, t := range r.ResourceTypes {
+			if arn.ResourceType(t) == rt {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, nil
+		}
+	}
+	if r.When == "" {
+		return true, nil
+	}
+
+	results, err := evalJQ(r.When, v, values...)
+	if err != nil {
+		return false, err
+	}
+	if len(results) == 0 {
+		return false, nil
+	}
+	match, ok := results[0].(bool)
+	return ok && match, nil
+}
+
+// getTagRules reads tag rules from the 'tagRules' config table array. Patterns
+// of each rule are compiled so invalid rules are reported before any events
+// are parsed.
+func getTagRules() ([]tagRule, error) {
+	var rules []tagRule
+	if err := viper.UnmarshalKey("tagRules", &rules); err != nil {
+		return nil, fmt.Errorf("read tagRules: %s", err)
+	}
+
+	for i, r := range rules {
+		if len(r.TagPatterns) == 0 {
+			return nil, fmt.Errorf("tagRules %d: no tagPatterns", i)
+		}
+		for _, rt := range r.ResourceTypes {
+			if arn.NamespaceForResource(arn.ResourceType(rt)) == "" {
+				return nil, fmt.Errorf("tagRules %d: unknown resourceType %q", i, rt)
+			}
+		}
+		for _, p := range append([]string{r.When}, r.TagPatterns...) {
+			if p == "" {
+				continue
+			}
+			if _, err := compileJQ(p); err != nil {
+				return nil, fmt.Errorf("tagRules %d: %s", i, err)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// getPatternVars reads pattern variables from the 'vars' config table and
+// GRF_VAR_<NAME> env variables, which override config fields of the same name.
+// Names are lower case, as in config fields.
+func getPatternVars() map[string]interface{} {
+	vars := make(map[string]interface{})
+	for k, v := range viper.GetStringMap("vars") {
+		vars[k] = v
+	}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, patternVarEnvPrefix) {
+			continue
+		}
+		kv = strings.TrimPrefix(kv, patternVarEnvPrefix)
+		if i := strings.Index(kv, "="); i > 0 {
+			vars[strings.ToLower(kv[:i])] = kv[i+1:]
+		}
+	}
+	return vars
+}
+
+// initTagRules sets tag rules and pattern variables from config and env
+// variables.
+func initTagRules() {
+	rules, err := getTagRules()
+	if err != nil {
+		exitWithError(err)
+	}
+	tagRules = rules
+	patternVars = getPatternVars()
+}
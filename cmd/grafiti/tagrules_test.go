@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/grafiti/arn"
+	"github.com/spf13/viper"
+)
+
+func TestGetTagRules(t *testing.T) {
+	defer viper.Set("tagRules", nil)
+
+	cases := []struct {
+		Input    []map[string]interface{}
+		Expected []tagRule
+		WantErr  bool
+	}{
+		{
+			[]map[string]interface{}{
+				{"resourceTypes": []string{"AWS::EC2::Instance"}, "tagPatterns": []string{"{TTL: \"1d\"}"}},
+				{"when": "$owner.Type == \"AssumedRole\"", "tagPatterns": []string{"{CI: \"true\"}"}},
+			},
+			[]tagRule{
+				{ResourceTypes: []string{"AWS::EC2::Instance"}, TagPatterns: []string{"{TTL: \"1d\"}"}},
+				{When: "$owner.Type == \"AssumedRole\"", TagPatterns: []string{"{CI: \"true\"}"}},
+			},
+			false,
+		},
+		{[]map[string]interface{}{{"resourceTypes": []string{"AWS::EC2::Instance"}}}, nil, true},
+		{[]map[string]interface{}{{"resourceTypes": []string{"AWS::Nothing::Thing"}, "tagPatterns": []string{"{}"}}}, nil, true},
+		{[]map[string]interface{}{{"when": ".eventName ==", "tagPatterns": []string{"{}"}}}, nil, true},
+		{[]map[string]interface{}{{"tagPatterns": []string{"{TTL: $unknown}"}}}, nil, true},
+	}
+
+	for i, c := range cases {
+		viper.Set("tagRules", c.Input)
+		got, err := getTagRules()
+		if (err != nil) != c.WantErr {
+			t.Errorf("getTagRules case %d: wanted error %t, got %v", i+1, c.WantErr, err)
+			continue
+		}
+		if !c.WantErr && !reflect.DeepEqual(got, c.Expected) {
+			t.Errorf("getTagRules case %d failed\nwanted: %+v\ngot: %+v", i+1, c.Expected, got)
+		}
+	}
+}
+
+func TestGetPatternVars(t *testing.T) {
+	viper.Set("vars", map[string]interface{}{"team": "infra", "ttldays": 14})
+	defer viper.Set("vars", nil)
+	os.Setenv("GRF_VAR_TEAM", "ci")
+	defer os.Unsetenv("GRF_VAR_TEAM")
+
+	expected := map[string]interface{}{"team": "ci", "ttldays": 14}
+	if got := getPatternVars(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("getPatternVars failed\nwanted: %v\ngot: %v", expected, got)
+	}
+}
+
+func TestGetTagsRules(t *testing.T) {
+	viper.Set("tagPatterns", []string{
+		"{Team: $vars.team, ExpiresAt: \"14d\"}",
+		"{Resource: $metadata.ResourceARN, Event: $event.eventName}",
+	})
+	defer viper.Set("tagPatterns", []string{})
+	patternVars = map[string]interface{}{"team": "infra"}
+	defer func() { patternVars = map[string]interface{}{} }()
+	tagRules = []tagRule{
+		{ResourceTypes: []string{"AWS::EC2::Instance"}, TagPatterns: []string{"{ExpiresAt: \"1d\"}"}},
+		{When: "$metadata.Region == \"us-east-1\"", TagPatterns: []string{"{Region: $metadata.Region}"}},
+	}
+	defer func() { tagRules = nil }()
+
+	event := `{"eventName":"RunInstances"}`
+	cases := []struct {
+		Input    TaggingMetadata
+		Expected map[string]string
+	}{
+		{
+			TaggingMetadata{ResourceType: arn.EC2InstanceRType, ResourceARN: "arn:aws:ec2:us-west-2:123456789101:instance/i-1", Region: "us-west-2"},
+			map[string]string{"Team": "infra", "ExpiresAt": "1d", "Resource": "arn:aws:ec2:us-west-2:123456789101:instance/i-1", "Event": "RunInstances"},
+		},
+		{
+			TaggingMetadata{ResourceType: arn.EC2VolumeRType, ResourceARN: "arn:aws:ec2:us-east-1:123456789101:volume/vol-1", Region: "us-east-1"},
+			map[string]string{"Team": "infra", "ExpiresAt": "14d", "Resource": "arn:aws:ec2:us-east-1:123456789101:volume/vol-1", "Event": "RunInstances", "Region": "us-east-1"},
+		},
+	}
+
+	for i, c := range cases {
+		if got := getTags(event, &c.Input); !reflect.DeepEqual(got, c.Expected) {
+			t.Errorf("getTags case %d failed\nwanted: %v\ngot: %v", i+1, c.Expected, got)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright © 2017 grafiti authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	rgta "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+)
+
+// TimeFilter matches resources with a tag whose value is a time before and/or
+// after a point in time. Before and After take "now", "now+<duration>",
+// "now-<duration>", RFC-3339 timestamps, or dates formatted "yyyy-mm-dd".
+// Durations take Go duration units plus "d" (days) and "w" (weeks), ex.
+// "now+7d". Tag values must be RFC-3339 timestamps or "yyyy-mm-dd" dates.
+type TimeFilter struct {
+	Key    string
+	Before string
+	After  string
+}
+
+// timePredicate is a TimeFilter with Before and After resolved to times
+type timePredicate struct {
+	Key           string
+	Before, After time.Time
+}
+
+type timePredicates []timePredicate
+
+// compileTimeFilters resolves all time expressions in tfs relative to now.
+func compileTimeFilters(tfs []*TimeFilter, now time.Time) (timePredicates, error) {
+	preds := make(timePredicates, 0, len(tfs))
+	for _, tf := range tfs {
+		if tf == nil {
+			continue
+		}
+		if tf.Key == "" {
+			return nil, fmt.Errorf("time filter: Key is required")
+		}
+		if tf.Before == "" && tf.After == "" {
+			return nil, fmt.Errorf("time filter %q: one of Before, After is required", tf.Key)
+		}
+
+		p := timePredicate{Key: tf.Key}
+		var err error
+		if tf.Before != "" {
+			if p.Before, err = parseTimeExpr(tf.Before, now); err != nil {
+				return nil, fmt.Errorf("time filter %q: %s", tf.Key, err)
+			}
+		}
+		if tf.After != "" {
+			if p.After, err = parseTimeExpr(tf.After, now); err != nil {
+				return nil, fmt.Errorf("time filter %q: %s", tf.Key, err)
+			}
+		}
+		preds = append(preds, p)
+	}
+	return preds, nil
+}
+
+// Match returns whether tags satisfy all predicates. Resources missing a tag,
+// or with a tag value that is not a time, do not match.
+func (ps timePredicates) Match(tags map[string]string) bool {
+	for _, p := range ps {
+		v, ok := tags[p.Key]
+		if !ok {
+			return false
+		}
+		t, err := parseTagTime(v)
+		if err != nil {
+			logger.Debugf("time filter %q: %s", p.Key, err)
+			return false
+		}
+		if !p.Before.IsZero() && !t.Before(p.Before) {
+			return false
+		}
+		if !p.After.IsZero() && !t.After(p.After) {
+			return false
+		}
+	}
+	return true
+}
+
+// addKeyTagFilters adds a key-only TagFilter for each predicate key not in tfs,
+// so only resources with those tags are requested.
+func (ps timePredicates) addKeyTagFilters(tfs []*rgta.TagFilter) []*rgta.TagFilter {
+	for _, p := range ps {
+		found := false
+		for _, tf := range tfs {
+			if aws.StringValue(tf.Key) == p.Key {
+				found = true
+				break
+			}
+		}
+		if !found {
+			tfs = append(tfs, &rgta.TagFilter{Key: aws.String(p.Key)})
+		}
+	}
+	return tfs
+}
+
+// Formats of times accepted in tag values and time expressions
+var tagTimeFormats = []string{time.RFC3339, "2006-01-02"}
+
+func parseTagTime(v string) (time.Time, error) {
+	for _, f := range tagTimeFormats {
+		if t, err := time.Parse(f, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a RFC-3339 timestamp or yyyy-mm-dd date", v)
+}
+
+// parseTimeExpr parses "now", "now+<duration>", "now-<duration>", or a time
+// accepted by parseTagTime.
+func parseTimeExpr(expr string, now time.Time) (time.Time, error) {
+	expr = strings.TrimSpace(expr)
+	if !strings.HasPrefix(expr, "now") {
+		return parseTagTime(expr)
+	}
+
+	offset := strings.TrimPrefix(expr, "now")
+	if offset == "" {
+		return now, nil
+	}
+	sign := offset[0]
+	if sign != '+' && sign != '-' {
+		return time.Time{}, fmt.Errorf("invalid time expression %q", expr)
+	}
+	d, err := parseDuration(offset[1:])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time expression %q: %s", expr, err)
+	}
+	if sign == '-' {
+		d = -d
+	}
+	return now.Add(d), nil
+}
+
+// parseDuration parses Go durations plus whole numbers of days ("7d") and
+// weeks ("2w").
+func parseDuration(s string) (time.Duration, error) {
+	units := map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+	}
+	for u, ud := range units {
+		if strings.HasSuffix(s, u) {
+			n, err := strconv.Atoi(strings.TrimSuffix(s, u))
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			return time.Duration(n) * ud, nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+// parseTimeFilterFlag parses a --time-filter flag value of the form
+// "Key<expr" (tag time before expr) or "Key>expr" (tag time after expr).
+func parseTimeFilterFlag(s string) (*TimeFilter, error) {
+	if i := strings.IndexAny(s, "<>"); i > 0 {
+		key, expr := strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:])
+		if s[i] == '<' {
+			return &TimeFilter{Key: key, Before: expr}, nil
+		}
+		return &TimeFilter{Key: key, After: expr}, nil
+	}
+	return nil, fmt.Errorf("invalid time filter %q, expected 'Key<time' or 'Key>time'", s)
+}
+
+// parseTimeFilterFlags parses all --time-filter flag values.
+func parseTimeFilterFlags(vals []string) ([]*TimeFilter, error) {
+	tfs := make([]*TimeFilter, 0, len(vals))
+	for _, v := range vals {
+		tf, err := parseTimeFilterFlag(v)
+		if err != nil {
+			return nil, err
+		}
+		tfs = append(tfs, tf)
+	}
+	return tfs, nil
+}
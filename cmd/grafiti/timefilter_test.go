@@ -0,0 +1,177 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	rgta "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/coreos/grafiti/arn"
+	"github.com/spf13/viper"
+)
+
+var testNow = time.Date(2017, 8, 15, 12, 0, 0, 0, time.UTC)
+
+func TestParseTimeExpr(t *testing.T) {
+	cases := []struct {
+		Input    string
+		Expected time.Time
+		Err      bool
+	}{
+		{Input: "now", Expected: testNow},
+		{Input: "now+7d", Expected: testNow.AddDate(0, 0, 7)},
+		{Input: "now-2w", Expected: testNow.AddDate(0, 0, -14)},
+		{Input: "now+36h", Expected: testNow.Add(36 * time.Hour)},
+		{Input: "2017-08-01", Expected: time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC)},
+		{Input: "2017-08-01T10:00:00Z", Expected: time.Date(2017, 8, 1, 10, 0, 0, 0, time.UTC)},
+		{Input: "now*7d", Err: true},
+		{Input: "now+xd", Err: true},
+		{Input: "tomorrow", Err: true},
+	}
+
+	for i, c := range cases {
+		got, err := parseTimeExpr(c.Input, testNow)
+		if c.Err {
+			if err == nil {
+				t.Errorf("case %d: parseTimeExpr(%q) failed: expected error", i, c.Input)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(c.Expected) {
+			t.Errorf("case %d: parseTimeExpr(%q) failed\nwanted %s\ngot %s (err: %v)\n", i, c.Input, c.Expected, got, err)
+		}
+	}
+}
+
+func TestTimePredicatesMatch(t *testing.T) {
+	cases := []struct {
+		Filters  []*TimeFilter
+		Tags     map[string]string
+		Expected bool
+	}{
+		{
+			// No filters match everything
+			Tags:     map[string]string{},
+			Expected: true,
+		},
+		{
+			Filters:  []*TimeFilter{{Key: "ExpiresAt", Before: "now"}},
+			Tags:     map[string]string{"ExpiresAt": "2017-08-14"},
+			Expected: true,
+		},
+		{
+			Filters:  []*TimeFilter{{Key: "ExpiresAt", Before: "now"}},
+			Tags:     map[string]string{"ExpiresAt": "2017-08-16"},
+			Expected: false,
+		},
+		{
+			// Expires within 7 days
+			Filters:  []*TimeFilter{{Key: "ExpiresAt", Before: "now+7d", After: "now"}},
+			Tags:     map[string]string{"ExpiresAt": "2017-08-20T00:00:00Z"},
+			Expected: true,
+		},
+		{
+			Filters:  []*TimeFilter{{Key: "ExpiresAt", Before: "now+7d", After: "now"}},
+			Tags:     map[string]string{"ExpiresAt": "2017-08-30"},
+			Expected: false,
+		},
+		{
+			// Missing tag
+			Filters:  []*TimeFilter{{Key: "ExpiresAt", Before: "now"}},
+			Tags:     map[string]string{"CreatedBy": "user"},
+			Expected: false,
+		},
+		{
+			// Tag value is not a time
+			Filters:  []*TimeFilter{{Key: "ExpiresAt", Before: "now"}},
+			Tags:     map[string]string{"ExpiresAt": "never"},
+			Expected: false,
+		},
+	}
+
+	for i, c := range cases {
+		preds, err := compileTimeFilters(c.Filters, testNow)
+		if err != nil {
+			t.Fatalf("case %d: compileTimeFilters failed: %s", i, err)
+		}
+		if got := preds.Match(c.Tags); got != c.Expected {
+			t.Errorf("case %d: Match failed\nwanted %t\ngot %t\n", i, c.Expected, got)
+		}
+	}
+}
+
+func TestCompileTimeFiltersInvalid(t *testing.T) {
+	cases := [][]*TimeFilter{
+		{{Before: "now"}},
+		{{Key: "ExpiresAt"}},
+		{{Key: "ExpiresAt", After: "yesterday"}},
+	}
+
+	for i, c := range cases {
+		if _, err := compileTimeFilters(c, testNow); err == nil {
+			t.Errorf("case %d: compileTimeFilters failed: expected error", i)
+		}
+	}
+}
+
+func TestParseTimeFilterFlag(t *testing.T) {
+	cases := []struct {
+		Input    string
+		Expected *TimeFilter
+	}{
+		{Input: "ExpiresAt<now", Expected: &TimeFilter{Key: "ExpiresAt", Before: "now"}},
+		{Input: "CreatedAt > 2017-01-01", Expected: &TimeFilter{Key: "CreatedAt", After: "2017-01-01"}},
+		{Input: "ExpiresAt=now"},
+		{Input: "<now"},
+	}
+
+	for i, c := range cases {
+		got, err := parseTimeFilterFlag(c.Input)
+		if c.Expected == nil {
+			if err == nil {
+				t.Errorf("case %d: parseTimeFilterFlag(%q) failed: expected error", i, c.Input)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, c.Expected) {
+			t.Errorf("case %d: parseTimeFilterFlag(%q) failed\nwanted %+v\ngot %+v (err: %v)\n", i, c.Input, c.Expected, got, err)
+		}
+	}
+}
+
+func TestGetResourcesForTagsTimeFilters(t *testing.T) {
+	viper.Set("resourceTypes", []string{})
+
+	svc := &mockRGTAGetResources{
+		Resp: rgta.GetResourcesOutput{
+			ResourceTagMappingList: []*rgta.ResourceTagMapping{
+				{
+					ResourceARN: aws.String("arn:aws:ec2:us-west-2:123456789101:instance/i-expired"),
+					Tags:        []*rgta.Tag{{Key: aws.String("ExpiresAt"), Value: aws.String("2017-08-01")}},
+				}, {
+					ResourceARN: aws.String("arn:aws:ec2:us-west-2:123456789101:instance/i-alive"),
+					Tags:        []*rgta.Tag{{Key: aws.String("ExpiresAt"), Value: aws.String("2017-09-01")}},
+				},
+			},
+		},
+	}
+
+	preds, err := compileTimeFilters([]*TimeFilter{{Key: "ExpiresAt", Before: "now"}}, testNow)
+	if err != nil {
+		t.Fatalf("compileTimeFilters failed: %s", err)
+	}
+	tagFilters := preds.addKeyTagFilters(nil)
+	if len(tagFilters) != 1 || aws.StringValue(tagFilters[0].Key) != "ExpiresAt" {
+		t.Errorf("addKeyTagFilters failed: got %v", tagFilters)
+	}
+
+	rs, err := getResourcesForTags(svc, tagFilters, preds, nil)
+	if err != nil {
+		t.Fatalf("getResourcesForTags failed: %s", err)
+	}
+	expected := arn.ResourceARNs{"arn:aws:ec2:us-west-2:123456789101:instance/i-expired"}
+	if got := rs.ARNs(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("getResourcesForTags failed\nwanted\n%v\ngot\n%v\n", expected, got)
+	}
+}
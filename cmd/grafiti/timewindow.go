@@ -0,0 +1,250 @@
+// Copyright © 2017 grafiti authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/spf13/viper"
+)
+
+// lastRunExpr is the time window expression for the end of the last run.
+const lastRunExpr = "last-run"
+
+// timeWindow is a time window to parse events in.
+type timeWindow struct {
+	start, end time.Time
+}
+
+// Time window flags of `grafiti parse`, which take precedence over all time
+// window config fields.
+var parseSince, parseUntil string
+
+// getTimeWindow calculates the time window to parse events in from either
+// --since and --until, or one of the 'since' and 'until', 'startTimeStamp'
+// and 'endTimeStamp' or 'startHour' and 'endHour' config field pairs. The
+// window is calculated once per run and cached in st.
+func getTimeWindow(st *State) (*time.Time, *time.Time, error) {
+	if st.window == nil {
+		w, err := calcTimeWindow(st, time.Now())
+		if err != nil {
+			return nil, nil, fmt.Errorf("time window: %s", err)
+		}
+		st.window = w
+	}
+	return aws.Time(st.window.start), aws.Time(st.window.end), nil
+}
+
+func calcTimeWindow(st *State, now time.Time) (*timeWindow, error) {
+	since, until := parseSince, parseUntil
+	if since == "" && until == "" {
+		since, until = viper.GetString("since"), viper.GetString("until")
+		// GRF_SINCE and GRF_UNTIL override config fields like flags do
+		fromEnv := os.Getenv("GRF_SINCE") != "" || os.Getenv("GRF_UNTIL") != ""
+		if (since != "" || until != "") && !fromEnv {
+			for _, key := range []string{"startHour", "endHour", "startTimeStamp", "endTimeStamp"} {
+				if isWindowFieldSet(key) {
+					return nil, fmt.Errorf("since and until cannot be used with %s, remove one of them from your config", key)
+				}
+			}
+		}
+	}
+
+	var start, end *time.Time
+	var err error
+	switch {
+	case since != "" || until != "":
+		start, end, err = calcTimeWindowFromExprs(since, until, now, st.LastRunEnd)
+	case isWindowFieldSet("startTimeStamp") && isWindowFieldSet("endTimeStamp"):
+		start, end, err = calcTimeWindowFromTimeStamp(viper.GetString("startTimeStamp"), viper.GetString("endTimeStamp"))
+	case isWindowFieldSet("startHour") && isWindowFieldSet("endHour"):
+		start, end, err = calcTimeWindowFromHourRange(viper.GetInt("startHour"), viper.GetInt("endHour"))
+	default:
+		err = errors.New("no time window set, use --since (ex. --since 8h) or the since and until config fields")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &timeWindow{*start, *end}, nil
+}
+
+// isWindowFieldSet returns true if the time window config field key is set to
+// a non-empty value.
+func isWindowFieldSet(key string) bool {
+	return viper.IsSet(key) && viper.GetString(key) != ""
+}
+
+// calcTimeWindowFromExprs calculates a time window from since and until time
+// expressions, which are parsed by parseWindowExpr. until defaults to now.
+func calcTimeWindowFromExprs(since, until string, now time.Time, lastRun *time.Time) (*time.Time, *time.Time, error) {
+	if since == "" {
+		return nil, nil, fmt.Errorf("until (%q) requires since", until)
+	}
+	startTime, err := parseWindowExpr(since, now, lastRun)
+	if err != nil {
+		return nil, nil, fmt.Errorf("since: %s", err)
+	}
+	endTime := now
+	if until != "" {
+		if endTime, err = parseWindowExpr(until, now, lastRun); err != nil {
+			return nil, nil, fmt.Errorf("until: %s", err)
+		}
+	}
+
+	if !startTime.Before(endTime) {
+		return nil, nil, fmt.Errorf("since (%q, %s) must be before until (%s)", since, startTime.Format(time.RFC3339), endTime.Format(time.RFC3339))
+	}
+	return aws.Time(startTime), aws.Time(endTime), nil
+}
+
+// Calculates a time window between a starting RFC3339 timestamp string and
+// ending RFC3339 timestamp string.
+func calcTimeWindowFromTimeStamp(start, end string) (*time.Time, *time.Time, error) {
+	startTime, err := time.Parse(time.RFC3339, start)
+	if err != nil {
+		return nil, nil, fmt.Errorf("startTimeStamp %q is not a RFC-3339 timestamp, ex. 2017-06-14T08:00:00Z", start)
+	}
+
+	endTime, err := time.Parse(time.RFC3339, end)
+	if err != nil {
+		return nil, nil, fmt.Errorf("endTimeStamp %q is not a RFC-3339 timestamp, ex. 2017-06-14T08:00:00Z", end)
+	}
+
+	if !startTime.Before(endTime) {
+		return nil, nil, fmt.Errorf("startTimeStamp (%s) must be before endTimeStamp (%s)", start, end)
+	}
+
+	return aws.Time(startTime), aws.Time(endTime), nil
+}
+
+// Calculates a time window between a starting hour and ending hour, both
+// relative to now.
+func calcTimeWindowFromHourRange(start, end int) (*time.Time, *time.Time, error) {
+	if start > 0 || end > 0 {
+		return nil, nil, fmt.Errorf("startHour (%d) and endHour (%d) are hours relative to now and must be 0 or negative, ex. startHour = -8 and endHour = 0 for the last 8 hours, or since = \"8h\"", start, end)
+	}
+	if start >= end {
+		return nil, nil, fmt.Errorf("startHour (%d) must be before endHour (%d), ex. startHour = %d and endHour = %d", start, end, end, start)
+	}
+
+	now := time.Now()
+	startTime := now.Add(time.Duration(start) * time.Hour)
+	endTime := now.Add(time.Duration(end) * time.Hour)
+
+	return aws.Time(startTime), aws.Time(endTime), nil
+}
+
+// Calendar anchors of time window expressions, in UTC
+var calendarAnchors = map[string]func(now time.Time) time.Time{
+	"now": func(now time.Time) time.Time { return now },
+	"today": func(now time.Time) time.Time {
+		return startOfDay(now)
+	},
+	"yesterday": func(now time.Time) time.Time {
+		return startOfDay(now).AddDate(0, 0, -1)
+	},
+	"this-week": func(now time.Time) time.Time {
+		return startOfWeek(now)
+	},
+	"last-week": func(now time.Time) time.Time {
+		return startOfWeek(now).AddDate(0, 0, -7)
+	},
+	"this-month": func(now time.Time) time.Time {
+		y, m, _ := now.UTC().Date()
+		return time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+	},
+	"last-month": func(now time.Time) time.Time {
+		y, m, _ := now.UTC().Date()
+		return time.Date(y, m-1, 1, 0, 0, 0, 0, time.UTC)
+	},
+}
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// startOfWeek returns the start of the Monday of t's week.
+func startOfWeek(t time.Time) time.Time {
+	day := startOfDay(t)
+	return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+}
+
+// Formats of times accepted in time window expressions, in addition to
+// tagTimeFormats. Times without a zone are in UTC.
+var windowTimeFormats = []string{"2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02 15:04:05"}
+
+// parseWindowExpr parses a time window expression relative to now:
+//   - a duration ago, ex. "36h", "90m", "7d" or "2w"
+//   - "last-run", the end of the time window of the last completed run
+//   - a calendar anchor with an optional offset, ex. "today", "yesterday+9h",
+//     "this-week", "last-month" or "now-1h"
+//   - a RFC-3339 timestamp, a yyyy-mm-dd date, or "yyyy-mm-dd hh:mm" in UTC
+func parseWindowExpr(expr string, now time.Time, lastRun *time.Time) (time.Time, error) {
+	expr = strings.ToLower(strings.TrimSpace(expr))
+
+	if expr == lastRunExpr {
+		if lastRun == nil {
+			return time.Time{}, fmt.Errorf("%q requires a completed run recorded in stateFile", expr)
+		}
+		return *lastRun, nil
+	}
+
+	// Durations are always in the past, so their sign cannot be backwards
+	if d, err := parseDuration(strings.TrimSuffix(strings.TrimPrefix(expr, "-"), " ago")); err == nil {
+		if strings.HasPrefix(expr, "+") || d < 0 {
+			return time.Time{}, fmt.Errorf("duration %q must be how long ago, ex. \"36h\"", expr)
+		}
+		return now.Add(-d), nil
+	}
+
+	// Longer anchors are matched first, so "this-week-1d" is not read as "this"
+	for _, name := range []string{"yesterday", "this-month", "last-month", "this-week", "last-week", "today", "now"} {
+		if !strings.HasPrefix(expr, name) {
+			continue
+		}
+		anchor := calendarAnchors[name](now)
+		offset := strings.TrimPrefix(expr, name)
+		if offset == "" {
+			return anchor, nil
+		}
+		if offset[0] != '+' && offset[0] != '-' {
+			break
+		}
+		d, err := parseDuration(offset[1:])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid offset in %q: %s", expr, err)
+		}
+		if offset[0] == '-' {
+			d = -d
+		}
+		return anchor.Add(d), nil
+	}
+
+	if t, err := parseTagTime(strings.ToUpper(expr)); err == nil {
+		return t, nil
+	}
+	for _, f := range windowTimeFormats {
+		if t, err := time.Parse(f, expr); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected a duration ago (ex. \"36h\" or \"7d\"), %q, a calendar expression (ex. \"today\", \"yesterday+9h\" or \"this-week\"), a RFC-3339 timestamp or a yyyy-mm-dd date", expr, lastRunExpr)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestParseWindowExpr(t *testing.T) {
+	// A Thursday
+	now := time.Date(2026, 10, 15, 13, 30, 0, 0, time.UTC)
+	lastRun := time.Date(2026, 10, 14, 8, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		Input    string
+		LastRun  *time.Time
+		Expected time.Time
+		WantErr  bool
+	}{
+		{"36h", nil, now.Add(-36 * time.Hour), false},
+		{"90m", nil, now.Add(-90 * time.Minute), false},
+		{"7d", nil, now.AddDate(0, 0, -7), false},
+		{"2w", nil, now.AddDate(0, 0, -14), false},
+		{"-8h", nil, now.Add(-8 * time.Hour), false},
+		{"8h ago", nil, now.Add(-8 * time.Hour), false},
+		{"+8h", nil, time.Time{}, true},
+		{"last-run", &lastRun, lastRun, false},
+		{"last-run", nil, time.Time{}, true},
+		{"now", nil, now, false},
+		{"now-1h", nil, now.Add(-time.Hour), false},
+		{"today", nil, time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC), false},
+		{"yesterday", nil, time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC), false},
+		{"yesterday+9h", nil, time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC), false},
+		{"this-week", nil, time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC), false},
+		{"last-week", nil, time.Date(2026, 10, 5, 0, 0, 0, 0, time.UTC), false},
+		{"this-week-1d", nil, time.Date(2026, 10, 11, 0, 0, 0, 0, time.UTC), false},
+		{"this-month", nil, time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC), false},
+		{"last-month", nil, time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC), false},
+		{"today+", nil, time.Time{}, true},
+		{"todayish", nil, time.Time{}, true},
+		{"2026-10-01", nil, time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC), false},
+		{"2026-10-01T08:00:00Z", nil, time.Date(2026, 10, 1, 8, 0, 0, 0, time.UTC), false},
+		{"2026-10-01T08:00:00.5Z", nil, time.Date(2026, 10, 1, 8, 0, 0, 5e8, time.UTC), false},
+		{"2026-10-01 08:00", nil, time.Date(2026, 10, 1, 8, 0, 0, 0, time.UTC), false},
+		{"10/01/2026", nil, time.Time{}, true},
+	}
+
+	for i, c := range cases {
+		got, err := parseWindowExpr(c.Input, now, c.LastRun)
+		if (err != nil) != c.WantErr {
+			t.Errorf("parseWindowExpr case %d (%q): wanted error %t, got %v", i+1, c.Input, c.WantErr, err)
+			continue
+		}
+		if !got.Equal(c.Expected) {
+			t.Errorf("parseWindowExpr case %d (%q) failed\nwanted: %s\ngot: %s", i+1, c.Input, c.Expected, got)
+		}
+	}
+}
+
+func TestCalcTimeWindow(t *testing.T) {
+	now := time.Date(2026, 10, 15, 13, 30, 0, 0, time.UTC)
+	lastRun := time.Date(2026, 10, 15, 5, 0, 0, 0, time.UTC)
+	keys := []string{"since", "until", "startHour", "endHour", "startTimeStamp", "endTimeStamp"}
+	defer func() {
+		parseSince, parseUntil = "", ""
+		for _, k := range keys {
+			viper.Set(k, "")
+		}
+		viper.Set("startHour", -8)
+		viper.Set("endHour", 0)
+	}()
+
+	cases := []struct {
+		Since, Until  string
+		Config        map[string]interface{}
+		LastRun       *time.Time
+		ExpectedStart time.Time
+		ExpectedEnd   time.Time
+		WantErr       bool
+	}{
+		// Flags override config fields
+		{
+			Since:         "8h",
+			Config:        map[string]interface{}{"startHour": -2, "endHour": 0},
+			ExpectedStart: now.Add(-8 * time.Hour),
+			ExpectedEnd:   now,
+		},
+		{
+			Since:         "last-run",
+			Until:         "now-1h",
+			LastRun:       &lastRun,
+			ExpectedStart: lastRun,
+			ExpectedEnd:   now.Add(-time.Hour),
+		},
+		{
+			Config:        map[string]interface{}{"since": "yesterday", "until": "today"},
+			ExpectedStart: time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC),
+			ExpectedEnd:   time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			Config:        map[string]interface{}{"startTimeStamp": "2026-10-01T00:00:00Z", "endTimeStamp": "2026-10-02T00:00:00Z"},
+			ExpectedStart: time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC),
+			ExpectedEnd:   time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC),
+		},
+		// since in config conflicts with other time window fields
+		{Config: map[string]interface{}{"since": "8h", "startHour": -8, "endHour": 0}, WantErr: true},
+		{Until: "today", WantErr: true},
+		{Since: "today", Until: "yesterday", WantErr: true},
+		{Since: "last-run", WantErr: true},
+		{Config: map[string]interface{}{"startHour": 8, "endHour": 0}, WantErr: true},
+		{WantErr: true},
+	}
+
+	for i, c := range cases {
+		parseSince, parseUntil = c.Since, c.Until
+		for _, k := range keys {
+			v, ok := c.Config[k]
+			if !ok {
+				v = ""
+			}
+			viper.Set(k, v)
+		}
+
+		w, err := calcTimeWindow(&State{LastRunEnd: c.LastRun}, now)
+		if (err != nil) != c.WantErr {
+			t.Errorf("calcTimeWindow case %d: wanted error %t, got %v", i+1, c.WantErr, err)
+			continue
+		}
+		if c.WantErr {
+			continue
+		}
+		if !w.start.Equal(c.ExpectedStart) || !w.end.Equal(c.ExpectedEnd) {
+			t.Errorf("calcTimeWindow case %d failed\nwanted: %s - %s\ngot: %s - %s", i+1, c.ExpectedStart, c.ExpectedEnd, w.start, w.end)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright © 2017 grafiti authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	rgta "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	rgtaiface "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+	"github.com/coreos/grafiti/arn"
+	"github.com/coreos/grafiti/deleter"
+	"github.com/spf13/cobra"
+)
+
+var (
+	untagFile        string
+	untagKeys        []string
+	untagTimeFilters []string
+)
+
+func init() {
+	RootCmd.AddCommand(untagCmd)
+	untagCmd.PersistentFlags().StringVarP(&untagFile, "untag-file", "f", "", "File of tags of resources to untag. Format is that of 'grafiti delete' input.")
+	untagCmd.PersistentFlags().StringSliceVarP(&untagKeys, "keys", "k", nil, "Keys of tags to remove from matching resources.")
+	untagCmd.PersistentFlags().StringSliceVar(&untagTimeFilters, "time-filter", nil, "Only untag resources with a time tag before ('Key<time') or after ('Key>time') a time, ex. 'ExpiresAt<now'. Applies to every untag file entry.")
+}
+
+var untagCmd = &cobra.Command{
+	Use:           "untag",
+	Short:         "Remove tags from resources in AWS.",
+	Long:          "Remove tags with keys in 'keys' from resources with tags specified in 'untag-file'.",
+	RunE:          runUntagCommand,
+	SilenceErrors: true,
+	SilenceUsage:  true,
+}
+
+func runUntagCommand(cmd *cobra.Command, args []string) error {
+	if len(untagKeys) == 0 {
+		return fmt.Errorf("untag: no tag keys, set --keys")
+	}
+	if len(untagKeys) > maxRGTATags {
+		return fmt.Errorf("untag: at most %d tag keys can be removed at once", maxRGTATags)
+	}
+
+	input, err := readTagFileInput(untagFile)
+	if err != nil {
+		return fmt.Errorf("untag: %s", err)
+	}
+	if err := untagFromTags(input, untagKeys); err != nil {
+		return fmt.Errorf("untag: %s", err)
+	}
+	return nil
+}
+
+// readTagFileInput reads TagFileInput's encoded in fname, or stdin if fname
+// is empty.
+func readTagFileInput(fname string) ([]byte, error) {
+	if fname == "" {
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("read input: %s", err)
+		}
+		return b, nil
+	}
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, fmt.Errorf("read input file: %s", err)
+	}
+	return b, nil
+}
+
+// untagFromTags removes tags with keys from resources with tags encoded in
+// input, in every account and region.
+func untagFromTags(input []byte, keys []string) error {
+	tfs, err := parseTimeFilterFlags(untagTimeFilters)
+	if err != nil {
+		return err
+	}
+
+	var failures []tagFailure
+	err = forEachAccountRegion(func() error {
+		rs, err := getResourcesForTagFile(rgta.New(newAWSSession()), bytes.NewReader(input), tfs)
+		if err != nil {
+			return err
+		}
+
+		fs, err := untagResources(rs, keys)
+		failures = append(failures, fs...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Resources that kept their tags might still be deleted, so they fail the run
+	if !ignoreErrors {
+		return tagFailuresError(failures, "untagged")
+	}
+	return nil
+}
+
+// untagResources removes tags with keys from each resource in rs that has any
+// of them. Resources the RGTA failed to untag are logged and returned.
+func untagResources(rs taggedResources, keys []string) ([]tagFailure, error) {
+	sess := newAWSSession()
+
+	var arns arn.ResourceARNs
+	for _, r := range rs {
+		rkeys := presentTagKeys(r.Tags, keys)
+		if len(rkeys) == 0 {
+			continue
+		}
+
+		rt, rn := arn.MapARNToRTypeAndRName(r.ARN)
+		if _, ok := arn.RGTAUnsupportedResourceTypes[rt]; !ok {
+			arns = append(arns, r.ARN)
+			continue
+		}
+
+		var err error
+		switch rt {
+		case arn.AutoScalingGroupRType:
+			err = untagAutoScalingResource(autoscaling.New(sess), rn, rkeys)
+		case arn.Route53HostedZoneRType:
+			err = untagRoute53Resource(route53.New(sess), rn, rkeys)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return untagARNs(rgta.New(sess), arns, keys)
+}
+
+// presentTagKeys returns the keys in keys that tags has.
+func presentTagKeys(tags map[string]string, keys []string) []string {
+	var present []string
+	for _, k := range keys {
+		if _, ok := tags[k]; ok {
+			present = append(present, k)
+		}
+	}
+	return present
+}
+
+// untagARNs removes tags with keys from every ARN in arns, in batches of at
+// most 20 ARNs.
+func untagARNs(svc rgtaiface.ResourceGroupsTaggingAPIAPI, arns arn.ResourceARNs, keys []string) ([]tagFailure, error) {
+	var failures []tagFailure
+	size := len(arns)
+	for i := 0; i < size; i += maxRGTAResources {
+		stop := deleter.CalcChunk(i, size, maxRGTAResources)
+		params := &rgta.UntagResourcesInput{
+			ResourceARNList: arns[i:stop].AWSStringSlice(),
+			TagKeys:         aws.StringSlice(keys),
+		}
+
+		pj, err := json.Marshal(params)
+		if err != nil {
+			if ignoreErrors {
+				logger.Debugln("marshal rgta params:", err)
+				continue
+			}
+			return nil, fmt.Errorf("marshal rgta params: %s", err)
+		}
+		fmt.Println(string(pj))
+
+		if dryRun {
+			continue
+		}
+
+		// Requests are rate limited by the session svc was created from
+		resp, err := svc.UntagResources(params)
+		if err != nil {
+			if ignoreErrors {
+				logger.Debugln("rgta: untag resources:", err)
+				continue
+			}
+			return nil, fmt.Errorf("rgta: untag resources %s", err)
+		}
+
+		for a, fi := range resp.FailedResourcesMap {
+			if fi == nil {
+				continue
+			}
+			f := tagFailure{
+				ARN:          arn.ResourceARN(a),
+				ErrorCode:    aws.StringValue(fi.ErrorCode),
+				ErrorMessage: aws.StringValue(fi.ErrorMessage),
+			}
+			f.log()
+			failures = append(failures, f)
+		}
+	}
+	return failures, nil
+}
+
+// untagAutoScalingResource removes tags with keys from autoscaling group rn.
+func untagAutoScalingResource(svc autoscalingiface.AutoScalingAPI, rn arn.ResourceName, keys []string) error {
+	asgTags := make([]*autoscaling.Tag, 0, len(keys))
+	for _, k := range keys {
+		asgTags = append(asgTags, &autoscaling.Tag{
+			Key:          aws.String(k),
+			ResourceType: aws.String("auto-scaling-group"),
+			ResourceId:   rn.AWSString(),
+		})
+	}
+	params := &autoscaling.DeleteTagsInput{
+		Tags: asgTags,
+	}
+
+	pj, err := json.Marshal(params)
+	if err != nil {
+		if ignoreErrors {
+			logger.Debugln("marshal autoscaling params:", err)
+			return nil
+		}
+		return fmt.Errorf("marshal autoscaling params: %s", err)
+	}
+	fmt.Println(string(pj))
+
+	if dryRun {
+		return nil
+	}
+
+	ctx := aws.BackgroundContext()
+	if _, err := svc.DeleteTagsWithContext(ctx, params); err != nil {
+		if ignoreErrors {
+			logger.Debugln("autoscaling: untag resources:", err)
+			return nil
+		}
+		return fmt.Errorf("autoscaling: untag resources %s", err)
+	}
+
+	return nil
+}
+
+// untagRoute53Resource removes tags with keys from hosted zone rn.
+func untagRoute53Resource(svc route53iface.Route53API, rn arn.ResourceName, keys []string) error {
+	params := &route53.ChangeTagsForResourceInput{
+		RemoveTagKeys: aws.StringSlice(keys),
+		ResourceId:    rn.AWSString(),
+		ResourceType:  aws.String("hostedzone"),
+	}
+
+	pj, err := json.Marshal(params)
+	if err != nil {
+		if ignoreErrors {
+			logger.Debugln("marshal route53 params:", err)
+			return nil
+		}
+		return fmt.Errorf("marshal route53 params: %s", err)
+	}
+	fmt.Println(string(pj))
+
+	if dryRun {
+		return nil
+	}
+
+	ctx := aws.BackgroundContext()
+	if _, err := svc.ChangeTagsForResourceWithContext(ctx, params); err != nil {
+		if ignoreErrors {
+			logger.Debugln("route53: untag resources:", err)
+			return nil
+		}
+		return fmt.Errorf("route53: untag resources %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	rgta "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	rgtaiface "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+	"github.com/coreos/grafiti/arn"
+)
+
+func TestPresentTagKeys(t *testing.T) {
+	cases := []struct {
+		Tags     map[string]string
+		Keys     []string
+		Expected []string
+	}{
+		{map[string]string{"ExpiresAt": "2017-06-01", "CreatedBy": "test-user"}, []string{"ExpiresAt", "TaggedAt"}, []string{"ExpiresAt"}},
+		{map[string]string{"CreatedBy": "test-user"}, []string{"ExpiresAt"}, nil},
+		{nil, []string{"ExpiresAt"}, nil},
+	}
+
+	for i, c := range cases {
+		if got := presentTagKeys(c.Tags, c.Keys); !reflect.DeepEqual(got, c.Expected) {
+			t.Errorf("presentTagKeys case %d failed\nwanted: %v\ngot: %v", i+1, c.Expected, got)
+		}
+	}
+}
+
+// Mock RGTA type that records ARNs untagged in each call, and fails to untag
+// ARNs in Failures
+type mockUntagResources struct {
+	rgtaiface.ResourceGroupsTaggingAPIAPI
+	Failures map[string]*rgta.FailureInfo
+	Calls    [][]string
+}
+
+func (tr *mockUntagResources) UntagResources(in *rgta.UntagResourcesInput) (*rgta.UntagResourcesOutput, error) {
+	arns := aws.StringValueSlice(in.ResourceARNList)
+	sort.Strings(arns)
+	tr.Calls = append(tr.Calls, arns)
+
+	out := &rgta.UntagResourcesOutput{FailedResourcesMap: map[string]*rgta.FailureInfo{}}
+	for _, a := range arns {
+		if fi, ok := tr.Failures[a]; ok {
+			out.FailedResourcesMap[a] = fi
+		}
+	}
+	return out, nil
+}
+
+func TestUntagARNs(t *testing.T) {
+	var arns arn.ResourceARNs
+	for i := 0; i < 25; i++ {
+		arns = append(arns, arn.ResourceARN(fmt.Sprintf("arn:aws:ec2:us-west-2:123456789101:instance/i-%02d", i)))
+	}
+	failed := arns[21].String()
+	tr := &mockUntagResources{Failures: map[string]*rgta.FailureInfo{
+		failed: {ErrorCode: aws.String(rgta.ErrorCodeInvalidParameterException)},
+	}}
+
+	var failures []tagFailure
+	var err error
+	f := func(v interface{}) {
+		failures, err = untagARNs(tr, arns, []string{"ExpiresAt"})
+	}
+	out := captureStdOut(f, nil)
+	if err != nil {
+		t.Fatal("untagARNs:", err)
+	}
+
+	if len(tr.Calls) != 2 || len(tr.Calls[0]) != 20 || len(tr.Calls[1]) != 5 {
+		t.Errorf("untagARNs failed\nwanted calls of 20 and 5 ARNs\ngot: %v", tr.Calls)
+	}
+	expected := []tagFailure{{ARN: arn.ResourceARN(failed), ErrorCode: rgta.ErrorCodeInvalidParameterException}}
+	if !reflect.DeepEqual(failures, expected) {
+		t.Errorf("untagARNs failed\nwanted failures: %v\ngot: %v", expected, failures)
+	}
+	expectedOut := fmt.Sprint(`{"ResourceARNList":["arn:aws:ec2:us-west-2:123456789101:instance/i-20",`,
+		`"arn:aws:ec2:us-west-2:123456789101:instance/i-21","arn:aws:ec2:us-west-2:123456789101:instance/i-22",`,
+		`"arn:aws:ec2:us-west-2:123456789101:instance/i-23","arn:aws:ec2:us-west-2:123456789101:instance/i-24"],`,
+		`"TagKeys":["ExpiresAt"]}`, "\n")
+	if l := len(expectedOut); len(out) < l || out[len(out)-l:] != expectedOut {
+		t.Errorf("untagARNs failed\nwanted output ending with\n%s\ngot\n%s", expectedOut, out)
+	}
+}
+
+type mockUntagAutoScalingResources struct {
+	autoscalingiface.AutoScalingAPI
+}
+
+func (tr *mockUntagAutoScalingResources) DeleteTagsWithContext(ctx aws.Context, in *autoscaling.DeleteTagsInput, opts ...request.Option) (*autoscaling.DeleteTagsOutput, error) {
+	return &autoscaling.DeleteTagsOutput{}, nil
+}
+
+type mockUntagRoute53Resources struct {
+	route53iface.Route53API
+}
+
+func (tr *mockUntagRoute53Resources) ChangeTagsForResourceWithContext(ctx aws.Context, in *route53.ChangeTagsForResourceInput, opts ...request.Option) (*route53.ChangeTagsForResourceOutput, error) {
+	return &route53.ChangeTagsForResourceOutput{}, nil
+}
+
+func TestUntagRGTAUnsupportedResources(t *testing.T) {
+	cases := []struct {
+		Untag    func() error
+		Expected string
+	}{
+		{
+			func() error {
+				return untagAutoScalingResource(&mockUntagAutoScalingResources{}, "demo-master", []string{"ExpiresAt"})
+			},
+			fmt.Sprint(`{"Tags":[{"Key":"ExpiresAt","PropagateAtLaunch":null,"ResourceId":"demo-master",`,
+				`"ResourceType":"auto-scaling-group","Value":null}]}`, "\n"),
+		},
+		{
+			func() error {
+				return untagRoute53Resource(&mockUntagRoute53Resources{}, "ZABCDEFGHIJ", []string{"ExpiresAt", "TaggedAt"})
+			},
+			`{"AddTags":null,"RemoveTagKeys":["ExpiresAt","TaggedAt"],"ResourceId":"ZABCDEFGHIJ","ResourceType":"hostedzone"}` + "\n",
+		},
+	}
+
+	for i, c := range cases {
+		var err error
+		out := captureStdOut(func(v interface{}) { err = c.Untag() }, nil)
+		if err != nil {
+			t.Fatalf("untag case %d: %s", i+1, err)
+		}
+		if out != c.Expected {
+			t.Errorf("untag case %d failed\nwanted\n%s\ngot\n%s", i+1, c.Expected, out)
+		}
+	}
+}
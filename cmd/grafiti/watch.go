@@ -0,0 +1,481 @@
+// Copyright © 2017 grafiti authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/coreos/grafiti/arn"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// watchWaitTimeSeconds is the longest a receive request waits for messages.
+	// Buckets are checked for ejection at least this often.
+	watchWaitTimeSeconds = 20
+	// watchMaxMessages is the number of messages received or deleted at once
+	watchMaxMessages = 10
+	// watchMaxVisibilityTimeout is the longest SQS hides a received message
+	watchMaxVisibilityTimeout = 12 * time.Hour
+	// watchDedupeWindow is how long events and log files are remembered after
+	// their resources are tagged
+	watchDedupeWindow = 24 * time.Hour
+	// watchIgnoreRefreshInterval is how long resources tagged with tags in the
+	// ignore file are remembered before they are requested again
+	watchIgnoreRefreshInterval = time.Minute
+)
+
+var (
+	watchQueueURL   string
+	watchIgnoreFile string
+)
+
+func init() {
+	RootCmd.AddCommand(watchCmd)
+	watchCmd.PersistentFlags().StringVar(&watchQueueURL, "queue-url", "", "URL of the SQS queue to receive CloudTrail events from (default: the 'watch.queueURL' config field).")
+	watchCmd.PersistentFlags().StringVarP(&watchIgnoreFile, "ignore-file", "i", "", "File containing tags of resources to not tag, like 'grafiti filter --ignore-file' (default: the 'watch.ignoreFile' config field).")
+}
+
+var watchCmd = &cobra.Command{
+	Use:           "watch",
+	Short:         "Tag resources as CloudTrail events arrive.",
+	Long:          "Continuously receive CloudTrail events from an SQS queue, fed by EventBridge or a trail's SNS topic, and tag the resources they create. Events are parsed, filtered and tagged like 'grafiti parse | grafiti tag'. Stops gracefully on SIGTERM or SIGINT.",
+	RunE:          runWatchCommand,
+	SilenceErrors: true,
+	SilenceUsage:  true,
+}
+
+func runWatchCommand(cmd *cobra.Command, args []string) error {
+	queueURL := watchQueueURL
+	if queueURL == "" {
+		queueURL = viper.GetString("watch.queueURL")
+	}
+	if queueURL == "" {
+		return errors.New("watch: no queue URL, set --queue-url or the 'watch.queueURL' config field")
+	}
+
+	ignoreFile := watchIgnoreFile
+	if ignoreFile == "" {
+		ignoreFile = viper.GetString("watch.ignoreFile")
+	}
+	var ignoreTags []byte
+	if ignoreFile != "" {
+		var err error
+		if ignoreTags, err = ioutil.ReadFile(ignoreFile); err != nil {
+			return fmt.Errorf("watch: %s", err)
+		}
+	}
+
+	st, err := loadState()
+	if err != nil {
+		return fmt.Errorf("watch: %s", err)
+	}
+
+	// Received messages are checkpointed and deleted before exiting
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(sigs)
+	go func() {
+		select {
+		case sig := <-sigs:
+			logger.Infof("watch: received %s, shutting down", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	sess := newAWSSession()
+	w := newWatcher(sqs.New(sess, sqsConfig()), s3.New(sess, s3Config()), queueURL, st)
+	if ignoreTags != nil {
+		w.ignore = func() (map[arn.ResourceARN]struct{}, error) {
+			return getIgnoreTagMap(bytes.NewReader(ignoreTags))
+		}
+	}
+	if err := w.run(ctx); err != nil {
+		return fmt.Errorf("watch: %s", err)
+	}
+	return nil
+}
+
+// sqsConfig creates a config for SQS clients. Requests are sent to the
+// SQS-compatible endpoint in the 'sqsEndpoint' config field, if set.
+func sqsConfig() *aws.Config {
+	cfg := &aws.Config{}
+	if ep := viper.GetString("sqsEndpoint"); ep != "" {
+		cfg.Endpoint = aws.String(ep)
+	}
+	return cfg
+}
+
+// watchedMessage is a received SQS message and the events and log files in
+// it.
+type watchedMessage struct {
+	receiptHandle string
+	receivedAt    time.Time
+	eventIDs      map[string]time.Time
+	s3Keys        map[string]time.Time
+}
+
+// watcher tags resources created by CloudTrail events received from an SQS
+// queue. A message is only deleted, and its events checkpointed, once the
+// resources parsed from it are tagged. Resources are bucketed and tagged like
+// `grafiti tag`, so every resource is tagged within 'bucketEjectLimitSeconds'
+// of the message holding its event being received.
+type watcher struct {
+	sqs      sqsiface.SQSAPI
+	s3       s3iface.S3API
+	queueURL string
+	state    *State
+	tagger   *tagger
+	// ejectLimit is the longest a resource waits in a bucket
+	ejectLimit time.Duration
+	pending    []*watchedMessage
+	// ignore requests the ARNs of resources to not tag, if set. Resources are
+	// requested again every watchIgnoreRefreshInterval, so resources tagged
+	// with ignored tags less than that before their event is received can still
+	// be tagged.
+	ignore    func() (map[arn.ResourceARN]struct{}, error)
+	ignored   map[arn.ResourceARN]struct{}
+	ignoredAt time.Time
+}
+
+func newWatcher(sqsSvc sqsiface.SQSAPI, s3Svc s3iface.S3API, queueURL string, st *State) *watcher {
+	if st.Watch == nil {
+		st.Watch = &WatchCheckpoint{}
+	}
+	if st.Watch.EventIDs == nil {
+		st.Watch.EventIDs = make(map[string]time.Time)
+	}
+	if st.Watch.S3Keys == nil {
+		st.Watch.S3Keys = make(map[string]time.Time)
+	}
+	return &watcher{
+		sqs:        sqsSvc,
+		s3:         s3Svc,
+		queueURL:   queueURL,
+		state:      st,
+		tagger:     newTagger(),
+		ejectLimit: time.Duration(viper.GetInt("bucketEjectLimitSeconds")) * time.Second,
+	}
+}
+
+// run receives and handles messages until ctx is done, then tags all bucketed
+// resources and deletes all received messages.
+func (w *watcher) run(ctx context.Context) error {
+	outputHandler = w.handleOutput
+	defer func() { outputHandler = nil }()
+
+	for ctx.Err() == nil {
+		if err := w.receive(ctx); err != nil && ctx.Err() == nil {
+			if serr := w.checkpoint(true); serr != nil {
+				logger.Errorln("watch:", serr)
+			}
+			return err
+		}
+		if err := w.checkpoint(false); err != nil {
+			return err
+		}
+	}
+
+	logger.Infoln("watch: tagging remaining resources")
+	return w.checkpoint(true)
+}
+
+// visibilityTimeout is how long SQS hides a received message, which must be
+// longer than it takes to tag its resources and delete it.
+func (w *watcher) visibilityTimeout() int64 {
+	timeout := 2*w.ejectLimit + watchWaitTimeSeconds*time.Second
+	if timeout > watchMaxVisibilityTimeout {
+		timeout = watchMaxVisibilityTimeout
+	}
+	return int64(timeout / time.Second)
+}
+
+func (w *watcher) receive(ctx context.Context) error {
+	resp, err := w.sqs.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(w.queueURL),
+		MaxNumberOfMessages: aws.Int64(watchMaxMessages),
+		WaitTimeSeconds:     aws.Int64(watchWaitTimeSeconds),
+		VisibilityTimeout:   aws.Int64(w.visibilityTimeout()),
+	})
+	if err != nil {
+		return fmt.Errorf("sqs: receive messages: %s", err)
+	}
+	if len(resp.Messages) != 0 {
+		if err := w.refreshIgnored(); err != nil {
+			return err
+		}
+	}
+
+	for _, msg := range resp.Messages {
+		m := &watchedMessage{
+			receiptHandle: aws.StringValue(msg.ReceiptHandle),
+			receivedAt:    time.Now(),
+			eventIDs:      make(map[string]time.Time),
+			s3Keys:        make(map[string]time.Time),
+		}
+		// Messages that are not CloudTrail events or log file notifications are
+		// deleted like any other, so they are not received again. Messages that
+		// failed to be parsed otherwise, ex. because a log file could not be read,
+		// are kept so they are received again once their visibility timeout
+		// expires, or moved to the queue's dead-letter queue, if any.
+		if err := w.parseMessage(aws.StringValue(msg.Body), m); err != nil {
+			logger.Errorf("watch: message %s: %s", aws.StringValue(msg.MessageId), err)
+			if _, ok := err.(invalidMessageError); !ok {
+				continue
+			}
+		}
+		w.pending = append(w.pending, m)
+	}
+	return nil
+}
+
+// watchMessageBody holds the fields of the message bodies grafiti understands:
+// SNS notifications, EventBridge events, and CloudTrail log file delivery
+// notifications.
+type watchMessageBody struct {
+	// SNS notification
+	Type    string
+	Message string
+	// EventBridge event
+	Detail json.RawMessage `json:"detail"`
+	// Log file delivery notification
+	S3Bucket    string   `json:"s3Bucket"`
+	S3ObjectKey []string `json:"s3ObjectKey"`
+}
+
+// invalidMessageError is returned by parseMessage for message bodies that can
+// never be parsed.
+type invalidMessageError string
+
+func (e invalidMessageError) Error() string {
+	return string(e)
+}
+
+// parseMessage parses CloudTrail events in an SQS message body. Bodies are
+// EventBridge events holding a CloudTrail event, or notifications of log files
+// delivered by a trail, either of which can be wrapped in an SNS notification.
+func (w *watcher) parseMessage(body string, m *watchedMessage) error {
+	var b watchMessageBody
+	if err := json.Unmarshal([]byte(body), &b); err != nil {
+		return invalidMessageError(fmt.Sprintf("decode message body: %s", err))
+	}
+
+	switch {
+	case b.Type == "Notification" && b.Message != "":
+		return w.parseMessage(b.Message, m)
+	case len(b.Detail) != 0:
+		w.parseEvent(string(b.Detail), m)
+	case b.S3Bucket != "":
+		for _, key := range b.S3ObjectKey {
+			if err := w.parseLogFile(b.S3Bucket, key, m); err != nil {
+				return err
+			}
+		}
+	default:
+		return invalidMessageError("message body is not a CloudTrail event or log file notification")
+	}
+	return nil
+}
+
+// parseEvent parses a CloudTrail event unless its resources were already
+// tagged or are pending.
+func (w *watcher) parseEvent(event string, m *watchedMessage) {
+	parsedEvent := gjson.Parse(event)
+	if id := parsedEvent.Get("eventID").String(); id != "" {
+		if w.seenEvent(id) {
+			logger.Debugln("watch: skipping seen event", id)
+			return
+		}
+		m.eventIDs[id] = eventTime(parsedEvent)
+	}
+	printRawCloudTrailEvent(event)
+}
+
+// parseLogFile parses a CloudTrail log file in S3 unless its resources were
+// already tagged or are pending.
+func (w *watcher) parseLogFile(bucket, key string, m *watchedMessage) error {
+	url := s3Location{Bucket: bucket}.url(key)
+	if w.seenLogFile(url) {
+		logger.Debugln("watch: skipping seen log file", url)
+		return nil
+	}
+	if err := parseS3Object(w.s3, bucket, key); err != nil {
+		return err
+	}
+	m.s3Keys[url] = m.receivedAt
+	return nil
+}
+
+func (w *watcher) seenEvent(id string) bool {
+	if _, ok := w.state.Watch.EventIDs[id]; ok {
+		return true
+	}
+	for _, m := range w.pending {
+		if _, ok := m.eventIDs[id]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *watcher) seenLogFile(url string) bool {
+	if _, ok := w.state.Watch.S3Keys[url]; ok {
+		return true
+	}
+	for _, m := range w.pending {
+		if _, ok := m.s3Keys[url]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshIgnored requests resources to not tag if they were last requested
+// over watchIgnoreRefreshInterval ago.
+func (w *watcher) refreshIgnored() error {
+	if w.ignore == nil || time.Since(w.ignoredAt) < watchIgnoreRefreshInterval {
+		return nil
+	}
+	ignored, err := w.ignore()
+	if err != nil {
+		return fmt.Errorf("get ignored resources: %s", err)
+	}
+	w.ignored, w.ignoredAt = ignored, time.Now()
+	return nil
+}
+
+// handleOutput buckets the resource in a parse output for tagging, unless it
+// is filtered out by the ignore file.
+func (w *watcher) handleOutput(output string) {
+	var t TagInput
+	if err := json.Unmarshal([]byte(output), &t); err != nil {
+		logger.Debugln("watch: decode parse output:", err)
+		return
+	}
+	if _, ok := w.ignored[t.TaggingMetadata.ResourceARN]; ok {
+		logger.Debugln("watch: skipping ignored resource", t.TaggingMetadata.ResourceARN)
+		return
+	}
+	w.tagger.add(&t)
+}
+
+// checkpoint tags resources in buckets that should be ejected, or all buckets
+// if all is true. Messages whose resources are all tagged are recorded in the
+// state file, then deleted.
+func (w *watcher) checkpoint(all bool) error {
+	// Buckets are never older than the messages of resources in them, so every
+	// message received ejectLimit before ejection has had its resources tagged.
+	now := time.Now()
+	if err := w.tagger.eject(all); err != nil {
+		return err
+	}
+	// Resources that failed to be tagged are logged, and watch keeps running
+	w.tagger.failures = nil
+	// Existing tags change as resources are created, so they are read again
+	w.tagger.existing = nil
+
+	var done, kept []*watchedMessage
+	for _, m := range w.pending {
+		if all || !now.Before(m.receivedAt.Add(w.ejectLimit)) {
+			done = append(done, m)
+		} else {
+			kept = append(kept, m)
+		}
+	}
+	if len(done) == 0 {
+		return nil
+	}
+
+	cp := w.state.Watch
+	for _, m := range done {
+		for id, t := range m.eventIDs {
+			cp.EventIDs[id] = t
+			if t.After(cp.LastEventTime) {
+				cp.LastEventTime = t
+			}
+		}
+		for url, t := range m.s3Keys {
+			cp.S3Keys[url] = t
+		}
+	}
+	for id, t := range cp.EventIDs {
+		if t.Before(cp.LastEventTime.Add(-watchDedupeWindow)) {
+			delete(cp.EventIDs, id)
+		}
+	}
+	for url, t := range cp.S3Keys {
+		if t.Before(now.Add(-watchDedupeWindow)) {
+			delete(cp.S3Keys, url)
+		}
+	}
+	if err := w.state.save(); err != nil {
+		return err
+	}
+
+	if err := w.deleteMessages(done); err != nil {
+		return err
+	}
+	w.pending = kept
+	return nil
+}
+
+// deleteMessages deletes ms from the queue in batches.
+func (w *watcher) deleteMessages(ms []*watchedMessage) error {
+	for i := 0; i < len(ms); i += watchMaxMessages {
+		batch := ms[i:]
+		if len(batch) > watchMaxMessages {
+			batch = batch[:watchMaxMessages]
+		}
+
+		params := &sqs.DeleteMessageBatchInput{QueueUrl: aws.String(w.queueURL)}
+		for j, m := range batch {
+			params.Entries = append(params.Entries, &sqs.DeleteMessageBatchRequestEntry{
+				Id:            aws.String(strconv.Itoa(j)),
+				ReceiptHandle: aws.String(m.receiptHandle),
+			})
+		}
+
+		// Messages are deleted even if watch is shutting down
+		ctx := aws.BackgroundContext()
+		resp, err := w.sqs.DeleteMessageBatchWithContext(ctx, params)
+		if err != nil {
+			return fmt.Errorf("sqs: delete messages: %s", err)
+		}
+		for _, f := range resp.Failed {
+			logger.Errorf("watch: sqs: delete message: %s: %s", aws.StringValue(f.Code), aws.StringValue(f.Message))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/coreos/grafiti/arn"
+	"github.com/spf13/viper"
+)
+
+// mockSQSServer is a minimal SQS-compatible stand-in serving ReceiveMessage and
+// DeleteMessageBatch requests for one queue. Each message is received once.
+// onEmpty is called when a receive request finds no messages left.
+type mockSQSServer struct {
+	mu       sync.Mutex
+	bodies   []string
+	received int
+	deleted  []string
+	onEmpty  func()
+}
+
+type mockSQSMessage struct {
+	MessageId     string
+	ReceiptHandle string
+	MD5OfBody     string
+	Body          string
+}
+
+type mockSQSReceiveResponse struct {
+	XMLName  xml.Name         `xml:"ReceiveMessageResponse"`
+	Messages []mockSQSMessage `xml:"ReceiveMessageResult>Message"`
+}
+
+type mockSQSDeleteResponse struct {
+	XMLName xml.Name `xml:"DeleteMessageBatchResponse"`
+	IDs     []string `xml:"DeleteMessageBatchResult>DeleteMessageBatchResultEntry>Id"`
+}
+
+func (m *mockSQSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var res interface{}
+	switch r.Form.Get("Action") {
+	case "ReceiveMessage":
+		resp := mockSQSReceiveResponse{}
+		for ; m.received < len(m.bodies) && len(resp.Messages) < watchMaxMessages; m.received++ {
+			body := m.bodies[m.received]
+			sum := md5.Sum([]byte(body))
+			resp.Messages = append(resp.Messages, mockSQSMessage{
+				MessageId:     fmt.Sprintf("msg-%d", m.received),
+				ReceiptHandle: fmt.Sprintf("handle-%d", m.received),
+				MD5OfBody:     hex.EncodeToString(sum[:]),
+				Body:          body,
+			})
+		}
+		if len(resp.Messages) == 0 && m.onEmpty != nil {
+			m.onEmpty()
+		}
+		res = resp
+	case "DeleteMessageBatch":
+		resp := mockSQSDeleteResponse{}
+		for i := 1; r.Form.Get(fmt.Sprintf("DeleteMessageBatchRequestEntry.%d.Id", i)) != ""; i++ {
+			resp.IDs = append(resp.IDs, r.Form.Get(fmt.Sprintf("DeleteMessageBatchRequestEntry.%d.Id", i)))
+			m.deleted = append(m.deleted, r.Form.Get(fmt.Sprintf("DeleteMessageBatchRequestEntry.%d.ReceiptHandle", i)))
+		}
+		res = resp
+	default:
+		http.Error(w, "<ErrorResponse><Error><Code>InvalidAction</Code></Error></ErrorResponse>", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/xml")
+	xml.NewEncoder(w).Encode(res)
+}
+
+func newMockSQSClient(url string) *sqs.SQS {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(url),
+	}))
+	return sqs.New(sess)
+}
+
+// newEventBridgeBody wraps a CloudTrail event in an EventBridge event.
+func newEventBridgeBody(event string) string {
+	return fmt.Sprintf(`{"version": "0", "detail-type": "AWS API Call via CloudTrail", "source": "aws.ec2", "detail": %s}`, event)
+}
+
+// newSNSBody wraps a message in an SNS notification.
+func newSNSBody(message string) string {
+	b, _ := json.Marshal(map[string]string{"Type": "Notification", "Message": message})
+	return string(b)
+}
+
+func TestWatch(t *testing.T) {
+	wd, _ := os.Getwd()
+	viper.Set("tagPatterns", []string{`{"CreatedBy": .userIdentity.arn}`})
+	viper.Set("filterPatterns", []string{})
+	defer viper.Set("tagPatterns", []string{})
+	dryRun = true
+	defer func() { dryRun = false }()
+
+	logFile, err := ioutil.ReadFile(wd + "/../../testdata/parse/cloudtrail-logfile-input.json")
+	if err != nil {
+		t.Fatal("Failed to open log file:", err)
+	}
+	key := "AWSLogs/123456789101/CloudTrail/us-west-2/2017/06/01/123456789101_CloudTrail_us-west-2_20170601T1905Z_a.json"
+	retryKey := strings.Replace(key, "_a.json", "_b.json", 1)
+	s3mock := &mockS3Server{bucket: "trail", objects: map[string][]byte{key: logFile, retryKey: logFile}}
+	s3srv := httptest.NewServer(s3mock)
+	defer s3srv.Close()
+
+	dir, err := ioutil.TempDir("", "grafiti-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	viper.Set("stateFile", filepath.Join(dir, "state.json"))
+	defer viper.Set("stateFile", "")
+
+	event := newTestLifecycleEvent("RunInstances", "2017-06-01T19:00:00Z", `"eventID": "event-1", "responseElements": {"instancesSet": {"items": [{"instanceId": "i-watch"}]}}`)
+	ignoredEvent := newTestLifecycleEvent("RunInstances", "2017-06-01T19:01:00Z", `"eventID": "event-2", "responseElements": {"instancesSet": {"items": [{"instanceId": "i-ignored"}, {"instanceId": "i-kept"}]}}`)
+	logFileNotification := fmt.Sprintf(`{"s3Bucket": "trail", "s3ObjectKey": [%q]}`, key)
+	retryNotification := fmt.Sprintf(`{"s3Bucket": "trail", "s3ObjectKey": [%q]}`, retryKey)
+
+	cases := []struct {
+		Bodies []string
+		// Ignored are resources tagged with tags in the ignore file
+		Ignored []arn.ResourceARN
+		// Expected are substrings of tagging output, and Unexpected are not
+		Expected   []string
+		Unexpected []string
+		// FailGets is the number of log file requests that fail
+		FailGets int
+		// Kept are the indices of messages that are not deleted
+		Kept []int
+	}{
+		{
+			Bodies: []string{
+				newEventBridgeBody(event),
+				newSNSBody(newEventBridgeBody(event)),
+				newSNSBody(logFileNotification),
+				"not json",
+			},
+			Expected: []string{"i-watch", "i-0aad897efd1368e2c", `"CreatedBy":"arn:aws:iam::123456789101:user/test-user"`},
+		},
+		// Events and log files whose resources were tagged are skipped
+		{
+			Bodies: []string{newEventBridgeBody(event), logFileNotification},
+		},
+		// Resources filtered out by the ignore file are not tagged
+		{
+			Bodies:     []string{newEventBridgeBody(ignoredEvent)},
+			Ignored:    []arn.ResourceARN{"arn:aws:ec2:us-west-2:123456789101:instance/i-ignored"},
+			Expected:   []string{"i-kept"},
+			Unexpected: []string{"i-ignored"},
+		},
+		// Messages whose log files could not be read are kept, and their
+		// resources are tagged once they are received again
+		{
+			Bodies:   []string{newSNSBody(retryNotification)},
+			FailGets: 1,
+			Kept:     []int{0},
+		},
+		{
+			Bodies:   []string{newSNSBody(retryNotification)},
+			Expected: []string{"i-0aad897efd1368e2c"},
+		},
+	}
+
+	for i, c := range cases {
+		st, err := loadState()
+		if err != nil {
+			t.Fatalf("watch case %d: %s", i+1, err)
+		}
+
+		s3mock.failGets = c.FailGets
+		ctx, cancel := context.WithCancel(context.Background())
+		mock := &mockSQSServer{bodies: c.Bodies, onEmpty: cancel}
+		sqssrv := httptest.NewServer(mock)
+		w := newWatcher(newMockSQSClient(sqssrv.URL), newMockS3Client(s3srv.URL), sqssrv.URL+"/123456789101/events", st)
+		if c.Ignored != nil {
+			w.ignore = func() (map[arn.ResourceARN]struct{}, error) {
+				ignored := map[arn.ResourceARN]struct{}{}
+				for _, a := range c.Ignored {
+					ignored[a] = struct{}{}
+				}
+				return ignored, nil
+			}
+		}
+
+		var runErr error
+		got := captureStdOut(func(interface{}) { runErr = w.run(ctx) }, nil)
+		sqssrv.Close()
+		cancel()
+		if runErr != nil {
+			t.Fatalf("watch case %d failed: %s", i+1, runErr)
+		}
+
+		for _, e := range c.Expected {
+			if !strings.Contains(got, e) {
+				t.Errorf("watch case %d: output does not contain %s:\n%s", i+1, e, got)
+			}
+		}
+		for _, u := range c.Unexpected {
+			if strings.Contains(got, u) {
+				t.Errorf("watch case %d: output contains %s:\n%s", i+1, u, got)
+			}
+		}
+		if len(c.Expected) == 0 && got != "" {
+			t.Errorf("watch case %d: wanted no output, got:\n%s", i+1, got)
+		}
+
+		var wantDeleted []string
+		for j := range c.Bodies {
+			kept := false
+			for _, k := range c.Kept {
+				kept = kept || k == j
+			}
+			if !kept {
+				wantDeleted = append(wantDeleted, fmt.Sprintf("handle-%d", j))
+			}
+		}
+		sort.Strings(mock.deleted)
+		if !reflect.DeepEqual(mock.deleted, wantDeleted) {
+			t.Errorf("watch case %d: wanted deleted messages %v, got %v", i+1, wantDeleted, mock.deleted)
+		}
+	}
+
+	st, err := loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := st.Watch.EventIDs["event-1"]; !ok {
+		t.Errorf("watch did not checkpoint event-1: %+v", st.Watch)
+	}
+	if len(st.Watch.S3Keys) != 2 {
+		t.Errorf("watch checkpointed %d log files, wanted 2: %+v", len(st.Watch.S3Keys), st.Watch)
+	}
+}
+
+func TestSQSConfig(t *testing.T) {
+	cases := []struct {
+		Endpoint string
+		Expected *string
+	}{
+		{"", nil},
+		{"http://localhost:9324", aws.String("http://localhost:9324")},
+	}
+
+	defer viper.Set("sqsEndpoint", "")
+	for i, c := range cases {
+		viper.Set("sqsEndpoint", c.Endpoint)
+		if got := sqsConfig().Endpoint; !reflect.DeepEqual(got, c.Expected) {
+			t.Errorf("sqsConfig case %d: wanted endpoint %v, got %v", i+1, aws.StringValue(c.Expected), aws.StringValue(got))
+		}
+	}
+}
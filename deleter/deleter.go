@@ -10,6 +10,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/coreos/grafiti/arn"
 	"github.com/coreos/grafiti/deleter/retryer"
+	"github.com/coreos/grafiti/ratelimit"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
@@ -22,13 +23,34 @@ const drStr = "(dry-run)"
 // backend expectations, ex. when a requested resource cannot be found
 const ErrCodeValidationError = "ValidationError"
 
+// sessionConfig is merged into the config of every session created by a
+// ResourceDeleter
+var sessionConfig = &aws.Config{}
+
+// SetSessionConfig sets config, ex. a region, merged into the config of
+// sessions created by ResourceDeleters. Clients created before calling
+// SetSessionConfig are not affected, so it must not be called while resources
+// are being deleted.
+func SetSessionConfig(cfg *aws.Config) {
+	if cfg == nil {
+		cfg = &aws.Config{}
+	}
+	sessionConfig = cfg
+}
+
+// SessionConfig returns the config set by SetSessionConfig.
+func SessionConfig() *aws.Config {
+	return sessionConfig
+}
+
 func setUpAWSSession() *session.Session {
 	maxRetries := viper.GetInt("maxNumRequestRetries")
-	return session.Must(session.NewSession(
+	return ratelimit.Attach(session.Must(session.NewSession(
 		&aws.Config{
 			Retryer: retryer.DeleteRetryer{NumMaxRetries: maxRetries},
 		},
-	))
+		sessionConfig,
+	)))
 }
 
 // CalcChunk calculates the ending index of a slice
@@ -57,6 +79,9 @@ type LogEntry struct {
 	ErrMsg             string           `json:"err_msg,omitempty"`
 	ParentResourceType arn.ResourceType `json:"parent_resource_type,omitempty"`
 	ParentResourceName arn.ResourceName `json:"parent_resource_name,omitempty"`
+	VPCID              string           `json:"vpc_id,omitempty"`
+	Region             string           `json:"region,omitempty"`
+	AccountID          string           `json:"account_id,omitempty"`
 }
 
 // Log errors to a DeleteConfig.Logger
@@ -799,11 +799,11 @@ func (rd *EC2InstanceDeleter) DeleteResources(cfg *DeleteConfig) error {
 
 	// Instances take awhile to shut down, so block until they've terminated
 	if len(resp.TerminatingInstances) > 0 {
-		fmt.Println("Waiting for EC2 Instances to terminate...")
 		termInstances := make([]*string, 0, len(resp.TerminatingInstances))
 		for _, r := range resp.TerminatingInstances {
 			termInstances = append(termInstances, r.InstanceId)
 		}
+		fmt.Printf("Waiting for EC2 Instances %s to terminate...\n", strings.Join(aws.StringValueSlice(termInstances), ", "))
 		rd.waitUntilInstancesTerminated(cfg, termInstances)
 	}
 
@@ -1229,11 +1229,15 @@ func (rd *EC2NatGatewayDeleter) DeleteResources(cfg *DeleteConfig) error {
 
 	// If we don't wait until nat gateways are deleted, EIP disassociation/release
 	// and customer gateway disassociation/deletion will fail
-	fmt.Println("Waiting for EC2 NAT Gateways to delete...")
+	ngwIDs := make([]string, 0, len(ngws))
+	for _, ngw := range ngws {
+		ngwIDs = append(ngwIDs, aws.StringValue(ngw.NatGatewayId))
+	}
+	fmt.Printf("Waiting for EC2 NAT Gateways %s to delete...\n", strings.Join(ngwIDs, ", "))
 	deletedNGWs, aliveNGWs, err := rd.waitUntilNatGatewaysDeleted(ngws)
 	if err != nil {
 		if cfg.IgnoreErrors {
-			fmt.Printf("{\"error\": \"%s\"}", err)
+			fmt.Printf("{\"error\": \"%s\"}\n", err)
 		} else {
 			return err
 		}
@@ -0,0 +1,157 @@
+package graph
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/coreos/grafiti/arn"
+	"github.com/coreos/grafiti/deleter"
+)
+
+// Child is a resource created implicitly with a parent resource, ex. the
+// volumes and network interfaces created when an instance is launched. Only
+// resources deleted with their parent, or created by it, are children, so
+// resources attached to a parent later are not
+type Child struct {
+	// Parent is the name of the resource the child was discovered from
+	Parent arn.ResourceName
+	Type   arn.ResourceType
+	Name   arn.ResourceName
+}
+
+// A childDiscoverFunc requests all children of resources of the same
+// ResourceType
+type childDiscoverFunc func(parents arn.ResourceNames) ([]Child, error)
+
+// childDiscoverers maps a ResourceType to the function that discovers children
+// of resources of that type. Types not in this map have no discoverable
+// children
+var childDiscoverers = map[arn.ResourceType]childDiscoverFunc{
+	arn.EC2InstanceRType:   discoverInstanceChildren,
+	arn.EC2NatGatewayRType: discoverNatGatewayChildren,
+}
+
+// ec2Client is the client children are requested with. A client is created by
+// deleter if it is not set
+var ec2Client deleter.EC2Client
+
+// HasChildren returns true if children of resources of type rt can be
+// discovered
+func HasChildren(rt arn.ResourceType) bool {
+	_, ok := childDiscoverers[rt]
+	return ok
+}
+
+// DiscoverChildren requests all children of resources of type rt with names,
+// and their children. The Parent of each child is the name in names it was
+// discovered from, directly or through another child. Discovery stops at the
+// first failed request
+func DiscoverChildren(rt arn.ResourceType, names arn.ResourceNames) ([]Child, error) {
+	type resource struct {
+		Type arn.ResourceType
+		Name arn.ResourceName
+	}
+
+	// Maps each resource to expand to the name in names it descends from
+	roots := make(map[arn.ResourceType]map[arn.ResourceName]arn.ResourceName)
+	roots[rt] = make(map[arn.ResourceName]arn.ResourceName, len(names))
+	seen := make(map[resource]bool, len(names))
+	for _, n := range names {
+		roots[rt][n] = n
+		seen[resource{rt, n}] = true
+	}
+
+	var children []Child
+	for len(roots) > 0 {
+		next := make(map[arn.ResourceType]map[arn.ResourceName]arn.ResourceName)
+		for prt, parents := range roots {
+			discover, ok := childDiscoverers[prt]
+			if !ok {
+				continue
+			}
+			pns := make(arn.ResourceNames, 0, len(parents))
+			for n := range parents {
+				pns = append(pns, n)
+			}
+
+			discovered, err := discover(pns)
+			if err != nil {
+				return nil, err
+			}
+			for _, c := range discovered {
+				r := resource{c.Type, c.Name}
+				root, ok := parents[c.Parent]
+				if !ok || seen[r] {
+					continue
+				}
+				seen[r] = true
+				children = append(children, Child{Parent: root, Type: c.Type, Name: c.Name})
+
+				if _, ok := next[c.Type]; !ok {
+					next[c.Type] = make(map[arn.ResourceName]arn.ResourceName)
+				}
+				next[c.Type][c.Name] = root
+			}
+		}
+		roots = next
+	}
+
+	return children, nil
+}
+
+func appendChild(children []Child, parentID *string, rt arn.ResourceType, id *string) []Child {
+	if aws.StringValue(parentID) == "" || aws.StringValue(id) == "" {
+		return children
+	}
+	return append(children, Child{Parent: arn.ToResourceName(parentID), Type: rt, Name: arn.ToResourceName(id)})
+}
+
+// discoverInstanceChildren discovers the network interfaces and EBS volumes of
+// instances that are deleted on termination, which are those created with the
+// instance. Elastic IPs are never created with an instance, so they are not
+// children
+func discoverInstanceChildren(parents arn.ResourceNames) (children []Child, err error) {
+	instanceDel := &deleter.EC2InstanceDeleter{Client: ec2Client, ResourceType: arn.EC2InstanceRType, ResourceNames: parents}
+
+	// Get EC2 network interfaces
+	enis, err := instanceDel.RequestEC2NetworkInterfacesFromInstances()
+	if err != nil {
+		return nil, err
+	}
+	for _, eni := range enis {
+		if eni.Attachment != nil && aws.BoolValue(eni.Attachment.DeleteOnTermination) {
+			children = appendChild(children, eni.Attachment.InstanceId, arn.EC2NetworkInterfaceRType, eni.NetworkInterfaceId)
+		}
+	}
+
+	// Get EBS volumes
+	instances, err := instanceDel.RequestEC2Instances()
+	if err != nil {
+		return nil, err
+	}
+	for _, instance := range instances {
+		for _, bdm := range instance.BlockDeviceMappings {
+			if bdm.Ebs != nil && aws.BoolValue(bdm.Ebs.DeleteOnTermination) {
+				children = appendChild(children, instance.InstanceId, arn.EC2VolumeRType, bdm.Ebs.VolumeId)
+			}
+		}
+	}
+
+	return children, nil
+}
+
+func discoverNatGatewayChildren(parents arn.ResourceNames) (children []Child, err error) {
+	ngwDel := &deleter.EC2NatGatewayDeleter{Client: ec2Client, ResourceType: arn.EC2NatGatewayRType, ResourceNames: parents}
+
+	// Get EIP allocations and network interfaces
+	ngws, err := ngwDel.RequestEC2NatGateways()
+	if err != nil {
+		return nil, err
+	}
+	for _, ngw := range ngws {
+		for _, adr := range ngw.NatGatewayAddresses {
+			children = appendChild(children, ngw.NatGatewayId, arn.EC2EIPRType, adr.AllocationId)
+			children = appendChild(children, ngw.NatGatewayId, arn.EC2NetworkInterfaceRType, adr.NetworkInterfaceId)
+		}
+	}
+
+	return children, nil
+}
@@ -0,0 +1,157 @@
+package graph
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/coreos/grafiti/arn"
+	"github.com/coreos/grafiti/deleter"
+)
+
+func TestDiscoverChildren(t *testing.T) {
+	oldDiscoverers := childDiscoverers
+	defer func() { childDiscoverers = oldDiscoverers }()
+
+	// Children of resources by type and name. Network interfaces have children
+	// here, unlike in childDiscoverers, so children of children are discovered
+	children := map[arn.ResourceType]map[arn.ResourceName][]testNode{
+		arn.EC2InstanceRType: {
+			"i-1": {{arn.EC2NetworkInterfaceRType, "eni-1"}, {arn.EC2VolumeRType, "vol-1"}},
+			"i-2": {{arn.EC2VolumeRType, "vol-2"}},
+		},
+		arn.EC2NetworkInterfaceRType: {
+			"eni-1": {{arn.EC2EIPRType, "eipalloc-1"}},
+		},
+		arn.EC2NatGatewayRType: {
+			"nat-1": {{arn.EC2NetworkInterfaceRType, "eni-2"}, {arn.EC2EIPRType, "eipalloc-2"}},
+		},
+	}
+	childDiscoverers = make(map[arn.ResourceType]childDiscoverFunc)
+	for rt := range children {
+		rt := rt
+		childDiscoverers[rt] = func(parents arn.ResourceNames) (cs []Child, err error) {
+			for _, p := range parents {
+				if p == "fail" {
+					return nil, errors.New("request failed")
+				}
+				for _, c := range children[rt][p] {
+					cs = append(cs, Child{Parent: p, Type: c.Type, Name: c.Name})
+				}
+			}
+			return cs, nil
+		}
+	}
+	// eni-2 was discovered through nat-1, but has children of its own
+	children[arn.EC2NetworkInterfaceRType]["eni-2"] = []testNode{{arn.EC2EIPRType, "eipalloc-2"}}
+
+	cases := []struct {
+		Type     arn.ResourceType
+		Names    arn.ResourceNames
+		Expected []Child
+		WantErr  bool
+	}{
+		{
+			arn.EC2InstanceRType,
+			arn.ResourceNames{"i-1", "i-2", "i-3"},
+			[]Child{
+				{"i-1", arn.EC2EIPRType, "eipalloc-1"},
+				{"i-1", arn.EC2NetworkInterfaceRType, "eni-1"},
+				{"i-1", arn.EC2VolumeRType, "vol-1"},
+				{"i-2", arn.EC2VolumeRType, "vol-2"},
+			},
+			false,
+		},
+		{
+			arn.EC2NatGatewayRType,
+			arn.ResourceNames{"nat-1"},
+			[]Child{
+				{"nat-1", arn.EC2EIPRType, "eipalloc-2"},
+				{"nat-1", arn.EC2NetworkInterfaceRType, "eni-2"},
+			},
+			false,
+		},
+		{arn.EC2VPCRType, arn.ResourceNames{"vpc-1"}, nil, false},
+		// Failed requests are returned
+		{arn.EC2InstanceRType, arn.ResourceNames{"fail"}, nil, true},
+	}
+
+	for i, c := range cases {
+		got, err := DiscoverChildren(c.Type, c.Names)
+		if (err != nil) != c.WantErr {
+			t.Errorf("DiscoverChildren case %d: wanted error %t, got %v", i+1, c.WantErr, err)
+		}
+		// Children are discovered in no particular order
+		if len(got) != len(c.Expected) || !reflect.DeepEqual(childSet(got), childSet(c.Expected)) {
+			t.Errorf("DiscoverChildren case %d failed\nwanted: %v\ngot: %v", i+1, c.Expected, got)
+		}
+	}
+}
+
+func childSet(cs []Child) map[Child]bool {
+	m := make(map[Child]bool, len(cs))
+	for _, c := range cs {
+		m[c] = true
+	}
+	return m
+}
+
+// Mock EC2 type that describes Instances and ENIs regardless of filters
+type mockChildrenEC2 struct {
+	ec2iface.EC2API
+	Instances []*ec2.Instance
+	ENIs      []*ec2.NetworkInterface
+}
+
+func (m *mockChildrenEC2) DescribeInstancesWithContext(ctx aws.Context, in *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	return &ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{{Instances: m.Instances}}}, nil
+}
+
+func (m *mockChildrenEC2) DescribeNetworkInterfacesWithContext(ctx aws.Context, in *ec2.DescribeNetworkInterfacesInput, opts ...request.Option) (*ec2.DescribeNetworkInterfacesOutput, error) {
+	return &ec2.DescribeNetworkInterfacesOutput{NetworkInterfaces: m.ENIs}, nil
+}
+
+func TestDiscoverInstanceChildren(t *testing.T) {
+	newENI := func(id string, deleteOnTermination bool) *ec2.NetworkInterface {
+		return &ec2.NetworkInterface{
+			NetworkInterfaceId: aws.String(id),
+			Attachment: &ec2.NetworkInterfaceAttachment{
+				InstanceId:          aws.String("i-1"),
+				DeleteOnTermination: aws.Bool(deleteOnTermination),
+			},
+		}
+	}
+	newBDM := func(id string, deleteOnTermination bool) *ec2.InstanceBlockDeviceMapping {
+		return &ec2.InstanceBlockDeviceMapping{
+			Ebs: &ec2.EbsInstanceBlockDevice{VolumeId: aws.String(id), DeleteOnTermination: aws.Bool(deleteOnTermination)},
+		}
+	}
+
+	ec2Client = deleter.EC2Client{EC2API: &mockChildrenEC2{
+		Instances: []*ec2.Instance{{
+			InstanceId: aws.String("i-1"),
+			State:      &ec2.InstanceState{Code: aws.Int64(16)},
+			// vol-2 was attached after the instance was launched
+			BlockDeviceMappings: []*ec2.InstanceBlockDeviceMapping{newBDM("vol-1", true), newBDM("vol-2", false)},
+		}},
+		// eni-2 was attached after the instance was launched
+		ENIs: []*ec2.NetworkInterface{newENI("eni-1", true), newENI("eni-2", false)},
+	}}
+	defer func() { ec2Client = deleter.EC2Client{} }()
+
+	expected := []Child{
+		{"i-1", arn.EC2NetworkInterfaceRType, "eni-1"},
+		{"i-1", arn.EC2VolumeRType, "vol-1"},
+	}
+	got, err := DiscoverChildren(arn.EC2InstanceRType, arn.ResourceNames{"i-1"})
+	if err != nil {
+		t.Fatal("DiscoverChildren of instances:", err)
+	}
+	if len(got) != len(expected) || !reflect.DeepEqual(childSet(got), childSet(expected)) {
+		t.Errorf("DiscoverChildren of instances failed\nwanted: %v\ngot: %v", expected, got)
+	}
+}
@@ -0,0 +1,340 @@
+package graph
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/coreos/grafiti/arn"
+	"github.com/coreos/grafiti/deleter"
+)
+
+// dependency is a resource discovered from a parent resource
+type dependency struct {
+	Parent *Node
+	Type   arn.ResourceType
+	Name   arn.ResourceName
+}
+
+// A discoverFunc requests all dependencies of a batch of nodes of the same
+// ResourceType
+type discoverFunc func(parents []*Node) []dependency
+
+// discoverers maps a ResourceType to the function that discovers dependencies
+// of resources of that type. Types not in this map have no discoverable
+// dependencies
+var discoverers = map[arn.ResourceType]discoverFunc{
+	arn.EC2VPCRType:                         discoverVPCDependencies,
+	arn.EC2VPNGatewayRType:                  discoverVPNGatewayDependencies,
+	arn.EC2InstanceRType:                    discoverInstanceDependencies,
+	arn.EC2NetworkInterfaceRType:            discoverNetworkInterfaceDependencies,
+	arn.EC2RouteTableRType:                  discoverRouteTableDependencies,
+	arn.AutoScalingGroupRType:               discoverAutoScalingGroupDependencies,
+	arn.AutoScalingLaunchConfigurationRType: discoverLaunchConfigurationDependencies,
+	arn.IAMInstanceProfileRType:             discoverInstanceProfileDependencies,
+}
+
+// FillDependencyGraph adds all dependencies of the resources in g, and their
+// dependencies, to g. Each discovered node is linked to the node it was
+// discovered from
+func FillDependencyGraph(g *Graph) {
+	if g == nil {
+		return
+	}
+
+	expanded := make(map[*Node]bool)
+	for {
+		// Batch all unexpanded nodes by type so dependencies of each type are
+		// requested together
+		batches := make(map[arn.ResourceType][]*Node)
+		var types arn.ResourceTypes
+		for _, n := range g.Nodes() {
+			if expanded[n] {
+				continue
+			}
+			expanded[n] = true
+			if _, ok := discoverers[n.Type]; !ok {
+				continue
+			}
+			if _, ok := batches[n.Type]; !ok {
+				types = append(types, n.Type)
+			}
+			batches[n.Type] = append(batches[n.Type], n)
+		}
+
+		if len(types) == 0 {
+			return
+		}
+
+		for _, rt := range types {
+			for _, d := range discoverers[rt](batches[rt]) {
+				g.AddEdge(d.Parent, g.AddNode(d.Type, d.Name))
+			}
+		}
+	}
+}
+
+func namesOf(nodes []*Node) arn.ResourceNames {
+	names := make(arn.ResourceNames, 0, len(nodes))
+	for _, n := range nodes {
+		names = append(names, n.Name)
+	}
+	return names
+}
+
+func nodesByName(nodes []*Node) map[arn.ResourceName]*Node {
+	m := make(map[arn.ResourceName]*Node, len(nodes))
+	for _, n := range nodes {
+		m[n.Name] = n
+	}
+	return m
+}
+
+func appendDependency(deps []dependency, parent *Node, rt arn.ResourceType, id *string) []dependency {
+	if parent == nil || aws.StringValue(id) == "" {
+		return deps
+	}
+	return append(deps, dependency{Parent: parent, Type: rt, Name: arn.ToResourceName(id)})
+}
+
+func discoverVPCDependencies(parents []*Node) (deps []dependency) {
+	vpcDel := &deleter.EC2VPCDeleter{ResourceType: arn.EC2VPCRType, ResourceNames: namesOf(parents)}
+
+	// Ensures that no default VPC's are used
+	vpcs, err := vpcDel.RequestEC2VPCs()
+	if err != nil || len(vpcs) == 0 {
+		return nil
+	}
+
+	vpcDel.ResourceNames = nil
+	for _, vpc := range vpcs {
+		vpcDel.AddResourceNames(arn.ToResourceName(vpc.VpcId))
+	}
+
+	byName := nodesByName(parents)
+	parentOf := func(id *string) *Node {
+		return byName[arn.ToResourceName(id)]
+	}
+
+	// Get EC2 instances
+	instances, _ := vpcDel.RequestEC2InstancesFromVPCs()
+	for _, instance := range instances {
+		deps = appendDependency(deps, parentOf(instance.VpcId), arn.EC2InstanceRType, instance.InstanceId)
+	}
+
+	// Get EC2 internet gateways
+	igws, _ := vpcDel.RequestEC2InternetGatewaysFromVPCs()
+	for _, igw := range igws {
+		for _, a := range igw.Attachments {
+			deps = appendDependency(deps, parentOf(a.VpcId), arn.EC2InternetGatewayRType, igw.InternetGatewayId)
+		}
+	}
+
+	// Get EC2 NAT gateways
+	ngws, _ := vpcDel.RequestEC2NatGatewaysFromVPCs()
+	for _, ngw := range ngws {
+		deps = appendDependency(deps, parentOf(ngw.VpcId), arn.EC2NatGatewayRType, ngw.NatGatewayId)
+	}
+
+	// Get EC2 network interfaces
+	enis, _ := vpcDel.RequestEC2NetworkInterfacesFromVPCs()
+	for _, eni := range enis {
+		deps = appendDependency(deps, parentOf(eni.VpcId), arn.EC2NetworkInterfaceRType, eni.NetworkInterfaceId)
+	}
+
+	// Get Route Tables
+	rtbs, _ := vpcDel.RequestEC2RouteTablesFromVPCs()
+	for _, rtb := range rtbs {
+		deps = appendDependency(deps, parentOf(rtb.VpcId), arn.EC2RouteTableRType, rtb.RouteTableId)
+	}
+
+	// Get Security Groups
+	sgs, _ := vpcDel.RequestEC2SecurityGroupsFromVPCs()
+	for _, sg := range sgs {
+		deps = appendDependency(deps, parentOf(sg.VpcId), arn.EC2SecurityGroupRType, sg.GroupId)
+	}
+
+	// Get Subnets
+	sns, _ := vpcDel.RequestEC2SubnetsFromVPCs()
+	for _, sn := range sns {
+		deps = appendDependency(deps, parentOf(sn.VpcId), arn.EC2SubnetRType, sn.SubnetId)
+	}
+
+	// Get VPN Gateways
+	vgws, _ := vpcDel.RequestEC2VPNGatewaysFromVPCs()
+	for _, vgw := range vgws {
+		for _, a := range vgw.VpcAttachments {
+			deps = appendDependency(deps, parentOf(a.VpcId), arn.EC2VPNGatewayRType, vgw.VpnGatewayId)
+		}
+	}
+
+	return deps
+}
+
+func discoverVPNGatewayDependencies(parents []*Node) (deps []dependency) {
+	vgwDel := &deleter.EC2VPNGatewayDeleter{ResourceType: arn.EC2VPNGatewayRType, ResourceNames: namesOf(parents)}
+
+	// Get EC2 vpn connections
+	vcs, err := vgwDel.RequestEC2VPNConnectionsFromVPNGateways()
+	if err != nil || len(vcs) == 0 {
+		return nil
+	}
+
+	byName := nodesByName(parents)
+	for _, vc := range vcs {
+		deps = appendDependency(deps, byName[arn.ToResourceName(vc.VpnGatewayId)], arn.EC2VPNConnectionRType, vc.VpnConnectionId)
+	}
+
+	return deps
+}
+
+func discoverInstanceDependencies(parents []*Node) (deps []dependency) {
+	instanceDel := &deleter.EC2InstanceDeleter{ResourceType: arn.EC2InstanceRType, ResourceNames: namesOf(parents)}
+	byName := nodesByName(parents)
+
+	// Get EC2 network interfaces
+	enis, _ := instanceDel.RequestEC2NetworkInterfacesFromInstances()
+	for _, eni := range enis {
+		if eni.Attachment != nil {
+			deps = appendDependency(deps, byName[arn.ToResourceName(eni.Attachment.InstanceId)], arn.EC2NetworkInterfaceRType, eni.NetworkInterfaceId)
+		}
+	}
+
+	// Get IAM instance profiles
+	iprs, err := instanceDel.RequestIAMInstanceProfilesFromInstances()
+	if err != nil || len(iprs) == 0 {
+		return deps
+	}
+
+	// Instance profiles do not reference instances, so link each profile to
+	// the instances that use it
+	instances, err := instanceDel.RequestEC2Instances()
+	if err != nil {
+		return deps
+	}
+	for _, ipr := range iprs {
+		for _, instance := range instances {
+			if instance.IamInstanceProfile == nil {
+				continue
+			}
+			_, iprName := arn.MapARNToRTypeAndRName(arn.ToResourceARN(instance.IamInstanceProfile.Arn))
+			if iprName == arn.ToResourceName(ipr.InstanceProfileName) {
+				deps = appendDependency(deps, byName[arn.ToResourceName(instance.InstanceId)], arn.IAMInstanceProfileRType, ipr.InstanceProfileName)
+			}
+		}
+	}
+
+	return deps
+}
+
+func discoverNetworkInterfaceDependencies(parents []*Node) (deps []dependency) {
+	eniDel := &deleter.EC2NetworkInterfaceDeleter{ResourceType: arn.EC2NetworkInterfaceRType, ResourceNames: namesOf(parents)}
+
+	// Get EIP Addresses
+	adrs, err := eniDel.RequestEC2EIPAddressessFromNetworkInterfaces()
+	if err != nil || len(adrs) == 0 {
+		return nil
+	}
+
+	byName := nodesByName(parents)
+	for _, adr := range adrs {
+		parent := byName[arn.ToResourceName(adr.NetworkInterfaceId)]
+		// Get EIP Allocations
+		deps = appendDependency(deps, parent, arn.EC2EIPRType, adr.AllocationId)
+		// Get EIP Associations
+		deps = appendDependency(deps, parent, arn.EC2EIPAssociationRType, adr.AssociationId)
+	}
+
+	return deps
+}
+
+func discoverRouteTableDependencies(parents []*Node) (deps []dependency) {
+	// RouteTable Routes will be deleted when deleting a RouteTable
+	rtDel := &deleter.EC2RouteTableDeleter{ResourceType: arn.EC2RouteTableRType, ResourceNames: namesOf(parents)}
+	rtbs, err := rtDel.RequestEC2RouteTables()
+	if err != nil || len(rtbs) == 0 {
+		return nil
+	}
+
+	byName := nodesByName(parents)
+	// Get Subnet-RouteTable Association
+	for _, rtb := range rtbs {
+		for _, rta := range rtb.Associations {
+			if rta.Main != nil && !*rta.Main {
+				deps = appendDependency(deps, byName[arn.ToResourceName(rtb.RouteTableId)], arn.EC2RouteTableAssociationRType, rta.RouteTableAssociationId)
+			}
+		}
+	}
+
+	return deps
+}
+
+func discoverAutoScalingGroupDependencies(parents []*Node) (deps []dependency) {
+	asgDel := &deleter.AutoScalingGroupDeleter{ResourceType: arn.AutoScalingGroupRType, ResourceNames: namesOf(parents)}
+	asgs, err := asgDel.RequestAutoScalingGroups()
+	if err != nil || len(asgs) == 0 {
+		return nil
+	}
+
+	byName := nodesByName(parents)
+	for _, asg := range asgs {
+		parent := byName[arn.ToResourceName(asg.AutoScalingGroupName)]
+		// Get launch configurations
+		deps = appendDependency(deps, parent, arn.AutoScalingLaunchConfigurationRType, asg.LaunchConfigurationName)
+		// Get ELB's
+		for _, elbName := range asg.LoadBalancerNames {
+			deps = appendDependency(deps, parent, arn.ElasticLoadBalancingLoadBalancerRType, elbName)
+		}
+	}
+
+	return deps
+}
+
+func discoverLaunchConfigurationDependencies(parents []*Node) (deps []dependency) {
+	lcDel := &deleter.AutoScalingLaunchConfigurationDeleter{ResourceType: arn.AutoScalingLaunchConfigurationRType, ResourceNames: namesOf(parents)}
+
+	// Get IAM instance profiles
+	iprs, err := lcDel.RequestIAMInstanceProfilesFromLaunchConfigurations()
+	if err != nil || len(iprs) == 0 {
+		return nil
+	}
+
+	// Instance profiles do not reference launch configurations, so link each
+	// profile to the launch configurations that use it
+	lcs, err := lcDel.RequestAutoScalingLaunchConfigurations()
+	if err != nil {
+		return nil
+	}
+	byName := nodesByName(parents)
+	for _, ipr := range iprs {
+		for _, lc := range lcs {
+			// IamInstanceProfile can be either an ARN or name
+			iprName := aws.StringValue(lc.IamInstanceProfile)
+			if iprSplit := strings.Split(iprName, "instance-profile/"); len(iprSplit) == 2 {
+				iprName = iprSplit[1]
+			}
+			if iprName == aws.StringValue(ipr.InstanceProfileName) {
+				deps = appendDependency(deps, byName[arn.ToResourceName(lc.LaunchConfigurationName)], arn.IAMInstanceProfileRType, ipr.InstanceProfileName)
+			}
+		}
+	}
+
+	return deps
+}
+
+func discoverInstanceProfileDependencies(parents []*Node) (deps []dependency) {
+	iprDel := &deleter.IAMInstanceProfileDeleter{ResourceType: arn.IAMInstanceProfileRType, ResourceNames: namesOf(parents)}
+	iprs, err := iprDel.RequestIAMInstanceProfiles()
+	if err != nil || len(iprs) == 0 {
+		return nil
+	}
+
+	byName := nodesByName(parents)
+	// Get IAM roles
+	for _, ipr := range iprs {
+		for _, rl := range ipr.Roles {
+			deps = appendDependency(deps, byName[arn.ToResourceName(ipr.InstanceProfileName)], arn.IAMRoleRType, rl.RoleName)
+		}
+	}
+
+	return deps
+}
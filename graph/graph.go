@@ -1,278 +1,377 @@
 package graph
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/coreos/grafiti/arn"
 	"github.com/coreos/grafiti/deleter"
 )
 
-// Hard-coded rounds of retrieval
-var r0 = arn.ResourceTypes{
-	arn.EC2VPCRType,
-	arn.AutoScalingGroupRType,
-	arn.Route53HostedZoneRType,
-	arn.S3BucketRType,
+// dependencies maps a ResourceType to all ResourceTypes whose resources must be
+// deleted before resources of that type can be deleted. This is the single
+// source of truth for deletion order; add a rule here when supporting a new
+// resource type.
+var dependencies = map[arn.ResourceType]arn.ResourceTypes{
+	arn.AutoScalingLaunchConfigurationRType: {
+		arn.AutoScalingGroupRType,
+	},
+	arn.ElasticLoadBalancingLoadBalancerRType: {
+		arn.AutoScalingGroupRType,
+	},
+	arn.EC2CustomerGatewayRType: {
+		arn.EC2VPNConnectionRType,
+	},
+	arn.EC2EIPAssociationRType: {
+		arn.EC2NatGatewayRType,
+	},
+	arn.EC2EIPRType: {
+		arn.EC2EIPAssociationRType,
+		arn.EC2NatGatewayRType,
+	},
+	arn.EC2InternetGatewayRType: {
+		arn.EC2InstanceRType,
+		arn.EC2NatGatewayRType,
+		arn.EC2EIPAssociationRType,
+		arn.EC2EIPRType,
+	},
+	arn.EC2NetworkInterfaceRType: {
+		arn.EC2InstanceRType,
+		arn.EC2NatGatewayRType,
+		arn.ElasticLoadBalancingLoadBalancerRType,
+		arn.EC2EIPAssociationRType,
+		arn.EC2EIPRType,
+	},
+	arn.EC2RouteTableRType: {
+		arn.EC2RouteTableAssociationRType,
+	},
+	arn.EC2SecurityGroupRType: {
+		arn.EC2InstanceRType,
+		arn.EC2NetworkInterfaceRType,
+		arn.ElasticLoadBalancingLoadBalancerRType,
+	},
+	arn.EC2SubnetRType: {
+		arn.EC2InstanceRType,
+		arn.EC2NetworkInterfaceRType,
+		arn.EC2NatGatewayRType,
+		arn.ElasticLoadBalancingLoadBalancerRType,
+		arn.EC2RouteTableAssociationRType,
+	},
+	arn.EC2VolumeRType: {
+		arn.EC2InstanceRType,
+	},
+	arn.EC2VPNGatewayRType: {
+		arn.EC2VPNConnectionRType,
+	},
+	arn.EC2VPCRType: {
+		arn.EC2InstanceRType,
+		arn.EC2InternetGatewayRType,
+		arn.EC2NatGatewayRType,
+		arn.EC2NetworkACLRType,
+		arn.EC2NetworkInterfaceRType,
+		arn.EC2RouteTableRType,
+		arn.EC2SecurityGroupRType,
+		arn.EC2SubnetRType,
+		arn.EC2VPCCIDRAssociationRType,
+		arn.EC2VPNGatewayRType,
+		arn.ElasticLoadBalancingLoadBalancerRType,
+	},
+	arn.IAMInstanceProfileRType: {
+		arn.EC2InstanceRType,
+		arn.AutoScalingLaunchConfigurationRType,
+	},
+	arn.IAMRoleRType: {
+		arn.IAMInstanceProfileRType,
+	},
 }
 
-var r1 = arn.ResourceTypes{
-	arn.EC2VPNGatewayRType,
-	arn.EC2NatGatewayRType,
-	arn.EC2InternetGatewayRType,
-	arn.EC2InstanceRType,
-	arn.EC2SubnetRType,
-	arn.EC2NetworkInterfaceRType,
-	arn.EC2SecurityGroupRType,
-	arn.EC2RouteTableRType,
-	arn.AutoScalingLaunchConfigurationRType,
+// dependsOn returns whether resources of type a must be deleted after all
+// resources of type b
+func dependsOn(a, b arn.ResourceType) bool {
+	for _, t := range dependencies[a] {
+		if t == b {
+			return true
+		}
+	}
+	return false
 }
 
-var r2 = arn.ResourceTypes{
-	arn.EC2RouteTableAssociationRType,
-	arn.EC2EIPRType,
-	arn.EC2EIPAssociationRType,
-	arn.EC2NetworkACLRType,
+type nodeKey struct {
+	Type arn.ResourceType
+	Name arn.ResourceName
 }
 
-var rounds = []arn.ResourceTypes{r0, r1, r2}
-
-// FillDependencyGraph creates a depGraph starting from an inital set of
-// resources found by tags
-func FillDependencyGraph(initDepMap map[arn.ResourceType]deleter.ResourceDeleter) {
-	if initDepMap == nil {
-		return
-	}
-
-	for _, round := range rounds {
-		for _, r := range round {
-			if _, ok := initDepMap[r]; ok {
-				traverseDependencyGraph(r, initDepMap)
-			}
-		}
-	}
+// Node is a concrete AWS resource in a dependency graph
+type Node struct {
+	Type arn.ResourceType
+	Name arn.ResourceName
+	// DiscoveredFrom holds all nodes through which this node was found. Nodes
+	// found by tag have no parents
+	DiscoveredFrom []*Node
+	// Scope is the ID of the VPC this resource belongs to, if known. Dependency
+	// rules are not applied between resources in different known scopes
+	Scope string
+}
 
-	return
+// inScope returns whether dependency rules apply between resources in scopes
+// a and b
+func inScope(a, b string) bool {
+	return a == "" || b == "" || a == b
 }
 
-// traverseDependencyGraph traverses necesssary linkages of each resource
-func traverseDependencyGraph(rt arn.ResourceType, depMap map[arn.ResourceType]deleter.ResourceDeleter) {
-	switch rt {
-	case arn.EC2VPCRType:
-		vpcDel := depMap[rt].(*deleter.EC2VPCDeleter)
+func (n *Node) String() string {
+	return fmt.Sprintf("%s %s", n.Type, n.Name)
+}
 
-		// Ensures that no default VPC's are used
-		vpcs, err := vpcDel.RequestEC2VPCs()
-		if err != nil || len(vpcs) == 0 {
-			break
-		}
+// Graph is a directed acyclic graph of AWS resources. Edges point from the
+// node a resource was discovered from to the discovered resource
+type Graph struct {
+	nodes map[nodeKey]*Node
+	// Preserve insertion order so sorting is deterministic
+	order []*Node
+}
 
-		vpcDel.ResourceNames = nil
-		for _, vpc := range vpcs {
-			vpcDel.AddResourceNames(arn.ToResourceName(vpc.VpcId))
-		}
+// NewGraph creates an empty Graph
+func NewGraph() *Graph {
+	return &Graph{nodes: make(map[nodeKey]*Node)}
+}
 
-		// Get EC2 instances
-		instances, _ := vpcDel.RequestEC2InstancesFromVPCs()
-		if _, ok := depMap[arn.EC2InstanceRType]; !ok {
-			depMap[arn.EC2InstanceRType] = deleter.InitResourceDeleter(arn.EC2InstanceRType)
-		}
-		for _, instance := range instances {
-			depMap[arn.EC2InstanceRType].AddResourceNames(arn.ToResourceName(instance.InstanceId))
-		}
+// AddNode adds a resource to g, or returns the existing node if the resource
+// is already in g. Resources with an empty type or name are not added
+func (g *Graph) AddNode(rt arn.ResourceType, rn arn.ResourceName) *Node {
+	if rt == "" || rn == "" {
+		return nil
+	}
+	k := nodeKey{rt, rn}
+	if n, ok := g.nodes[k]; ok {
+		return n
+	}
+	n := &Node{Type: rt, Name: rn}
+	if rt == arn.EC2VPCRType {
+		n.Scope = rn.String()
+	}
+	g.nodes[k] = n
+	g.order = append(g.order, n)
+	return n
+}
 
-		// Get EC2 internet gateways
-		igws, _ := vpcDel.RequestEC2InternetGatewaysFromVPCs()
-		if _, ok := depMap[arn.EC2InternetGatewayRType]; !ok {
-			depMap[arn.EC2InternetGatewayRType] = deleter.InitResourceDeleter(arn.EC2InternetGatewayRType)
-		}
-		for _, igw := range igws {
-			depMap[arn.EC2InternetGatewayRType].AddResourceNames(arn.ToResourceName(igw.InternetGatewayId))
+// AddEdge records that child was discovered from parent. child inherits the
+// scope of parent if its scope is unknown
+func (g *Graph) AddEdge(parent, child *Node) {
+	if parent == nil || child == nil || parent == child {
+		return
+	}
+	for _, p := range child.DiscoveredFrom {
+		if p == parent {
+			return
 		}
+	}
+	child.DiscoveredFrom = append(child.DiscoveredFrom, parent)
+	if child.Scope == "" {
+		child.Scope = parent.Scope
+	}
+}
 
-		// Get EC2 NAT gateways
-		ngws, _ := vpcDel.RequestEC2NatGatewaysFromVPCs()
-		if _, ok := depMap[arn.EC2NatGatewayRType]; !ok {
-			depMap[arn.EC2NatGatewayRType] = deleter.InitResourceDeleter(arn.EC2NatGatewayRType)
-		}
-		for _, ngw := range ngws {
-			depMap[arn.EC2NatGatewayRType].AddResourceNames(arn.ToResourceName(ngw.NatGatewayId))
-		}
+// Node returns the node for a resource, or nil if it is not in g
+func (g *Graph) Node(rt arn.ResourceType, rn arn.ResourceName) *Node {
+	return g.nodes[nodeKey{rt, rn}]
+}
 
-		// Get EC2 network interfaces
-		enis, _ := vpcDel.RequestEC2NetworkInterfacesFromVPCs()
-		if _, ok := depMap[arn.EC2NetworkInterfaceRType]; !ok {
-			depMap[arn.EC2NetworkInterfaceRType] = deleter.InitResourceDeleter(arn.EC2NetworkInterfaceRType)
-		}
-		for _, eni := range enis {
-			depMap[arn.EC2NetworkInterfaceRType].AddResourceNames(arn.ToResourceName(eni.NetworkInterfaceId))
-		}
+// Nodes returns all nodes in g in insertion order
+func (g *Graph) Nodes() []*Node {
+	return g.order
+}
 
-		// Get Route Tables
-		rts, _ := vpcDel.RequestEC2RouteTablesFromVPCs()
-		if _, ok := depMap[arn.EC2RouteTableRType]; !ok {
-			depMap[arn.EC2RouteTableRType] = deleter.InitResourceDeleter(arn.EC2RouteTableRType)
-		}
-		for _, rt := range rts {
-			depMap[arn.EC2RouteTableRType].AddResourceNames(arn.ToResourceName(rt.RouteTableId))
-		}
+// Len returns the number of nodes in g
+func (g *Graph) Len() int {
+	return len(g.order)
+}
 
-		// Get Security Groups
-		sgs, _ := vpcDel.RequestEC2SecurityGroupsFromVPCs()
-		if _, ok := depMap[arn.EC2SecurityGroupRType]; !ok {
-			depMap[arn.EC2SecurityGroupRType] = deleter.InitResourceDeleter(arn.EC2SecurityGroupRType)
-		}
-		for _, sg := range sgs {
-			depMap[arn.EC2SecurityGroupRType].AddResourceNames(arn.ToResourceName(sg.GroupId))
+// predecessors returns all nodes that must be deleted before n can be deleted,
+// determined by discovered-from edges. Edges are oriented by the dependency
+// rules of both node types; if neither type depends on the other, a child is
+// deleted before the parent it was discovered from
+func (g *Graph) predecessors() map[*Node][]*Node {
+	preds := make(map[*Node][]*Node)
+	for _, c := range g.order {
+		for _, p := range c.DiscoveredFrom {
+			if dependsOn(c.Type, p.Type) {
+				preds[c] = append(preds[c], p)
+			} else {
+				preds[p] = append(preds[p], c)
+			}
 		}
+	}
+	return preds
+}
 
-		// Get Subnets
-		sns, _ := vpcDel.RequestEC2SubnetsFromVPCs()
-		if _, ok := depMap[arn.EC2SubnetRType]; !ok {
-			depMap[arn.EC2SubnetRType] = deleter.InitResourceDeleter(arn.EC2SubnetRType)
-		}
-		for _, sn := range sns {
-			depMap[arn.EC2SubnetRType].AddResourceNames(arn.ToResourceName(sn.SubnetId))
-		}
+type batchKey struct {
+	Type  arn.ResourceType
+	Scope string
+}
 
-		// Get VPN Gateways
-		vgws, _ := vpcDel.RequestEC2VPNGatewaysFromVPCs()
-		if _, ok := depMap[arn.EC2VPNGatewayRType]; !ok {
-			depMap[arn.EC2VPNGatewayRType] = deleter.InitResourceDeleter(arn.EC2VPNGatewayRType)
-		}
-		for _, vgw := range vgws {
-			depMap[arn.EC2VPNGatewayRType].AddResourceNames(arn.ToResourceName(vgw.VpnGatewayId))
-		}
-	case arn.EC2VPNGatewayRType:
-		vgwDel := depMap[rt].(*deleter.EC2VPNGatewayDeleter)
-		// Get EC2 vpn connections
-		vcs, err := vgwDel.RequestEC2VPNConnectionsFromVPNGateways()
-		if err != nil || len(vcs) == 0 {
-			break
-		}
+// Batch is a group of resources of the same type and scope that are deleted
+// together
+type Batch struct {
+	Type  arn.ResourceType
+	Scope string
+	Nodes []*Node
+	// Level is the length of the longest chain of batches that must be
+	// deleted before this batch
+	Level int
+	// deps holds all batches that must be deleted before this batch
+	deps []*Batch
+}
 
-		if _, ok := depMap[arn.EC2VPNConnectionRType]; !ok {
-			depMap[arn.EC2VPNConnectionRType] = deleter.InitResourceDeleter(arn.EC2VPNConnectionRType)
-		}
-		for _, vc := range vcs {
-			depMap[arn.EC2VPNConnectionRType].AddResourceNames(arn.ToResourceName(vc.VpnConnectionId))
-		}
-	case arn.EC2SubnetRType:
-		// Get Network ACL's
-	case arn.EC2InstanceRType:
-		instanceDel := depMap[rt].(*deleter.EC2InstanceDeleter)
+func (b *Batch) String() string {
+	if b.Scope == "" {
+		return b.Type.String()
+	}
+	return fmt.Sprintf("%s (%s)", b.Type, b.Scope)
+}
 
-		// Get EC2 network interfaces
-		enis, _ := instanceDel.RequestEC2NetworkInterfacesFromInstances()
-		if _, ok := depMap[arn.EC2NetworkInterfaceRType]; !ok {
-			depMap[arn.EC2NetworkInterfaceRType] = deleter.InitResourceDeleter(arn.EC2NetworkInterfaceRType)
-		}
-		for _, eni := range enis {
-			depMap[arn.EC2NetworkInterfaceRType].AddResourceNames(arn.ResourceName(*eni.NetworkInterfaceId))
-		}
+// Batches groups the nodes of g by type and scope, and topologically sorts
+// the groups in deletion order. A batch can be deleted once all batches it
+// depends on have been deleted. An error is returned if g contains a
+// dependency cycle
+func (g *Graph) Batches() ([]*Batch, error) {
+	var all []*Batch
+	batchOf := make(map[*Node]*Batch, len(g.order))
+	byKey := make(map[batchKey]*Batch)
+	byType := make(map[arn.ResourceType][]*Batch)
+	for _, n := range g.order {
+		k := batchKey{n.Type, n.Scope}
+		b, ok := byKey[k]
+		if !ok {
+			b = &Batch{Type: n.Type, Scope: n.Scope}
+			byKey[k] = b
+			byType[n.Type] = append(byType[n.Type], b)
+			all = append(all, b)
+		}
+		b.Nodes = append(b.Nodes, n)
+		batchOf[n] = b
+	}
 
-		// Get IAM instance profiles
-		iprs, err := instanceDel.RequestIAMInstanceProfilesFromInstances()
-		if err != nil || len(iprs) == 0 {
-			break
+	// Collect dependencies from dependency rules and discovered-from edges
+	depSets := make(map[*Batch]map[*Batch]bool, len(all))
+	addDep := func(b, dep *Batch) {
+		if b == dep {
+			return
 		}
-
-		if _, ok := depMap[arn.IAMInstanceProfileRType]; !ok {
-			depMap[arn.IAMInstanceProfileRType] = deleter.InitResourceDeleter(arn.IAMInstanceProfileRType)
+		if depSets[b] == nil {
+			depSets[b] = make(map[*Batch]bool)
 		}
-		if _, ok := depMap[arn.IAMRoleRType]; !ok {
-			depMap[arn.IAMRoleRType] = deleter.InitResourceDeleter(arn.IAMRoleRType)
+		if !depSets[b][dep] {
+			depSets[b][dep] = true
+			b.deps = append(b.deps, dep)
 		}
-		for _, ipr := range iprs {
-			depMap[arn.IAMInstanceProfileRType].AddResourceNames(arn.ToResourceName(ipr.InstanceProfileName))
-			// Get IAM roles
-			for _, rl := range ipr.Roles {
-				depMap[arn.IAMRoleRType].AddResourceNames(arn.ToResourceName(rl.RoleName))
+	}
+	for _, b := range all {
+		for _, t := range dependencies[b.Type] {
+			for _, dep := range byType[t] {
+				if inScope(b.Scope, dep.Scope) {
+					addDep(b, dep)
+				}
 			}
 		}
-	case arn.EC2NetworkInterfaceRType:
-		// Get EIP Addresses
-		adrDel := depMap[rt].(*deleter.EC2NetworkInterfaceDeleter)
-		adrs, err := adrDel.RequestEC2EIPAddressessFromNetworkInterfaces()
-		if err != nil || len(adrs) == 0 {
-			break
+	}
+	for n, preds := range g.predecessors() {
+		for _, p := range preds {
+			addDep(batchOf[n], batchOf[p])
 		}
+	}
 
-		// Get EIP Allocations
-		if _, ok := depMap[arn.EC2EIPRType]; !ok {
-			depMap[arn.EC2EIPRType] = deleter.InitResourceDeleter(arn.EC2EIPRType)
-		}
-		// Get EIP Associations
-		if _, ok := depMap[arn.EC2EIPAssociationRType]; !ok {
-			depMap[arn.EC2EIPAssociationRType] = deleter.InitResourceDeleter(arn.EC2EIPAssociationRType)
-		}
-		for _, adr := range adrs {
-			if adr.AllocationId != nil {
-				depMap[arn.EC2EIPRType].AddResourceNames(arn.ToResourceName(adr.AllocationId))
+	// Sort batches level by level, preserving insertion order within a level
+	done := make(map[*Batch]bool, len(all))
+	sorted := make([]*Batch, 0, len(all))
+	for level := 0; len(sorted) < len(all); level++ {
+		var ready []*Batch
+		for _, b := range all {
+			if done[b] {
+				continue
 			}
-			if adr.AssociationId != nil {
-				depMap[arn.EC2EIPAssociationRType].AddResourceNames(arn.ToResourceName(adr.AssociationId))
+			isReady := true
+			for _, dep := range b.deps {
+				if !done[dep] {
+					isReady = false
+					break
+				}
+			}
+			if isReady {
+				ready = append(ready, b)
 			}
-		}
-	case arn.EC2RouteTableRType:
-		// RouteTable Routes will be deleted when deleting a RouteTable
-		rtDel := depMap[rt].(*deleter.EC2RouteTableDeleter)
-		rts, rerr := rtDel.RequestEC2RouteTables()
-		if rerr != nil || len(rts) == 0 {
-			break
 		}
 
-		// Get Subnet-RouteTable Association
-		if _, ok := depMap[arn.EC2RouteTableAssociationRType]; !ok {
-			depMap[arn.EC2RouteTableAssociationRType] = deleter.InitResourceDeleter(arn.EC2RouteTableAssociationRType)
-		}
-		for _, rt := range rts {
-			for _, rta := range rt.Associations {
-				if rta.Main != nil && !*rta.Main {
-					depMap[arn.EC2RouteTableAssociationRType].AddResourceNames(arn.ToResourceName(rta.RouteTableAssociationId))
+		if len(ready) == 0 {
+			var cycle []string
+			for _, n := range g.order {
+				if !done[batchOf[n]] {
+					cycle = append(cycle, n.String())
 				}
 			}
-		}
-	case arn.AutoScalingGroupRType:
-		asgDel := depMap[rt].(*deleter.AutoScalingGroupDeleter)
-		asgs, err := asgDel.RequestAutoScalingGroups()
-		if err != nil || len(asgs) == 0 {
-			break
+			return nil, fmt.Errorf("dependency cycle between resources: %s", strings.Join(cycle, ", "))
 		}
 
-		// Get launch configurations
-		if _, ok := depMap[arn.AutoScalingLaunchConfigurationRType]; !ok {
-			depMap[arn.AutoScalingLaunchConfigurationRType] = deleter.InitResourceDeleter(arn.AutoScalingLaunchConfigurationRType)
-		}
-		// Get ELB's
-		if _, ok := depMap[arn.ElasticLoadBalancingLoadBalancerRType]; !ok {
-			depMap[arn.ElasticLoadBalancingLoadBalancerRType] = deleter.InitResourceDeleter(arn.ElasticLoadBalancingLoadBalancerRType)
-		}
-		for _, asg := range asgs {
-			depMap[arn.AutoScalingLaunchConfigurationRType].AddResourceNames(arn.ToResourceName(asg.LaunchConfigurationName))
-			for _, elbName := range asg.LoadBalancerNames {
-				depMap[arn.ElasticLoadBalancingLoadBalancerRType].AddResourceNames(arn.ToResourceName(elbName))
-			}
-		}
-	case arn.AutoScalingLaunchConfigurationRType:
-		lcDel := depMap[rt].(*deleter.AutoScalingLaunchConfigurationDeleter)
-		// Get IAM instance profiles
-		iprs, err := lcDel.RequestIAMInstanceProfilesFromLaunchConfigurations()
-		if err != nil || len(iprs) == 0 {
-			break
+		for _, b := range ready {
+			b.Level = level
+			done[b] = true
 		}
+		sorted = append(sorted, ready...)
+	}
 
-		if _, ok := depMap[arn.IAMInstanceProfileRType]; !ok {
-			depMap[arn.IAMInstanceProfileRType] = deleter.InitResourceDeleter(arn.IAMInstanceProfileRType)
-		}
-		if _, ok := depMap[arn.IAMRoleRType]; !ok {
-			depMap[arn.IAMRoleRType] = deleter.InitResourceDeleter(arn.IAMRoleRType)
+	return sorted, nil
+}
+
+// Levels topologically sorts g into levels of nodes in deletion order. All
+// nodes in a level can be deleted once all nodes in previous levels have been
+// deleted. An error is returned if g contains a dependency cycle
+func (g *Graph) Levels() ([][]*Node, error) {
+	batches, err := g.Batches()
+	if err != nil {
+		return nil, err
+	}
+
+	levels := make([][]*Node, 0)
+	for _, b := range batches {
+		if b.Level == len(levels) {
+			levels = append(levels, nil)
 		}
-		for _, ipr := range iprs {
-			depMap[arn.IAMInstanceProfileRType].AddResourceNames(arn.ToResourceName(ipr.InstanceProfileName))
-			// Get IAM roles
-			for _, rl := range ipr.Roles {
-				depMap[arn.IAMRoleRType].AddResourceNames(arn.ToResourceName(rl.RoleName))
+		levels[b.Level] = append(levels[b.Level], b.Nodes...)
+	}
+	return levels, nil
+}
+
+// Sort topologically sorts g into a list of nodes in deletion order
+func (g *Graph) Sort() ([]*Node, error) {
+	levels, err := g.Levels()
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := make([]*Node, 0, len(g.order))
+	for _, level := range levels {
+		sorted = append(sorted, level...)
+	}
+	return sorted, nil
+}
+
+// Deleters groups nodes by ResourceType into ResourceDeleters, in order of
+// first appearance. Nodes of types without a ResourceDeleter are skipped
+func Deleters(nodes []*Node) []deleter.ResourceDeleter {
+	dels := make([]deleter.ResourceDeleter, 0)
+	byType := make(map[arn.ResourceType]deleter.ResourceDeleter)
+	for _, n := range nodes {
+		rd, ok := byType[n.Type]
+		if !ok {
+			rd = deleter.InitResourceDeleter(n.Type)
+			byType[n.Type] = rd
+			if rd != nil {
+				dels = append(dels, rd)
 			}
 		}
+		if rd != nil {
+			rd.AddResourceNames(n.Name)
+		}
 	}
-
-	return
+	return dels
 }
@@ -1,6 +1,7 @@
 package graph
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
 
@@ -8,28 +9,234 @@ import (
 	"github.com/coreos/grafiti/deleter"
 )
 
-func TestFillDependencyGraph(t *testing.T) {
+type testNode struct {
+	Type arn.ResourceType
+	Name arn.ResourceName
+}
+
+type testEdge struct {
+	Parent, Child testNode
+}
+
+func buildTestGraph(nodes []testNode, edges []testEdge) *Graph {
+	g := NewGraph()
+	for _, n := range nodes {
+		g.AddNode(n.Type, n.Name)
+	}
+	for _, e := range edges {
+		g.AddEdge(g.AddNode(e.Parent.Type, e.Parent.Name), g.AddNode(e.Child.Type, e.Child.Name))
+	}
+	return g
+}
+
+func toTestLevels(levels [][]*Node) [][]testNode {
+	tls := make([][]testNode, 0, len(levels))
+	for _, level := range levels {
+		tl := make([]testNode, 0, len(level))
+		for _, n := range level {
+			tl = append(tl, testNode{n.Type, n.Name})
+		}
+		tls = append(tls, tl)
+	}
+	return tls
+}
+
+var (
+	vpc      = testNode{arn.EC2VPCRType, "vpc-1"}
+	subnet   = testNode{arn.EC2SubnetRType, "subnet-1"}
+	instance = testNode{arn.EC2InstanceRType, "i-1"}
+	eni      = testNode{arn.EC2NetworkInterfaceRType, "eni-1"}
+	ipr      = testNode{arn.IAMInstanceProfileRType, "ipr-1"}
+	role     = testNode{arn.IAMRoleRType, "role-1"}
+	asg      = testNode{arn.AutoScalingGroupRType, "asg-1"}
+	lc       = testNode{arn.AutoScalingLaunchConfigurationRType, "lc-1"}
+	bucket   = testNode{arn.S3BucketRType, "bucket-1"}
+	user     = testNode{arn.IAMUserRType, "user-1"}
+)
+
+func TestLevels(t *testing.T) {
 	cases := []struct {
-		Input    map[arn.ResourceType]deleter.ResourceDeleter
-		Expected map[arn.ResourceType]deleter.ResourceDeleter
+		Nodes    []testNode
+		Edges    []testEdge
+		Expected [][]testNode
 	}{
 		{
-			Input: map[arn.ResourceType]deleter.ResourceDeleter{
-				arn.AutoScalingGroupRType:               &deleter.AutoScalingGroupDeleter{},
-				arn.AutoScalingLaunchConfigurationRType: &deleter.AutoScalingLaunchConfigurationDeleter{},
+			Nodes:    []testNode{},
+			Expected: [][]testNode{},
+		},
+		{
+			// Type dependency rules order resources without edges
+			Nodes: []testNode{vpc, subnet, instance},
+			Expected: [][]testNode{
+				{instance},
+				{subnet},
+				{vpc},
+			},
+		},
+		{
+			// Duplicate resources are added once
+			Nodes:    []testNode{bucket, user, bucket},
+			Expected: [][]testNode{{bucket, user}},
+		},
+		{
+			// Children discovered from a parent are deleted before the parent
+			Nodes: []testNode{vpc},
+			Edges: []testEdge{
+				{vpc, instance},
+				{vpc, subnet},
+				{instance, eni},
 			},
-			Expected: map[arn.ResourceType]deleter.ResourceDeleter{
-				arn.AutoScalingGroupRType:               &deleter.AutoScalingGroupDeleter{},
-				arn.AutoScalingLaunchConfigurationRType: &deleter.AutoScalingLaunchConfigurationDeleter{},
+			Expected: [][]testNode{
+				{instance},
+				{eni},
+				{subnet},
+				{vpc},
+			},
+		},
+		{
+			// Children that depend on their parent are deleted after the parent
+			Nodes: []testNode{asg, instance},
+			Edges: []testEdge{
+				{asg, lc},
+				{instance, ipr},
+				{lc, ipr},
+				{ipr, role},
+			},
+			Expected: [][]testNode{
+				{asg, instance},
+				{lc},
+				{ipr},
+				{role},
 			},
 		},
 	}
 
-	for _, c := range cases {
-		FillDependencyGraph(c.Input)
+	for i, c := range cases {
+		g := buildTestGraph(c.Nodes, c.Edges)
+		levels, err := g.Levels()
+		if err != nil {
+			t.Errorf("case %d: Levels failed: %s", i, err)
+			continue
+		}
+		if got := toTestLevels(levels); !reflect.DeepEqual(got, c.Expected) {
+			t.Errorf("case %d: Levels failed\nwanted\n%v\ngot\n%v\n", i, c.Expected, got)
+		}
+	}
+}
 
-		if !reflect.DeepEqual(c.Input, c.Expected) {
-			t.Errorf("FillDependencyGraph failed\nwanted\n%s\ngot\n%s\n", c.Expected, c.Input)
+func TestBatches(t *testing.T) {
+	vpc2 := testNode{arn.EC2VPCRType, "vpc-2"}
+	subnet2 := testNode{arn.EC2SubnetRType, "subnet-2"}
+	cases := []struct {
+		Nodes    []testNode
+		Edges    []testEdge
+		Expected []string
+	}{
+		{
+			// Resources in different VPC's do not wait on each other
+			Edges: []testEdge{
+				{vpc, subnet},
+				{vpc2, subnet2},
+				{subnet, eni},
+			},
+			Expected: []string{
+				"0 AWS::EC2::Subnet (vpc-2)",
+				"0 AWS::EC2::NetworkInterface (vpc-1)",
+				"1 AWS::EC2::Subnet (vpc-1)",
+				"1 AWS::EC2::VPC (vpc-2)",
+				"2 AWS::EC2::VPC (vpc-1)",
+			},
+		},
+		{
+			// Resources with an unknown VPC are deleted before all VPC's
+			Nodes: []testNode{subnet2},
+			Edges: []testEdge{
+				{vpc, subnet},
+			},
+			Expected: []string{
+				"0 AWS::EC2::Subnet",
+				"0 AWS::EC2::Subnet (vpc-1)",
+				"1 AWS::EC2::VPC (vpc-1)",
+			},
+		},
+	}
+
+	for i, c := range cases {
+		g := buildTestGraph(c.Nodes, c.Edges)
+		batches, err := g.Batches()
+		if err != nil {
+			t.Errorf("case %d: Batches failed: %s", i, err)
+			continue
+		}
+		got := make([]string, 0, len(batches))
+		for _, b := range batches {
+			got = append(got, fmt.Sprintf("%d %s", b.Level, b))
+		}
+		if !reflect.DeepEqual(got, c.Expected) {
+			t.Errorf("case %d: Batches failed\nwanted\n%v\ngot\n%v\n", i, c.Expected, got)
+		}
+	}
+}
+
+func TestLevelsCycle(t *testing.T) {
+	// Resources discovered from each other without a dependency rule form a
+	// cycle
+	g := buildTestGraph(nil, []testEdge{{bucket, user}, {user, bucket}})
+	if _, err := g.Levels(); err == nil {
+		t.Errorf("Levels failed: expected cycle error")
+	}
+}
+
+func TestDependencyRulesAcyclic(t *testing.T) {
+	// Add one node of every type in the dependency rules. Sorting must succeed
+	// for the rules to be usable
+	g := NewGraph()
+	for rt, deps := range dependencies {
+		g.AddNode(rt, "a")
+		for _, d := range deps {
+			g.AddNode(d, "a")
 		}
 	}
+	if _, err := g.Levels(); err != nil {
+		t.Errorf("dependency rules contain a cycle: %s", err)
+	}
+}
+
+func TestFillDependencyGraph(t *testing.T) {
+	cases := []struct {
+		Nodes    []testNode
+		Expected int
+	}{
+		{
+			// Types without discoverable dependencies are not expanded
+			Nodes:    []testNode{bucket, user},
+			Expected: 2,
+		},
+		{
+			Nodes:    []testNode{},
+			Expected: 0,
+		},
+	}
+
+	for i, c := range cases {
+		g := buildTestGraph(c.Nodes, nil)
+		FillDependencyGraph(g)
+
+		if g.Len() != c.Expected {
+			t.Errorf("case %d: FillDependencyGraph failed\nwanted %d nodes\ngot %d nodes\n", i, c.Expected, g.Len())
+		}
+	}
+}
+
+func TestDeleters(t *testing.T) {
+	g := buildTestGraph([]testNode{instance, bucket, {arn.EC2InstanceRType, "i-2"}, {"AWS::Fake::Type", "fake"}}, nil)
+	dels := Deleters(g.Nodes())
+
+	expected := []deleter.ResourceDeleter{
+		&deleter.EC2InstanceDeleter{ResourceType: arn.EC2InstanceRType, ResourceNames: arn.ResourceNames{"i-1", "i-2"}},
+		&deleter.S3BucketDeleter{ResourceType: arn.S3BucketRType, ResourceNames: arn.ResourceNames{"bucket-1"}},
+	}
+	if !reflect.DeepEqual(dels, expected) {
+		t.Errorf("Deleters failed\nwanted\n%v\ngot\n%v\n", expected, dels)
+	}
 }
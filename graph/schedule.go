@@ -0,0 +1,92 @@
+package graph
+
+import (
+	"github.com/coreos/grafiti/arn"
+)
+
+// Scheduler runs batches concurrently, starting each batch once all batches it
+// depends on have finished
+type Scheduler struct {
+	// Workers is the maximum number of batches run at once. Values less than 1
+	// run one batch at a time
+	Workers int
+	// ServiceLimits maps an AWS service namespace, ex. "ec2", to the maximum
+	// number of batches of that service's resources run at once. Services
+	// without a positive limit are only limited by Workers
+	ServiceLimits map[string]int
+}
+
+type batchResult struct {
+	Batch *Batch
+	Err   error
+}
+
+// Run calls fn on every batch in batches, which must be sorted by Graph.Batches.
+// Once fn returns an error no more batches are started, and the first error is
+// returned after all running batches finish
+func (s *Scheduler) Run(batches []*Batch, fn func(*Batch) error) error {
+	workers := s.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	// Number of unfinished dependencies of each batch, and batches that depend
+	// on each batch
+	pending := make(map[*Batch]int, len(batches))
+	dependents := make(map[*Batch][]*Batch, len(batches))
+	for _, b := range batches {
+		pending[b] = len(b.deps)
+		for _, dep := range b.deps {
+			dependents[dep] = append(dependents[dep], b)
+		}
+	}
+
+	started := make(map[*Batch]bool, len(batches))
+	runningByService := make(map[string]int)
+	results := make(chan batchResult)
+
+	var (
+		firstErr error
+		running  int
+		finished int
+	)
+	for finished < len(batches) {
+		// Start ready batches in sorted order while limits allow
+		for _, b := range batches {
+			if firstErr != nil || running >= workers {
+				break
+			}
+			svc := arn.NamespaceForResource(b.Type)
+			if started[b] || pending[b] > 0 {
+				continue
+			}
+			if limit := s.ServiceLimits[svc]; limit > 0 && runningByService[svc] >= limit {
+				continue
+			}
+
+			started[b] = true
+			running++
+			runningByService[svc]++
+			go func(b *Batch) {
+				results <- batchResult{b, fn(b)}
+			}(b)
+		}
+
+		if running == 0 {
+			break
+		}
+
+		r := <-results
+		running--
+		finished++
+		runningByService[arn.NamespaceForResource(r.Batch.Type)]--
+		if r.Err != nil && firstErr == nil {
+			firstErr = r.Err
+		}
+		for _, d := range dependents[r.Batch] {
+			pending[d]--
+		}
+	}
+
+	return firstErr
+}
@@ -0,0 +1,102 @@
+package graph
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/grafiti/arn"
+)
+
+func TestSchedulerRun(t *testing.T) {
+	g := buildTestGraph(
+		[]testNode{bucket, user, {arn.IAMRoleRType, "role-2"}},
+		[]testEdge{{vpc, instance}, {vpc, subnet}, {instance, ipr}, {ipr, role}},
+	)
+	batches, err := g.Batches()
+	if err != nil {
+		t.Fatalf("Batches failed: %s", err)
+	}
+
+	cases := []struct {
+		Workers       int
+		ServiceLimits map[string]int
+		// Maximum number of batches expected to run at once, overall and by
+		// service
+		MaxRunning          int
+		MaxRunningByService map[string]int
+	}{
+		{Workers: 0, MaxRunning: 1},
+		{Workers: 8, ServiceLimits: map[string]int{"iam": 1}, MaxRunning: 8, MaxRunningByService: map[string]int{"iam": 1}},
+	}
+
+	for i, c := range cases {
+		var (
+			mu               sync.Mutex
+			running, maxSeen int
+			runningBySvc     = make(map[string]int)
+			done             = make(map[*Batch]bool)
+		)
+		s := &Scheduler{Workers: c.Workers, ServiceLimits: c.ServiceLimits}
+		err := s.Run(batches, func(b *Batch) error {
+			svc := arn.NamespaceForResource(b.Type)
+			mu.Lock()
+			for _, dep := range b.deps {
+				if !done[dep] {
+					t.Errorf("case %d: %s started before dependency %s finished", i, b, dep)
+				}
+			}
+			running++
+			runningBySvc[svc]++
+			if running > maxSeen {
+				maxSeen = running
+			}
+			if limit, ok := c.MaxRunningByService[svc]; ok && runningBySvc[svc] > limit {
+				t.Errorf("case %d: %d %s batches running, wanted at most %d", i, runningBySvc[svc], svc, limit)
+			}
+			mu.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			mu.Lock()
+			running--
+			runningBySvc[svc]--
+			done[b] = true
+			mu.Unlock()
+			return nil
+		})
+		if err != nil {
+			t.Errorf("case %d: Run failed: %s", i, err)
+		}
+		if len(done) != len(batches) {
+			t.Errorf("case %d: ran %d batches, wanted %d", i, len(done), len(batches))
+		}
+		if maxSeen > c.MaxRunning {
+			t.Errorf("case %d: %d batches running at once, wanted at most %d", i, maxSeen, c.MaxRunning)
+		}
+	}
+}
+
+func TestSchedulerRunError(t *testing.T) {
+	g := buildTestGraph(nil, []testEdge{{vpc, subnet}})
+	batches, err := g.Batches()
+	if err != nil {
+		t.Fatalf("Batches failed: %s", err)
+	}
+
+	var ran []arn.ResourceType
+	s := &Scheduler{Workers: 4}
+	err = s.Run(batches, func(b *Batch) error {
+		ran = append(ran, b.Type)
+		return errors.New("delete failed")
+	})
+	if err == nil {
+		t.Errorf("Run failed: expected error")
+	}
+	// Batches depending on a failed batch must not run
+	if expected := []arn.ResourceType{arn.EC2SubnetRType}; !reflect.DeepEqual(ran, expected) {
+		t.Errorf("Run failed\nwanted\n%v\ngot\n%v\n", expected, ran)
+	}
+}
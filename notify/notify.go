@@ -0,0 +1,204 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/grafiti/arn"
+)
+
+// Events a Summary can describe
+const (
+	// EventExpiring summaries list resources that expire soon
+	EventExpiring = "expiring"
+	// EventDeleted summaries list resources that were deleted, or failed to be
+	// deleted
+	EventDeleted = "deleted"
+)
+
+// UnknownOwner is displayed for resources without an owner tag
+const UnknownOwner = "unknown owner"
+
+// Resource is a resource included in a notification
+type Resource struct {
+	ResourceType arn.ResourceType
+	ResourceName arn.ResourceName
+	ResourceARN  arn.ResourceARN `json:",omitempty"`
+	AccountID    string          `json:",omitempty"`
+	Region       string          `json:",omitempty"`
+	Owner        string          `json:",omitempty"`
+	ExpiresAt    string          `json:",omitempty"`
+	// Error is set if an EventDeleted resource failed to be deleted
+	Error string `json:",omitempty"`
+}
+
+func (r Resource) String() string {
+	var location []string
+	if r.AccountID != "" {
+		location = append(location, "account "+r.AccountID)
+	}
+	if r.Region != "" {
+		location = append(location, r.Region)
+	}
+	if len(location) == 0 {
+		return fmt.Sprintf("%s %s", r.ResourceType, r.ResourceName)
+	}
+	return fmt.Sprintf("%s %s (%s)", r.ResourceType, r.ResourceName, strings.Join(location, ", "))
+}
+
+// Summary holds all resources of one owner for an event
+type Summary struct {
+	Event     string
+	Owner     string
+	Resources []Resource
+}
+
+// GroupByOwner creates one Summary per owner of rs, sorted by owner
+func GroupByOwner(event string, rs []Resource) []*Summary {
+	byOwner := make(map[string]*Summary)
+	owners := make([]string, 0)
+	for _, r := range rs {
+		s, ok := byOwner[r.Owner]
+		if !ok {
+			s = &Summary{Event: event, Owner: r.Owner}
+			byOwner[r.Owner] = s
+			owners = append(owners, r.Owner)
+		}
+		s.Resources = append(s.Resources, r)
+	}
+
+	sort.Strings(owners)
+	summaries := make([]*Summary, 0, len(owners))
+	for _, o := range owners {
+		summaries = append(summaries, byOwner[o])
+	}
+	return summaries
+}
+
+// Text formats s as a human-readable message
+func (s *Summary) Text() string {
+	owner := s.Owner
+	if owner == "" {
+		owner = UnknownOwner
+	}
+
+	var b bytes.Buffer
+	switch s.Event {
+	case EventExpiring:
+		fmt.Fprintf(&b, "%d resource(s) owned by %s expire soon:\n", len(s.Resources), owner)
+		for _, r := range s.Resources {
+			fmt.Fprintf(&b, "• %s expires at %s\n", r, r.ExpiresAt)
+		}
+	case EventDeleted:
+		var deleted, failed []Resource
+		for _, r := range s.Resources {
+			if r.Error != "" {
+				failed = append(failed, r)
+			} else {
+				deleted = append(deleted, r)
+			}
+		}
+		if len(deleted) > 0 {
+			fmt.Fprintf(&b, "Deleted %d resource(s) owned by %s:\n", len(deleted), owner)
+			for _, r := range deleted {
+				fmt.Fprintf(&b, "• %s\n", r)
+			}
+		}
+		if len(failed) > 0 {
+			fmt.Fprintf(&b, "Failed to delete %d resource(s) owned by %s:\n", len(failed), owner)
+			for _, r := range failed {
+				fmt.Fprintf(&b, "• %s: %s\n", r, r.Error)
+			}
+		}
+	default:
+		fmt.Fprintf(&b, "%d resource(s) owned by %s (%s):\n", len(s.Resources), owner, s.Event)
+		for _, r := range s.Resources {
+			fmt.Fprintf(&b, "• %s\n", r)
+		}
+	}
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// A Notifier sends a Summary to its owner
+type Notifier interface {
+	Notify(*Summary) error
+}
+
+// defaultClient is used by notifiers without a Client
+var defaultClient = &http.Client{Timeout: 30 * time.Second}
+
+// postJSON posts v encoded as JSON to url, and returns an error if the
+// response status is not 2xx
+func postJSON(client *http.Client, url string, v interface{}) error {
+	if client == nil {
+		client = defaultClient
+	}
+
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal notification: %s", err)
+	}
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("post notification: %s", err)
+	}
+	defer resp.Body.Close()
+	// Drain the body so the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("post notification: unexpected status %q", resp.Status)
+	}
+	return nil
+}
+
+// SlackNotifier posts summaries as text to a Slack-compatible incoming
+// webhook
+type SlackNotifier struct {
+	WebhookURL string
+	Client     *http.Client
+}
+
+// SlackMessage is the payload of a Slack incoming webhook request
+type SlackMessage struct {
+	Text string `json:"text"`
+}
+
+// Notify posts the text of s to n.WebhookURL
+func (n *SlackNotifier) Notify(s *Summary) error {
+	return postJSON(n.Client, n.WebhookURL, &SlackMessage{Text: s.Text()})
+}
+
+// WebhookNotifier posts summaries as JSON to a generic webhook
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+// Notify posts s encoded as JSON to n.URL
+func (n *WebhookNotifier) Notify(s *Summary) error {
+	return postJSON(n.Client, n.URL, s)
+}
+
+// NotifyAll sends every summary with every notifier. All notifications are
+// attempted; the first error encountered is returned
+func NotifyAll(notifiers []Notifier, summaries []*Summary) error {
+	var firstErr error
+	for _, s := range summaries {
+		for _, n := range notifiers {
+			if err := n.Notify(s); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
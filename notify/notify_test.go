@@ -0,0 +1,145 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/grafiti/arn"
+)
+
+var testResources = []Resource{
+	{ResourceType: arn.EC2InstanceRType, ResourceName: "i-1", Owner: "bob", ExpiresAt: "2017-08-20"},
+	{ResourceType: arn.EC2VPCRType, ResourceName: "vpc-1", Owner: "alice", ExpiresAt: "2017-08-21"},
+	{ResourceType: arn.EC2SubnetRType, ResourceName: "subnet-1", ExpiresAt: "2017-08-22"},
+	{ResourceType: arn.EC2InstanceRType, ResourceName: "i-2", Owner: "bob", ExpiresAt: "2017-08-23"},
+}
+
+func TestGroupByOwner(t *testing.T) {
+	expected := []*Summary{
+		{Event: EventExpiring, Owner: "", Resources: []Resource{testResources[2]}},
+		{Event: EventExpiring, Owner: "alice", Resources: []Resource{testResources[1]}},
+		{Event: EventExpiring, Owner: "bob", Resources: []Resource{testResources[0], testResources[3]}},
+	}
+
+	if got := GroupByOwner(EventExpiring, testResources); !reflect.DeepEqual(got, expected) {
+		t.Errorf("GroupByOwner failed\nwanted\n%+v\ngot\n%+v\n", expected, got)
+	}
+}
+
+func TestSummaryText(t *testing.T) {
+	cases := []struct {
+		Input    *Summary
+		Expected string
+	}{
+		{
+			Input: &Summary{Event: EventExpiring, Owner: "bob", Resources: []Resource{testResources[0]}},
+			Expected: "1 resource(s) owned by bob expire soon:\n" +
+				"• AWS::EC2::Instance i-1 expires at 2017-08-20",
+		},
+		{
+			Input: &Summary{
+				Event: EventDeleted,
+				Resources: []Resource{
+					{ResourceType: arn.EC2VPCRType, ResourceName: "vpc-1"},
+					{ResourceType: arn.EC2SubnetRType, ResourceName: "subnet-1", Error: "DependencyViolation"},
+				},
+			},
+			Expected: "Deleted 1 resource(s) owned by unknown owner:\n" +
+				"• AWS::EC2::VPC vpc-1\n" +
+				"Failed to delete 1 resource(s) owned by unknown owner:\n" +
+				"• AWS::EC2::Subnet subnet-1: DependencyViolation",
+		},
+		{
+			Input: &Summary{
+				Event: EventExpiring,
+				Owner: "alice",
+				Resources: []Resource{
+					{ResourceType: arn.EC2VPCRType, ResourceName: "vpc-2", Region: "eu-west-1", ExpiresAt: "2017-08-21"},
+					{ResourceType: arn.EC2VPCRType, ResourceName: "vpc-3", AccountID: "123456789101", Region: "us-east-1", ExpiresAt: "2017-08-22"},
+				},
+			},
+			Expected: "2 resource(s) owned by alice expire soon:\n" +
+				"• AWS::EC2::VPC vpc-2 (eu-west-1) expires at 2017-08-21\n" +
+				"• AWS::EC2::VPC vpc-3 (account 123456789101, us-east-1) expires at 2017-08-22",
+		},
+	}
+
+	for i, c := range cases {
+		if got := c.Input.Text(); got != c.Expected {
+			t.Errorf("case %d: Text failed\nwanted\n%s\ngot\n%s\n", i, c.Expected, got)
+		}
+	}
+}
+
+// recordServer is a local webhook stand-in that records request bodies
+func recordServer(t *testing.T, status int, bodies *[][]byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("unexpected Content-Type %q", ct)
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		*bodies = append(*bodies, b)
+		w.WriteHeader(status)
+	}))
+}
+
+func TestSlackNotifier(t *testing.T) {
+	var bodies [][]byte
+	srv := recordServer(t, http.StatusOK, &bodies)
+	defer srv.Close()
+
+	s := GroupByOwner(EventExpiring, testResources[:1])[0]
+	n := &SlackNotifier{WebhookURL: srv.URL}
+	if err := n.Notify(s); err != nil {
+		t.Fatalf("Notify failed: %s", err)
+	}
+
+	var msg SlackMessage
+	if len(bodies) != 1 || json.Unmarshal(bodies[0], &msg) != nil || msg.Text != s.Text() {
+		t.Errorf("Notify failed\nwanted text\n%s\ngot bodies\n%q\n", s.Text(), bodies)
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var bodies [][]byte
+	srv := recordServer(t, http.StatusNoContent, &bodies)
+	defer srv.Close()
+
+	summaries := GroupByOwner(EventDeleted, testResources)
+	if err := NotifyAll([]Notifier{&WebhookNotifier{URL: srv.URL}}, summaries); err != nil {
+		t.Fatalf("NotifyAll failed: %s", err)
+	}
+
+	if len(bodies) != len(summaries) {
+		t.Fatalf("NotifyAll failed: wanted %d requests, got %d", len(summaries), len(bodies))
+	}
+	for i, b := range bodies {
+		var got Summary
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("request %d: unmarshal failed: %s", i, err)
+		}
+		if !reflect.DeepEqual(&got, summaries[i]) {
+			t.Errorf("request %d: NotifyAll failed\nwanted\n%+v\ngot\n%+v\n", i, summaries[i], got)
+		}
+	}
+}
+
+func TestNotifierErrorStatus(t *testing.T) {
+	var bodies [][]byte
+	srv := recordServer(t, http.StatusInternalServerError, &bodies)
+	defer srv.Close()
+
+	summaries := GroupByOwner(EventDeleted, testResources)
+	err := NotifyAll([]Notifier{&SlackNotifier{WebhookURL: srv.URL}}, summaries)
+	if err == nil {
+		t.Errorf("NotifyAll failed: expected error")
+	}
+	// All summaries are attempted after an error
+	if len(bodies) != len(summaries) {
+		t.Errorf("NotifyAll failed: wanted %d requests, got %d", len(summaries), len(bodies))
+	}
+}
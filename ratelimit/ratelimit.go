@@ -0,0 +1,164 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// HandlerName is the name of the request handler that waits on a Limiter
+// before signing each request attempt
+const HandlerName = "grafiti.ratelimit.Wait"
+
+// Limit configures the request rate of a single AWS service
+type Limit struct {
+	// RequestsPerSecond is the sustained request rate. Values <= 0 disable rate
+	// limiting for a service
+	RequestsPerSecond float64
+	// Burst is the number of requests that can be made at once. Values < 1 are
+	// treated as 1
+	Burst int
+}
+
+// DefaultLimits holds limits for services that are throttled even when
+// grafiti runs serially. Keys are aws-sdk-go service names, ex. "tagging" for
+// the Resource Groups Tagging API
+var DefaultLimits = map[string]Limit{
+	// The Resource Groups Tagging API returns a rate limit error if there is no
+	// pause between requests
+	"tagging": {RequestsPerSecond: 0.5, Burst: 1},
+}
+
+// Limiter is a token bucket rate limiter safe for concurrent use
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter creates a Limiter that allows rate requests per second with a
+// burst of burst requests. The bucket starts full
+func NewLimiter(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes a token from the bucket and returns how long the caller must
+// wait before the token is available
+func (l *Limiter) reserve(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens = math.Min(l.burst, l.tokens+elapsed.Seconds()*l.rate)
+		l.last = now
+	}
+
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// cancel returns a token reserved by a caller that stopped waiting
+func (l *Limiter) cancel() {
+	l.mu.Lock()
+	l.tokens++
+	l.mu.Unlock()
+}
+
+// Wait blocks until a request can be made or ctx is done
+func (l *Limiter) Wait(ctx aws.Context) error {
+	wait := l.reserve(time.Now())
+	if wait <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		l.cancel()
+		return ctx.Err()
+	}
+}
+
+var (
+	mu       sync.Mutex
+	limits   = copyLimits(DefaultLimits)
+	limiters = make(map[string]*Limiter)
+)
+
+func copyLimits(ls map[string]Limit) map[string]Limit {
+	c := make(map[string]Limit, len(ls))
+	for svc, l := range ls {
+		c[svc] = l
+	}
+	return c
+}
+
+// SetLimits overrides DefaultLimits with ls. Limiters of services in ls are
+// replaced, so SetLimits should be called before any requests are made
+func SetLimits(ls map[string]Limit) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for svc, l := range ls {
+		limits[svc] = l
+		delete(limiters, svc)
+	}
+}
+
+// LimiterFor returns the Limiter shared by all sessions for a service, or nil
+// if the service is not rate limited
+func LimiterFor(service string) *Limiter {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if l, ok := limiters[service]; ok {
+		return l
+	}
+	lim, ok := limits[service]
+	if !ok || lim.RequestsPerSecond <= 0 {
+		return nil
+	}
+	l := NewLimiter(lim.RequestsPerSecond, lim.Burst)
+	limiters[service] = l
+	return l
+}
+
+// waitHandler waits on the Limiter of a request's service before each attempt,
+// including retries
+var waitHandler = request.NamedHandler{
+	Name: HandlerName,
+	Fn: func(r *request.Request) {
+		if l := LimiterFor(r.ClientInfo.ServiceName); l != nil {
+			if err := l.Wait(r.Context()); err != nil {
+				r.Error = err
+			}
+		}
+	},
+}
+
+// Attach adds rate limiting to all clients created from sess. Limiters are
+// shared by service, so all sessions together stay within a service's limit
+func Attach(sess *session.Session) *session.Session {
+	sess.Handlers.Sign.PushFrontNamed(waitHandler)
+	return sess
+}
@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+func TestLimiterReserve(t *testing.T) {
+	start := time.Now()
+	cases := []struct {
+		Rate     float64
+		Burst    int
+		At       []time.Duration
+		Expected []time.Duration
+	}{
+		{
+			// Burst requests are not delayed, later requests are spaced by rate
+			Rate:     2,
+			Burst:    2,
+			At:       []time.Duration{0, 0, 0, 0},
+			Expected: []time.Duration{0, 0, 500 * time.Millisecond, time.Second},
+		},
+		{
+			// Tokens refill over time up to burst
+			Rate:     1,
+			Burst:    1,
+			At:       []time.Duration{0, time.Second, 5 * time.Second, 5 * time.Second},
+			Expected: []time.Duration{0, 0, 0, time.Second},
+		},
+	}
+
+	for i, c := range cases {
+		l := NewLimiter(c.Rate, c.Burst)
+		l.last = start
+		for j, at := range c.At {
+			if got := l.reserve(start.Add(at)); got != c.Expected[j] {
+				t.Errorf("case %d, request %d: reserve failed\nwanted %s\ngot %s\n", i, j, c.Expected[j], got)
+			}
+		}
+	}
+}
+
+func TestLimiterWaitCanceled(t *testing.T) {
+	l := NewLimiter(0.001, 1)
+	if err := l.Wait(aws.BackgroundContext()); err != nil {
+		t.Fatalf("Wait failed: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx); err == nil {
+		t.Errorf("Wait failed: expected context error")
+	}
+	if l.tokens < -0.5 {
+		t.Errorf("Wait failed: canceled reservation was not returned, %f tokens", l.tokens)
+	}
+}
+
+func TestLimiterFor(t *testing.T) {
+	SetLimits(map[string]Limit{
+		"ec2":     {RequestsPerSecond: 10, Burst: 5},
+		"tagging": {RequestsPerSecond: 0},
+	})
+	defer SetLimits(DefaultLimits)
+
+	if l := LimiterFor("ec2"); l == nil || l.rate != 10 || l.burst != 5 {
+		t.Errorf("LimiterFor(ec2) failed: got %+v", l)
+	}
+	if LimiterFor("ec2") != LimiterFor("ec2") {
+		t.Errorf("LimiterFor(ec2) failed: limiter is not shared")
+	}
+	if l := LimiterFor("tagging"); l != nil {
+		t.Errorf("LimiterFor(tagging) failed: expected no limiter, got %+v", l)
+	}
+	if l := LimiterFor("iam"); l != nil {
+		t.Errorf("LimiterFor(iam) failed: expected no limiter, got %+v", l)
+	}
+}
+
+func TestWaitHandler(t *testing.T) {
+	SetLimits(map[string]Limit{"ec2": {RequestsPerSecond: 0.001, Burst: 1}})
+	defer SetLimits(DefaultLimits)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	r := &request.Request{
+		ClientInfo:  metadata.ClientInfo{ServiceName: "ec2"},
+		HTTPRequest: &http.Request{},
+	}
+	r.SetContext(ctx)
+
+	// The first request uses the burst token, the second waits until ctx is done
+	waitHandler.Fn(r)
+	if r.Error != nil {
+		t.Fatalf("waitHandler failed: %s", r.Error)
+	}
+	waitHandler.Fn(r)
+	if r.Error == nil {
+		t.Errorf("waitHandler failed: expected context error")
+	}
+}